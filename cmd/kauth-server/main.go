@@ -2,30 +2,34 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
+	"crypto/ed25519"
+	"flag"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
-	"strconv"
-	"strings"
 	"syscall"
 	"time"
 
 	"kauth/pkg/audit"
 	"kauth/pkg/handlers"
 	"kauth/pkg/jwt"
+	"kauth/pkg/metrics"
 	"kauth/pkg/middleware"
 	"kauth/pkg/oauth"
 	"kauth/pkg/server"
 	"kauth/pkg/session"
-	"kauth/pkg/validation"
+	"kauth/pkg/tracing"
 
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
 func main() {
+	check := flag.Bool("check", false, "validate the configuration and OIDC provider connectivity, then exit")
+	flag.Parse()
+
 	// Initialize structured logger
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
 		Level: slog.LevelInfo,
@@ -34,73 +38,61 @@ func main() {
 
 	slog.Info("Starting kauth-server")
 
-	// Load JWT keys from environment (REQUIRED)
-	jwtSigningKey := getEnvBytes("JWT_SIGNING_KEY")
-	jwtEncryptionKey := getEnvBytes("JWT_ENCRYPTION_KEY")
-
-	if len(jwtSigningKey) == 0 || len(jwtEncryptionKey) == 0 {
-		slog.Error("JWT keys are required",
-			"error", "JWT_SIGNING_KEY and JWT_ENCRYPTION_KEY must be set",
-			"hint", "Generate with: openssl rand -base64 32")
+	cfg, err := server.LoadConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
 		os.Exit(1)
 	}
-
-	if len(jwtSigningKey) < 32 {
-		slog.Error("JWT_SIGNING_KEY too short", "min_bytes", 32, "actual_bytes", len(jwtSigningKey))
-		os.Exit(1)
+	if cfg.PKCEMethod == oauth.PKCEMethodPlain {
+		slog.Warn("PKCE_METHOD is plain: the code verifier is sent in the authorization URL. Use only for IdPs without S256 support")
 	}
-
-	if len(jwtEncryptionKey) != 32 {
-		slog.Error("JWT_ENCRYPTION_KEY wrong size", "required_bytes", 32, "actual_bytes", len(jwtEncryptionKey))
+	if cfg.OIDCInsecureSkipVerify {
+		slog.Warn("OIDC_INSECURE_SKIP_VERIFY is set: IdP TLS certificates are not verified. Use for development only")
+	}
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.OTLPEndpoint, "kauth-server")
+	if err != nil {
+		slog.Error("Failed to set up tracing", "error", err)
 		os.Exit(1)
 	}
+	if cfg.OTLPEndpoint != "" {
+		slog.Info("OpenTelemetry tracing enabled", "endpoint", cfg.OTLPEndpoint)
+	}
 
-	// Validate cluster name
-	clusterName := getEnv("CLUSTER_NAME", "kubernetes")
-	if err := validation.ValidateResourceName(clusterName); err != nil {
-		slog.Error("Invalid CLUSTER_NAME", "error", err, "hint", "Cluster name must be lowercase alphanumeric with hyphens or dots (RFC 1123), max 63 characters")
+	oidcHTTPClient, err := oauth.NewHTTPClient(cfg.OIDCCAFile, cfg.OIDCInsecureSkipVerify, cfg.OIDCMinRSABits)
+	if err != nil {
+		slog.Error("Failed to configure OIDC HTTP client", "error", err)
 		os.Exit(1)
 	}
 
-	cfg := server.Config{
-		IssuerURL:          getEnv("OIDC_ISSUER_URL", ""),
-		ClientID:           getEnv("OIDC_CLIENT_ID", ""),
-		ClientSecret:       getEnv("OIDC_CLIENT_SECRET", ""),
-		ClusterName:        clusterName,
-		BaseURL:            getEnv("BASE_URL", ""),
-		ListenAddr:         getEnv("LISTEN_ADDR", ":8080"),
-		TLSCertFile:        getEnv("TLS_CERT_FILE", ""),
-		TLSKeyFile:         getEnv("TLS_KEY_FILE", ""),
-		WebhookListenAddr: getEnv("WEBHOOK_LISTEN_ADDR", ""),
-		JWTSigningKey:      jwtSigningKey,
-		JWTEncryptionKey:   jwtEncryptionKey,
-		SessionTTL:         getEnvDuration("SESSION_TTL", 15*time.Minute),
-		RefreshTokenTTL:    getEnvDuration("REFRESH_TOKEN_TTL", 7*24*time.Hour),
-		AllowedOrigins:     getEnvStringSlice("ALLOWED_ORIGINS", []string{}),
-		AllowedGroups:      getEnvStringSlice("ALLOWED_GROUPS", []string{}),
-		AdminGroups:        getEnvStringSlice("ADMIN_GROUPS", []string{}),
-		RateLimitRPS:       getEnvFloat("RATE_LIMIT_RPS", 10.0),
-		RateLimitBurst:     getEnvInt("RATE_LIMIT_BURST", 20),
-		RotationWindow:     getEnvInt("ROTATION_WINDOW", 2),
-		TrustedProxyCIDRs:  getEnvStringSlice("TRUSTED_PROXY_CIDRS", []string{}),
-	}
-
-	if cfg.IssuerURL == "" || cfg.ClientID == "" || cfg.ClientSecret == "" {
-		slog.Error("Required OIDC configuration missing", "error", "OIDC_ISSUER_URL, OIDC_CLIENT_ID, and OIDC_CLIENT_SECRET are required")
-		os.Exit(1)
+	oidcConfig := oauth.Config{
+		IssuerURL:    cfg.IssuerURL,
+		ClientID:     cfg.ClientID,
+		ClientSecret: cfg.ClientSecret,
+		RedirectURL:  cfg.BaseURL + "/callback",
+		ClaimsPrefix: cfg.ClaimsPrefix,
+		HTTPClient:   oidcHTTPClient,
+		PKCEMethod:   cfg.PKCEMethod,
+
+		AdditionalAudiences: cfg.AdditionalAudiences,
+
+		JWKSRefreshInterval:    cfg.JWKSRefreshInterval,
+		JWKSMinRefreshInterval: cfg.JWKSMinRefreshInterval,
+
+		ExchangeTimeout: cfg.ExchangeTimeout,
+		VerifyTimeout:   cfg.VerifyTimeout,
 	}
 
-	if cfg.BaseURL == "" {
-		slog.Error("BASE_URL is required", "hint", "e.g. https://kauth.example.com")
+	successTemplate, err := handlers.LoadSuccessTemplate(cfg.SuccessTemplateFile)
+	if err != nil {
+		slog.Error("Invalid success page template", "error", err)
 		os.Exit(1)
 	}
 
-	// Get cluster API endpoint URL (must be set manually)
-	clusterServer := getEnv("KUBERNETES_API_URL", "")
-	if clusterServer == "" {
-		slog.Error("KUBERNETES_API_URL is required", "hint", "e.g. https://kubernetes.example.com:6443")
-		os.Exit(1)
+	if *check {
+		os.Exit(runCheck(oidcConfig, cfg.DiscoveryTimeout))
 	}
+
+	clusterServer := cfg.ClusterServer
 	slog.Info("Cluster API URL", "url", clusterServer)
 
 	// Auto-detect cluster CA (from env or in-cluster mount)
@@ -112,12 +104,29 @@ func main() {
 	slog.Info("Cluster CA loaded successfully")
 
 	// Initialize JWT manager
-	jwtManager, err := jwt.NewManager(cfg.JWTSigningKey, cfg.JWTEncryptionKey)
+	jwtOpts := []jwt.Option{
+		jwt.WithIssuer(cfg.BaseURL),
+		jwt.WithAudience(cfg.ClusterName),
+		jwt.WithCompression(),
+		jwt.WithAlgorithm(jwt.Algorithm(cfg.JWTAlgorithm)),
+	}
+	if len(cfg.JWTEd25519Key) > 0 {
+		jwtOpts = append(jwtOpts, jwt.WithEd25519Signer(ed25519.NewKeyFromSeed(cfg.JWTEd25519Key)))
+	}
+	if !cfg.UnscopedTokensUntil.IsZero() {
+		jwtOpts = append(jwtOpts, jwt.WithUnscopedTokensUntil(cfg.UnscopedTokensUntil))
+		slog.Info("Accepting tokens without issuer and audience until UNSCOPED_TOKENS_UNTIL", "unscoped_tokens_until", cfg.UnscopedTokensUntil)
+	}
+	if !cfg.MinTokenIssuedAt.IsZero() {
+		jwtOpts = append(jwtOpts, jwt.WithMinIssuedAt(cfg.MinTokenIssuedAt))
+		slog.Info("Rejecting tokens from logins before MIN_TOKEN_ISSUED_AT", "min_token_issued_at", cfg.MinTokenIssuedAt)
+	}
+	jwtManager, err := jwt.NewManager(cfg.JWTSigningKey, cfg.JWTEncryptionKey, jwtOpts...)
 	if err != nil {
 		slog.Error("Failed to initialize JWT manager", "error", err)
 		os.Exit(1)
 	}
-	slog.Info("JWT manager initialized")
+	slog.Info("JWT manager initialized", "algorithm", cfg.JWTAlgorithm, "ed25519", jwtManager.PublicKey() != nil)
 
 	ctx := context.Background()
 
@@ -129,7 +138,7 @@ func main() {
 	}
 
 	// Create session client for managing OAuthSession CRDs
-	namespace := getEnv("KAUTH_NAMESPACE", "default")
+	namespace := cfg.Namespace
 	sessionClient, err := session.NewClient(k8sConfig, namespace)
 	if err != nil {
 		slog.Error("Failed to create session client", "error", err)
@@ -137,6 +146,25 @@ func main() {
 	}
 	slog.Info("Session client initialized", "namespace", namespace)
 
+	if cfg.AuditLog != "" {
+		sink, err := audit.OpenJSONSink(cfg.AuditLog, cfg.ClusterName)
+		if err != nil {
+			slog.Error("Failed to open audit log", "error", err)
+			os.Exit(1)
+		}
+		audit.AddSink(sink)
+		slog.Info("Writing JSON audit records", "target", cfg.AuditLog)
+	}
+	if cfg.AuditK8sEvents {
+		coreClient, err := corev1client.NewForConfig(k8sConfig)
+		if err != nil {
+			slog.Error("Failed to create Kubernetes events client", "error", err)
+			os.Exit(1)
+		}
+		audit.AddSink(audit.NewEventSink(coreClient, namespace))
+		slog.Info("Recording audit events as Kubernetes Events", "namespace", namespace)
+	}
+
 	// Initialize OIDC provider in background with retries
 	var provider *oauth.Provider
 	providerReady := make(chan struct{})
@@ -150,106 +178,129 @@ func main() {
 	webhookHandler := handlers.NewWebhookHandler(jwtManager, sessionClient)
 
 	go func() {
-		maxRetries := 60
-		retryDelay := 5 * time.Second
-		maxRetryDelay := 2 * time.Minute
-
-		for attempt := 1; attempt <= maxRetries; attempt++ {
-			p, err := oauth.NewProvider(ctx, oauth.Config{
-				IssuerURL:    cfg.IssuerURL,
-				ClientID:     cfg.ClientID,
-				ClientSecret: cfg.ClientSecret,
-				RedirectURL:  cfg.BaseURL + "/callback",
-			})
-			if err == nil {
-				provider = p
-				loginHandler = handlers.NewLoginHandler(
-					provider,
-					jwtManager,
-					cfg.ClusterName,
-					clusterServer,
-					clusterCA,
-					cfg.SessionTTL,
-					cfg.RefreshTokenTTL,
-					cfg.AllowedGroups,
-					sessionClient,
-				)
-				refreshHandler = handlers.NewRefreshHandler(
-					provider,
-					jwtManager,
-					sessionClient,
-					cfg.ClusterName,
-					clusterServer,
-					clusterCA,
-					cfg.RefreshTokenTTL,
-					cfg.RotationWindow,
-					cfg.AllowedGroups,
-				)
-				close(providerReady)
-				slog.Info("Successfully connected to OIDC provider", "url", cfg.IssuerURL)
-				return
-			}
-
-			slog.Warn("Failed to connect to OIDC provider", "attempt", attempt, "max_attempts", maxRetries, "error", err)
-
-			if attempt == maxRetries {
-				slog.Error("Failed to setup OIDC provider after all retries", "attempts", maxRetries)
-				return
-			}
-
-			// Exponential backoff with max delay
-			currentDelay := retryDelay * time.Duration(attempt)
-			if currentDelay > maxRetryDelay {
-				currentDelay = maxRetryDelay
-			}
+		p, err := oauth.NewProviderWithRetry(ctx, oidcConfig, oauth.DiscoveryRetry{
+			Attempts:     cfg.DiscoveryRetries,
+			Timeout:      cfg.DiscoveryTimeout,
+			InitialDelay: 5 * time.Second,
+			MaxDelay:     2 * time.Minute,
+		})
+		if err != nil {
+			slog.Error("Failed to setup OIDC provider after all retries", "error", err)
+			return
+		}
 
-			slog.Info("Retrying OIDC connection", "delay", currentDelay)
-			time.Sleep(currentDelay)
+		provider = p
+		kubeconfig := handlers.KubeconfigGenerator{
+			ClusterName:          cfg.ClusterName,
+			ClusterServer:        clusterServer,
+			ClusterCA:            clusterCA,
+			ClusterProxyURL:      cfg.ClusterProxyURL,
+			ClusterTLSServerName: cfg.ClusterTLSServerName,
+			ServerURL:            cfg.BaseURL,
+			UsernamePrefix:       cfg.UsernamePrefix,
 		}
+		loginHandler = handlers.NewLoginHandler(handlers.LoginHandlerOptions{
+			Provider:               provider,
+			JWTManager:             jwtManager,
+			SessionClient:          sessionClient,
+			Kubeconfig:             kubeconfig,
+			SessionTTL:             cfg.SessionTTL,
+			RefreshTokenTTL:        cfg.RefreshTokenTTL,
+			AbsoluteSessionTTL:     cfg.AbsoluteSessionTTL,
+			AllowedGroups:          cfg.AllowedGroups,
+			MaxGroups:              cfg.MaxGroups,
+			RequireVerifiedEmail:   cfg.RequireVerifiedEmail,
+			RequiredClaims:         cfg.RequiredClaims,
+			UsernameClaim:          cfg.UsernameClaim,
+			MaxPendingSessions:     cfg.MaxPendingSessions,
+			CleanupInterval:        cfg.SessionCleanupInterval,
+			WatchKeepaliveInterval: cfg.WatchKeepaliveInterval,
+			WatchMaxDuration:       cfg.WatchMaxDuration,
+			SuccessTemplate:        successTemplate,
+		})
+		refreshHandler = handlers.NewRefreshHandler(handlers.RefreshHandlerOptions{
+			Provider:             provider,
+			JWTManager:           jwtManager,
+			SessionClient:        sessionClient,
+			Kubeconfig:           kubeconfig,
+			RefreshTokenTTL:      cfg.RefreshTokenTTL,
+			AbsoluteSessionTTL:   cfg.AbsoluteSessionTTL,
+			RotationWindow:       cfg.RotationWindow,
+			AllowedGroups:        cfg.AllowedGroups,
+			MaxGroups:            cfg.MaxGroups,
+			RequireContentType:   cfg.RefreshRequireContentType,
+			RequireVerifiedEmail: cfg.RequireVerifiedEmail,
+			RequiredClaims:       cfg.RequiredClaims,
+			UsernameClaim:        cfg.UsernameClaim,
+		})
+		close(providerReady)
+		slog.Info("Successfully connected to OIDC provider", "url", cfg.IssuerURL)
 	}()
 
 	mux := http.NewServeMux()
 
 	// Middleware to check if OIDC provider is ready
 	requireProvider := func(next http.HandlerFunc) http.HandlerFunc {
-		return func(w http.ResponseWriter, r *http.Request) {
-			select {
-			case <-providerReady:
-				// Provider is ready, proceed
-				next(w, r)
-			default:
-				// Provider not ready yet
-				http.Error(w, "Service temporarily unavailable: OIDC provider initializing", http.StatusServiceUnavailable)
-			}
-		}
+		return requireReady(providerReady, next)
+	}
+
+	// Cluster-scoped API routes (see handleClusterRoute). /callback stays
+	// flat: it is the redirect URI registered with the IdP.
+	route := func(method, path string, h http.Handler) {
+		handleClusterRoute(mux, cfg.ClusterName, method, path, h)
 	}
 
-	mux.HandleFunc("/info", handlers.HandleInfo(
+	route(http.MethodGet, "/info", handlers.HandleInfo(
 		cfg.ClusterName,
 		clusterServer,
+		clusterCA,
+		cfg.ClusterProxyURL,
+		cfg.ClusterTLSServerName,
 		cfg.IssuerURL,
 		cfg.ClientID,
 		cfg.BaseURL,
 	))
-	mux.HandleFunc("/start-login", requireProvider(func(w http.ResponseWriter, r *http.Request) {
+	if pub := jwtManager.PublicKey(); pub != nil {
+		jwksHandler, err := handlers.HandleJWKS(pub)
+		if err != nil {
+			slog.Error("Failed to build JWKS", "error", err)
+			os.Exit(1)
+		}
+		mux.HandleFunc("GET /jwks.json", jwksHandler)
+	}
+	route(http.MethodGet, "/login", requireProvider(func(w http.ResponseWriter, r *http.Request) {
+		loginHandler.HandleLogin(w, r)
+	}))
+	route(http.MethodGet, "/start-login", requireProvider(func(w http.ResponseWriter, r *http.Request) {
 		loginHandler.HandleStartLogin(w, r)
 	}))
-	mux.HandleFunc("/watch", requireProvider(func(w http.ResponseWriter, r *http.Request) {
+	route(http.MethodGet, "/watch", requireProvider(func(w http.ResponseWriter, r *http.Request) {
 		loginHandler.HandleWatch(w, r)
 	}))
-	mux.HandleFunc("/callback", requireProvider(func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET /callback", requireProvider(func(w http.ResponseWriter, r *http.Request) {
 		loginHandler.HandleCallback(w, r)
 	}))
-	mux.HandleFunc("/refresh", requireProvider(func(w http.ResponseWriter, r *http.Request) {
-		refreshHandler.HandleRefresh(w, r)
+	route(http.MethodPost, "/exchange", requireProvider(func(w http.ResponseWriter, r *http.Request) {
+		loginHandler.HandleExchange(w, r)
 	}))
-	mux.HandleFunc("/revoke", requireProvider(handlers.RequireAuth(func() *oauth.Provider { return provider }, func(w http.ResponseWriter, r *http.Request) {
+	// CORS (inactive while no origins are specified; origins reload on SIGHUP)
+	corsPolicy := middleware.NewCORSPolicy(cfg.AllowedOrigins)
+
+	var refreshRoute http.Handler = requireProvider(func(w http.ResponseWriter, r *http.Request) {
+		refreshHandler.HandleRefresh(w, r)
+	})
+	if cfg.RefreshRequireNoOrigin {
+		// Refresh tokens belong to the CLI; reject browser origins outside ALLOWED_ORIGINS
+		refreshRoute = corsPolicy.RequireAllowedOrigin(refreshRoute)
+	}
+	route(http.MethodPost, "/refresh", refreshRoute)
+	route(http.MethodPost, "/revoke", requireProvider(handlers.RequireAuth(func() *oauth.Provider { return provider }, func(w http.ResponseWriter, r *http.Request) {
 		handlers.NewRevokeHandler(sessionClient, cfg.AdminGroups).HandleRevoke(w, r)
 	})))
-	mux.HandleFunc("/sessions", requireProvider(handlers.RequireAuth(func() *oauth.Provider { return provider }, func(w http.ResponseWriter, r *http.Request) {
+	route(http.MethodGet, "/sessions", requireProvider(handlers.RequireAuth(func() *oauth.Provider { return provider }, func(w http.ResponseWriter, r *http.Request) {
 		handlers.NewSessionsHandler(sessionClient, cfg.AdminGroups).HandleListSessions(w, r)
 	})))
-	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("OK"))
 	})
@@ -257,18 +308,24 @@ func main() {
 	// Apply middleware
 	var handler http.Handler = mux
 
+	// Request timeout (SSE stream is long-lived by design)
+	handler = middleware.Timeout(cfg.RequestTimeout, "/watch", "/clusters/"+cfg.ClusterName+"/watch")(handler)
+
+	// Bounded request bodies
+	handler = middleware.MaxBodySize(int64(cfg.MaxRequestBodyBytes))(handler)
+
 	// IP extraction with trusted proxy support
 	ipExtractor := middleware.NewClientIPExtractor(cfg.TrustedProxyCIDRs)
 
 	// Request logging
 	handler = middleware.RequestLogger(ipExtractor)(handler)
 
+	// Client IP for auth logs and audit events (middleware.ClientIP)
+	handler = ipExtractor.Middleware(handler)
+
 	// Request ID (applied last, runs first to set context for all other middleware)
 	handler = middleware.RequestID(handler)
 
-	// Audit logging
-	audit.SetIPExtractor(ipExtractor)
-
 	// Security headers
 	handler = middleware.SecurityHeaders(handler)
 
@@ -277,21 +334,30 @@ func main() {
 		handler = middleware.HSTS(handler)
 	}
 
-	// CORS (if origins are specified)
-	if len(cfg.AllowedOrigins) > 0 {
-		handler = middleware.CORS(cfg.AllowedOrigins)(handler)
+	// Redirect plain HTTP to HTTPS, leaving in-cluster probes alone
+	if cfg.EnforceHTTPS {
+		handler = middleware.EnforceHTTPS(cfg.BaseURL, ipExtractor, "/health")(handler)
 	}
 
+	// CORS
+	handler = corsPolicy.Middleware(handler)
+
 	// Rate limiting
 	rateLimiter := middleware.NewRateLimiter(cfg.RateLimitRPS, cfg.RateLimitBurst, 5*time.Minute, cfg.TrustedProxyCIDRs)
 	handler = rateLimiter.Middleware(handler)
 
+	// Tracing (outermost, so spans cover the whole request)
+	if cfg.OTLPEndpoint != "" {
+		handler = middleware.Tracing(mux)(handler)
+	}
+
 	slog.Info("Starting kauth server",
 		"listen_addr", cfg.ListenAddr,
 		"base_url", cfg.BaseURL,
 		"cluster", cfg.ClusterName,
 		"session_ttl", cfg.SessionTTL,
 		"refresh_token_ttl", cfg.RefreshTokenTTL,
+		"absolute_session_ttl", cfg.AbsoluteSessionTTL,
 		"rate_limit_rps", cfg.RateLimitRPS,
 		"rate_limit_burst", cfg.RateLimitBurst,
 	)
@@ -299,6 +365,9 @@ func main() {
 	if len(cfg.AllowedOrigins) > 0 {
 		slog.Info("CORS enabled", "origins", cfg.AllowedOrigins)
 	}
+	if cfg.RefreshRequireNoOrigin {
+		slog.Info("Browser origins outside ALLOWED_ORIGINS are rejected on /refresh")
+	}
 	if len(cfg.AllowedGroups) > 0 {
 		slog.Info("Group authorization enabled", "allowed_groups", cfg.AllowedGroups)
 	} else {
@@ -311,9 +380,15 @@ func main() {
 	}
 
 	// Create HTTP server
+	tlsConfig, err := server.TLSConfig(cfg.TLSMinVersion)
+	if err != nil {
+		slog.Error("Invalid TLS configuration", "error", err)
+		os.Exit(1)
+	}
 	server := &http.Server{
-		Addr:    cfg.ListenAddr,
-		Handler: handler,
+		Addr:      cfg.ListenAddr,
+		Handler:   handler,
+		TLSConfig: tlsConfig,
 	}
 
 	// Dedicated HTTP listener for the Kubernetes token-review webhook. Kept
@@ -323,25 +398,42 @@ func main() {
 	var webhookServer *http.Server
 	if cfg.WebhookListenAddr != "" {
 		webhookMux := http.NewServeMux()
-		webhookMux.HandleFunc("/webhook/token-review", func(w http.ResponseWriter, r *http.Request) {
+		webhookMux.HandleFunc("POST /webhook/token-review", func(w http.ResponseWriter, r *http.Request) {
 			webhookHandler.HandleTokenReview(w, r)
 		})
 		var webhookHTTPHandler http.Handler = webhookMux
+		webhookHTTPHandler = middleware.MaxBodySize(int64(cfg.MaxRequestBodyBytes))(webhookHTTPHandler)
 		webhookHTTPHandler = middleware.RequestLogger(ipExtractor)(webhookHTTPHandler)
+		webhookHTTPHandler = ipExtractor.Middleware(webhookHTTPHandler)
 		webhookHTTPHandler = middleware.RequestID(webhookHTTPHandler)
+		if cfg.OTLPEndpoint != "" {
+			webhookHTTPHandler = middleware.Tracing(webhookMux)(webhookHTTPHandler)
+		}
 		webhookServer = &http.Server{
 			Addr:    cfg.WebhookListenAddr,
 			Handler: webhookHTTPHandler,
 		}
 	}
 
+	// Internal listener for Prometheus scrapes, so metrics are not served
+	// to anyone who can reach the public API.
+	var metricsServer *http.Server
+	if cfg.MetricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("GET /metrics", metrics.Handler())
+		metricsServer = &http.Server{
+			Addr:    cfg.MetricsAddr,
+			Handler: metricsMux,
+		}
+	}
+
 	// Channel to listen for errors from server
 	serverErrors := make(chan error, 1)
 
 	// Start server in goroutine
 	go func() {
 		if cfg.TLSCertFile != "" && cfg.TLSKeyFile != "" {
-			slog.Info("Starting server with TLS")
+			slog.Info("Starting server with TLS", "min_version", cfg.TLSMinVersion)
 			serverErrors <- server.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
 		} else {
 			serverErrors <- server.ListenAndServe()
@@ -357,6 +449,24 @@ func main() {
 		slog.Info("Webhook token-review listener disabled (set WEBHOOK_LISTEN_ADDR to enable)")
 	}
 
+	if metricsServer != nil {
+		go func() {
+			slog.Info("Starting metrics listener", "listen_addr", cfg.MetricsAddr)
+			serverErrors <- metricsServer.ListenAndServe()
+		}()
+	} else {
+		slog.Info("Metrics listener disabled (set METRICS_ADDR to enable)")
+	}
+
+	// SIGHUP reloads the settings that can change without a restart
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			reloadConfig(corsPolicy, rateLimiter, jwtManager)
+		}
+	}()
+
 	// Setup signal handling for graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
@@ -385,77 +495,58 @@ func main() {
 				os.Exit(1)
 			}
 		}
+		if metricsServer != nil {
+			if err := metricsServer.Shutdown(shutdownCtx); err != nil {
+				slog.Error("Metrics listener forced to shutdown", "error", err)
+				os.Exit(1)
+			}
+		}
 
-		slog.Info("Server stopped gracefully")
-	}
-}
-
-func getEnv(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
-	}
-	return defaultValue
-}
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			slog.Warn("Failed to flush traces", "error", err)
+		}
 
-func getEnvBytes(key string) []byte {
-	value := os.Getenv(key)
-	if value == "" {
-		return nil
-	}
-	// Try base64 decoding
-	decoded, err := base64.StdEncoding.DecodeString(value)
-	if err == nil {
-		return decoded
+		slog.Info("Server stopped gracefully")
 	}
-	// Fall back to raw bytes
-	return []byte(value)
 }
 
-func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
-	}
-	duration, err := time.ParseDuration(value)
-	if err != nil {
-		slog.Warn("invalid env var, using default", "key", key, "value", value)
-		return defaultValue
+// runCheck validates OIDC connectivity for --check and returns the process
+// exit code. Each request to the IdP is bounded by timeout.
+func runCheck(oidcConfig oauth.Config, timeout time.Duration) int {
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		// discovery, JWKS and token endpoint
+		ctx, cancel = context.WithTimeout(ctx, 3*timeout)
+		defer cancel()
 	}
-	return duration
-}
 
-func getEnvInt(key string, defaultValue int) int {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
-	}
-	intVal, err := strconv.Atoi(value)
-	if err != nil {
-		slog.Warn("invalid env var, using default", "key", key, "value", value)
-		return defaultValue
+	if err := oauth.Check(ctx, oidcConfig, os.Stdout); err != nil {
+		return 1
 	}
-	return intVal
+	return 0
 }
 
-func getEnvFloat(key string, defaultValue float64) float64 {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
-	}
-	floatVal, err := strconv.ParseFloat(value, 64)
+// reloadConfig re-reads the configuration (environment and CONFIG_FILE) and
+// applies the settings that are safe to change at runtime: CORS origins, rate
+// limits and the token cutoff. On an invalid configuration the current
+// settings are kept.
+func reloadConfig(cors *middleware.CORSPolicy, rateLimiter *middleware.RateLimiter, jwtManager *jwt.Manager) {
+	cfg, err := server.LoadConfigFromEnv()
 	if err != nil {
-		slog.Warn("invalid env var, using default", "key", key, "value", value)
-		return defaultValue
+		slog.Error("Config reload failed, keeping current settings", "error", err)
+		return
 	}
-	return floatVal
-}
 
-func getEnvStringSlice(key string, defaultValue []string) []string {
-	value := os.Getenv(key)
-	if value == "" {
-		return defaultValue
-	}
-	return strings.Split(value, ",")
+	cors.SetOrigins(cfg.AllowedOrigins)
+	rateLimiter.SetLimits(cfg.RateLimitRPS, cfg.RateLimitBurst)
+	jwtManager.SetMinIssuedAt(cfg.MinTokenIssuedAt)
+	slog.Info("Configuration reloaded",
+		"allowed_origins", cfg.AllowedOrigins,
+		"rate_limit_rps", cfg.RateLimitRPS,
+		"rate_limit_burst", cfg.RateLimitBurst,
+		"min_token_issued_at", cfg.MinTokenIssuedAt,
+	)
 }
 
 // getK8sConfig returns Kubernetes client config (in-cluster or from kubeconfig)
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"kauth/pkg/apierror"
+)
+
+// clusterPrefix scopes a route to a cluster: GET /clusters/{cluster}/info
+// serves the same handler as GET /info.
+const clusterPrefix = "/clusters/{cluster}"
+
+// handleClusterRoute registers h for method and path both under
+// /clusters/{cluster} and at the top level. The flat routes are the older
+// form, kept as aliases for clusterName while clients move over. A request
+// naming any other cluster gets 404.
+func handleClusterRoute(mux *http.ServeMux, clusterName, method, path string, h http.Handler) {
+	mux.Handle(method+" "+path, h)
+	mux.Handle(method+" "+clusterPrefix+path, requireCluster(clusterName, h))
+}
+
+// requireCluster rejects requests whose {cluster} path value is not
+// clusterName.
+func requireCluster(clusterName string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("cluster") != clusterName {
+			apierror.Write(w, http.StatusNotFound, apierror.CodeUnknownCluster, "Unknown cluster")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// providerRetryAfter is the Retry-After sent while the OIDC provider is still
+// being discovered: the first discovery retry waits this long.
+const providerRetryAfter = 5 * time.Second
+
+// requireReady answers 503 with Retry-After until ready is closed. Nothing
+// has run yet when it refuses, so clients may safely resend the request,
+// including a /refresh.
+func requireReady(ready <-chan struct{}, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-ready:
+			next(w, r)
+		default:
+			w.Header().Set("Retry-After", strconv.Itoa(int(providerRetryAfter.Seconds())))
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "Service temporarily unavailable: OIDC provider initializing")
+		}
+	}
+}
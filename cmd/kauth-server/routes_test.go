@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"kauth/pkg/apierror"
+)
+
+func TestHandleClusterRoute(t *testing.T) {
+	mux := http.NewServeMux()
+	ok := func(name string) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(name))
+		})
+	}
+	handleClusterRoute(mux, "prod", http.MethodGet, "/info", ok("info"))
+	handleClusterRoute(mux, "prod", http.MethodPost, "/refresh", ok("refresh"))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+		wantAllow  string
+		wantCode   string
+	}{
+		{name: "flat alias", method: http.MethodGet, path: "/info", wantStatus: http.StatusOK, wantBody: "info"},
+		{name: "cluster scoped", method: http.MethodGet, path: "/clusters/prod/info", wantStatus: http.StatusOK, wantBody: "info"},
+		{name: "cluster scoped POST", method: http.MethodPost, path: "/clusters/prod/refresh", wantStatus: http.StatusOK, wantBody: "refresh"},
+		{name: "unknown cluster", method: http.MethodGet, path: "/clusters/staging/info", wantStatus: http.StatusNotFound, wantCode: apierror.CodeUnknownCluster},
+		{name: "wrong method flat", method: http.MethodPost, path: "/info", wantStatus: http.StatusMethodNotAllowed, wantAllow: "GET, HEAD"},
+		{name: "wrong method scoped", method: http.MethodGet, path: "/clusters/prod/refresh", wantStatus: http.StatusMethodNotAllowed, wantAllow: "POST"},
+		{name: "unknown path", method: http.MethodGet, path: "/clusters/prod/nope", wantStatus: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			mux.ServeHTTP(rr, httptest.NewRequest(tt.method, tt.path, nil))
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && rr.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", rr.Body.String(), tt.wantBody)
+			}
+			if tt.wantAllow != "" && rr.Header().Get("Allow") != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", rr.Header().Get("Allow"), tt.wantAllow)
+			}
+			if tt.wantCode != "" {
+				var resp apierror.Response
+				if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Code != tt.wantCode {
+					t.Errorf("body = %s, want error code %q", rr.Body.String(), tt.wantCode)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireReady(t *testing.T) {
+	ready := make(chan struct{})
+	h := requireReady(ready, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	rr := httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodPost, "/refresh", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Fatalf("status before ready = %d, want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if rr.Header().Get("Retry-After") != "5" {
+		t.Errorf("Retry-After = %q, want 5", rr.Header().Get("Retry-After"))
+	}
+	var resp apierror.Response
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil || resp.Code != apierror.CodeUnavailable {
+		t.Errorf("body = %s, want error code %q", rr.Body.String(), apierror.CodeUnavailable)
+	}
+
+	close(ready)
+	rr = httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodPost, "/refresh", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "ok" {
+		t.Errorf("after ready = %d %q, want 200 ok", rr.Code, rr.Body.String())
+	}
+}
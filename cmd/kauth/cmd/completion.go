@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var completionCmd = &cobra.Command{
+	Use:   "completion bash|zsh|fish|powershell",
+	Short: "Generate a shell completion script",
+	Long: `Generate a completion script for kauth commands and flags.
+
+Bash (requires bash-completion):
+  source <(kauth completion bash)
+  # or permanently:
+  kauth completion bash > /etc/bash_completion.d/kauth
+
+Zsh:
+  kauth completion zsh > "${fpath[1]}/_kauth"
+
+Fish:
+  kauth completion fish > ~/.config/fish/completions/kauth.fish
+
+PowerShell:
+  kauth completion powershell | Out-String | Invoke-Expression`,
+	ValidArgs:             []string{"bash", "zsh", "fish", "powershell"},
+	Args:                  cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs),
+	DisableFlagsInUseLine: true,
+	// Completion scripts are loaded at shell start-up; don't set up the
+	// HTTP client or anything else the root pre-run does.
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error { return nil },
+	RunE:              runCompletion,
+}
+
+func init() {
+	rootCmd.AddCommand(completionCmd)
+}
+
+func runCompletion(cmd *cobra.Command, args []string) error {
+	out := cmd.OutOrStdout()
+	switch args[0] {
+	case "bash":
+		return rootCmd.GenBashCompletionV2(out, true)
+	case "zsh":
+		return rootCmd.GenZshCompletion(out)
+	case "fish":
+		return rootCmd.GenFishCompletion(out, true)
+	case "powershell":
+		return rootCmd.GenPowerShellCompletionWithDesc(out)
+	}
+	return fmt.Errorf("unsupported shell %q", args[0])
+}
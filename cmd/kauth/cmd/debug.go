@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// debugOut receives --verbose output. It is always stderr so that commands
+// writing machine-readable stdout, like get-token, stay clean.
+var debugOut io.Writer = os.Stderr
+
+// debugf logs a line to stderr when --verbose is set.
+func debugf(format string, args ...any) {
+	if !debug {
+		return
+	}
+	_, _ = fmt.Fprintf(debugOut, "  [debug] "+format+"\n", args...)
+}
+
+// debugTransport logs each request's method, URL and response status when
+// --verbose is set. Token query parameters are redacted; bodies are never
+// logged.
+type debugTransport struct {
+	next http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !debug {
+		return t.next.RoundTrip(req)
+	}
+	target := redactURL(req.URL)
+	debugf("%s %s", req.Method, target)
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		debugf("%s %s failed after %s: %v", req.Method, target, time.Since(start).Round(time.Millisecond), err)
+		return nil, err
+	}
+	debugf("%s %s -> %s in %s", req.Method, target, resp.Status, time.Since(start).Round(time.Millisecond))
+	return resp, nil
+}
+
+// isSecretKey reports whether a query parameter or JSON field holds a
+// credential.
+func isSecretKey(key string) bool {
+	return strings.Contains(strings.ToLower(key), "token")
+}
+
+// redactURL returns u as a string with the values of token query parameters
+// replaced.
+func redactURL(u *url.URL) string {
+	q := u.Query()
+	redacted := false
+	for key := range q {
+		if isSecretKey(key) {
+			q.Set(key, "REDACTED")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// redactJSON returns a JSON object with token fields replaced and the
+// kubeconfig reduced to its size, for logging SSE data lines. Anything that
+// does not parse as an object is reported by length only.
+func redactJSON(data string) string {
+	var fields map[string]any
+	if err := json.Unmarshal([]byte(data), &fields); err != nil {
+		return fmt.Sprintf("<%d bytes, not a JSON object>", len(data))
+	}
+	for key, v := range fields {
+		switch {
+		case isSecretKey(key):
+			fields[key] = "REDACTED"
+		case key == "kubeconfig":
+			if s, ok := v.(string); ok {
+				fields[key] = fmt.Sprintf("<%d bytes>", len(s))
+			}
+		}
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Sprintf("<%d bytes>", len(data))
+	}
+	return string(out)
+}
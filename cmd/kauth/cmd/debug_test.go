@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRedactURL(t *testing.T) {
+	u, _ := url.Parse("https://kauth.example.com/watch?session_token=secret&x=1")
+	got := redactURL(u)
+	if strings.Contains(got, "secret") {
+		t.Errorf("redactURL() = %q, leaks the token", got)
+	}
+	if !strings.Contains(got, "x=1") || !strings.Contains(got, "/watch") {
+		t.Errorf("redactURL() = %q, lost non-secret parts", got)
+	}
+}
+
+func TestRedactJSON(t *testing.T) {
+	got := redactJSON(`{"ready":true,"refresh_token":"rt-secret","webhook_token":"wt-secret","kubeconfig":"apiVersion: v1"}`)
+	for _, secret := range []string{"rt-secret", "wt-secret", "apiVersion"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redactJSON() = %q, leaks %q", got, secret)
+		}
+	}
+	if !strings.Contains(got, `"ready":true`) {
+		t.Errorf("redactJSON() = %q, lost non-secret fields", got)
+	}
+	if got := redactJSON("not json"); strings.Contains(got, "not json") {
+		t.Errorf("redactJSON() = %q, echoes unparsed data", got)
+	}
+}
+
+func TestDebugTransport(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer srv.Close()
+
+	var out bytes.Buffer
+	debugOut = &out
+	t.Cleanup(func() { debugOut, debug = os.Stderr, false })
+
+	client := &http.Client{Transport: &debugTransport{next: http.DefaultTransport}}
+
+	debug = false
+	resp, err := client.Get(srv.URL + "/watch?session_token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if out.Len() != 0 {
+		t.Errorf("logged without --verbose: %q", out.String())
+	}
+
+	debug = true
+	resp, err = client.Get(srv.URL + "/watch?session_token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if !strings.Contains(out.String(), "GET "+srv.URL+"/watch") || !strings.Contains(out.String(), "418") {
+		t.Errorf("missing request log: %q", out.String())
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("log leaks the token: %q", out.String())
+	}
+}
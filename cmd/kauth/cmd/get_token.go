@@ -3,6 +3,9 @@ package cmd
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strings"
 	"time"
 
 	"kauth/pkg/token"
@@ -17,12 +20,48 @@ var getTokenCmd = &cobra.Command{
 
 The token is a long-lived encrypted session credential. kubectl caches it until
 the session expires. Revocation takes effect within the API server's webhook
-cache TTL (default 30s). Re-run kauth login after expiry or revocation.`,
-	RunE: runGetToken,
+cache TTL (default 30s). Re-run kauth login after expiry or revocation.
+
+If KAUTH_TOKEN is set (see kauth login --token-in-kubeconfig), it is used
+instead of the token cache.
+
+The kauth server is taken from --server-url, then KAUTH_SERVER_URL, then the
+token cache.
+
+A credential within --expiry-buffer (or KAUTH_EXPIRY_BUFFER, default 5m) of
+its expiry is treated as expired, so it cannot expire in flight.
+
+The ExecCredential apiVersion is taken from --exec-credential-version, then
+the apiVersion kubectl passes in KUBERNETES_EXEC_INFO, then defaults to
+client.authentication.k8s.io/v1. Clusters older than Kubernetes 1.22 need
+v1beta1.
+
+Only the ExecCredential is written to stdout; warnings, errors and --verbose
+output go to stderr.
+
+For debugging, --raw prints the cached ID token from the identity provider
+instead (e.g. to inspect its claims). kubectl cannot use that output, so
+never put --raw in a kubeconfig.`,
+	// kubectl parses stdout as the ExecCredential, so cobra must never
+	// print usage or errors there.
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE:          runGetToken,
 }
 
+var (
+	getTokenServerURL             string
+	getTokenExecCredentialVersion string
+	getTokenExpiryBuffer          time.Duration
+	getTokenRaw                   bool
+)
+
 func init() {
 	rootCmd.AddCommand(getTokenCmd)
+	getTokenCmd.Flags().StringVar(&getTokenServerURL, "server-url", "", "kauth server URL (overrides KAUTH_SERVER_URL and the token cache)")
+	getTokenCmd.Flags().StringVar(&getTokenExecCredentialVersion, "exec-credential-version", "", "ExecCredential apiVersion to emit: v1 or v1beta1 (overrides KUBERNETES_EXEC_INFO)")
+	getTokenCmd.Flags().BoolVar(&getTokenRaw, "raw", false, "print the cached ID token instead of an ExecCredential, for debugging (not for kubeconfigs)")
+	getTokenCmd.Flags().DurationVar(&getTokenExpiryBuffer, "expiry-buffer", 0, "treat the credential as expired this long before its expiry (overrides KAUTH_EXPIRY_BUFFER, default 5m)")
 }
 
 type ExecCredential struct {
@@ -36,27 +75,222 @@ type ExecCredentialStatus struct {
 	ExpirationTimestamp *time.Time `json:"expirationTimestamp,omitempty"`
 }
 
+// Exec environment variables written by kauth login --token-in-kubeconfig.
+const (
+	envToken       = "KAUTH_TOKEN"
+	envTokenExpiry = "KAUTH_TOKEN_EXPIRY"
+)
+
+// ExecCredential API versions get-token can emit. Both share the status
+// shape kauth uses.
+const (
+	execCredentialV1      = "client.authentication.k8s.io/v1"
+	execCredentialV1beta1 = "client.authentication.k8s.io/v1beta1"
+)
+
+// envExecInfo is set by kubectl to the ExecCredential it expects, including
+// its apiVersion.
+const envExecInfo = "KUBERNETES_EXEC_INFO"
+
+// envExpiryBuffer overrides the expiry buffer when --expiry-buffer is not set.
+const envExpiryBuffer = "KAUTH_EXPIRY_BUFFER"
+
+// envServerURL is set by the server-generated kubeconfig to the kauth server
+// the context authenticates against.
+const envServerURL = "KAUTH_SERVER_URL"
+
 func runGetToken(cmd *cobra.Command, args []string) error {
-	storage := token.NewStorage(token.DefaultCachePath())
+	// Anything but the ExecCredential on stdout breaks the exec plugin, so
+	// only the credential goes to out; warnings go to stderr.
+	out, stderr := cmd.OutOrStdout(), cmd.ErrOrStderr()
 
-	cachedToken, err := storage.Load()
-	if err != nil || cachedToken == nil || cachedToken.ServerURL == "" {
-		return fmt.Errorf("not authenticated.\n\nTo authenticate, run:\n  kauth login --url <server-url>\n\nExample:\n  kauth login --url https://kauth.example.com")
+	buffer, err := resolveExpiryBuffer(getTokenExpiryBuffer)
+	if err != nil {
+		return err
 	}
 
-	if cachedToken.WebhookToken != "" {
-		if cachedToken.Expiry.IsZero() || time.Now().Before(cachedToken.Expiry.Add(-5*time.Minute)) {
-			return outputExecCredential(cachedToken.WebhookToken, cachedToken.Expiry)
+	// KAUTH_TOKEN holds only the kauth credential, so --raw reads the cache.
+	if tok, expiry, ok, err := tokenFromEnv(); ok && !getTokenRaw {
+		if err != nil {
+			return err
 		}
-		return fmt.Errorf("session expired.\n\nTo re-authenticate, run:\n  kauth login")
+		return outputUnexpired(out, tok, expiry, time.Now(), buffer)
+	}
+
+	store, err := token.DefaultCredentialStore()
+	if err != nil {
+		return err
+	}
+
+	cachedToken, err := store.Get()
+	if err != nil {
+		cachedToken = nil
+	}
+
+	serverURL := resolveGetTokenServerURL(getTokenServerURL, cachedToken)
+	if serverURL == "" {
+		return fmt.Errorf("not authenticated and no kauth server configured.\n\nSet the server with one of:\n  kauth get-token --server-url <server-url>\n  KAUTH_SERVER_URL=<server-url>\n  kauth login --url <server-url>  (stores it in the token cache)")
+	}
+	if cachedToken == nil || cachedToken.ServerURL == "" {
+		return fmt.Errorf("not authenticated.\n\nTo authenticate, run:\n  kauth login --url %s", serverURL)
+	}
+
+	// The cache holds a single server's credential; don't hand it to a
+	// context that belongs to a different kauth server.
+	if !sameServer(serverURL, cachedToken.ServerURL) {
+		return fmt.Errorf("cached credential is for %s, but this context uses %s.\n\nTo authenticate, run:\n  kauth login --url %s", cachedToken.ServerURL, serverURL, serverURL)
+	}
+
+	if getTokenRaw {
+		return outputRawIDToken(out, stderr, cachedToken)
+	}
+
+	if cachedToken.WebhookToken != "" {
+		warnRefreshExpiry(stderr, cachedToken.RefreshExpiry, time.Now())
+		return outputUnexpired(out, cachedToken.WebhookToken, cachedToken.Expiry, time.Now(), buffer)
 	}
 
 	return fmt.Errorf("no webhook token found.\n\nYour authentication session may be from an older version of kauth.\nTo re-authenticate, run:\n  kauth login")
 }
 
-func outputExecCredential(tok string, expiresAt time.Time) error {
+// outputRawIDToken writes the cached ID token, alone, to w for --raw, with a
+// note on stderr that this is not the ExecCredential kubectl expects. The
+// refresh token is never printed.
+func outputRawIDToken(w, stderr io.Writer, cached *token.Cache) error {
+	if cached.IDToken == "" {
+		return fmt.Errorf("no ID token in the token cache.\n\nTo authenticate, run:\n  kauth login --url %s", cached.ServerURL)
+	}
+	_, _ = fmt.Fprintln(stderr, "kauth: --raw prints the ID token for debugging; kubectl needs the default ExecCredential output")
+	_, err := fmt.Fprintln(w, cached.IDToken)
+	return err
+}
+
+// warnRefreshExpiry warns on w (stderr, which kubectl shows) when the cached
+// refresh token is close to expiring and a new login will soon be needed.
+func warnRefreshExpiry(w io.Writer, refreshExpiry, now time.Time) {
+	if refreshExpiry.IsZero() {
+		return
+	}
+	remaining := refreshExpiry.Sub(now)
+	if remaining > refreshExpiryWarning {
+		return
+	}
+	if remaining <= 0 {
+		_, _ = fmt.Fprintln(w, "kauth: refresh token expired; run kauth login to renew your session")
+		return
+	}
+	_, _ = fmt.Fprintf(w, "kauth: refresh token expires in %s; run kauth login to renew your session\n", formatDuration(remaining))
+}
+
+// tokenFromEnv returns the credential kubectl passed through the exec env.
+// ok reports whether KAUTH_TOKEN was set at all.
+func tokenFromEnv() (tok string, expiry time.Time, ok bool, err error) {
+	tok = os.Getenv(envToken)
+	if tok == "" {
+		return "", time.Time{}, false, nil
+	}
+	if v := os.Getenv(envTokenExpiry); v != "" {
+		expiry, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			return "", time.Time{}, true, fmt.Errorf("invalid %s: %w", envTokenExpiry, err)
+		}
+	}
+	return tok, expiry, true, nil
+}
+
+// resolveGetTokenServerURL picks the kauth server from, in order, the
+// --server-url flag, KAUTH_SERVER_URL, and the token cache.
+func resolveGetTokenServerURL(flag string, cached *token.Cache) string {
+	if flag != "" {
+		return flag
+	}
+	if env := os.Getenv(envServerURL); env != "" {
+		return env
+	}
+	if cached != nil {
+		return cached.ServerURL
+	}
+	return ""
+}
+
+// sameServer compares two kauth server URLs, ignoring a trailing slash.
+func sameServer(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+// resolveExpiryBuffer picks the expiry buffer from, in order, the
+// --expiry-buffer flag, KAUTH_EXPIRY_BUFFER, and token.DefaultExpiryBuffer.
+func resolveExpiryBuffer(flag time.Duration) (time.Duration, error) {
+	if flag < 0 {
+		return 0, fmt.Errorf("--expiry-buffer must not be negative, got %s", flag)
+	}
+	if flag > 0 {
+		return flag, nil
+	}
+	if v := os.Getenv(envExpiryBuffer); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			return 0, fmt.Errorf("invalid %s %q: want a duration such as 5m", envExpiryBuffer, v)
+		}
+		return d, nil
+	}
+	return token.DefaultExpiryBuffer, nil
+}
+
+// outputUnexpired writes tok as an ExecCredential if it is still valid at
+// now with buffer to spare.
+func outputUnexpired(w io.Writer, tok string, expiry, now time.Time, buffer time.Duration) error {
+	if token.IsTokenValid(expiry, now, buffer) {
+		return outputExecCredential(w, tok, expiry)
+	}
+	return fmt.Errorf("session expired.\n\nTo re-authenticate, run:\n  kauth login")
+}
+
+// outputExecCredential writes tok as an ExecCredential in the apiVersion
+// kubectl asked for (see resolveExecCredentialVersion).
+func outputExecCredential(w io.Writer, tok string, expiresAt time.Time) error {
+	apiVersion, err := resolveExecCredentialVersion(getTokenExecCredentialVersion)
+	if err != nil {
+		return err
+	}
+	return writeExecCredential(w, apiVersion, tok, expiresAt)
+}
+
+// resolveExecCredentialVersion picks the ExecCredential apiVersion from, in
+// order, the --exec-credential-version flag, KUBERNETES_EXEC_INFO, and v1.
+func resolveExecCredentialVersion(flag string) (string, error) {
+	if flag != "" {
+		switch flag {
+		case "v1", execCredentialV1:
+			return execCredentialV1, nil
+		case "v1beta1", execCredentialV1beta1:
+			return execCredentialV1beta1, nil
+		}
+		return "", fmt.Errorf("unsupported --exec-credential-version %q (use v1 or v1beta1)", flag)
+	}
+
+	if info := os.Getenv(envExecInfo); info != "" {
+		var execInfo struct {
+			APIVersion string `json:"apiVersion"`
+		}
+		if err := json.Unmarshal([]byte(info), &execInfo); err != nil {
+			return "", fmt.Errorf("invalid %s: %w", envExecInfo, err)
+		}
+		switch execInfo.APIVersion {
+		case execCredentialV1, execCredentialV1beta1:
+			return execInfo.APIVersion, nil
+		case "":
+		default:
+			return "", fmt.Errorf("unsupported ExecCredential apiVersion %q in %s (kauth supports v1 and v1beta1)", execInfo.APIVersion, envExecInfo)
+		}
+	}
+
+	return execCredentialV1, nil
+}
+
+func writeExecCredential(w io.Writer, apiVersion, tok string, expiresAt time.Time) error {
 	execCred := ExecCredential{
-		APIVersion: "client.authentication.k8s.io/v1",
+		APIVersion: apiVersion,
 		Kind:       "ExecCredential",
 		Status: &ExecCredentialStatus{
 			Token: tok,
@@ -71,6 +305,6 @@ func outputExecCredential(tok string, expiresAt time.Time) error {
 		return fmt.Errorf("failed to marshal exec credential: %w", err)
 	}
 
-	fmt.Println(string(data))
-	return nil
+	_, err = fmt.Fprintln(w, string(data))
+	return err
 }
@@ -0,0 +1,449 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"kauth/pkg/token"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestTokenFromEnv_KubeconfigRoundTrip(t *testing.T) {
+	expiry := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+
+	data, err := setExecEnv(serverKubeconfig, []envVar{
+		{Name: envToken, Value: "webhook-token"},
+		{Name: envTokenExpiry, Value: expiry.Format(time.RFC3339)},
+	})
+	if err != nil {
+		t.Fatalf("setExecEnv() error = %v", err)
+	}
+
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+		t.Fatalf("failed to parse kubeconfig: %v", err)
+	}
+	exec := kc.Users[0].User.Exec
+	if exec == nil || len(exec.Env) != 2 {
+		t.Fatalf("exec env = %+v, want 2 entries", exec)
+	}
+
+	// kubectl exports the exec env to get-token.
+	for _, e := range exec.Env {
+		t.Setenv(e.Name, e.Value)
+	}
+
+	tok, gotExpiry, ok, err := tokenFromEnv()
+	if err != nil || !ok {
+		t.Fatalf("tokenFromEnv() = ok %v, error %v", ok, err)
+	}
+	if tok != "webhook-token" {
+		t.Errorf("token = %q, want %q", tok, "webhook-token")
+	}
+	if !gotExpiry.Equal(expiry) {
+		t.Errorf("expiry = %v, want %v", gotExpiry, expiry)
+	}
+
+	// Logging in again replaces rather than duplicates the variables.
+	again, err := setExecEnv(data, []envVar{{Name: envToken, Value: "rotated"}})
+	if err != nil {
+		t.Fatalf("setExecEnv() error = %v", err)
+	}
+	if err := yaml.Unmarshal([]byte(again), &kc); err != nil {
+		t.Fatalf("failed to parse kubeconfig: %v", err)
+	}
+	if n := len(kc.Users[0].User.Exec.Env); n != 2 {
+		t.Errorf("exec env has %d entries after update, want 2", n)
+	}
+}
+
+func TestTokenFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		token   string
+		expiry  string
+		wantOK  bool
+		wantErr bool
+	}{
+		{name: "unset", wantOK: false},
+		{name: "token without expiry", token: "t", wantOK: true},
+		{name: "invalid expiry", token: "t", expiry: "tomorrow", wantOK: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envToken, tt.token)
+			t.Setenv(envTokenExpiry, tt.expiry)
+
+			_, _, ok, err := tokenFromEnv()
+			if ok != tt.wantOK {
+				t.Errorf("tokenFromEnv() ok = %v, want %v", ok, tt.wantOK)
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("tokenFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOutputUnexpired_RejectsExpiredToken(t *testing.T) {
+	if err := outputUnexpired(io.Discard, "t", time.Now().Add(-time.Minute), time.Now(), token.DefaultExpiryBuffer); err == nil {
+		t.Error("outputUnexpired() error = nil for expired token, want error")
+	}
+}
+
+func TestOutputUnexpired_ExpiryBufferBoundary(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	buffer := 5 * time.Minute
+
+	tests := []struct {
+		name    string
+		expiry  time.Time
+		wantErr bool
+	}{
+		{name: "no expiry", expiry: time.Time{}},
+		{name: "just outside buffer", expiry: now.Add(buffer + time.Second)},
+		{name: "at buffer", expiry: now.Add(buffer), wantErr: true},
+		{name: "inside buffer", expiry: now.Add(buffer - time.Second), wantErr: true},
+		{name: "expired", expiry: now.Add(-time.Second), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := outputUnexpired(io.Discard, "t", tt.expiry, now, buffer)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("outputUnexpired() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if valid := token.IsTokenValid(tt.expiry, now, buffer); valid == tt.wantErr {
+				t.Errorf("IsTokenValid() = %v, disagrees with outputUnexpired", valid)
+			}
+		})
+	}
+}
+
+func TestResolveExpiryBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    time.Duration
+		env     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: token.DefaultExpiryBuffer},
+		{name: "env", env: "90s", want: 90 * time.Second},
+		{name: "env zero disables", env: "0s", want: 0},
+		{name: "flag overrides env", flag: time.Minute, env: "90s", want: time.Minute},
+		{name: "invalid env", env: "soon", wantErr: true},
+		{name: "negative env", env: "-1m", wantErr: true},
+		{name: "negative flag", flag: -time.Minute, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envExpiryBuffer, tt.env)
+			got, err := resolveExpiryBuffer(tt.flag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveExpiryBuffer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveExpiryBuffer() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWarnRefreshExpiry(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		expiry time.Time
+		want   string
+	}{
+		{name: "unknown", want: ""},
+		{name: "far off", expiry: now.Add(72 * time.Hour), want: ""},
+		{name: "within a day", expiry: now.Add(3 * time.Hour), want: "expires in"},
+		{name: "expired", expiry: now.Add(-time.Minute), want: "expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			warnRefreshExpiry(&buf, tt.expiry, now)
+			if tt.want == "" && buf.Len() != 0 {
+				t.Errorf("warnRefreshExpiry() wrote %q, want nothing", buf.String())
+			}
+			if tt.want != "" && !strings.Contains(buf.String(), tt.want) {
+				t.Errorf("warnRefreshExpiry() wrote %q, want it to contain %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveExecCredentialVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		flag     string
+		execInfo string
+		want     string
+		wantErr  bool
+	}{
+		{name: "default", want: execCredentialV1},
+		{name: "flag short v1beta1", flag: "v1beta1", want: execCredentialV1beta1},
+		{name: "flag full v1", flag: execCredentialV1, want: execCredentialV1},
+		{name: "flag unsupported", flag: "v1alpha1", wantErr: true},
+		{name: "exec info v1beta1", execInfo: `{"apiVersion":"client.authentication.k8s.io/v1beta1","kind":"ExecCredential","spec":{"interactive":false}}`, want: execCredentialV1beta1},
+		{name: "flag overrides exec info", flag: "v1", execInfo: `{"apiVersion":"client.authentication.k8s.io/v1beta1"}`, want: execCredentialV1},
+		{name: "exec info without apiVersion", execInfo: `{"kind":"ExecCredential"}`, want: execCredentialV1},
+		{name: "exec info unsupported", execInfo: `{"apiVersion":"client.authentication.k8s.io/v1alpha1"}`, wantErr: true},
+		{name: "exec info malformed", execInfo: `{`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envExecInfo, tt.execInfo)
+			got, err := resolveExecCredentialVersion(tt.flag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveExecCredentialVersion() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveExecCredentialVersion() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteExecCredential(t *testing.T) {
+	expiry := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, apiVersion := range []string{execCredentialV1, execCredentialV1beta1} {
+		t.Run(apiVersion, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := writeExecCredential(&buf, apiVersion, "webhook-token", expiry); err != nil {
+				t.Fatalf("writeExecCredential() error = %v", err)
+			}
+
+			var got map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatalf("output is not JSON: %v\n%s", err, buf.String())
+			}
+			if got["apiVersion"] != apiVersion || got["kind"] != "ExecCredential" {
+				t.Errorf("apiVersion/kind = %v/%v, want %s/ExecCredential", got["apiVersion"], got["kind"], apiVersion)
+			}
+			status, _ := got["status"].(map[string]any)
+			if status["token"] != "webhook-token" || status["expirationTimestamp"] != "2030-01-02T03:04:05Z" {
+				t.Errorf("status = %v", status)
+			}
+		})
+	}
+}
+
+func TestRunGetToken_HonoursExecInfoAPIVersion(t *testing.T) {
+	t.Setenv(envToken, "webhook-token")
+	t.Setenv(envTokenExpiry, "")
+	t.Setenv(envExecInfo, `{"kind":"ExecCredential","apiVersion":"client.authentication.k8s.io/v1beta1","spec":{"interactive":false}}`)
+
+	var out bytes.Buffer
+	getTokenCmd.SetOut(&out)
+	t.Cleanup(func() { getTokenCmd.SetOut(nil) })
+
+	if err := runGetToken(getTokenCmd, nil); err != nil {
+		t.Fatalf("runGetToken() error = %v", err)
+	}
+
+	var cred ExecCredential
+	if err := json.Unmarshal(out.Bytes(), &cred); err != nil {
+		t.Fatalf("output is not an ExecCredential: %v\n%s", err, out.String())
+	}
+	if cred.APIVersion != execCredentialV1beta1 || cred.Kind != "ExecCredential" {
+		t.Errorf("apiVersion/kind = %s/%s, want %s/ExecCredential", cred.APIVersion, cred.Kind, execCredentialV1beta1)
+	}
+	if cred.Status == nil || cred.Status.Token != "webhook-token" {
+		t.Errorf("status = %+v, want token webhook-token", cred.Status)
+	}
+}
+
+func TestRunGetToken_ServerURLMismatch(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(envToken, "")
+
+	storage := token.NewStorage(token.DefaultCachePath())
+	if err := storage.Save(&token.Cache{ServerURL: "https://kauth.a.example.com", WebhookToken: "wh"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	t.Setenv(envServerURL, "https://kauth.b.example.com")
+	err := runGetToken(getTokenCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "kauth login --url https://kauth.b.example.com") {
+		t.Errorf("runGetToken() error = %v, want mismatch error", err)
+	}
+
+	t.Setenv(envServerURL, "https://kauth.a.example.com/")
+	if err := runGetToken(getTokenCmd, nil); err != nil {
+		t.Errorf("runGetToken() error = %v for matching server", err)
+	}
+}
+
+func TestResolveGetTokenServerURL(t *testing.T) {
+	cached := &token.Cache{ServerURL: "https://cache.example.com"}
+
+	tests := []struct {
+		name   string
+		flag   string
+		env    string
+		cached *token.Cache
+		want   string
+	}{
+		{name: "flag wins", flag: "https://flag.example.com", env: "https://env.example.com", cached: cached, want: "https://flag.example.com"},
+		{name: "env over cache", env: "https://env.example.com", cached: cached, want: "https://env.example.com"},
+		{name: "cache fallback", cached: cached, want: "https://cache.example.com"},
+		{name: "nothing configured", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envServerURL, tt.env)
+			if got := resolveGetTokenServerURL(tt.flag, tt.cached); got != tt.want {
+				t.Errorf("resolveGetTokenServerURL() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunGetToken_NoCacheMentionsServer(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(envToken, "")
+	t.Setenv(envServerURL, "https://kauth.example.com")
+
+	err := runGetToken(getTokenCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "kauth login --url https://kauth.example.com") {
+		t.Errorf("runGetToken() error = %v, want login hint for the configured server", err)
+	}
+}
+
+// captureStdout runs fn with os.Stdout redirected and returns what was
+// written to it.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+
+	fn()
+
+	_ = w.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestGetToken_StdoutIsOnlyExecCredential(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(envToken, "webhook-token")
+	t.Setenv(envTokenExpiry, "")
+	t.Setenv(envExecInfo, "")
+	t.Cleanup(func() {
+		rootCmd.SetArgs(nil)
+		debug = false
+	})
+
+	// --verbose output must land on stderr, not in the credential.
+	rootCmd.SetArgs([]string{"get-token", "--verbose"})
+	var execErr error
+	stdout := captureStdout(t, func() { execErr = rootCmd.Execute() })
+	if execErr != nil {
+		t.Fatalf("Execute() error = %v", execErr)
+	}
+
+	dec := json.NewDecoder(strings.NewReader(stdout))
+	var cred ExecCredential
+	if err := dec.Decode(&cred); err != nil {
+		t.Fatalf("stdout is not an ExecCredential: %v\n%s", err, stdout)
+	}
+	if cred.Kind != "ExecCredential" || cred.Status == nil || cred.Status.Token != "webhook-token" {
+		t.Errorf("unexpected credential %+v", cred)
+	}
+	if dec.More() {
+		t.Errorf("stdout has more than one JSON value:\n%s", stdout)
+	}
+}
+
+func TestGetToken_ErrorsLeaveStdoutEmpty(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(envToken, "")
+	t.Setenv(envServerURL, "")
+	t.Cleanup(func() { rootCmd.SetArgs(nil) })
+
+	rootCmd.SetArgs([]string{"get-token"})
+	var execErr error
+	stdout := captureStdout(t, func() { execErr = rootCmd.Execute() })
+	if execErr == nil {
+		t.Fatal("Execute() error = nil, want not authenticated")
+	}
+	if stdout != "" {
+		t.Errorf("stdout = %q, want nothing", stdout)
+	}
+}
+
+func TestRunGetToken_Raw(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(envToken, "")
+	t.Setenv(envServerURL, "")
+	t.Setenv(envExecInfo, "")
+
+	storage := token.NewStorage(token.DefaultCachePath())
+	if err := storage.Save(&token.Cache{
+		ServerURL:    "https://kauth.example.com",
+		IDToken:      "id-token",
+		RefreshToken: "refresh-token",
+		WebhookToken: "webhook-token",
+	}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	var out, stderr bytes.Buffer
+	getTokenCmd.SetOut(&out)
+	getTokenCmd.SetErr(&stderr)
+	t.Cleanup(func() {
+		getTokenCmd.SetOut(nil)
+		getTokenCmd.SetErr(nil)
+		getTokenRaw = false
+	})
+
+	// Default: an ExecCredential for kubectl.
+	if err := runGetToken(getTokenCmd, nil); err != nil {
+		t.Fatalf("runGetToken() error = %v", err)
+	}
+	var cred ExecCredential
+	if err := json.Unmarshal(out.Bytes(), &cred); err != nil || cred.Kind != "ExecCredential" {
+		t.Fatalf("default output is not an ExecCredential: %v\n%s", err, out.String())
+	}
+
+	// --raw: the bare ID token and a note on stderr.
+	out.Reset()
+	getTokenRaw = true
+	if err := runGetToken(getTokenCmd, nil); err != nil {
+		t.Fatalf("runGetToken(--raw) error = %v", err)
+	}
+	if out.String() != "id-token\n" {
+		t.Errorf("--raw output = %q, want the bare ID token", out.String())
+	}
+	if strings.Contains(out.String()+stderr.String(), "refresh-token") {
+		t.Error("--raw printed the refresh token")
+	}
+	if !strings.Contains(stderr.String(), "debugging") {
+		t.Errorf("stderr = %q, want a debugging note", stderr.String())
+	}
+}
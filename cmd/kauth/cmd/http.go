@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"kauth/pkg/apierror"
+)
+
+const (
+	// defaultHTTPTimeout bounds a whole request to the kauth server.
+	defaultHTTPTimeout = 30 * time.Second
+	// httpConnectTimeout bounds the TCP connect and TLS handshake, so an
+	// unreachable server fails fast even with a long overall timeout.
+	httpConnectTimeout = 10 * time.Second
+)
+
+// envHTTPTimeout overrides the request timeout when --timeout is not set.
+const envHTTPTimeout = "KAUTH_TIMEOUT"
+
+// httpClient is used for requests to the kauth server. It is rebuilt with
+// the resolved timeout before each command runs.
+var httpClient = newHTTPClient(defaultHTTPTimeout)
+
+var httpTimeout time.Duration
+
+func init() {
+	rootCmd.PersistentFlags().DurationVar(&httpTimeout, "timeout", 0, "timeout for requests to the kauth server (default 30s, env KAUTH_TIMEOUT)")
+}
+
+// newHTTPClient creates the client for requests to the kauth server. Proxy
+// settings (HTTPS_PROXY, NO_PROXY) are honoured as with the default
+// transport, and requests are logged with --verbose.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{
+		Timeout:   httpConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}).DialContext
+	transport.TLSHandshakeTimeout = httpConnectTimeout
+	return &http.Client{Timeout: timeout, Transport: &debugTransport{next: transport}}
+}
+
+// resolveHTTPTimeout picks the request timeout from, in order, the
+// --timeout flag, KAUTH_TIMEOUT, and defaultHTTPTimeout.
+func resolveHTTPTimeout(flag time.Duration) (time.Duration, error) {
+	if flag < 0 {
+		return 0, fmt.Errorf("--timeout must not be negative, got %s", flag)
+	}
+	if flag > 0 {
+		return flag, nil
+	}
+	if v := os.Getenv(envHTTPTimeout); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("invalid %s %q: want a positive duration such as 45s", envHTTPTimeout, v)
+		}
+		return d, nil
+	}
+	return defaultHTTPTimeout, nil
+}
+
+// serverError is a non-2xx response from the kauth server. Code is the
+// server's machine-readable error code (see pkg/apierror), empty for
+// servers that predate JSON error bodies.
+type serverError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *serverError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("server returned status %d", e.Status)
+	}
+	return fmt.Sprintf("%s (HTTP %d)", e.Message, e.Status)
+}
+
+// readServerError reads the error body of resp. JSON bodies are decoded;
+// the plain-text bodies of older servers become the message.
+func readServerError(resp *http.Response) *serverError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	se := &serverError{Status: resp.StatusCode}
+	var apiErr apierror.Response
+	if json.Unmarshal(body, &apiErr) == nil && apiErr.Code != "" {
+		se.Code, se.Message = apiErr.Code, apiErr.Message
+		return se
+	}
+	se.Message = strings.TrimSpace(string(body))
+	return se
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResolveHTTPTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		flag    time.Duration
+		env     string
+		want    time.Duration
+		wantErr bool
+	}{
+		{name: "default", want: defaultHTTPTimeout},
+		{name: "env", env: "45s", want: 45 * time.Second},
+		{name: "flag wins over env", flag: 5 * time.Second, env: "45s", want: 5 * time.Second},
+		{name: "invalid env", env: "soon", wantErr: true},
+		{name: "zero env", env: "0s", wantErr: true},
+		{name: "negative flag", flag: -time.Second, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(envHTTPTimeout, tt.env)
+			got, err := resolveHTTPTimeout(tt.flag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolveHTTPTimeout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("resolveHTTPTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewHTTPClient(t *testing.T) {
+	client := newHTTPClient(time.Minute)
+	if client.Timeout != time.Minute {
+		t.Errorf("Timeout = %v, want 1m", client.Timeout)
+	}
+	logged, ok := client.Transport.(*debugTransport)
+	if !ok {
+		t.Fatalf("Transport = %T, want *debugTransport", client.Transport)
+	}
+	transport, ok := logged.next.(*http.Transport)
+	if !ok {
+		t.Fatalf("wrapped Transport = %T, want *http.Transport", logged.next)
+	}
+	if transport.TLSHandshakeTimeout != httpConnectTimeout {
+		t.Errorf("TLSHandshakeTimeout = %v, want %v", transport.TLSHandshakeTimeout, httpConnectTimeout)
+	}
+	if transport.Proxy == nil {
+		t.Error("transport dropped proxy support (HTTPS_PROXY)")
+	}
+}
+
+func TestNewHTTPClient_TimesOut(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(release) })
+
+	resp, err := newHTTPClient(50 * time.Millisecond).Get(srv.URL)
+	if err == nil {
+		_ = resp.Body.Close()
+		t.Fatal("Get() error = nil, want timeout")
+	}
+}
+
+func TestReadServerError(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		wantCode    string
+		wantMessage string
+	}{
+		{name: "json", body: `{"error":"rate_limited","message":"Rate limit exceeded"}` + "\n", wantCode: "rate_limited", wantMessage: "Rate limit exceeded"},
+		{name: "plain text from an older server", body: "Rate limit exceeded\n", wantMessage: "Rate limit exceeded"},
+		{name: "empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: http.StatusTooManyRequests, Body: io.NopCloser(strings.NewReader(tt.body))}
+			se := readServerError(resp)
+			if se.Status != http.StatusTooManyRequests || se.Code != tt.wantCode || se.Message != tt.wantMessage {
+				t.Errorf("readServerError() = %+v", se)
+			}
+			if se.Error() == "" {
+				t.Error("empty Error()")
+			}
+		})
+	}
+}
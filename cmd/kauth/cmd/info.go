@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"kauth/pkg/token"
+
+	"github.com/spf13/cobra"
+)
+
+var infoCmd = &cobra.Command{
+	Use:   "info",
+	Short: "Show the configuration a kauth server advertises",
+	Long: `Show the cluster and OIDC configuration a kauth server advertises at /info,
+without logging in: cluster name, API server, issuer, client ID, and the
+login and refresh URLs. Use it to check you are pointing at the right server
+and cluster before kauth login.
+
+--output json or yaml prints the /info response as-is.
+
+The server is taken from --url, then KAUTH_SERVER_URL, then the token cache.`,
+	RunE: runInfo,
+}
+
+var (
+	infoURL    string
+	infoOutput string
+)
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+	infoCmd.Flags().StringVar(&infoURL, "url", "", "kauth server URL (overrides KAUTH_SERVER_URL and the token cache)")
+	addOutputFlag(infoCmd, &infoOutput)
+}
+
+func runInfo(cmd *cobra.Command, args []string) error {
+	if err := checkOutputFormat(infoOutput); err != nil {
+		return err
+	}
+
+	var cached *token.Cache
+	if store, err := token.DefaultCredentialStore(); err == nil {
+		cached, _ = store.Get()
+	}
+	serverURL := strings.TrimRight(resolveGetTokenServerURL(infoURL, cached), "/")
+	if serverURL == "" {
+		return errors.New("no kauth server configured.\n\nSet the server with --url or KAUTH_SERVER_URL")
+	}
+
+	info, err := fetchInfo(httpClient, serverURL)
+	if err != nil {
+		return err
+	}
+
+	if infoOutput != outputTable {
+		return writeOutput(cmd.OutOrStdout(), infoOutput, info)
+	}
+	fmt.Printf("\n  %s %s\n\n", accent.Render("●"), bold.Render("Server Info"))
+	fmt.Printf("  %s %s\n", accent.Render("Server"), orange.Render(serverURL))
+	fmt.Printf("  %s %s\n", accent.Render("Cluster"), orange.Render(info.ClusterName))
+	fmt.Printf("  %s %s\n", accent.Render("API Server"), orange.Render(info.ClusterServer))
+	if info.ClusterProxy != "" {
+		fmt.Printf("  %s %s\n", accent.Render("Proxy"), orange.Render(info.ClusterProxy))
+	}
+	if info.ClusterTLSSNI != "" {
+		fmt.Printf("  %s %s\n", accent.Render("TLS Server Name"), orange.Render(info.ClusterTLSSNI))
+	}
+	fmt.Printf("  %s %s\n", accent.Render("Issuer"), orange.Render(info.IssuerURL))
+	fmt.Printf("  %s %s\n", accent.Render("Client ID"), orange.Render(info.ClientID))
+	fmt.Printf("  %s %s\n", accent.Render("Login URL"), orange.Render(info.LoginURL))
+	fmt.Printf("  %s %s\n\n", accent.Render("Refresh URL"), orange.Render(info.RefreshURL))
+	return nil
+}
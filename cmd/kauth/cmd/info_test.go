@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRunInfo(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv(envServerURL, "")
+
+	want := InfoResponse{
+		ClusterName:   "prod",
+		ClusterServer: "https://k8s.example.com",
+		IssuerURL:     "https://idp.example.com",
+		ClientID:      "kauth",
+		LoginURL:      "https://kauth.example.com/start-login",
+		RefreshURL:    "https://kauth.example.com/refresh",
+	}
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		wantErr string
+	}{
+		{
+			name: "ok",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_ = json.NewEncoder(w).Encode(want)
+			},
+		},
+		{
+			name: "server error",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				_, _ = w.Write([]byte(`{"error":"unavailable","message":"OIDC provider not ready"}`))
+			},
+			wantErr: "OIDC provider not ready (HTTP 503)",
+		},
+		{
+			name: "not JSON",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("<html>hello</html>"))
+			},
+			wantErr: "is this a kauth server?",
+		},
+		{
+			name: "missing cluster",
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte(`{"issuer_url":"https://idp.example.com"}`))
+			},
+			wantErr: "did not report a cluster name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+
+			var buf bytes.Buffer
+			infoCmd.SetOut(&buf)
+			infoURL, infoOutput = srv.URL, outputJSON
+			t.Cleanup(func() {
+				infoCmd.SetOut(nil)
+				infoURL, infoOutput = "", outputTable
+			})
+
+			err := runInfo(infoCmd, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("runInfo() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("runInfo() error = %v", err)
+			}
+			var got InfoResponse
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil || got != want {
+				t.Errorf("runInfo() output = %+v, %v, want %+v", got, err, want)
+			}
+		})
+	}
+}
@@ -3,6 +3,7 @@ package cmd
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"strings"
 
@@ -14,26 +15,28 @@ type promptOption struct {
 	label string
 }
 
-func promptMenu(options []promptOption, indent string) (string, error) {
+// promptMenu asks on out for one of options, reading a single key press
+// when stdin is a terminal.
+func promptMenu(out io.Writer, options []promptOption, indent string) (string, error) {
 	fd := int(os.Stdin.Fd())
 	if !term.IsTerminal(fd) {
-		return promptMenuFallback(options, indent)
+		return promptMenuFallback(out, options, indent)
 	}
 
 	oldState, err := term.MakeRaw(fd)
 	if err != nil {
-		return promptMenuFallback(options, indent)
+		return promptMenuFallback(out, options, indent)
 	}
 	defer term.Restore(fd, oldState) //nolint:errcheck
 
-	fmt.Print("\x1b[?25l")
-	defer fmt.Print("\x1b[?25h")
+	fmt.Fprint(out, "\x1b[?25l")
+	defer fmt.Fprint(out, "\x1b[?25h")
 
 	var parts []string
 	for _, opt := range options {
 		parts = append(parts, fmt.Sprintf("%s %s", pill.Render(opt.key), muted.Render(opt.label)))
 	}
-	fmt.Printf("\n%s%s\r\n\r\n", indent, strings.Join(parts, muted.Render(" / ")))
+	fmt.Fprintf(out, "\n%s%s\r\n\r\n", indent, strings.Join(parts, muted.Render(" / ")))
 
 	buf := make([]byte, 32)
 	for {
@@ -45,16 +48,16 @@ func promptMenu(options []promptOption, indent string) (string, error) {
 
 		switch b[0] {
 		case 3:
-			fmt.Print("\r\n")
+			fmt.Fprint(out, "\r\n")
 			return "", fmt.Errorf("interrupted")
 		default:
 			key := strings.ToLower(string(b[0]))
 			for _, opt := range options {
 				if key == opt.key {
 					if key == "c" {
-						fmt.Printf("%s%s %s\r\n", indent, warningIcon, muted.Render("Cancelled"))
+						fmt.Fprintf(out, "%s%s %s\r\n", indent, warningIcon, muted.Render("Cancelled"))
 					} else {
-						fmt.Printf("%s%s %s\r\n", indent, successIcon, muted.Render(opt.label))
+						fmt.Fprintf(out, "%s%s %s\r\n", indent, successIcon, muted.Render(opt.label))
 					}
 					return key, nil
 				}
@@ -63,12 +66,12 @@ func promptMenu(options []promptOption, indent string) (string, error) {
 	}
 }
 
-func promptMenuFallback(options []promptOption, indent string) (string, error) {
+func promptMenuFallback(out io.Writer, options []promptOption, indent string) (string, error) {
 	var parts []string
 	for _, opt := range options {
 		parts = append(parts, fmt.Sprintf("%s %s", pill.Render(opt.key), muted.Render(opt.label)))
 	}
-	fmt.Printf("\n%s%s\r\n", indent, strings.Join(parts, muted.Render(" / ")))
+	fmt.Fprintf(out, "\n%s%s\r\n", indent, strings.Join(parts, muted.Render(" / ")))
 
 	r := bufio.NewReader(os.Stdin)
 	line, err := r.ReadString('\n')
@@ -77,15 +80,15 @@ func promptMenuFallback(options []promptOption, indent string) (string, error) {
 	}
 	in := strings.TrimSpace(strings.ToLower(line))
 	if in == "" {
-		fmt.Printf("%s%s %s\r\n", indent, successIcon, muted.Render(options[0].label))
+		fmt.Fprintf(out, "%s%s %s\r\n", indent, successIcon, muted.Render(options[0].label))
 		return options[0].key, nil
 	}
 	for _, opt := range options {
 		if in == opt.key {
 			if in == "c" {
-				fmt.Printf("%s%s %s\r\n", indent, warningIcon, muted.Render("Cancelled"))
+				fmt.Fprintf(out, "%s%s %s\r\n", indent, warningIcon, muted.Render("Cancelled"))
 			} else {
-				fmt.Printf("%s%s %s\r\n", indent, successIcon, muted.Render(opt.label))
+				fmt.Fprintf(out, "%s%s %s\r\n", indent, successIcon, muted.Render(opt.label))
 			}
 			return in, nil
 		}
@@ -2,18 +2,25 @@ package cmd
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/cookiejar"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"kauth/pkg/apierror"
+	"kauth/pkg/oauth"
 	"kauth/pkg/token"
 
 	"gopkg.in/yaml.v3"
@@ -21,7 +28,27 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var serverURL string
+var (
+	serverURL         string
+	loginClusterName  string
+	tokenInKubeconfig bool
+	allowInsecure     bool
+	loginTimeout      time.Duration
+	loginKubeconfig   string
+	loginMerge        bool
+	loginFlow         string
+	callbackPort      int
+	callbackHost      string
+	loginProxyURL     string
+	loginTLSServer    string
+)
+
+// stdoutPath as --kubeconfig writes the kubeconfig to stdout.
+const stdoutPath = "-"
+
+// defaultLoginTimeout bounds the whole browser login, matching the server's
+// own wait for the OAuth callback.
+const defaultLoginTimeout = 5 * time.Minute
 
 var loginCmd = &cobra.Command{
 	Use:   "login",
@@ -29,27 +56,54 @@ var loginCmd = &cobra.Command{
 	Long: `Authenticate with your Kubernetes cluster.
 
 Clusters are discovered automatically via DNS TXT records at _kauth.<domain>.
-If no DNS records are found, the previously used server URL is tried.`,
+If no DNS records are found, the previously used server URL is tried.
+
+By default the kauth server runs the OAuth flow. Where its redirect is
+blocked, --flow browser (local callback server) or --flow device (device
+code) authenticate against the identity provider directly; the IdP client
+must then allow public clients.
+
+The kubeconfig is merged into the first file in KUBECONFIG, or
+~/.kube/config. --kubeconfig writes it to another file, replacing it unless
+--merge is given, or to stdout with --kubeconfig -.
+
+Credentials are cached in ~/.kube/cache/kauth-token.json. Set
+KAUTH_CACHE_BACKEND=keyring to keep them in the OS keyring instead.`,
 	RunE: runLogin,
 }
 
 func init() {
 	rootCmd.AddCommand(loginCmd)
 	loginCmd.Flags().StringVar(&serverURL, "url", "", "kauth server URL (skips DNS discovery)")
+	loginCmd.Flags().StringVar(&loginClusterName, "cluster-name", "", "local name for the cluster, context and user (defaults to the server's cluster name)")
+	loginCmd.Flags().BoolVar(&allowInsecure, "allow-insecure", false, "accept a kubeconfig that skips TLS verification of the API server")
+	loginCmd.Flags().DurationVar(&loginTimeout, "login-timeout", defaultLoginTimeout, "how long to wait for the browser login to complete")
+	loginCmd.Flags().StringVar(&loginKubeconfig, "kubeconfig", "", "kubeconfig file to write, or - for stdout (defaults to KUBECONFIG or ~/.kube/config)")
+	loginCmd.Flags().BoolVar(&loginMerge, "merge", false, "merge into the --kubeconfig file instead of replacing it")
+	loginCmd.Flags().StringVar(&loginFlow, "flow", flowServer, "login flow: server (kauth runs the OAuth flow), browser (local callback server) or device (device code)")
+	loginCmd.Flags().IntVar(&callbackPort, "callback-port", 8000, "local port for the --flow browser callback (0 picks a free port; the IdP must accept any loopback port)")
+	loginCmd.Flags().StringVar(&callbackHost, "callback-host", oauth.DefaultCallbackHost, "local address for the --flow browser callback, e.g. 127.0.0.1 where localhost does not reach this machine")
+	loginCmd.Flags().StringVar(&loginProxyURL, "proxy-url", "", "proxy kubectl reaches the API server through (sets the cluster's proxy-url)")
+	loginCmd.Flags().StringVar(&loginTLSServer, "tls-server-name", "", "name to verify the API server certificate against (sets the cluster's tls-server-name)")
+	loginCmd.Flags().BoolVar(&tokenInKubeconfig, "token-in-kubeconfig", false, "store the cluster credential in the kubeconfig exec env instead of the token cache (anyone who can read the kubeconfig can use it)")
 }
 
 type InfoResponse struct {
-	ClusterName   string `json:"cluster_name"`
-	ClusterServer string `json:"cluster_server"`
-	IssuerURL     string `json:"issuer_url"`
-	ClientID      string `json:"client_id"`
-	LoginURL      string `json:"login_url"`
-	RefreshURL    string `json:"refresh_url"`
+	ClusterName   string `json:"cluster_name" yaml:"cluster_name"`
+	ClusterServer string `json:"cluster_server" yaml:"cluster_server"`
+	ClusterCA     string `json:"cluster_ca,omitempty" yaml:"cluster_ca,omitempty"`
+	ClusterProxy  string `json:"cluster_proxy_url,omitempty" yaml:"cluster_proxy_url,omitempty"`
+	ClusterTLSSNI string `json:"cluster_tls_server_name,omitempty" yaml:"cluster_tls_server_name,omitempty"`
+	IssuerURL     string `json:"issuer_url" yaml:"issuer_url"`
+	ClientID      string `json:"client_id" yaml:"client_id"`
+	LoginURL      string `json:"login_url" yaml:"login_url"`
+	RefreshURL    string `json:"refresh_url" yaml:"refresh_url"`
 }
 
 type StartLoginResponse struct {
 	SessionToken string `json:"session_token"`
 	LoginURL     string `json:"login_url"`
+	Nonce        string `json:"nonce"`
 }
 
 type StatusResponse struct {
@@ -60,10 +114,29 @@ type StatusResponse struct {
 	WebhookToken  string    `json:"webhook_token,omitempty"`
 	SessionExpiry time.Time `json:"session_expiry,omitempty"`
 	Error         string    `json:"error,omitempty"`
+
+	RefreshTokenExpiresIn int64  `json:"refresh_token_expires_in,omitempty"`
+	SessionExpiresIn      int64  `json:"session_expires_in,omitempty"`
+	Warning               string `json:"warning,omitempty"`
 }
 
 func runLogin(cmd *cobra.Command, args []string) error {
-	serverURL, err := resolveServerURL()
+	store, err := token.DefaultCredentialStore()
+	if err != nil {
+		return err
+	}
+
+	kubeconfigPath, merge := resolveKubeconfigPath(loginKubeconfig)
+	merge = merge || loginMerge
+	// progress receives everything shown to the user during login. With
+	// --kubeconfig - it goes to stderr, keeping stdout for the kubeconfig
+	// alone.
+	progress := io.Writer(os.Stdout)
+	if kubeconfigPath == stdoutPath {
+		progress = os.Stderr
+	}
+
+	serverURL, err := resolveServerURL(progress)
 	if err != nil {
 		return err
 	}
@@ -72,10 +145,26 @@ func runLogin(cmd *cobra.Command, args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to create cookie jar: %w", err)
 	}
-	client := &http.Client{Jar: jar}
+	client := &http.Client{Jar: jar, Transport: httpClient.Transport}
+
+	if loginTimeout <= 0 {
+		return fmt.Errorf("--login-timeout must be positive, got %s", loginTimeout)
+	}
+	if err := validateLoginFlow(loginFlow); err != nil {
+		return err
+	}
+	// Ctrl-C or the deadline cancels every request below, including the
+	// long-lived /watch stream, so an abandoned login never hangs.
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, loginTimeout)
+	defer cancel()
 
-	resp, err := client.Get(serverURL + "/info")
+	resp, err := getWithContext(ctx, client, serverURL+"/info")
 	if err != nil {
+		if ctx.Err() != nil {
+			return loginContextError(ctx)
+		}
 		return fmt.Errorf("could not reach kauth at %s: %w", serverURL, err)
 	}
 	defer func() { _ = resp.Body.Close() }()
@@ -90,45 +179,68 @@ func runLogin(cmd *cobra.Command, args []string) error {
 	}
 
 	serverLink := hyperlink(muted.Render(urlHost(serverURL)), serverURL)
-	fmt.Printf("\n  %s %s %s\n\n", accent.Render("◆"), accent.Render(info.ClusterName), serverLink)
+	fmt.Fprintf(progress, "\n  %s %s %s\n\n", accent.Render("◆"), accent.Render(info.ClusterName), serverLink)
 
-	loginResp, err := client.Get(serverURL + "/start-login")
+	var status *StatusResponse
+	if loginFlow == flowServer {
+		status, err = serverLogin(ctx, progress, client, serverURL)
+	} else {
+		status, err = idpLogin(ctx, progress, serverURL, &info, loginFlow, callbackHost, callbackPort)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to start login: %w", err)
+		if ctx.Err() != nil {
+			return loginContextError(ctx)
+		}
+		return err
 	}
-	defer func() { _ = loginResp.Body.Close() }()
+	// The rest of the login is local; give Ctrl-C back to the prompts.
+	stop()
 
-	var loginData StartLoginResponse
-	if err := json.NewDecoder(loginResp.Body).Decode(&loginData); err != nil {
-		return fmt.Errorf("invalid login response: %w", err)
+	if err := validateServerKubeconfig(status.Kubeconfig, info.ClusterName); err != nil {
+		return fmt.Errorf("server returned an invalid kubeconfig: %w", err)
 	}
-
-	loginLink := hyperlink(link.Render("login page"), loginData.LoginURL)
-	if err := openBrowser(loginData.LoginURL); err != nil {
-		fmt.Printf("  %s %s %s\n\n", accent.Render("◐"), muted.Render("Open"), loginLink)
-	} else {
-		fmt.Printf("  %s %s %s\n", accent.Render("◐"), muted.Render("Opening browser… didn't open?"), loginLink)
+	insecure, err := checkClusterTLS(status.Kubeconfig, allowInsecure)
+	if err != nil {
+		return err
+	}
+	if insecure {
+		fmt.Fprintf(progress, "\n  %s %s\n", warningIcon, yellow.Render("TLS verification of the API server is DISABLED for this cluster"))
 	}
 
-	fmt.Printf("  %s %s\n", accent.Render("◌"), muted.Render("Waiting for authentication…"))
+	clusterName := info.ClusterName
+	if loginClusterName != "" {
+		renamed, err := renameKubeconfig(status.Kubeconfig, loginClusterName)
+		if err != nil {
+			return fmt.Errorf("failed to rename kubeconfig entries: %w", err)
+		}
+		status.Kubeconfig = renamed
+		clusterName = loginClusterName
+	}
 
-	status, err := watchForCompletion(client, serverURL, loginData.SessionToken)
-	if err != nil {
-		return err
+	if loginProxyURL != "" || loginTLSServer != "" {
+		updated, err := setClusterOptions(status.Kubeconfig, loginProxyURL, loginTLSServer)
+		if err != nil {
+			return fmt.Errorf("failed to set cluster options in kubeconfig: %w", err)
+		}
+		status.Kubeconfig = updated
 	}
 
-	kubeconfigPath := filepath.Join(os.Getenv("HOME"), ".kube", "config")
-	if err := os.MkdirAll(filepath.Dir(kubeconfigPath), 0755); err != nil {
-		return fmt.Errorf("failed to create .kube directory: %w", err)
+	if tokenInKubeconfig && status.WebhookToken != "" {
+		env := []envVar{{Name: envToken, Value: status.WebhookToken}}
+		if !status.SessionExpiry.IsZero() {
+			env = append(env, envVar{Name: envTokenExpiry, Value: status.SessionExpiry.UTC().Format(time.RFC3339)})
+		}
+		withEnv, err := setExecEnv(status.Kubeconfig, env)
+		if err != nil {
+			return fmt.Errorf("failed to add token to kubeconfig: %w", err)
+		}
+		status.Kubeconfig = withEnv
 	}
 
-	fileExists := false
-	shouldMerge := false
-	if existingData, err := os.ReadFile(kubeconfigPath); err == nil && len(existingData) > 0 {
-		fileExists = true
-		if hasConflict(existingData, info.ClusterName) {
-			fmt.Printf("\n  %s %s\n", warningIcon, muted.Render(fmt.Sprintf("Context %q already exists", info.ClusterName)))
-			choice, err := promptMenu([]promptOption{
+	if merge && kubeconfigPath != stdoutPath {
+		if existingData, err := os.ReadFile(kubeconfigPath); err == nil && hasConflict(existingData, clusterName) {
+			fmt.Fprintf(progress, "\n  %s %s\n", warningIcon, muted.Render(fmt.Sprintf("Context %q already exists", clusterName)))
+			choice, err := promptMenu(progress, []promptOption{
 				{key: "m", label: "merge"},
 				{key: "o", label: "overwrite"},
 				{key: "c", label: "cancel"},
@@ -140,33 +252,24 @@ func runLogin(cmd *cobra.Command, args []string) error {
 				return err
 			}
 			switch choice {
-			case "m":
-				shouldMerge = true
 			case "o":
-				shouldMerge = false
+				merge = false
 			case "c":
 				return nil
 			}
-		} else {
-			shouldMerge = true
 		}
 	}
 
-	if shouldMerge && fileExists {
-		if err := mergeKubeconfig(kubeconfigPath, status.Kubeconfig); err != nil {
-			return fmt.Errorf("failed to merge kubeconfig: %w", err)
-		}
-	} else {
-		if err := os.WriteFile(kubeconfigPath, []byte(status.Kubeconfig), 0600); err != nil {
-			return fmt.Errorf("failed to save kubeconfig: %w", err)
-		}
+	if err := writeLoginKubeconfig(os.Stdout, kubeconfigPath, status.Kubeconfig, merge); err != nil {
+		return err
 	}
 
-	storage := token.NewStorage(token.DefaultCachePath())
 	newCache := &token.Cache{
-		ServerURL:    serverURL,
-		SessionID:    status.SessionID,
-		WebhookToken: status.WebhookToken,
+		ServerURL: serverURL,
+		SessionID: status.SessionID,
+	}
+	if !tokenInKubeconfig {
+		newCache.WebhookToken = status.WebhookToken
 	}
 
 	if !status.SessionExpiry.IsZero() {
@@ -177,26 +280,43 @@ func runLogin(cmd *cobra.Command, args []string) error {
 	}
 
 	if status.RefreshToken != "" {
+		// Cache the refresh token from the login itself, so a failed
+		// exchange below (e.g. a network blip) does not leave the user
+		// without one.
+		newCache.RefreshToken = status.RefreshToken
+		newCache.RefreshExpiry = refreshChainExpiry(time.Now(), status.RefreshTokenExpiresIn, status.SessionExpiresIn)
 		refreshResp, err := refreshTokenFromServer(serverURL, status.RefreshToken)
-		if err == nil {
+		if err != nil {
+			debugf("post-login refresh failed, keeping the login's refresh token: %v", err)
+		} else {
 			newCache.IDToken = refreshResp.IDToken
 			newCache.RefreshToken = refreshResp.RefreshToken
+			newCache.RefreshExpiry = refreshChainExpiry(time.Now(), refreshResp.RefreshTokenExpiresIn, refreshResp.SessionExpiresIn)
 			if newCache.Expiry.IsZero() {
 				newCache.Expiry = time.Now().Add(time.Duration(refreshResp.ExpiresIn) * time.Second)
 			}
 		}
 	}
 
-	if err := storage.Save(newCache); err != nil {
+	if err := store.Set(newCache); err != nil {
 		fmt.Fprintf(os.Stderr, "warning: failed to cache token: %v\n", err)
 	}
 
-	fmt.Printf("\n  %s %s %s\n", successIcon, green.Render("Logged in to "+info.ClusterName), muted.Render(kubeconfigPath))
+	written := kubeconfigPath
+	if written == stdoutPath {
+		written = "stdout"
+	}
+	fmt.Fprintf(progress, "\n  %s %s %s\n", successIcon, green.Render("Logged in to "+clusterName), muted.Render(written))
+	if status.Warning != "" {
+		fmt.Fprintf(progress, "\n  %s %s\n", warningIcon, yellow.Render(status.Warning))
+	}
 
 	return nil
 }
 
-func resolveServerURL() (string, error) {
+// resolveServerURL picks the kauth server to log in to, asking on out if
+// DNS discovery finds several.
+func resolveServerURL(out io.Writer) (string, error) {
 	if serverURL != "" {
 		return serverURL, nil
 	}
@@ -204,25 +324,27 @@ func resolveServerURL() (string, error) {
 	if domain, err := detectDomain(); err == nil {
 		for d := domain; strings.Contains(d, "."); {
 			if servers := discoverDNS(d); len(servers) > 0 {
-				return selectServer(servers)
+				return selectServer(out, servers)
 			}
 			_, d, _ = strings.Cut(d, ".")
 		}
 	}
 
-	if cached, err := token.NewStorage(token.DefaultCachePath()).Load(); err == nil && cached != nil && cached.ServerURL != "" {
-		return cached.ServerURL, nil
+	if store, err := token.DefaultCredentialStore(); err == nil {
+		if cached, err := store.Get(); err == nil && cached != nil && cached.ServerURL != "" {
+			return cached.ServerURL, nil
+		}
 	}
 
 	return "", fmt.Errorf("no kauth servers found.\n\nConfigure DNS TXT records at _kauth.<domain> or run:\n  kauth login --url <server-url>")
 }
 
-func selectServer(servers []discoveredServer) (string, error) {
+func selectServer(out io.Writer, servers []discoveredServer) (string, error) {
 	if len(servers) == 1 {
 		return servers[0].URL, nil
 	}
 
-	fmt.Printf("\n  %s\n", muted.Render("Multiple kauth servers found"))
+	fmt.Fprintf(out, "\n  %s\n", muted.Render("Multiple kauth servers found"))
 	opts := make([]promptOption, len(servers))
 	for i, s := range servers {
 		name := s.Name
@@ -235,7 +357,7 @@ func selectServer(servers []discoveredServer) (string, error) {
 		}
 	}
 
-	choice, err := promptMenu(opts, "  ")
+	choice, err := promptMenu(out, opts, "  ")
 	if err != nil {
 		return "", err
 	}
@@ -243,6 +365,49 @@ func selectServer(servers []discoveredServer) (string, error) {
 	return servers[n-1].URL, nil
 }
 
+// startLogin begins a login at /start-login.
+func startLogin(ctx context.Context, client *http.Client, serverURL string) (*StartLoginResponse, error) {
+	loginResp, err := getWithContext(ctx, client, serverURL+"/start-login")
+	if err != nil {
+		return nil, fmt.Errorf("failed to start login: %w", err)
+	}
+	defer func() { _ = loginResp.Body.Close() }()
+	if loginResp.StatusCode != http.StatusOK {
+		se := readServerError(loginResp)
+		if se.Code == apierror.CodeTooManyLogins || se.Code == apierror.CodeRateLimited {
+			return nil, fmt.Errorf("the kauth server is busy: %w\n\nPlease try again in a minute", se)
+		}
+		return nil, fmt.Errorf("failed to start login: %w", se)
+	}
+
+	var loginData StartLoginResponse
+	if err := json.NewDecoder(loginResp.Body).Decode(&loginData); err != nil {
+		return nil, fmt.Errorf("invalid login response: %w", err)
+	}
+	return &loginData, nil
+}
+
+// serverLogin runs the server-side flow: the kauth server redirects the
+// browser to the IdP and handles the callback while the CLI waits on /watch.
+// Instructions for the user are written to out.
+func serverLogin(ctx context.Context, out io.Writer, client *http.Client, serverURL string) (*StatusResponse, error) {
+	loginData, err := startLogin(ctx, client, serverURL)
+	if err != nil {
+		return nil, err
+	}
+
+	loginLink := hyperlink(link.Render("login page"), loginData.LoginURL)
+	if err := openBrowser(loginData.LoginURL); err != nil {
+		fmt.Fprintf(out, "  %s %s %s\n\n", accent.Render("◐"), muted.Render("Open"), loginLink)
+	} else {
+		fmt.Fprintf(out, "  %s %s %s\n", accent.Render("◐"), muted.Render("Opening browser… didn't open?"), loginLink)
+	}
+
+	fmt.Fprintf(out, "  %s %s\n", accent.Render("◌"), muted.Render("Waiting for authentication…"))
+
+	return watchForCompletion(ctx, client, serverURL, loginData.SessionToken)
+}
+
 // watchForCompletion waits for the login to complete by streaming the server's
 // /watch SSE endpoint. The connection is long-lived (it stays open while the
 // user authenticates in the browser) so it is vulnerable to being silently
@@ -254,32 +419,51 @@ func selectServer(servers []discoveredServer) (string, error) {
 // we reconnect. This is safe because the server immediately re-sends the final
 // status when the session is already active, so a reconnect recovers any result
 // that was missed during a drop.
-func watchForCompletion(client *http.Client, baseURL, sessionToken string) (*StatusResponse, error) {
-	deadline := time.Now().Add(15 * time.Minute)
+//
+// The overall wait is bounded by ctx (--login-timeout, or Ctrl-C).
+func watchForCompletion(ctx context.Context, client *http.Client, baseURL, sessionToken string) (*StatusResponse, error) {
 	for {
-		status, retriable, err := watchOnce(client, baseURL, sessionToken)
+		status, retriable, err := watchOnce(ctx, client, baseURL, sessionToken)
 		switch {
+		case ctx.Err() != nil:
+			return nil, loginContextError(ctx)
 		case err != nil && !retriable:
 			return nil, err
 		case status != nil:
 			return status, nil
 		}
 
-		if !time.Now().Before(deadline) {
-			return nil, fmt.Errorf("timed out waiting for authentication.\n\nPlease try logging in again")
-		}
-		if debug {
-			fmt.Fprintf(os.Stderr, "  [debug] reconnecting in 2s...\n")
+		debugf("reconnecting to /watch in 2s")
+		select {
+		case <-ctx.Done():
+			return nil, loginContextError(ctx)
+		case <-time.After(2 * time.Second):
 		}
-		time.Sleep(2 * time.Second)
 	}
 }
 
+// loginContextError explains why ctx ended the login.
+func loginContextError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("timed out after %s waiting for authentication.\n\nPlease try logging in again, or raise --login-timeout", loginTimeout)
+	}
+	return errors.New("login cancelled")
+}
+
+// getWithContext issues a GET bound to ctx.
+func getWithContext(ctx context.Context, client *http.Client, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return client.Do(req)
+}
+
 // watchOnce makes a single /watch connection. It returns a non-nil status on
 // success. retriable is true when the connection dropped or idled without a
 // result, signalling the caller to reconnect.
-func watchOnce(client *http.Client, baseURL, sessionToken string) (status *StatusResponse, retriable bool, err error) {
-	resp, err := client.Get(fmt.Sprintf("%s/watch?session_token=%s", baseURL, sessionToken))
+func watchOnce(ctx context.Context, client *http.Client, baseURL, sessionToken string) (status *StatusResponse, retriable bool, err error) {
+	resp, err := getWithContext(ctx, client, fmt.Sprintf("%s/watch?session_token=%s", baseURL, sessionToken))
 	if err != nil {
 		return nil, true, nil // connection failure: reconnect
 	}
@@ -290,7 +474,7 @@ func watchOnce(client *http.Client, baseURL, sessionToken string) (status *Statu
 		if resp.StatusCode >= 500 {
 			return nil, true, nil
 		}
-		return nil, false, fmt.Errorf("watch endpoint returned error: %s\n\nYour session may have expired. Please try logging in again", resp.Status)
+		return nil, false, fmt.Errorf("watch endpoint returned error: %w\n\nYour session may have expired. Please try logging in again", readServerError(resp))
 	}
 
 	// Read the SSE stream in a goroutine so the main loop can enforce a
@@ -310,8 +494,9 @@ func watchOnce(client *http.Client, baseURL, sessionToken string) (status *Statu
 		close(lines)
 	}()
 
-	// The server sends a keepalive every 5s; if nothing arrives within this
-	// window the link is considered dead (half-open) and we reconnect.
+	// The server sends a keepalive at least every 10s (5s by default, see
+	// WATCH_KEEPALIVE_INTERVAL); if nothing arrives within this window the
+	// link is considered dead (half-open) and we reconnect.
 	const readTimeout = 30 * time.Second
 	timer := time.NewTimer(readTimeout)
 	defer timer.Stop()
@@ -320,9 +505,7 @@ func watchOnce(client *http.Client, baseURL, sessionToken string) (status *Statu
 		select {
 		case line, ok := <-lines:
 			if !ok {
-				if debug {
-					fmt.Fprintf(os.Stderr, "\n  [debug] watch stream ended, reconnecting\n")
-				}
+				debugf("watch stream ended, reconnecting")
 				return nil, true, nil // stream ended: reconnect
 			}
 			if !timer.Stop() {
@@ -332,11 +515,12 @@ func watchOnce(client *http.Client, baseURL, sessionToken string) (status *Statu
 
 			data, ok := strings.CutPrefix(line, "data: ")
 			if !ok {
-				if debug {
-					fmt.Fprintf(os.Stderr, ".")
+				if line != "" {
+					debugf("sse: %s", line)
 				}
 				continue // keepalive comment or blank line
 			}
+			debugf("sse data: %s", redactJSON(data))
 			var s StatusResponse
 			if err := json.Unmarshal([]byte(data), &s); err != nil {
 				continue
@@ -350,11 +534,11 @@ func watchOnce(client *http.Client, baseURL, sessionToken string) (status *Statu
 		case <-timer.C:
 			// No data within readTimeout: the connection is likely half-open.
 			// Closing the body unblocks the reader goroutine; then reconnect.
-			if debug {
-				fmt.Fprintf(os.Stderr, "\n  [debug] 30s read timeout, reconnecting\n")
-			}
+			debugf("no data from /watch in %s, reconnecting", readTimeout)
 			_ = resp.Body.Close()
 			return nil, true, nil
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
 		}
 	}
 }
@@ -401,14 +585,16 @@ type cluster struct {
 	CertificateAuthorityData string `yaml:"certificate-authority-data,omitempty"`
 	CertificateAuthority     string `yaml:"certificate-authority,omitempty"`
 	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify,omitempty"`
+	ProxyURL                 string `yaml:"proxy-url,omitempty"`
+	TLSServerName            string `yaml:"tls-server-name,omitempty"`
 }
 
 type namedContext struct {
-	Name    string  `yaml:"name"`
-	Context context `yaml:"context"`
+	Name    string      `yaml:"name"`
+	Context kubeContext `yaml:"context"`
 }
 
-type context struct {
+type kubeContext struct {
 	Cluster   string `yaml:"cluster"`
 	User      string `yaml:"user"`
 	Namespace string `yaml:"namespace,omitempty"`
@@ -471,66 +657,249 @@ func hasConflict(data []byte, clusterName string) bool {
 	return false
 }
 
-var httpClient = &http.Client{
-	Timeout: 30 * time.Second,
-}
+// validateServerKubeconfig checks that a server-issued kubeconfig parses and
+// describes exactly one cluster, user and context for clusterName, so a
+// malformed response never reaches the user's kubeconfig.
+func validateServerKubeconfig(data, clusterName string) error {
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+		return fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+
+	if len(kc.Clusters) != 1 || len(kc.Contexts) != 1 || len(kc.Users) != 1 {
+		return fmt.Errorf("expected exactly one cluster, context and user, got %d, %d and %d",
+			len(kc.Clusters), len(kc.Contexts), len(kc.Users))
+	}
 
-type RefreshRequest struct {
-	RefreshToken string `json:"refresh_token"`
+	c, ctx, u := kc.Clusters[0], kc.Contexts[0], kc.Users[0]
+	if c.Name != clusterName {
+		return fmt.Errorf("cluster is named %q, expected %q", c.Name, clusterName)
+	}
+	if c.Cluster.Server == "" {
+		return fmt.Errorf("cluster %q has no server", c.Name)
+	}
+	if u.Name == "" {
+		return fmt.Errorf("user has no name")
+	}
+	if !strings.HasSuffix(ctx.Name, "@"+clusterName) {
+		return fmt.Errorf("context is named %q, expected <user>@%s", ctx.Name, clusterName)
+	}
+	if ctx.Context.Cluster != c.Name || ctx.Context.User != u.Name {
+		return fmt.Errorf("context %q references cluster %q and user %q, expected %q and %q",
+			ctx.Name, ctx.Context.Cluster, ctx.Context.User, c.Name, u.Name)
+	}
+	if kc.CurrentContext != ctx.Name {
+		return fmt.Errorf("current-context is %q, expected %q", kc.CurrentContext, ctx.Name)
+	}
+	return nil
 }
 
-type RefreshResponse struct {
-	IDToken      string `json:"id_token"`
-	RefreshToken string `json:"refresh_token"`
-	ExpiresIn    int64  `json:"expires_in"`
-	TokenType    string `json:"token_type"`
-	Kubeconfig   string `json:"kubeconfig"`
+// setClusterOptions sets the proxy-url and tls-server-name of every cluster
+// in a server-issued kubeconfig. Empty values leave the server's setting.
+func setClusterOptions(data, proxyURL, tlsServerName string) (string, error) {
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+		return "", fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+	for i := range kc.Clusters {
+		if proxyURL != "" {
+			kc.Clusters[i].Cluster.ProxyURL = proxyURL
+		}
+		if tlsServerName != "" {
+			kc.Clusters[i].Cluster.TLSServerName = tlsServerName
+		}
+	}
+	out, err := yaml.Marshal(&kc)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal kubeconfig: %w", err)
+	}
+	return string(out), nil
 }
 
-func refreshTokenFromServer(baseURL, refreshToken string) (*RefreshResponse, error) {
-	reqBody, err := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+// setExecEnv sets env on every exec-based user in a kubeconfig, replacing
+// existing variables of the same name. kubectl passes these to get-token.
+func setExecEnv(data string, env []envVar) (string, error) {
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+		return "", fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+
+	for i := range kc.Users {
+		exec := kc.Users[i].User.Exec
+		if exec == nil {
+			continue
+		}
+		kept := exec.Env[:0]
+		for _, e := range exec.Env {
+			if !slices.ContainsFunc(env, func(n envVar) bool { return n.Name == e.Name }) {
+				kept = append(kept, e)
+			}
+		}
+		exec.Env = append(kept, env...)
+	}
+
+	out, err := yaml.Marshal(&kc)
 	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
+		return "", fmt.Errorf("failed to marshal kubeconfig: %w", err)
+	}
+	return string(out), nil
+}
+
+// checkClusterTLS reports whether a server-issued kubeconfig connects to the
+// API server without TLS verification (insecure-skip-tls-verify or a plain
+// http:// server). That is refused unless allowInsecure is set, so a
+// misconfigured or malicious server cannot silently downgrade the user's
+// kubeconfig.
+func checkClusterTLS(data string, allowInsecure bool) (insecure bool, err error) {
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+		return false, fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+
+	for _, c := range kc.Clusters {
+		if !c.Cluster.InsecureSkipTLSVerify && !strings.HasPrefix(c.Cluster.Server, "http://") {
+			continue
+		}
+		if !allowInsecure {
+			return true, fmt.Errorf("server issued a kubeconfig without TLS verification for cluster %q.\n\nIf this is intended, run:\n  kauth login --allow-insecure", c.Name)
+		}
+		insecure = true
+	}
+	return insecure, nil
+}
+
+// renameKubeconfig relabels the single cluster in a server-issued kubeconfig.
+// The cluster and user are renamed to name and every context's "@<cluster>"
+// suffix and references are rewritten to match, so the entries stay linked.
+func renameKubeconfig(data, name string) (string, error) {
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+		return "", fmt.Errorf("failed to parse kubeconfig: %w", err)
 	}
+	if len(kc.Clusters) != 1 || len(kc.Users) != 1 {
+		return "", fmt.Errorf("expected exactly one cluster and user, got %d and %d", len(kc.Clusters), len(kc.Users))
+	}
+
+	oldCluster := kc.Clusters[0].Name
+	oldUser := kc.Users[0].Name
+	kc.Clusters[0].Name = name
+	kc.Users[0].Name = name
 
-	resp, err := httpClient.Post(
-		baseURL+"/refresh",
-		"application/json",
-		strings.NewReader(string(reqBody)),
-	)
+	for i, c := range kc.Contexts {
+		newContext := c.Name
+		if prefix, ok := strings.CutSuffix(c.Name, "@"+oldCluster); ok {
+			newContext = prefix + "@" + name
+		} else if c.Name == oldCluster {
+			newContext = name
+		}
+		if kc.CurrentContext == c.Name {
+			kc.CurrentContext = newContext
+		}
+		kc.Contexts[i].Name = newContext
+		if c.Context.Cluster == oldCluster {
+			kc.Contexts[i].Context.Cluster = name
+		}
+		if c.Context.User == oldUser {
+			kc.Contexts[i].Context.User = name
+		}
+	}
+
+	out, err := yaml.Marshal(&kc)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to server: %w", err)
+		return "", fmt.Errorf("failed to marshal kubeconfig: %w", err)
 	}
-	defer func() { _ = resp.Body.Close() }()
+	return string(out), nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("server returned status %d", resp.StatusCode)
+// defaultKubeconfigPath returns the kubeconfig kauth writes to.
+func defaultKubeconfigPath() string {
+	return filepath.Join(os.Getenv("HOME"), ".kube", "config")
+}
+
+// resolveKubeconfigPath picks the kubeconfig login writes: the --kubeconfig
+// flag, else the first file in KUBECONFIG, else ~/.kube/config. merge
+// reports whether that is the user's own kubeconfig, which login merges
+// into rather than replaces.
+func resolveKubeconfigPath(flag string) (path string, merge bool) {
+	if flag != "" {
+		return flag, flag == defaultKubeconfigPath()
+	}
+	for _, p := range filepath.SplitList(os.Getenv("KUBECONFIG")) {
+		if p != "" {
+			return p, true
+		}
 	}
+	return defaultKubeconfigPath(), true
+}
 
-	var refreshResp RefreshResponse
-	if err := json.NewDecoder(resp.Body).Decode(&refreshResp); err != nil {
-		return nil, fmt.Errorf("failed to parse response: %w", err)
+// writeLoginKubeconfig writes data to path, or to stdout when path is "-".
+// With merge set, an existing non-empty file is merged into instead of
+// replaced.
+func writeLoginKubeconfig(stdout io.Writer, path, data string, merge bool) error {
+	if path == stdoutPath {
+		if _, err := io.WriteString(stdout, data); err != nil {
+			return fmt.Errorf("failed to write kubeconfig: %w", err)
+		}
+		return nil
 	}
+	if merge {
+		if existing, err := os.ReadFile(path); err == nil && len(existing) > 0 {
+			if err := mergeKubeconfig(path, data); err != nil {
+				return fmt.Errorf("failed to merge kubeconfig: %w", err)
+			}
+			return nil
+		}
+	}
+	if err := writeKubeconfigFile(path, []byte(data)); err != nil {
+		return fmt.Errorf("failed to save kubeconfig: %w", err)
+	}
+	return nil
+}
 
-	return &refreshResp, nil
+// writeKubeconfigFile writes data to path with 0600 permissions, creating
+// the directory if needed. The mode is also applied to an existing file,
+// which os.WriteFile leaves untouched.
+func writeKubeconfigFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	return os.Chmod(path, 0600)
 }
 
 func mergeKubeconfig(existingPath, newConfigYAML string) error {
+	mergedData, err := mergedKubeconfig(existingPath, newConfigYAML)
+	if err != nil {
+		return err
+	}
+
+	if err := writeKubeconfigFile(existingPath, mergedData); err != nil {
+		return fmt.Errorf("failed to write merged kubeconfig (check permissions): %w", err)
+	}
+
+	return nil
+}
+
+// mergedKubeconfig returns the kubeconfig at existingPath with newConfigYAML
+// merged in, without writing it.
+func mergedKubeconfig(existingPath, newConfigYAML string) ([]byte, error) {
 	// Parse existing kubeconfig
 	existingData, err := os.ReadFile(existingPath)
 	if err != nil {
-		return fmt.Errorf("failed to read existing kubeconfig: %w", err)
+		return nil, fmt.Errorf("failed to read existing kubeconfig: %w", err)
 	}
 
 	var existing kubeconfig
 	if err := yaml.Unmarshal(existingData, &existing); err != nil {
-		return fmt.Errorf("failed to parse existing kubeconfig (may be invalid YAML): %w", err)
+		return nil, fmt.Errorf("failed to parse existing kubeconfig (may be invalid YAML): %w", err)
 	}
 
 	// Parse new kubeconfig
 	var newConfig kubeconfig
 	if err := yaml.Unmarshal([]byte(newConfigYAML), &newConfig); err != nil {
-		return fmt.Errorf("failed to parse new kubeconfig from server: %w", err)
+		return nil, fmt.Errorf("failed to parse new kubeconfig from server: %w", err)
 	}
 
 	// Merge clusters (upsert by name)
@@ -583,15 +952,9 @@ func mergeKubeconfig(existingPath, newConfigYAML string) error {
 		existing.CurrentContext = newConfig.CurrentContext
 	}
 
-	// Save merged kubeconfig
 	mergedData, err := yaml.Marshal(&existing)
 	if err != nil {
-		return fmt.Errorf("failed to marshal merged kubeconfig: %w", err)
+		return nil, fmt.Errorf("failed to marshal merged kubeconfig: %w", err)
 	}
-
-	if err := os.WriteFile(existingPath, mergedData, 0600); err != nil {
-		return fmt.Errorf("failed to write merged kubeconfig (check permissions): %w", err)
-	}
-
-	return nil
+	return mergedData, nil
 }
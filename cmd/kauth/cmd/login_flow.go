@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"kauth/pkg/oauth"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// Login flows for --flow.
+const (
+	flowServer  = "server"  // the kauth server runs the OAuth flow; the CLI waits on /watch
+	flowBrowser = "browser" // the CLI runs the authorization code flow with a local callback
+	flowDevice  = "device"  // the CLI runs the device authorization flow
+)
+
+// validateLoginFlow reports an error unless flow is a supported --flow value.
+func validateLoginFlow(flow string) error {
+	switch flow {
+	case flowServer, flowBrowser, flowDevice:
+		return nil
+	}
+	return fmt.Errorf("unsupported --flow %q (use %s, %s or %s)", flow, flowServer, flowBrowser, flowDevice)
+}
+
+// idpLogin authenticates against the IdP from /info directly, with the
+// browser or device flow, and exchanges the resulting tokens for a kauth
+// session. The login is started at /start-login first, and its nonce sent
+// to the IdP, so the server can tell the ID token was issued for it. The
+// IdP client must allow public (secret-less) clients for the chosen grant,
+// and echo the nonce in ID tokens from it; the browser flow also needs
+// http://localhost:<port>/callback as a redirect URI. Instructions for the
+// user are written to out.
+func idpLogin(ctx context.Context, out io.Writer, serverURL string, info *InfoResponse, flow, callbackHost string, callbackPort int) (*StatusResponse, error) {
+	if info.IssuerURL == "" || info.ClientID == "" {
+		return nil, errors.New("server did not report an issuer URL and client ID")
+	}
+	provider, err := oauth.NewProvider(ctx, oauth.Config{
+		IssuerURL:  info.IssuerURL,
+		ClientID:   info.ClientID,
+		HTTPClient: httpClient,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	login, err := startLogin(ctx, httpClient, serverURL)
+	if err != nil {
+		return nil, err
+	}
+	if login.Nonce == "" {
+		return nil, errors.New("server did not return a login nonce; upgrade the kauth server or use --flow server")
+	}
+	nonce := oidc.Nonce(login.Nonce)
+
+	var tok *oauth2.Token
+	switch flow {
+	case flowBrowser:
+		authURL, _, result, err := provider.StartAuthCodeFlow(ctx, callbackHost, callbackPort, nonce)
+		if err != nil {
+			return nil, err
+		}
+		loginLink := hyperlink(link.Render("login page"), authURL)
+		if err := openBrowser(authURL); err != nil {
+			fmt.Fprintf(out, "  %s %s %s\n\n", accent.Render("◐"), muted.Render("Open"), loginLink)
+		} else {
+			fmt.Fprintf(out, "  %s %s %s\n", accent.Render("◐"), muted.Render("Opening browser… didn't open?"), loginLink)
+		}
+		fmt.Fprintf(out, "  %s %s\n", accent.Render("◌"), muted.Render("Waiting for authentication…"))
+		tok, err = result.WaitContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+	case flowDevice:
+		tok, err = provider.StartDeviceFlow(ctx, out, nonce)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, validateLoginFlow(flow)
+	}
+
+	idToken, ok := tok.Extra("id_token").(string)
+	if !ok || idToken == "" {
+		return nil, errors.New("identity provider did not return an ID token")
+	}
+	return exchangeTokens(ctx, httpClient, serverURL, login.SessionToken, idToken, tok.RefreshToken)
+}
+
+// exchangeTokens trades IdP tokens for the kauth session started with
+// sessionToken at /exchange.
+func exchangeTokens(ctx context.Context, client *http.Client, serverURL, sessionToken, idToken, refreshToken string) (*StatusResponse, error) {
+	body, err := json.Marshal(map[string]string{
+		"session_token": sessionToken,
+		"id_token":      idToken,
+		"refresh_token": refreshToken,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, serverURL+"/exchange", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to exchange tokens: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token exchange failed: %w", readServerError(resp))
+	}
+
+	var status StatusResponse
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("invalid exchange response: %w", err)
+	}
+	if !status.Ready || status.Kubeconfig == "" {
+		return nil, errors.New("server did not return a kubeconfig")
+	}
+	return &status, nil
+}
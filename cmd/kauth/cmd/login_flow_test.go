@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateLoginFlow(t *testing.T) {
+	for _, flow := range []string{flowServer, flowBrowser, flowDevice} {
+		if err := validateLoginFlow(flow); err != nil {
+			t.Errorf("validateLoginFlow(%q) error = %v", flow, err)
+		}
+	}
+	if err := validateLoginFlow("popup"); err == nil {
+		t.Error("validateLoginFlow(popup) should fail")
+	}
+}
+
+func TestExchangeTokens(t *testing.T) {
+	var got map[string]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/exchange" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewDecoder(r.Body).Decode(&got)
+		_ = json.NewEncoder(w).Encode(StatusResponse{Ready: true, Kubeconfig: serverKubeconfig, WebhookToken: "wt"})
+	}))
+	defer srv.Close()
+
+	status, err := exchangeTokens(context.Background(), srv.Client(), srv.URL, "session-token", "id-token", "refresh-token")
+	if err != nil {
+		t.Fatalf("exchangeTokens() error = %v", err)
+	}
+	if got["session_token"] != "session-token" || got["id_token"] != "id-token" || got["refresh_token"] != "refresh-token" {
+		t.Errorf("request body = %v", got)
+	}
+	if status.WebhookToken != "wt" || status.Kubeconfig != serverKubeconfig {
+		t.Errorf("unexpected status %+v", status)
+	}
+}
+
+func TestExchangeTokens_Rejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "User is not a member of allowed groups", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	_, err := exchangeTokens(context.Background(), srv.Client(), srv.URL, "session-token", "id-token", "")
+	if err == nil || !strings.Contains(err.Error(), "allowed groups") {
+		t.Errorf("exchangeTokens() error = %v, want the server's message", err)
+	}
+}
@@ -0,0 +1,374 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const serverKubeconfig = `apiVersion: v1
+kind: Config
+current-context: alice@prod
+clusters:
+- name: prod
+  cluster:
+    server: https://k8s.example.com
+contexts:
+- name: alice@prod
+  context:
+    cluster: prod
+    user: alice@example.com
+users:
+- name: alice@example.com
+  user:
+    exec:
+      apiVersion: client.authentication.k8s.io/v1
+      command: kauth
+      args: [get-token]
+`
+
+func TestRenameKubeconfig(t *testing.T) {
+	out, err := renameKubeconfig(serverKubeconfig, "eu-prod")
+	if err != nil {
+		t.Fatalf("renameKubeconfig() error = %v", err)
+	}
+
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(out), &kc); err != nil {
+		t.Fatalf("failed to parse renamed kubeconfig: %v", err)
+	}
+
+	if got := kc.Clusters[0].Name; got != "eu-prod" {
+		t.Errorf("cluster name = %q, want %q", got, "eu-prod")
+	}
+	if got := kc.Users[0].Name; got != "eu-prod" {
+		t.Errorf("user name = %q, want %q", got, "eu-prod")
+	}
+	if kc.Users[0].User.Exec == nil || kc.Users[0].User.Exec.Command != "kauth" {
+		t.Errorf("user exec config was not preserved: %+v", kc.Users[0].User.Exec)
+	}
+
+	ctx := kc.Contexts[0]
+	if ctx.Name != "alice@eu-prod" {
+		t.Errorf("context name = %q, want %q", ctx.Name, "alice@eu-prod")
+	}
+	if ctx.Context.Cluster != "eu-prod" || ctx.Context.User != "eu-prod" {
+		t.Errorf("context refs = %+v, want cluster and user %q", ctx.Context, "eu-prod")
+	}
+	if kc.CurrentContext != "alice@eu-prod" {
+		t.Errorf("current-context = %q, want %q", kc.CurrentContext, "alice@eu-prod")
+	}
+
+	if !hasConflict([]byte(out), "eu-prod") {
+		t.Error("hasConflict() = false for renamed kubeconfig, want true")
+	}
+	if hasConflict([]byte(out), "prod") {
+		t.Error("hasConflict() = true for original cluster name, want false")
+	}
+}
+
+func TestRenameKubeconfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not yaml", "{"},
+		{"no clusters", "apiVersion: v1\nkind: Config\nusers:\n- name: a\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := renameKubeconfig(tt.data, "x"); err == nil {
+				t.Error("renameKubeconfig() error = nil, want error")
+			}
+		})
+	}
+}
+
+func TestSetClusterOptions(t *testing.T) {
+	out, err := setClusterOptions(serverKubeconfig, "http://proxy.example.com:3128", "k8s.internal")
+	if err != nil {
+		t.Fatalf("setClusterOptions() error = %v", err)
+	}
+	for _, want := range []string{"proxy-url: http://proxy.example.com:3128", "tls-server-name: k8s.internal"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("kubeconfig has no %q:\n%s", want, out)
+		}
+	}
+
+	// The fields round-trip, and are omitted when unset.
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(out), &kc); err != nil {
+		t.Fatalf("invalid YAML: %v", err)
+	}
+	if len(kc.Clusters) != 1 || kc.Clusters[0].Cluster.ProxyURL != "http://proxy.example.com:3128" || kc.Clusters[0].Cluster.TLSServerName != "k8s.internal" {
+		t.Errorf("clusters = %+v, want proxy-url and tls-server-name set", kc.Clusters)
+	}
+	kc.Clusters[0].Cluster.ProxyURL = ""
+	kc.Clusters[0].Cluster.TLSServerName = ""
+	data, err := yaml.Marshal(&kc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "proxy-url") || strings.Contains(string(data), "tls-server-name") {
+		t.Errorf("empty cluster options were written:\n%s", data)
+	}
+
+	// An empty option keeps the server's value.
+	out, err = setClusterOptions(out, "", "other.internal")
+	if err != nil {
+		t.Fatalf("setClusterOptions() error = %v", err)
+	}
+	if !strings.Contains(out, "proxy-url: http://proxy.example.com:3128") || !strings.Contains(out, "tls-server-name: other.internal") {
+		t.Errorf("unexpected kubeconfig:\n%s", out)
+	}
+}
+
+func TestValidateServerKubeconfig(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		wantErr     bool
+		errContains string
+	}{
+		{
+			name: "valid",
+			data: serverKubeconfig,
+		},
+		{
+			name:        "not yaml",
+			data:        "clusters: [",
+			wantErr:     true,
+			errContains: "failed to parse",
+		},
+		{
+			name:        "empty",
+			data:        "",
+			wantErr:     true,
+			errContains: "exactly one cluster",
+		},
+		{
+			name:        "wrong cluster name",
+			data:        strings.ReplaceAll(serverKubeconfig, "prod", "staging"),
+			wantErr:     true,
+			errContains: `cluster is named "staging"`,
+		},
+		{
+			name:        "missing server",
+			data:        strings.Replace(serverKubeconfig, "server: https://k8s.example.com", "server: \"\"", 1),
+			wantErr:     true,
+			errContains: "has no server",
+		},
+		{
+			name:        "context references another user",
+			data:        strings.Replace(serverKubeconfig, "    user: alice@example.com", "    user: bob@example.com", 1),
+			wantErr:     true,
+			errContains: "references cluster",
+		},
+		{
+			name:        "dangling current-context",
+			data:        strings.Replace(serverKubeconfig, "current-context: alice@prod", "current-context: other", 1),
+			wantErr:     true,
+			errContains: "current-context",
+		},
+		{
+			name:        "two clusters",
+			data:        strings.Replace(serverKubeconfig, "contexts:", "- name: extra\n  cluster:\n    server: https://other\ncontexts:", 1),
+			wantErr:     true,
+			errContains: "exactly one cluster",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateServerKubeconfig(tt.data, "prod")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("validateServerKubeconfig() error = nil, want error containing %q", tt.errContains)
+				}
+				if !strings.Contains(err.Error(), tt.errContains) {
+					t.Errorf("validateServerKubeconfig() error = %v, want error containing %q", err, tt.errContains)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("validateServerKubeconfig() unexpected error = %v", err)
+			}
+		})
+	}
+}
+
+func TestCheckClusterTLS(t *testing.T) {
+	insecureSkip := strings.Replace(serverKubeconfig, "server: https://k8s.example.com", "server: https://k8s.example.com\n    insecure-skip-tls-verify: true", 1)
+	plainHTTP := strings.Replace(serverKubeconfig, "https://", "http://", 1)
+
+	tests := []struct {
+		name          string
+		data          string
+		allowInsecure bool
+		wantInsecure  bool
+		wantErr       bool
+	}{
+		{name: "verified", data: serverKubeconfig},
+		{name: "skip verify refused", data: insecureSkip, wantInsecure: true, wantErr: true},
+		{name: "plain http refused", data: plainHTTP, wantInsecure: true, wantErr: true},
+		{name: "skip verify explicitly allowed", data: insecureSkip, allowInsecure: true, wantInsecure: true},
+		{name: "plain http explicitly allowed", data: plainHTTP, allowInsecure: true, wantInsecure: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			insecure, err := checkClusterTLS(tt.data, tt.allowInsecure)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkClusterTLS() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if insecure != tt.wantInsecure {
+				t.Errorf("checkClusterTLS() insecure = %v, want %v", insecure, tt.wantInsecure)
+			}
+		})
+	}
+}
+
+func TestWatchForCompletion_Context(t *testing.T) {
+	// A server whose login never completes: it only sends keepalives.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			_, _ = fmt.Fprint(w, ": keepalive\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}))
+	defer srv.Close()
+
+	t.Run("timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		_, err := watchForCompletion(ctx, srv.Client(), srv.URL, "token")
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Errorf("watchForCompletion() error = %v, want timeout", err)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(50*time.Millisecond, cancel)
+
+		_, err := watchForCompletion(ctx, srv.Client(), srv.URL, "token")
+		if err == nil || err.Error() != "login cancelled" {
+			t.Errorf("watchForCompletion() error = %v, want login cancelled", err)
+		}
+	})
+}
+
+func TestResolveKubeconfigPath(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	def := filepath.Join(home, ".kube", "config")
+
+	tests := []struct {
+		name      string
+		flag      string
+		env       string
+		wantPath  string
+		wantMerge bool
+	}{
+		{name: "default", wantPath: def, wantMerge: true},
+		{name: "KUBECONFIG", env: "/a/config" + string(filepath.ListSeparator) + "/b/config", wantPath: "/a/config", wantMerge: true},
+		{name: "flag wins over KUBECONFIG", flag: "/tmp/kubeconfig", env: "/a/config", wantPath: "/tmp/kubeconfig"},
+		{name: "flag naming the default", flag: def, wantPath: def, wantMerge: true},
+		{name: "stdout", flag: "-", wantPath: "-"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("KUBECONFIG", tt.env)
+			path, merge := resolveKubeconfigPath(tt.flag)
+			if path != tt.wantPath || merge != tt.wantMerge {
+				t.Errorf("resolveKubeconfigPath(%q) = %q, %v; want %q, %v", tt.flag, path, merge, tt.wantPath, tt.wantMerge)
+			}
+		})
+	}
+}
+
+func TestWriteLoginKubeconfig_Stdout(t *testing.T) {
+	var out bytes.Buffer
+	if err := writeLoginKubeconfig(&out, "-", serverKubeconfig, true); err != nil {
+		t.Fatalf("writeLoginKubeconfig() error = %v", err)
+	}
+	if out.String() != serverKubeconfig {
+		t.Errorf("stdout = %q, want the kubeconfig", out.String())
+	}
+}
+
+func TestWriteLoginKubeconfig_ExplicitPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "kubeconfig")
+	var out bytes.Buffer
+	if err := writeLoginKubeconfig(&out, path, serverKubeconfig, false); err != nil {
+		t.Fatalf("writeLoginKubeconfig() error = %v", err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("unexpected stdout output %q", out.String())
+	}
+	assertKubeconfigFile(t, path, serverKubeconfig)
+
+	// Without merge an existing file is replaced, and loosened permissions
+	// are tightened back to 0600.
+	if err := os.WriteFile(path, []byte("stale: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLoginKubeconfig(&out, path, serverKubeconfig, false); err != nil {
+		t.Fatalf("writeLoginKubeconfig() error = %v", err)
+	}
+	assertKubeconfigFile(t, path, serverKubeconfig)
+}
+
+func TestWriteLoginKubeconfig_Merge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kubeconfig")
+	existing := "apiVersion: v1\nkind: Config\nclusters:\n- name: other\n  cluster:\n    server: https://other.example.com\n"
+	if err := os.WriteFile(path, []byte(existing), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeLoginKubeconfig(io.Discard, path, serverKubeconfig, true); err != nil {
+		t.Fatalf("writeLoginKubeconfig() error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "other.example.com") || !strings.Contains(string(data), "k8s.example.com") {
+		t.Errorf("merged kubeconfig lost a cluster:\n%s", data)
+	}
+}
+
+func assertKubeconfigFile(t *testing.T, path, want string) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", fi.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != want {
+		t.Errorf("kubeconfig = %q, want %q", data, want)
+	}
+}
@@ -28,9 +28,12 @@ type RevokeRequest struct {
 }
 
 func runLogout(cmd *cobra.Command, args []string) error {
-	storage := token.NewStorage(token.DefaultCachePath())
+	store, err := token.DefaultCredentialStore()
+	if err != nil {
+		return err
+	}
 
-	cachedToken, err := storage.Load()
+	cachedToken, err := store.Get()
 	if err != nil || cachedToken == nil || cachedToken.RefreshToken == "" {
 		fmt.Println("Not authenticated.")
 		return nil
@@ -60,14 +63,14 @@ func runLogout(cmd *cobra.Command, args []string) error {
 			fmt.Fprintf(os.Stderr, "Warning: failed to contact server: %v\n", err)
 			fmt.Fprintf(os.Stderr, "Local cache will still be cleared.\n")
 		} else {
-			_ = resp.Body.Close()
 			if resp.StatusCode != http.StatusOK {
-				fmt.Fprintf(os.Stderr, "Warning: server returned status %d\n", resp.StatusCode)
+				fmt.Fprintf(os.Stderr, "Warning: %v\n", readServerError(resp))
 			}
+			_ = resp.Body.Close()
 		}
 	}
 
-	if err := storage.Save(&token.Cache{ServerURL: serverURL}); err != nil {
+	if err := store.Set(&token.Cache{ServerURL: serverURL}); err != nil {
 		return fmt.Errorf("failed to clear local cache: %w", err)
 	}
 
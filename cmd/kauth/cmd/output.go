@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/spf13/cobra"
+)
+
+// Formats accepted by --output. table is the human-readable default; json
+// and yaml are for scripts.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+var outputFormats = []string{outputTable, outputJSON, outputYAML}
+
+// addOutputFlag registers --output (-o) on cmd, storing the format in p.
+func addOutputFlag(cmd *cobra.Command, p *string) {
+	cmd.Flags().StringVarP(p, "output", "o", outputTable, "output format: table, json or yaml")
+	_ = cmd.RegisterFlagCompletionFunc("output", cobra.FixedCompletions(outputFormats, cobra.ShellCompDirectiveNoFileComp))
+}
+
+// checkOutputFormat rejects an unknown --output value before a command does
+// any work.
+func checkOutputFormat(format string) error {
+	if !slices.Contains(outputFormats, format) {
+		return fmt.Errorf("unsupported --output %q (use table, json or yaml)", format)
+	}
+	return nil
+}
+
+// writeOutput writes v to w in a machine-readable format. The table format
+// is rendered by each command itself.
+func writeOutput(w io.Writer, format string, v any) error {
+	switch format {
+	case outputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	case outputYAML:
+		enc := yaml.NewEncoder(w)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	return checkOutputFormat(format)
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestWriteOutput(t *testing.T) {
+	info := InfoResponse{ClusterName: "prod", ClusterServer: "https://k8s.example.com", IssuerURL: "https://idp.example.com", ClientID: "kauth"}
+
+	var buf bytes.Buffer
+	if err := writeOutput(&buf, outputJSON, info); err != nil {
+		t.Fatalf("writeOutput(json) error = %v", err)
+	}
+	var fromJSON InfoResponse
+	if err := json.Unmarshal(buf.Bytes(), &fromJSON); err != nil || fromJSON != info {
+		t.Errorf("json round trip = %+v, %v, want %+v", fromJSON, err, info)
+	}
+
+	buf.Reset()
+	if err := writeOutput(&buf, outputYAML, info); err != nil {
+		t.Fatalf("writeOutput(yaml) error = %v", err)
+	}
+	if !strings.Contains(buf.String(), "cluster_name: prod") {
+		t.Errorf("yaml output does not use the JSON field names:\n%s", buf.String())
+	}
+	var fromYAML InfoResponse
+	if err := yaml.Unmarshal(buf.Bytes(), &fromYAML); err != nil || fromYAML != info {
+		t.Errorf("yaml round trip = %+v, %v, want %+v", fromYAML, err, info)
+	}
+
+	if err := writeOutput(&buf, "xml", info); err == nil {
+		t.Error("writeOutput(xml) error = nil, want unsupported format")
+	}
+}
+
+func TestWriteStatus_NotAuthenticated(t *testing.T) {
+	var buf bytes.Buffer
+	err := writeStatus(&buf, outputJSON, nil, time.Now())
+	if !errors.Is(err, errStatusChecksFailed) {
+		t.Errorf("writeStatus() error = %v, want %v", err, errStatusChecksFailed)
+	}
+	if got := strings.TrimSpace(buf.String()); got != `{
+  "authenticated": false
+}` {
+		t.Errorf("writeStatus() output = %s", got)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish", "powershell"} {
+		t.Run(shell, func(t *testing.T) {
+			var buf bytes.Buffer
+			completionCmd.SetOut(&buf)
+			t.Cleanup(func() { completionCmd.SetOut(nil) })
+			if err := runCompletion(completionCmd, []string{shell}); err != nil {
+				t.Fatalf("runCompletion(%s) error = %v", shell, err)
+			}
+			if !strings.Contains(buf.String(), "kauth") {
+				t.Errorf("%s completion script does not mention kauth", shell)
+			}
+		})
+	}
+}
@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"kauth/pkg/apierror"
+	"kauth/pkg/token"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/spf13/cobra"
+)
+
+var refreshCmd = &cobra.Command{
+	Use:   "refresh",
+	Short: "Renew the cached ID token using the refresh token",
+	Long: `Exchange the cached refresh token for a new ID token without logging in again.
+
+Use this after your groups change in the identity provider to pick them up
+immediately.`,
+	RunE: runRefresh,
+}
+
+// refreshRetries is how many times a refresh is retried after the server
+// could not be reached or answered 503 before handling it.
+// refreshRetryBackoff is the wait before the first retry; it doubles after
+// each one.
+var (
+	refreshRetries      int
+	refreshRetryBackoff = 500 * time.Millisecond
+)
+
+func init() {
+	rootCmd.AddCommand(refreshCmd)
+	rootCmd.PersistentFlags().IntVar(&refreshRetries, "refresh-retries", 3, "retries for a token refresh that cannot reach the server or gets 503 before it is handled")
+}
+
+// errRefreshRejected is returned when the server refuses the refresh token
+// (expired, revoked, or rotated away).
+var errRefreshRejected = errors.New("refresh token rejected")
+
+// errSessionExpired is returned when the server refuses to rotate because the
+// session reached its absolute lifetime; only a new login helps.
+var errSessionExpired = errors.New("session expired, please run kauth login")
+
+// sessionExpiredMessage is the plain-text body older kauth-server versions
+// send with a 401 from /refresh once a session reached its absolute TTL.
+// Current servers send apierror.CodeSessionExpired.
+const sessionExpiredMessage = "Session expired, please run kauth login"
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+type RefreshResponse struct {
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+	TokenType    string `json:"token_type"`
+	Kubeconfig   string `json:"kubeconfig"`
+
+	RotationCounter int `json:"rotation_counter"`
+
+	RefreshTokenExpiresIn int64 `json:"refresh_token_expires_in"`
+	SessionExpiresIn      int64 `json:"session_expires_in,omitempty"`
+}
+
+// refreshExpiryWarning is how close to RefreshExpiry get-token and status
+// start warning that a new login will be needed.
+const refreshExpiryWarning = 24 * time.Hour
+
+// refreshChainExpiry returns when a refresh token stops working given the
+// server-reported seconds until the token and the session expire. A zero
+// sessionExpiresIn means the session has no absolute limit; a zero
+// refreshExpiresIn means the server did not say, and yields the zero time.
+func refreshChainExpiry(now time.Time, refreshExpiresIn, sessionExpiresIn int64) time.Time {
+	if refreshExpiresIn <= 0 {
+		return time.Time{}
+	}
+	seconds := refreshExpiresIn
+	if sessionExpiresIn > 0 {
+		seconds = min(seconds, sessionExpiresIn)
+	}
+	return now.Add(time.Duration(seconds) * time.Second)
+}
+
+func runRefresh(cmd *cobra.Command, args []string) error {
+	refreshResp, err := refreshCachedToken()
+	if err != nil {
+		return err
+	}
+
+	expiry := time.Now().Add(time.Duration(refreshResp.ExpiresIn) * time.Second)
+	fmt.Printf("\n  %s %s %s\n", successIcon, green.Render("Token refreshed"),
+		muted.Render("expires "+expiry.Local().Format(time.RFC1123)))
+
+	return nil
+}
+
+// refreshCachedToken exchanges the cached refresh token at /refresh and
+// persists the rotated tokens to the cache and kubeconfig.
+func refreshCachedToken() (*RefreshResponse, error) {
+	store, err := token.DefaultCredentialStore()
+	if err != nil {
+		return nil, err
+	}
+
+	// Hold the cache lock across load, refresh and save: the refresh token
+	// rotates, so a concurrent kauth process must wait and then use the
+	// rotated token rather than race us with the one we are spending.
+	var refreshResp *RefreshResponse
+	err = store.Update(func(cachedToken *token.Cache) (*token.Cache, error) {
+		if cachedToken == nil || cachedToken.ServerURL == "" || cachedToken.RefreshToken == "" {
+			return nil, fmt.Errorf("no refresh token found.\n\nTo authenticate, run:\n  kauth login")
+		}
+
+		resp, err := refreshTokenFromServer(cachedToken.ServerURL, cachedToken.RefreshToken)
+		if errors.Is(err, errSessionExpired) {
+			return nil, err
+		}
+		if errors.Is(err, errRefreshRejected) {
+			return nil, fmt.Errorf("%w.\n\nYour session may have expired or been revoked. To re-authenticate, run:\n  kauth login", err)
+		}
+		if err != nil {
+			// Not a verdict on the token: keep it cached (returning an error
+			// leaves the cache untouched) and don't send the user to log in.
+			return nil, fmt.Errorf("refresh failed: %w.\n\nThis looks like a temporary network or server problem; your session is still cached. Try again shortly", err)
+		}
+		refreshResp = resp
+
+		cachedToken.IDToken = resp.IDToken
+		cachedToken.RefreshToken = resp.RefreshToken
+		cachedToken.RefreshExpiry = refreshChainExpiry(time.Now(), resp.RefreshTokenExpiresIn, resp.SessionExpiresIn)
+		return cachedToken, nil
+	})
+	if err != nil {
+		if refreshResp != nil {
+			return nil, fmt.Errorf("failed to update token cache: %w", err)
+		}
+		return nil, err
+	}
+
+	// Only the cluster CA is taken from the server's kubeconfig: the user
+	// and context entries were shaped at login (--cluster-name,
+	// --token-in-kubeconfig) and the server's copy knows nothing of that.
+	if refreshResp.Kubeconfig != "" {
+		kubeconfigPath, _ := resolveKubeconfigPath("")
+		if _, err := os.Stat(kubeconfigPath); err == nil {
+			updated, err := updateClusterCA(kubeconfigPath, refreshResp.Kubeconfig)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: failed to update kubeconfig: %v\n", err)
+			} else if updated {
+				fmt.Fprintf(os.Stderr, "Updated cluster CA in %s (API server CA was rotated)\n", kubeconfigPath)
+			}
+		}
+	}
+
+	return refreshResp, nil
+}
+
+// refreshTokenFromServer exchanges refreshToken at /refresh. Only failures
+// where the server cannot have rotated the token are retried, up to
+// refreshRetries times with exponential backoff: DNS and dial errors, and a
+// 503 with Retry-After or apierror.CodeUnavailable, which kauth-server sends
+// before running the handler. Any other failure may have spent the token, and
+// resending it would look like a replay. A 401 or 403 means the token is no
+// longer valid and is returned at once as errRefreshRejected or
+// errSessionExpired.
+func refreshTokenFromServer(baseURL, refreshToken string) (*RefreshResponse, error) {
+	reqBody, err := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	backoff := refreshRetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, retriable, err := refreshOnce(baseURL, reqBody)
+		if err == nil || !retriable || attempt >= refreshRetries {
+			return resp, err
+		}
+		debugf("refresh attempt %d failed, retrying in %s: %v", attempt+1, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// refreshOnce makes a single /refresh request. retriable reports whether the
+// request can safely be sent again.
+func refreshOnce(baseURL string, reqBody []byte) (*RefreshResponse, bool, error) {
+	resp, err := httpClient.Post(
+		baseURL+"/refresh",
+		"application/json",
+		bytes.NewReader(reqBody),
+	)
+	if err != nil {
+		return nil, notSent(err), fmt.Errorf("failed to connect to server: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		se := readServerError(resp)
+		if resp.StatusCode != http.StatusUnauthorized && resp.StatusCode != http.StatusForbidden {
+			return nil, notHandled(resp, se), se
+		}
+		// Older servers send the session-expired message as plain text.
+		if se.Code == apierror.CodeSessionExpired || se.Message == sessionExpiredMessage {
+			return nil, false, errSessionExpired
+		}
+		if se.Message != "" {
+			return nil, false, fmt.Errorf("%w: %s", errRefreshRejected, se.Message)
+		}
+		return nil, false, errRefreshRejected
+	}
+
+	var refreshResp RefreshResponse
+	if err := json.NewDecoder(resp.Body).Decode(&refreshResp); err != nil {
+		return nil, false, fmt.Errorf("failed to parse response: %w", err)
+	}
+	debugf("refresh: expires_in=%ds rotation_counter=%d refresh_token_expires_in=%ds session_expires_in=%ds kubeconfig=%d bytes",
+		refreshResp.ExpiresIn, refreshResp.RotationCounter, refreshResp.RefreshTokenExpiresIn, refreshResp.SessionExpiresIn, len(refreshResp.Kubeconfig))
+
+	return &refreshResp, false, nil
+}
+
+// notHandled reports whether resp is a 503 the server sent without handling
+// the request: one asking to retry, or the unavailable error kauth-server
+// answers with while it is starting.
+func notHandled(resp *http.Response, se *serverError) bool {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return false
+	}
+	return resp.Header.Get("Retry-After") != "" || se.Code == apierror.CodeUnavailable
+}
+
+// notSent reports whether err is a DNS or dial failure, so the request never
+// reached the server.
+func notSent(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) || errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// updateClusterCA copies certificate-authority-data from the server-issued
+// kubeconfig into local clusters pointing at the same API server, so a CA
+// rotation reaches kubeconfigs minted before it. Clusters are matched by
+// server URL rather than name since login may have renamed them. Only the CA
+// is touched; local edits to users and contexts are preserved. It reports
+// whether the file was rewritten.
+func updateClusterCA(path, serverConfigYAML string) (bool, error) {
+	var serverConfig kubeconfig
+	if err := yaml.Unmarshal([]byte(serverConfigYAML), &serverConfig); err != nil {
+		return false, fmt.Errorf("failed to parse kubeconfig from server: %w", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read kubeconfig: %w", err)
+	}
+	var local kubeconfig
+	if err := yaml.Unmarshal(data, &local); err != nil {
+		return false, fmt.Errorf("failed to parse kubeconfig: %w", err)
+	}
+
+	updated := false
+	for _, sc := range serverConfig.Clusters {
+		if sc.Cluster.CertificateAuthorityData == "" {
+			continue
+		}
+		for i := range local.Clusters {
+			lc := &local.Clusters[i].Cluster
+			if lc.Server == sc.Cluster.Server && lc.CertificateAuthorityData != sc.Cluster.CertificateAuthorityData {
+				lc.CertificateAuthorityData = sc.Cluster.CertificateAuthorityData
+				updated = true
+			}
+		}
+	}
+	if !updated {
+		return false, nil
+	}
+
+	out, err := yaml.Marshal(&local)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal kubeconfig: %w", err)
+	}
+	if err := os.WriteFile(path, out, 0600); err != nil {
+		return false, fmt.Errorf("failed to write kubeconfig: %w", err)
+	}
+	return true, nil
+}
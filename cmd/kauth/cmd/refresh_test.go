@@ -0,0 +1,464 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kauth/pkg/apierror"
+	"kauth/pkg/handlers"
+	"kauth/pkg/token"
+
+	"gopkg.in/yaml.v3"
+)
+
+// fastRefreshRetries shortens the refresh retry backoff for a test.
+func fastRefreshRetries(t *testing.T, retries int) {
+	t.Helper()
+	origRetries, origBackoff := refreshRetries, refreshRetryBackoff
+	refreshRetries, refreshRetryBackoff = retries, time.Millisecond
+	t.Cleanup(func() { refreshRetries, refreshRetryBackoff = origRetries, origBackoff })
+}
+
+func TestRefreshTokenFromServer(t *testing.T) {
+	fastRefreshRetries(t, 3)
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		wantRejected bool
+		wantExpired  bool
+		wantErr      bool
+	}{
+		{name: "success", status: http.StatusOK, body: `{"id_token":"id","refresh_token":"rt2","expires_in":3600}`},
+		{name: "rejected", status: http.StatusUnauthorized, body: "Invalid refresh token\n", wantRejected: true, wantErr: true},
+		{name: "session expired (plain text)", status: http.StatusUnauthorized, body: sessionExpiredMessage + "\n", wantExpired: true, wantErr: true},
+		{name: "session expired", status: http.StatusUnauthorized, body: `{"error":"session_expired","message":"Session expired"}`, wantExpired: true, wantErr: true},
+		{name: "replay", status: http.StatusUnauthorized, body: `{"error":"token_replay","message":"Token replay detected"}`, wantRejected: true, wantErr: true},
+		{name: "server error", status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/refresh" || r.Method != http.MethodPost {
+					t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+				}
+				var req RefreshRequest
+				if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.RefreshToken != "rt1" {
+					t.Errorf("request refresh_token = %q, err %v", req.RefreshToken, err)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+
+			resp, err := refreshTokenFromServer(srv.URL, "rt1")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("refreshTokenFromServer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if errors.Is(err, errRefreshRejected) != tt.wantRejected {
+				t.Errorf("refreshTokenFromServer() error = %v, want rejected %v", err, tt.wantRejected)
+			}
+			if errors.Is(err, errSessionExpired) != tt.wantExpired {
+				t.Errorf("refreshTokenFromServer() error = %v, want session expired %v", err, tt.wantExpired)
+			}
+			if !tt.wantErr && resp.RefreshToken != "rt2" {
+				t.Errorf("RefreshToken = %q, want %q", resp.RefreshToken, "rt2")
+			}
+		})
+	}
+}
+
+func TestRefreshTokenFromServer_RetriesTransientFailures(t *testing.T) {
+	fastRefreshRetries(t, 3)
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= 2 {
+			// What kauth-server answers while the OIDC provider initializes.
+			w.Header().Set("Retry-After", "5")
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "Service temporarily unavailable: OIDC provider initializing")
+			return
+		}
+		_, _ = w.Write([]byte(`{"id_token":"id","refresh_token":"rt2","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	resp, err := refreshTokenFromServer(srv.URL, "rt1")
+	if err != nil {
+		t.Fatalf("refreshTokenFromServer() error = %v", err)
+	}
+	if resp.RefreshToken != "rt2" || calls != 3 {
+		t.Errorf("RefreshToken = %q after %d calls, want rt2 after 3", resp.RefreshToken, calls)
+	}
+}
+
+func TestRefreshTokenFromServer_RetryLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		code       string
+		wantCalls  int
+	}{
+		{name: "unauthorized is not retried", status: http.StatusUnauthorized, wantCalls: 1},
+		{name: "bad request is not retried", status: http.StatusBadRequest, wantCalls: 1},
+		{name: "bad gateway is not retried", status: http.StatusBadGateway, wantCalls: 1},
+		{name: "503 without Retry-After is not retried", status: http.StatusServiceUnavailable, wantCalls: 1},
+		{name: "503 with Retry-After gives up after the retries", status: http.StatusServiceUnavailable, retryAfter: "1", wantCalls: 3},
+		{name: "503 unavailable without Retry-After is retried", status: http.StatusServiceUnavailable, code: apierror.CodeUnavailable, wantCalls: 3},
+		{name: "500 internal is not retried", status: http.StatusInternalServerError, code: apierror.CodeInternal, wantCalls: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fastRefreshRetries(t, 2)
+			calls := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				if tt.code != "" {
+					apierror.Write(w, tt.status, tt.code, "failed")
+					return
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer srv.Close()
+
+			if _, err := refreshTokenFromServer(srv.URL, "rt1"); err == nil {
+				t.Fatal("refreshTokenFromServer() error = nil")
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("calls = %d, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// A 500 may come after the server rotated the token, so resending it would
+// be rejected as a replay and revoke the session.
+func TestRefreshTokenFromServer_DoesNotResendAfterRotation(t *testing.T) {
+	fastRefreshRetries(t, 3)
+
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			// Rotated, then failed before answering.
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"error":"token_replay","message":"Token replay detected"}`))
+	}))
+	defer srv.Close()
+
+	_, err := refreshTokenFromServer(srv.URL, "rt1")
+	if err == nil || errors.Is(err, errRefreshRejected) {
+		t.Errorf("refreshTokenFromServer() error = %v, want the server error", err)
+	}
+	if calls != 1 {
+		t.Errorf("calls = %d, want 1", calls)
+	}
+}
+
+func TestRefreshTokenFromServer_RetriesConnectionErrors(t *testing.T) {
+	fastRefreshRetries(t, 1)
+	srv := httptest.NewServer(http.NotFoundHandler())
+	url := srv.URL
+	srv.Close()
+
+	_, err := refreshTokenFromServer(url, "rt1")
+	if err == nil || !strings.Contains(err.Error(), "failed to connect") {
+		t.Errorf("refreshTokenFromServer() error = %v, want connection error", err)
+	}
+}
+
+func TestSessionExpiredMessageMatchesServer(t *testing.T) {
+	if sessionExpiredMessage != handlers.SessionExpiredMessage {
+		t.Errorf("sessionExpiredMessage = %q, server sends %q", sessionExpiredMessage, handlers.SessionExpiredMessage)
+	}
+}
+
+func TestRefreshChainExpiry(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name             string
+		refresh, session int64
+		want             time.Time
+	}{
+		{name: "refresh token first", refresh: 3600, session: 7200, want: now.Add(time.Hour)},
+		{name: "session first", refresh: 7200, session: 3600, want: now.Add(time.Hour)},
+		{name: "no session cap", refresh: 3600, want: now.Add(time.Hour)},
+		{name: "unknown", session: 3600, want: time.Time{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := refreshChainExpiry(now, tt.refresh, tt.session); !got.Equal(tt.want) {
+				t.Errorf("refreshChainExpiry() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunRefresh_UpdatesCache(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id_token":"new-id","refresh_token":"new-rt","expires_in":3600}`))
+	}))
+	defer srv.Close()
+
+	storage := token.NewStorage(token.DefaultCachePath())
+	if err := storage.Save(&token.Cache{ServerURL: srv.URL, RefreshToken: "old-rt", IDToken: "old-id", WebhookToken: "wh"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if err := runRefresh(refreshCmd, nil); err != nil {
+		t.Fatalf("runRefresh() error = %v", err)
+	}
+
+	cache, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cache.IDToken != "new-id" || cache.RefreshToken != "new-rt" {
+		t.Errorf("cache = %+v, want refreshed tokens", cache)
+	}
+	if cache.WebhookToken != "wh" {
+		t.Errorf("WebhookToken = %q, want it preserved", cache.WebhookToken)
+	}
+}
+
+func TestRunRefresh_NoRefreshToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	if err := runRefresh(refreshCmd, nil); err == nil {
+		t.Error("runRefresh() error = nil without a cached refresh token, want error")
+	}
+}
+
+func TestRunRotate_StoresNewToken(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"id_token":"id","refresh_token":"rotated-rt","expires_in":3600,"rotation_counter":4,"refresh_token_expires_in":86400}`))
+	}))
+	defer srv.Close()
+
+	storage := token.NewStorage(token.DefaultCachePath())
+	if err := storage.Save(&token.Cache{ServerURL: srv.URL, RefreshToken: "old-rt"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if err := runRotate(rotateCmd, nil); err != nil {
+		t.Fatalf("runRotate() error = %v", err)
+	}
+
+	cache, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if cache.RefreshToken == "old-rt" {
+		t.Error("refresh token was not replaced")
+	}
+	if cache.RefreshToken != "rotated-rt" {
+		t.Errorf("RefreshToken = %q, want %q", cache.RefreshToken, "rotated-rt")
+	}
+}
+
+func TestRefreshCachedToken_FailureKinds(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		wantRelogin bool
+	}{
+		{name: "rejected token needs a new login", status: http.StatusUnauthorized, wantRelogin: true},
+		{name: "server error is transient", status: http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fastRefreshRetries(t, 1)
+			t.Setenv("HOME", t.TempDir())
+			t.Setenv(token.BackendEnv, "")
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "nope", tt.status)
+			}))
+			defer srv.Close()
+
+			storage := token.NewStorage(token.DefaultCachePath())
+			if err := storage.Save(&token.Cache{ServerURL: srv.URL, RefreshToken: "rt1", WebhookToken: "wh"}); err != nil {
+				t.Fatalf("Save() error = %v", err)
+			}
+
+			_, err := refreshCachedToken()
+			if err == nil {
+				t.Fatal("refreshCachedToken() error = nil")
+			}
+			if got := strings.Contains(err.Error(), "kauth login"); got != tt.wantRelogin {
+				t.Errorf("error mentions kauth login = %v, want %v: %v", got, tt.wantRelogin, err)
+			}
+
+			cached, err := storage.Load()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cached.RefreshToken != "rt1" || cached.WebhookToken != "wh" {
+				t.Errorf("cache = %+v, want it unchanged", cached)
+			}
+		})
+	}
+}
+
+func TestRunRefresh_UpdatesRotatedCA(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("KUBECONFIG", "")
+
+	// Local kubeconfig was renamed at login and carries the old CA.
+	local, err := renameKubeconfig(strings.Replace(serverKubeconfig,
+		"server: https://k8s.example.com",
+		"server: https://k8s.example.com\n    certificate-authority-data: b2xkLWNh", 1), "eu-prod")
+	if err != nil {
+		t.Fatalf("renameKubeconfig() error = %v", err)
+	}
+	kubeconfigPath := filepath.Join(home, ".kube", "config")
+	if err := os.MkdirAll(filepath.Dir(kubeconfigPath), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(kubeconfigPath, []byte(local), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := strings.Replace(serverKubeconfig,
+		"server: https://k8s.example.com",
+		"server: https://k8s.example.com\n    certificate-authority-data: bmV3LWNh", 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(RefreshResponse{IDToken: "id", RefreshToken: "rt2", Kubeconfig: rotated})
+	}))
+	defer srv.Close()
+
+	storage := token.NewStorage(token.DefaultCachePath())
+	if err := storage.Save(&token.Cache{ServerURL: srv.URL, RefreshToken: "rt1"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if err := runRefresh(refreshCmd, nil); err != nil {
+		t.Fatalf("runRefresh() error = %v", err)
+	}
+
+	data, err := os.ReadFile(kubeconfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		t.Fatalf("failed to parse kubeconfig: %v", err)
+	}
+	if len(kc.Clusters) != 1 || kc.Clusters[0].Name != "eu-prod" {
+		t.Fatalf("clusters = %+v, want the renamed cluster only", kc.Clusters)
+	}
+	if got := kc.Clusters[0].Cluster.CertificateAuthorityData; got != "bmV3LWNh" {
+		t.Errorf("certificate-authority-data = %q, want the rotated CA", got)
+	}
+}
+
+// Regression: refresh used to merge the server's kubeconfig wholesale,
+// dropping the token stored by --token-in-kubeconfig and the contexts
+// renamed by --cluster-name.
+func TestRunRefresh_KeepsLoginKubeconfigOptions(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	kubeconfigPath := filepath.Join(t.TempDir(), "config")
+	t.Setenv("KUBECONFIG", kubeconfigPath)
+
+	// What kauth login --cluster-name eu-prod --token-in-kubeconfig writes.
+	local, err := renameKubeconfig(strings.Replace(serverKubeconfig,
+		"server: https://k8s.example.com",
+		"server: https://k8s.example.com\n    certificate-authority-data: b2xkLWNh", 1), "eu-prod")
+	if err != nil {
+		t.Fatalf("renameKubeconfig() error = %v", err)
+	}
+	wantEnv := []envVar{{Name: envToken, Value: "webhook-token"}, {Name: envTokenExpiry, Value: "2030-01-01T00:00:00Z"}}
+	local, err = setExecEnv(local, wantEnv)
+	if err != nil {
+		t.Fatalf("setExecEnv() error = %v", err)
+	}
+	if err := os.WriteFile(kubeconfigPath, []byte(local), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var before kubeconfig
+	if err := yaml.Unmarshal([]byte(local), &before); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := strings.Replace(serverKubeconfig,
+		"server: https://k8s.example.com",
+		"server: https://k8s.example.com\n    certificate-authority-data: bmV3LWNh", 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(RefreshResponse{IDToken: "id", RefreshToken: "rt2", Kubeconfig: rotated})
+	}))
+	defer srv.Close()
+
+	storage := token.NewStorage(token.DefaultCachePath())
+	if err := storage.Save(&token.Cache{ServerURL: srv.URL, RefreshToken: "rt1"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if err := runRefresh(refreshCmd, nil); err != nil {
+		t.Fatalf("runRefresh() error = %v", err)
+	}
+
+	data, err := os.ReadFile(kubeconfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		t.Fatalf("failed to parse kubeconfig: %v", err)
+	}
+	if len(kc.Clusters) != 1 || kc.Clusters[0].Cluster.CertificateAuthorityData != "bmV3LWNh" {
+		t.Errorf("clusters = %+v, want the rotated CA", kc.Clusters)
+	}
+	if kc.CurrentContext != before.CurrentContext || len(kc.Contexts) != 1 || kc.Contexts[0] != before.Contexts[0] {
+		t.Errorf("contexts = %+v (current %q), want %+v (current %q)", kc.Contexts, kc.CurrentContext, before.Contexts, before.CurrentContext)
+	}
+	if len(kc.Users) != 1 || kc.Users[0].Name != before.Users[0].Name || kc.Users[0].User.Exec == nil {
+		t.Fatalf("users = %+v, want %+v", kc.Users, before.Users)
+	}
+	if env := kc.Users[0].User.Exec.Env; len(env) != len(wantEnv) || env[0] != wantEnv[0] || env[1] != wantEnv[1] {
+		t.Errorf("exec env = %+v, want %+v", env, wantEnv)
+	}
+}
+
+func TestUpdateClusterCA_Unchanged(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	withCA := strings.Replace(serverKubeconfig,
+		"server: https://k8s.example.com",
+		"server: https://k8s.example.com\n    certificate-authority-data: Y2E=", 1)
+	if err := os.WriteFile(path, []byte(withCA), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	updated, err := updateClusterCA(path, withCA)
+	if err != nil {
+		t.Fatalf("updateClusterCA() error = %v", err)
+	}
+	if updated {
+		t.Error("updateClusterCA() = true for an identical CA, want false")
+	}
+	data, _ := os.ReadFile(path)
+	if string(data) != withCA {
+		t.Error("kubeconfig was rewritten although the CA did not change")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/spf13/cobra"
 )
 
+// debug is set by --verbose (or its older alias --debug).
 var debug bool
 
 var rootCmd = &cobra.Command{
@@ -18,6 +19,14 @@ Clusters are discovered automatically via DNS. Your browser will open,
 you'll authenticate, and kubectl will be configured automatically.`,
 	SilenceErrors: true,
 	SilenceUsage:  true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		timeout, err := resolveHTTPTimeout(httpTimeout)
+		if err != nil {
+			return err
+		}
+		httpClient = newHTTPClient(timeout)
+		return nil
+	},
 }
 
 func Execute() error {
@@ -25,5 +34,7 @@ func Execute() error {
 }
 
 func init() {
-	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "print debug output")
+	rootCmd.PersistentFlags().BoolVarP(&debug, "verbose", "v", false, "log requests, responses and login events to stderr (token values are never logged)")
+	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "alias for --verbose")
+	_ = rootCmd.PersistentFlags().MarkHidden("debug")
 }
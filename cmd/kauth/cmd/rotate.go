@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var rotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Rotate the cached refresh token now",
+	Long: `Exchange the cached refresh token for a new one immediately, invalidating the
+old token once it falls outside the server's rotation window.
+
+Use this after the token may have been exposed (for example on an untrusted
+network) to cut off the old token without logging in again.`,
+	RunE: runRotate,
+}
+
+func init() {
+	rootCmd.AddCommand(rotateCmd)
+}
+
+func runRotate(cmd *cobra.Command, args []string) error {
+	refreshResp, err := refreshCachedToken()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("\n  %s %s\n", successIcon, green.Render("Refresh token rotated"))
+	fmt.Printf("  %s #%d\n", muted.Render("rotation"), refreshResp.RotationCounter)
+	if refreshResp.RefreshTokenExpiresIn > 0 {
+		expiry := time.Now().Add(time.Duration(refreshResp.RefreshTokenExpiresIn) * time.Second)
+		fmt.Printf("  %s %s\n", muted.Render("expires "), expiry.Local().Format(time.RFC1123))
+	}
+
+	return nil
+}
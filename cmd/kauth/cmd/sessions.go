@@ -49,8 +49,11 @@ type RevokeSessionRequest struct {
 }
 
 func runSessions(cmd *cobra.Command, args []string) error {
-	storage := token.NewStorage(token.DefaultCachePath())
-	cachedToken, _ := storage.Load()
+	store, err := token.DefaultCredentialStore()
+	if err != nil {
+		return err
+	}
+	cachedToken, _ := store.Get()
 
 	if cachedToken == nil || cachedToken.IDToken == "" {
 		return fmt.Errorf("no valid token found.\n\nTo authenticate, run:\n  kauth login --url <server-url>")
@@ -90,7 +93,7 @@ func runSessions(cmd *cobra.Command, args []string) error {
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned status %d", resp.StatusCode)
+		return readServerError(resp)
 	}
 
 	var sessionsResp SessionsResponse
@@ -134,7 +137,7 @@ func revokeSession(serverURL, sessionID, idToken string) error {
 	defer func() { _ = resp.Body.Close() }()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("server returned status %d", resp.StatusCode)
+		return readServerError(resp)
 	}
 
 	fmt.Printf("\n  %s %s\n", successIcon, muted.Render(fmt.Sprintf("Session %s revoked.", sessionID)))
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	setupURL         string
+	setupContextName string
+	setupUserName    string
+	setupKubeconfig  string
+	setupDryRun      bool
+	setupProxyURL    string
+	setupTLSServer   string
+	setupKauthPath   string
+	setupStrict      bool
+)
+
+var setupCmd = &cobra.Command{
+	Use:   "setup",
+	Short: "Add a kauth cluster to kubeconfig without logging in",
+	Long: `Add the cluster served by a kauth server to your kubeconfig, with a user
+that runs kauth get-token, without logging in.
+
+This lets admins hand out a pre-configured kubeconfig. Until the user runs
+kauth login, kubectl reports that they are not authenticated and names the
+kauth login command to run.`,
+	RunE: runSetup,
+}
+
+func init() {
+	rootCmd.AddCommand(setupCmd)
+	setupCmd.Flags().StringVar(&setupURL, "url", "", "kauth server URL (required)")
+	setupCmd.Flags().StringVar(&setupContextName, "context-name", "", "kubeconfig context name (defaults to the server's cluster name)")
+	setupCmd.Flags().StringVar(&setupUserName, "user-name", "", "kubeconfig user name (defaults to kauth-<cluster>)")
+	setupCmd.Flags().StringVar(&setupKubeconfig, "kubeconfig", "", "kubeconfig file to update (defaults to ~/.kube/config)")
+	setupCmd.Flags().StringVar(&setupProxyURL, "proxy-url", "", "proxy kubectl reaches the API server through (defaults to the server's CLUSTER_PROXY_URL)")
+	setupCmd.Flags().StringVar(&setupTLSServer, "tls-server-name", "", "name to verify the API server certificate against (defaults to the server's CLUSTER_TLS_SERVER_NAME)")
+	setupCmd.Flags().StringVar(&setupKauthPath, "kauth-path", "", "kauth command kubectl runs (defaults to kauth if it is on PATH, else this binary's path)")
+	setupCmd.Flags().BoolVar(&setupStrict, "strict", false, "fail instead of warning if kubectl would not find the kauth command")
+	setupCmd.Flags().BoolVar(&setupDryRun, "dry-run", false, "print the resulting kubeconfig instead of writing it")
+	_ = setupCmd.MarkFlagRequired("url")
+}
+
+func runSetup(cmd *cobra.Command, args []string) error {
+	serverURL := strings.TrimRight(setupURL, "/")
+
+	resp, err := httpClient.Get(serverURL + "/info")
+	if err != nil {
+		return fmt.Errorf("could not reach kauth at %s: %w", serverURL, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("server returned %s", resp.Status)
+	}
+	var info InfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return fmt.Errorf("invalid response from server: %w", err)
+	}
+
+	if setupProxyURL != "" {
+		info.ClusterProxy = setupProxyURL
+	}
+	if setupTLSServer != "" {
+		info.ClusterTLSSNI = setupTLSServer
+	}
+	command := setupKauthPath
+	if command == "" {
+		command = defaultExecCommand()
+	}
+	if err := checkExecCommand(command); err != nil {
+		if setupStrict {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+	}
+	data, contextName, err := buildSetupKubeconfig(&info, serverURL, command, setupContextName, setupUserName)
+	if err != nil {
+		return err
+	}
+	if _, err := checkClusterTLS(data, false); err != nil {
+		return err
+	}
+
+	path := setupKubeconfig
+	if path == "" {
+		path = defaultKubeconfigPath()
+	}
+	existing, err := os.ReadFile(path)
+	merge := err == nil && len(existing) > 0
+	if setupDryRun {
+		result := []byte(data)
+		if merge {
+			if result, err = mergedKubeconfig(path, data); err != nil {
+				return fmt.Errorf("failed to merge kubeconfig: %w", err)
+			}
+		}
+		fmt.Printf("# %s (dry run, not written)\n%s", path, result)
+		return nil
+	}
+	if merge {
+		if err := mergeKubeconfig(path, data); err != nil {
+			return fmt.Errorf("failed to merge kubeconfig: %w", err)
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("failed to create kubeconfig directory: %w", err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+			return fmt.Errorf("failed to save kubeconfig: %w", err)
+		}
+	}
+
+	fmt.Printf("\n  %s %s %s\n", successIcon, green.Render("Added context "+contextName), muted.Render(path))
+	fmt.Printf("\n  Run %s to authenticate.\n\n", accent.Render("kauth login --url "+serverURL))
+	return nil
+}
+
+// defaultExecCommand is the kauth command setup writes when --kauth-path is
+// not given: plain kauth if it is on PATH, so the kubeconfig also works on
+// other machines, else the absolute path of this binary.
+func defaultExecCommand() string {
+	if _, err := exec.LookPath("kauth"); err == nil {
+		return "kauth"
+	}
+	if self, err := os.Executable(); err == nil {
+		return self
+	}
+	return "kauth"
+}
+
+// checkExecCommand reports an error if kubectl could not run command: a
+// path that is not an executable file, or a name not found on PATH.
+func checkExecCommand(command string) error {
+	if _, err := exec.LookPath(command); err != nil {
+		return fmt.Errorf("kubectl will not be able to run %q (%w); set --kauth-path", command, err)
+	}
+	return nil
+}
+
+// buildSetupKubeconfig returns a kubeconfig with the server's cluster, a
+// user that runs command get-token against serverURL, and a context joining
+// them, and the context's name.
+func buildSetupKubeconfig(info *InfoResponse, serverURL, command, contextName, userName string) (string, string, error) {
+	if info.ClusterName == "" || info.ClusterServer == "" {
+		return "", "", errors.New("server did not report a cluster name and API server")
+	}
+	if contextName == "" {
+		contextName = info.ClusterName
+	}
+	if userName == "" {
+		userName = "kauth-" + info.ClusterName
+	}
+
+	kc := kubeconfig{
+		APIVersion:     "v1",
+		Kind:           "Config",
+		CurrentContext: contextName,
+		Clusters: []namedCluster{{
+			Name: info.ClusterName,
+			Cluster: cluster{
+				Server:                   info.ClusterServer,
+				CertificateAuthorityData: info.ClusterCA,
+				ProxyURL:                 info.ClusterProxy,
+				TLSServerName:            info.ClusterTLSSNI,
+			},
+		}},
+		Users: []namedUser{{
+			Name: userName,
+			User: user{Exec: &execConfig{
+				APIVersion:      "client.authentication.k8s.io/v1",
+				Command:         command,
+				Args:            []string{"get-token"},
+				Env:             []envVar{{Name: envServerURL, Value: serverURL}},
+				InteractiveMode: "Never",
+			}},
+		}},
+		Contexts: []namedContext{{
+			Name:    contextName,
+			Context: kubeContext{Cluster: info.ClusterName, User: userName},
+		}},
+	}
+	data, err := yaml.Marshal(&kc)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal kubeconfig: %w", err)
+	}
+	return string(data), contextName, nil
+}
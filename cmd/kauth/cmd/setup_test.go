@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestBuildSetupKubeconfig(t *testing.T) {
+	info := &InfoResponse{ClusterName: "prod", ClusterServer: "https://k8s.example.com", ClusterCA: "Y2E="}
+
+	out, contextName, err := buildSetupKubeconfig(info, "https://kauth.example.com", "kauth", "", "")
+	if err != nil {
+		t.Fatalf("buildSetupKubeconfig() error = %v", err)
+	}
+	if contextName != "prod" {
+		t.Errorf("context name = %q, want prod", contextName)
+	}
+
+	var kc kubeconfig
+	if err := yaml.Unmarshal([]byte(out), &kc); err != nil {
+		t.Fatalf("invalid YAML: %v", err)
+	}
+	if kc.CurrentContext != "prod" || len(kc.Contexts) != 1 || kc.Contexts[0].Context.User != "kauth-prod" {
+		t.Errorf("unexpected contexts: current=%q %+v", kc.CurrentContext, kc.Contexts)
+	}
+	if len(kc.Clusters) != 1 || kc.Clusters[0].Cluster.CertificateAuthorityData != "Y2E=" {
+		t.Errorf("unexpected clusters: %+v", kc.Clusters)
+	}
+	exec := kc.Users[0].User.Exec
+	if exec == nil || exec.Command != "kauth" || len(exec.Args) != 1 || exec.Args[0] != "get-token" {
+		t.Fatalf("unexpected exec: %+v", exec)
+	}
+	if len(exec.Env) != 1 || exec.Env[0].Name != envServerURL || exec.Env[0].Value != "https://kauth.example.com" {
+		t.Errorf("unexpected exec env: %+v", exec.Env)
+	}
+
+	if _, _, err := buildSetupKubeconfig(&InfoResponse{}, "https://kauth.example.com", "kauth", "", ""); err == nil {
+		t.Error("expected error for empty /info response")
+	}
+}
+
+func TestRunSetup_MergesIntoExisting(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/info" {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(InfoResponse{ClusterName: "prod", ClusterServer: "https://k8s.example.com"})
+	}))
+	defer srv.Close()
+
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(serverKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	setupURL, setupContextName, setupUserName, setupKubeconfig = srv.URL, "staging", "bob", path
+	t.Cleanup(func() { setupURL, setupContextName, setupUserName, setupKubeconfig = "", "", "", "" })
+	if err := runSetup(setupCmd, nil); err != nil {
+		t.Fatalf("runSetup() error = %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		t.Fatalf("invalid YAML: %v", err)
+	}
+	contexts := map[string]kubeContext{}
+	for _, c := range kc.Contexts {
+		contexts[c.Name] = c.Context
+	}
+	if _, ok := contexts["alice@prod"]; !ok {
+		t.Error("existing context was dropped")
+	}
+	if got := contexts["staging"]; got.User != "bob" {
+		t.Errorf("staging context = %+v, want user bob", got)
+	}
+}
+
+func TestRunSetup_DryRunDoesNotWrite(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(InfoResponse{ClusterName: "prod", ClusterServer: "https://k8s.example.com"})
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "config")
+	if err := os.WriteFile(existing, []byte(serverKubeconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "new", "config")
+
+	t.Cleanup(func() { setupURL, setupKubeconfig, setupDryRun = "", "", false })
+	for _, path := range []string{existing, missing} {
+		setupURL, setupKubeconfig, setupDryRun = srv.URL, path, true
+		if err := runSetup(setupCmd, nil); err != nil {
+			t.Fatalf("runSetup(%s) error = %v", path, err)
+		}
+	}
+
+	data, err := os.ReadFile(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != serverKubeconfig {
+		t.Error("dry run rewrote the existing kubeconfig")
+	}
+	if _, err := os.Stat(filepath.Dir(missing)); !os.IsNotExist(err) {
+		t.Errorf("dry run created %s (stat error = %v)", filepath.Dir(missing), err)
+	}
+}
+
+// fakeKauth puts an executable named kauth in a directory that becomes the
+// only entry on PATH, and returns its path.
+func fakeKauth(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kauth")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+	return path
+}
+
+func TestCheckExecCommand(t *testing.T) {
+	kauthPath := fakeKauth(t)
+	notExecutable := filepath.Join(t.TempDir(), "kauth")
+	if err := os.WriteFile(notExecutable, []byte("#!/bin/sh\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		command string
+		wantErr bool
+	}{
+		{name: "on PATH", command: "kauth"},
+		{name: "absolute path", command: kauthPath},
+		{name: "not on PATH", command: "kauth-missing", wantErr: true},
+		{name: "missing path", command: filepath.Join(t.TempDir(), "kauth"), wantErr: true},
+		{name: "not executable", command: notExecutable, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkExecCommand(tt.command); (err != nil) != tt.wantErr {
+				t.Errorf("checkExecCommand(%q) error = %v, wantErr %v", tt.command, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultExecCommand(t *testing.T) {
+	fakeKauth(t)
+	if got := defaultExecCommand(); got != "kauth" {
+		t.Errorf("defaultExecCommand() with kauth on PATH = %q, want kauth", got)
+	}
+
+	t.Setenv("PATH", t.TempDir())
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := defaultExecCommand(); got != self {
+		t.Errorf("defaultExecCommand() without kauth on PATH = %q, want %q", got, self)
+	}
+}
+
+func TestRunSetup_StrictRejectsUnresolvableCommand(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(InfoResponse{ClusterName: "prod", ClusterServer: "https://k8s.example.com"})
+	}))
+	defer srv.Close()
+	path := filepath.Join(t.TempDir(), "config")
+
+	t.Cleanup(func() { setupURL, setupKubeconfig, setupKauthPath, setupStrict = "", "", "", false })
+	setupURL, setupKubeconfig, setupKauthPath, setupStrict = srv.URL, path, "/nonexistent/kauth", true
+	if err := runSetup(setupCmd, nil); err == nil || !strings.Contains(err.Error(), "--kauth-path") {
+		t.Errorf("runSetup() error = %v, want unresolvable command", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("kubeconfig written despite --strict failure (stat error = %v)", err)
+	}
+
+	// Without --strict it only warns.
+	setupStrict = false
+	if err := runSetup(setupCmd, nil); err != nil {
+		t.Fatalf("runSetup() without --strict error = %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "command: /nonexistent/kauth") {
+		t.Errorf("kubeconfig does not use --kauth-path:\n%s", data)
+	}
+}
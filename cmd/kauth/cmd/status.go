@@ -3,7 +3,9 @@ package cmd
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -21,21 +23,72 @@ import (
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Show authentication status",
-	RunE:  runStatus,
+	Long: `Show authentication status, followed by a checklist for troubleshooting
+kubectl authentication: cached credential, server /health and /info, whether
+the current kubeconfig context uses kauth, and whether kauth get-token
+succeeds. Exits non-zero if any check fails.
+
+--output json or yaml prints the same information for scripts.`,
+	RunE: runStatus,
 }
 
+// errStatusChecksFailed makes kauth status exit non-zero when a check fails.
+var errStatusChecksFailed = errors.New("one or more status checks failed")
+
+// statusCheck is one line of the kauth status checklist.
+type statusCheck struct {
+	name   string
+	ok     bool
+	detail string
+}
+
+// statusOutput is the --output format of kauth status.
+var statusOutput string
+
 func init() {
 	rootCmd.AddCommand(statusCmd)
+	addOutputFlag(statusCmd, &statusOutput)
+}
+
+// statusResult is kauth status in --output json/yaml form.
+type statusResult struct {
+	Authenticated bool      `json:"authenticated" yaml:"authenticated"`
+	User          string    `json:"user,omitempty" yaml:"user,omitempty"`
+	Server        string    `json:"server,omitempty" yaml:"server,omitempty"`
+	Cluster       string    `json:"cluster,omitempty" yaml:"cluster,omitempty"`
+	Context       string    `json:"context,omitempty" yaml:"context,omitempty"`
+	APIServer     string    `json:"api_server,omitempty" yaml:"api_server,omitempty"`
+	Roles         []string  `json:"roles,omitempty" yaml:"roles,omitempty"`
+	TokenExpiry   time.Time `json:"token_expiry,omitzero" yaml:"token_expiry,omitempty"`
+	RefreshExpiry time.Time `json:"refresh_expiry,omitzero" yaml:"refresh_expiry,omitempty"`
+
+	Checks []statusCheckResult `json:"checks,omitempty" yaml:"checks,omitempty"`
+}
+
+type statusCheckResult struct {
+	Name   string `json:"name" yaml:"name"`
+	OK     bool   `json:"ok" yaml:"ok"`
+	Detail string `json:"detail,omitempty" yaml:"detail,omitempty"`
 }
 
 func runStatus(cmd *cobra.Command, args []string) error {
-	storage := token.NewStorage(token.DefaultCachePath())
+	if err := checkOutputFormat(statusOutput); err != nil {
+		return err
+	}
 
-	cachedToken, _ := storage.Load()
+	store, err := token.DefaultCredentialStore()
+	if err != nil {
+		return err
+	}
+
+	cachedToken, _ := store.Get()
+	if statusOutput != outputTable {
+		return writeStatus(cmd.OutOrStdout(), statusOutput, cachedToken, time.Now())
+	}
 	if cachedToken == nil || cachedToken.RefreshToken == "" {
 		fmt.Printf("\n  %s %s\n", errorIcon, muted.Render("Not authenticated"))
 		fmt.Printf("\n  Run %s to authenticate.\n\n", accent.Render("kauth login"))
-		return nil
+		return errStatusChecksFailed
 	}
 
 	serverURLFull := cachedToken.ServerURL
@@ -67,7 +120,7 @@ func runStatus(cmd *cobra.Command, args []string) error {
 
 	fmt.Printf("  %s %s\n", accent.Render("Server"), orange.Render(serverURL))
 
-	reachable, latency := checkServerReachable(serverURLFull)
+	reachable, latency := checkServerEndpoint(serverURLFull, "/info")
 	if reachable {
 		fmt.Printf("  %s %s %s %s\n", accent.Render("Health"), successIcon, green.Render("Reachable"), muted.Render(fmt.Sprintf("(%s)", latency.Round(time.Millisecond))))
 	} else {
@@ -84,15 +137,28 @@ func runStatus(cmd *cobra.Command, args []string) error {
 		fmt.Printf("  %s %s %s %s\n", accent.Render("Token"), successIcon, green.Render("Valid"), muted.Render(fmt.Sprintf("(expires in %s)", formatDuration(timeUntilExpiry))))
 	}
 
-	fmt.Printf("  %s %s %s\n", accent.Render("Refresh"), successIcon, green.Render("Available"))
+	switch timeUntilRefreshExpiry := cachedToken.RefreshExpiry.Sub(now); {
+	case cachedToken.RefreshExpiry.IsZero():
+		fmt.Printf("  %s %s %s\n", accent.Render("Refresh"), successIcon, green.Render("Available"))
+	case timeUntilRefreshExpiry <= 0:
+		fmt.Printf("  %s %s %s %s\n", accent.Render("Refresh"), errorIcon, red.Render("Expired"), muted.Render(fmt.Sprintf("(%s ago)", formatDuration(-timeUntilRefreshExpiry))))
+	default:
+		fmt.Printf("  %s %s %s %s\n", accent.Render("Refresh"), successIcon, green.Render("Available"), muted.Render(fmt.Sprintf("(expires in %s)", formatDuration(timeUntilRefreshExpiry))))
+	}
 
-	fmt.Println()
+	fmt.Printf("\n  %s %s\n\n", accent.Render("●"), bold.Render("Checks"))
 
-	if kubeInfo == nil {
-		fmt.Printf("  %s %s\n", warningIcon, yellow.Render("Kubeconfig not found or invalid."))
-	} else {
-		fmt.Printf("  %s %s\n", successIcon, green.Render("kubectl ready."))
+	checks := runStatusChecks(cachedToken, serverURLFull, now)
+	failed := false
+	for _, c := range checks {
+		icon := successIcon
+		if !c.ok {
+			icon = errorIcon
+			failed = true
+		}
+		fmt.Printf("  %s %s %s\n", icon, c.name, muted.Render(c.detail))
 	}
+	fmt.Println()
 
 	now = time.Now()
 	timeUntilExpiry = cachedToken.Expiry.Sub(now)
@@ -100,14 +166,186 @@ func runStatus(cmd *cobra.Command, args []string) error {
 
 	if expired {
 		fmt.Printf("  %s %s\n", infoIcon, yellow.Render("Token expired — will auto-refresh on next kubectl use."))
-	} else if timeUntilExpiry < 5*time.Minute {
+	} else if timeUntilExpiry < token.DefaultExpiryBuffer {
 		fmt.Printf("  %s %s\n", warningIcon, yellow.Render("Token expires soon."))
 	}
+	if !cachedToken.RefreshExpiry.IsZero() && cachedToken.RefreshExpiry.Sub(now) < refreshExpiryWarning {
+		fmt.Printf("  %s %s\n", warningIcon, yellow.Render("Session ends within a day — run kauth login to renew."))
+	}
 
 	fmt.Println()
+	if failed {
+		return errStatusChecksFailed
+	}
+	return nil
+}
+
+// writeStatus writes kauth status for cached in format, returning
+// errStatusChecksFailed as the table output would.
+func writeStatus(w io.Writer, format string, cached *token.Cache, now time.Time) error {
+	if cached == nil || cached.RefreshToken == "" {
+		if err := writeOutput(w, format, statusResult{}); err != nil {
+			return err
+		}
+		return errStatusChecksFailed
+	}
+
+	result := statusResult{
+		Authenticated: true,
+		User:          getUserFromToken(cached.IDToken),
+		Server:        cached.ServerURL,
+		TokenExpiry:   cached.Expiry,
+		RefreshExpiry: cached.RefreshExpiry,
+	}
+	if kubeInfo, err := getKubeconfigInfo(); err == nil {
+		result.Cluster = kubeInfo.clusterName
+		result.Context = kubeInfo.contextName
+		result.APIServer = kubeInfo.apiServer
+		result.Roles = getClusterRoles(kubeInfo.apiServer, cached.IDToken, result.User, getGroupsFromToken(cached.IDToken))
+	}
+
+	failed := false
+	for _, c := range runStatusChecks(cached, cached.ServerURL, now) {
+		result.Checks = append(result.Checks, statusCheckResult{Name: c.name, OK: c.ok, Detail: c.detail})
+		failed = failed || !c.ok
+	}
+
+	if err := writeOutput(w, format, result); err != nil {
+		return err
+	}
+	if failed {
+		return errStatusChecksFailed
+	}
 	return nil
 }
 
+// runStatusChecks builds the kauth status checklist.
+func runStatusChecks(cached *token.Cache, serverURL string, now time.Time) []statusCheck {
+	var checks []statusCheck
+
+	cred := statusCheck{name: "Cached credential"}
+	switch {
+	case cached.WebhookToken == "":
+		cred.detail = "missing — run kauth login"
+	case !cached.Expiry.After(now):
+		cred.detail = fmt.Sprintf("expired %s ago — run kauth login", formatDuration(now.Sub(cached.Expiry)))
+	default:
+		cred.ok = true
+		cred.detail = fmt.Sprintf("expires in %s", formatDuration(cached.Expiry.Sub(now)))
+	}
+	checks = append(checks, cred)
+
+	health := statusCheck{name: "Server /health"}
+	if ok, latency := checkServerEndpoint(serverURL, "/health"); ok {
+		health.ok = true
+		health.detail = latency.Round(time.Millisecond).String()
+	} else {
+		health.detail = "unreachable " + serverURL
+	}
+	checks = append(checks, health)
+
+	info := statusCheck{name: "Server /info"}
+	if resp, err := fetchInfo(&http.Client{Timeout: 3 * time.Second}, serverURL); err != nil {
+		info.detail = err.Error()
+	} else {
+		info.ok = true
+		info.detail = "cluster " + resp.ClusterName
+	}
+	checks = append(checks, info)
+
+	current := statusCheck{name: "Current context uses kauth"}
+	if name, err := currentKauthContext(defaultKubeconfigPath()); err != nil {
+		current.detail = err.Error()
+	} else {
+		current.ok = true
+		current.detail = name
+	}
+	checks = append(checks, current)
+
+	getToken := statusCheck{name: "kauth get-token"}
+	if err := checkGetToken(); err != nil {
+		getToken.detail = strings.SplitN(err.Error(), "\n", 2)[0]
+	} else {
+		getToken.ok = true
+	}
+	checks = append(checks, getToken)
+
+	return checks
+}
+
+// fetchInfo fetches and decodes the server's /info, rejecting responses
+// without the cluster a kubeconfig needs.
+func fetchInfo(client *http.Client, serverURL string) (*InfoResponse, error) {
+	if serverURL == "" {
+		return nil, errors.New("no server in the token cache")
+	}
+	resp, err := client.Get(serverURL + "/info")
+	if err != nil {
+		return nil, fmt.Errorf("unreachable %s", serverURL)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s/info: %w", serverURL, readServerError(resp))
+	}
+	var info InfoResponse
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, fmt.Errorf("invalid response from %s/info (is this a kauth server?): %w", serverURL, err)
+	}
+	if info.ClusterName == "" || info.ClusterServer == "" {
+		return nil, fmt.Errorf("%s/info did not report a cluster name and API server (is this a kauth server?)", serverURL)
+	}
+	return &info, nil
+}
+
+// isKauthExec reports whether e runs kauth, by name or by path (kauth setup
+// may write the binary's absolute path).
+func isKauthExec(e *execConfig) bool {
+	if e == nil {
+		return false
+	}
+	name := filepath.Base(e.Command)
+	return name == "kauth" || name == "kauth.exe"
+}
+
+// currentKauthContext returns the kubeconfig's current context if its user
+// runs kauth as an exec plugin.
+func currentKauthContext(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("no kubeconfig at %s", path)
+	}
+	var kc kubeconfig
+	if err := yaml.Unmarshal(data, &kc); err != nil {
+		return "", fmt.Errorf("invalid kubeconfig: %w", err)
+	}
+	if kc.CurrentContext == "" {
+		return "", errors.New("no current-context set")
+	}
+	for _, ctx := range kc.Contexts {
+		if ctx.Name != kc.CurrentContext {
+			continue
+		}
+		for _, u := range kc.Users {
+			if u.Name == ctx.Context.User {
+				if isKauthExec(u.User.Exec) {
+					return ctx.Name, nil
+				}
+				return "", fmt.Errorf("context %q does not use kauth", ctx.Name)
+			}
+		}
+		return "", fmt.Errorf("context %q references missing user %q", ctx.Name, ctx.Context.User)
+	}
+	return "", fmt.Errorf("current-context %q not found", kc.CurrentContext)
+}
+
+// checkGetToken runs get-token as kubectl would, discarding its output.
+func checkGetToken() error {
+	cmd := &cobra.Command{}
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	return runGetToken(cmd, nil)
+}
+
 func formatDuration(d time.Duration) string {
 	d = d.Round(time.Second)
 
@@ -255,7 +493,7 @@ func getKubeconfigInfo() (*kubeconfigStatus, error) {
 
 	kauthUsers := make(map[string]bool)
 	for _, u := range kc.Users {
-		if u.User.Exec != nil && u.User.Exec.Command == "kauth" {
+		if isKauthExec(u.User.Exec) {
 			kauthUsers[u.Name] = true
 		}
 	}
@@ -277,14 +515,14 @@ func getKubeconfigInfo() (*kubeconfigStatus, error) {
 	return nil, fmt.Errorf("no kauth context found")
 }
 
-func checkServerReachable(serverURL string) (bool, time.Duration) {
-	if serverURL == "unknown" {
+func checkServerEndpoint(serverURL, path string) (bool, time.Duration) {
+	if serverURL == "" {
 		return false, 0
 	}
 
 	start := time.Now()
 	client := &http.Client{Timeout: 3 * time.Second}
-	resp, err := client.Get(serverURL + "/info")
+	resp, err := client.Get(serverURL + path)
 	elapsed := time.Since(start)
 
 	if err != nil {
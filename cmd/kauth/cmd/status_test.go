@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"kauth/pkg/token"
+)
+
+func TestCurrentKauthContext(t *testing.T) {
+	otherUser := strings.Replace(serverKubeconfig, "command: kauth", "command: kubelogin", 1)
+	otherContext := strings.Replace(serverKubeconfig, "current-context: alice@prod", "current-context: admin@prod", 1)
+
+	tests := []struct {
+		name    string
+		data    string
+		want    string
+		wantErr string
+	}{
+		{name: "kauth context", data: serverKubeconfig, want: "alice@prod"},
+		{name: "other exec plugin", data: otherUser, wantErr: "does not use kauth"},
+		{name: "missing current context", data: otherContext, wantErr: "not found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := currentKauthContext(path)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("currentKauthContext() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("currentKauthContext() = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunStatusChecks(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv(envToken, "")
+	t.Setenv(envServerURL, "")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/health":
+			w.WriteHeader(http.StatusOK)
+		case "/info":
+			_, _ = w.Write([]byte(`{"cluster_name":"prod","cluster_server":"https://k8s.example.com"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	cached := &token.Cache{ServerURL: srv.URL, WebhookToken: "wh", Expiry: now.Add(time.Hour)}
+	if err := token.NewStorage(token.DefaultCachePath()).Save(cached); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	failed := func(checks []statusCheck) []string {
+		var names []string
+		for _, c := range checks {
+			if !c.ok {
+				names = append(names, c.name)
+			}
+		}
+		return names
+	}
+
+	// No kubeconfig yet: only the context check fails.
+	if got := failed(runStatusChecks(cached, srv.URL, now)); len(got) != 1 || got[0] != "Current context uses kauth" {
+		t.Errorf("failed checks = %v, want only the context check", got)
+	}
+
+	if err := os.MkdirAll(filepath.Join(home, ".kube"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(defaultKubeconfigPath(), []byte(serverKubeconfig), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := failed(runStatusChecks(cached, srv.URL, now)); len(got) != 0 {
+		t.Errorf("failed checks = %v, want none", got)
+	}
+
+	// An expired credential and a down server are reported.
+	srv.Close()
+	if got := failed(runStatusChecks(cached, srv.URL, now.Add(2*time.Hour))); len(got) != 3 {
+		t.Errorf("failed checks = %v, want credential, /health and /info", got)
+	}
+}
+
+func TestIsKauthExec(t *testing.T) {
+	tests := []struct {
+		exec *execConfig
+		want bool
+	}{
+		{exec: nil, want: false},
+		{exec: &execConfig{Command: "kauth"}, want: true},
+		{exec: &execConfig{Command: "/usr/local/bin/kauth"}, want: true},
+		{exec: &execConfig{Command: "kubelogin"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := isKauthExec(tt.exec); got != tt.want {
+			t.Errorf("isKauthExec(%+v) = %v, want %v", tt.exec, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+// Package apierror defines the JSON error body kauth-server returns from its
+// API endpoints. Clients match on the stable Code rather than on the
+// human-readable Message, which may change.
+package apierror
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+)
+
+// Error codes. These are part of the API: never rename one, only add.
+const (
+	CodeMethodNotAllowed = "method_not_allowed"
+	CodeInvalidRequest   = "invalid_request"
+	CodeRequestTooLarge  = "request_too_large"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeUnauthorized     = "unauthorized"
+	CodeInvalidToken     = "invalid_token"
+	CodeTokenExpired     = "token_expired"
+	CodeInvalidSignature = "invalid_signature"
+	CodeTokenReplay      = "token_replay"
+	CodeUserMismatch     = "user_mismatch"
+	CodeSessionExpired   = "session_expired"
+	CodeSessionInactive  = "session_inactive"
+	CodeSessionNotFound  = "session_not_found"
+	CodeUnknownCluster   = "unknown_cluster"
+	CodeForbidden        = "forbidden"
+	CodeOriginNotAllowed = "origin_not_allowed"
+	CodeRateLimited      = "rate_limited"
+	CodeTooManyLogins    = "too_many_logins"
+	CodeIdPError         = "idp_error"
+	CodeUnavailable      = "unavailable" // sent before the request is handled; safe to retry
+	CodeInternal         = "internal_error"
+)
+
+// Response is the body of an API error.
+type Response struct {
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+// Write sends status with a Response body carrying code and message.
+func Write(w http.ResponseWriter, status int, code, message string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(Response{Code: code, Message: message}); err != nil {
+		slog.Error("failed to encode error response", "error", err)
+	}
+}
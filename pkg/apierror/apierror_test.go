@@ -0,0 +1,27 @@
+package apierror
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	rr := httptest.NewRecorder()
+	Write(rr, http.StatusUnauthorized, CodeTokenExpired, "Refresh token expired")
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", ct)
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+		t.Fatalf("body is not JSON: %v", err)
+	}
+	if body["error"] != CodeTokenExpired || body["message"] != "Refresh token expired" {
+		t.Errorf("body = %v", body)
+	}
+}
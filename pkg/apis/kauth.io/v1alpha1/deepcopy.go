@@ -97,6 +97,11 @@ func (in *OAuthSessionStatus) DeepCopyInto(out *OAuthSessionStatus) {
 		*out = new(metav1.Time)
 		(*in).DeepCopyInto(*out)
 	}
+	if in.LastRotation != nil {
+		in, out := &in.LastRotation, &out.LastRotation
+		*out = new(metav1.Time)
+		(*in).DeepCopyInto(*out)
+	}
 	if in.Groups != nil {
 		out.Groups = make([]string, len(in.Groups))
 		copy(out.Groups, in.Groups)
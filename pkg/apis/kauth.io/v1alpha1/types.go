@@ -72,6 +72,13 @@ type OAuthSessionStatus struct {
 
 	// WebhookToken is the encrypted webhook credential for Kubernetes exec plugin
 	WebhookToken string `json:"webhookToken,omitzero"`
+
+	// RotationCounter is the rotation counter of RefreshToken, the highest
+	// seen for this session
+	RotationCounter int `json:"rotationCounter,omitzero"`
+
+	// LastRotation is when RefreshToken was last rotated
+	LastRotation *metav1.Time `json:"lastRotation,omitzero"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
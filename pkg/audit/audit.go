@@ -2,26 +2,66 @@ package audit
 
 import (
 	"context"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"time"
 
 	"kauth/pkg/middleware"
 )
 
-var ipExtractor *middleware.ClientIPExtractor
+// Event is an audit event as delivered to sinks.
+type Event struct {
+	Type       string
+	User       string
+	Groups     []string
+	Cluster    string
+	Reason     string
+	SessionID  string
+	Actor      string // who acted on User's behalf, e.g. an admin revoking
+	RequestID  string
+	RemoteAddr string
+	Time       time.Time
+}
+
+// Sink receives the events logged by the typed helpers (LoginSuccess,
+// AuthorizationDeny, ...) in addition to the audit log.
+type Sink interface {
+	Emit(ctx context.Context, e Event)
+}
+
+var sinks []Sink
 
-func SetIPExtractor(extractor *middleware.ClientIPExtractor) {
-	ipExtractor = extractor
+// AddSink registers s. It must be called during startup, before requests
+// are served.
+func AddSink(s Sink) {
+	sinks = append(sinks, s)
+}
+
+// emit passes e, completed with request details, to every sink.
+func emit(ctx context.Context, r *http.Request, e Event) {
+	if len(sinks) == 0 {
+		return
+	}
+	e.RequestID, _ = ctx.Value(middleware.RequestIDKey).(string)
+	e.RemoteAddr = middleware.ClientIP(r)
+	e.Time = time.Now()
+	for _, s := range sinks {
+		s.Emit(ctx, e)
+	}
 }
 
 // Event types
 const (
 	EventLoginSuccess   = "login_success"
 	EventLoginFailure   = "login_failure"
+	EventLoginDenied    = "login_denied"
 	EventRefreshSuccess = "refresh_success"
 	EventRefreshFailure = "refresh_failure"
+	EventRefreshReplay  = "refresh_replay"
 	EventAuthzAllow     = "authorization_allow"
 	EventAuthzDeny      = "authorization_deny"
+	EventRevoke         = "revoke"
 )
 
 // Log logs an audit event with structured fields
@@ -29,18 +69,11 @@ func Log(ctx context.Context, r *http.Request, event string, attrs ...any) {
 	// Get request ID from context
 	requestID, _ := ctx.Value(middleware.RequestIDKey).(string)
 
-	var remoteAddr string
-	if ipExtractor != nil {
-		remoteAddr = ipExtractor.GetClientIP(r)
-	} else {
-		remoteAddr = middleware.GetClientIP(r)
-	}
-
 	// Build base attributes
 	baseAttrs := []any{
 		"audit_event", event,
 		"request_id", requestID,
-		"remote_addr", remoteAddr,
+		"remote_addr", middleware.ClientIP(r),
 		"user_agent", r.UserAgent(),
 	}
 
@@ -58,6 +91,7 @@ func LoginSuccess(ctx context.Context, r *http.Request, email, cluster string, g
 		"cluster", cluster,
 		"groups", groups,
 	)
+	emit(ctx, r, Event{Type: EventLoginSuccess, User: email, Cluster: cluster, Groups: groups})
 }
 
 // LoginFailure logs a failed login
@@ -66,13 +100,51 @@ func LoginFailure(ctx context.Context, r *http.Request, reason string, email str
 		"reason", reason,
 		"user", email,
 	)
+	emit(ctx, r, Event{Type: EventLoginFailure, User: email, Reason: reason})
+}
+
+// LoginDenied logs a login refused after the user authenticated with the IdP
+func LoginDenied(ctx context.Context, r *http.Request, email string, groups []string, reason string) {
+	Log(ctx, r, EventLoginDenied,
+		"user", email,
+		"groups", groups,
+		"reason", reason,
+	)
+	emit(ctx, r, Event{Type: EventLoginDenied, User: email, Groups: groups, Reason: reason})
 }
 
 // RefreshSuccess logs a successful token refresh
-func RefreshSuccess(ctx context.Context, r *http.Request, email string) {
+func RefreshSuccess(ctx context.Context, r *http.Request, email string, groups []string) {
 	Log(ctx, r, EventRefreshSuccess,
 		"user", email,
+		"groups", groups,
+	)
+	emit(ctx, r, Event{Type: EventRefreshSuccess, User: email, Groups: groups})
+}
+
+// RefreshReplay logs a refresh with a rotated-away refresh token
+func RefreshReplay(ctx context.Context, r *http.Request, email, sessionID string, incoming, stored int) {
+	Log(ctx, r, EventRefreshReplay,
+		"user", email,
+		"session_id", sessionID,
+		"incoming_counter", incoming,
+		"stored_counter", stored,
+	)
+	emit(ctx, r, Event{Type: EventRefreshReplay, User: email, SessionID: sessionID,
+		Reason: fmt.Sprintf("rotation counter %d outside window of stored %d", incoming, stored)})
+}
+
+// Revoke logs sessions revoked by caller. sessionID is empty when all of
+// email's sessions were revoked.
+func Revoke(ctx context.Context, r *http.Request, caller, email, sessionID string, count int) {
+	Log(ctx, r, EventRevoke,
+		"caller", caller,
+		"user", email,
+		"session_id", sessionID,
+		"count", count,
 	)
+	emit(ctx, r, Event{Type: EventRevoke, User: email, Actor: caller, SessionID: sessionID,
+		Reason: fmt.Sprintf("%d session(s) revoked", count)})
 }
 
 // RefreshFailure logs a failed token refresh
@@ -81,6 +153,7 @@ func RefreshFailure(ctx context.Context, r *http.Request, reason string, email s
 		"reason", reason,
 		"user", email,
 	)
+	emit(ctx, r, Event{Type: EventRefreshFailure, User: email, Reason: reason})
 }
 
 // AuthorizationAllow logs a successful authorization check
@@ -89,6 +162,7 @@ func AuthorizationAllow(ctx context.Context, r *http.Request, email string, grou
 		"user", email,
 		"groups", groups,
 	)
+	emit(ctx, r, Event{Type: EventAuthzAllow, User: email, Groups: groups})
 }
 
 // AuthorizationDeny logs a denied authorization check
@@ -98,4 +172,5 @@ func AuthorizationDeny(ctx context.Context, r *http.Request, email string, group
 		"user_groups", groups,
 		"allowed_groups", allowedGroups,
 	)
+	emit(ctx, r, Event{Type: EventAuthzDeny, User: email, Groups: groups, Reason: "not a member of an allowed group"})
 }
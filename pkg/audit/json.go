@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Record is the JSON object JSONSink writes per event, one per line. Its
+// field names are a stable schema for SIEM ingestion: fields may be added
+// but never renamed or removed.
+type Record struct {
+	Time      time.Time `json:"time"`
+	Event     string    `json:"event"`
+	User      string    `json:"user,omitempty"`
+	Groups    []string  `json:"groups,omitempty"`
+	Actor     string    `json:"actor,omitempty"`
+	SessionID string    `json:"session_id,omitempty"`
+	ClientIP  string    `json:"client_ip,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Cluster   string    `json:"cluster"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+// JSONSink writes audit events as JSON lines, separately from the
+// operational log so its format does not change with log settings.
+type JSONSink struct {
+	cluster string
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewJSONSink returns a sink writing to w. cluster is recorded on every
+// event.
+func NewJSONSink(w io.Writer, cluster string) *JSONSink {
+	return &JSONSink{w: w, cluster: cluster}
+}
+
+// OpenJSONSink returns a JSONSink for target: "stdout", or a file path that
+// is created if needed and appended to.
+func OpenJSONSink(target, cluster string) (*JSONSink, error) {
+	if target == "stdout" {
+		return NewJSONSink(os.Stdout, cluster), nil
+	}
+	f, err := os.OpenFile(target, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return NewJSONSink(f, cluster), nil
+}
+
+// Emit implements Sink.
+func (s *JSONSink) Emit(ctx context.Context, e Event) {
+	cluster := e.Cluster
+	if cluster == "" {
+		cluster = s.cluster
+	}
+	data, err := json.Marshal(Record{
+		Time:      e.Time.UTC(),
+		Event:     e.Type,
+		User:      e.User,
+		Groups:    e.Groups,
+		Actor:     e.Actor,
+		SessionID: e.SessionID,
+		ClientIP:  e.RemoteAddr,
+		RequestID: e.RequestID,
+		Cluster:   cluster,
+		Reason:    e.Reason,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "failed to encode audit record", "error", err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		slog.ErrorContext(ctx, "failed to write audit record", "error", err)
+	}
+}
@@ -0,0 +1,82 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"kauth/pkg/middleware"
+)
+
+func TestJSONSink(t *testing.T) {
+	var buf bytes.Buffer
+	AddSink(NewJSONSink(&buf, "prod"))
+	t.Cleanup(func() { sinks = nil })
+
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.RemoteAddr = "192.0.2.10:1234"
+	ctx := context.WithValue(context.Background(), middleware.RequestIDKey, "req-1")
+
+	LoginSuccess(ctx, req, "user@example.com", "prod", []string{"devs"})
+	LoginDenied(ctx, req, "other@example.com", []string{"guests"}, "not a member of an allowed group")
+	RefreshReplay(ctx, req, "user@example.com", "sess-1", 1, 4)
+	Revoke(ctx, req, "admin@example.com", "user@example.com", "", 2)
+
+	var records []Record
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var rec Record
+		if err := dec.Decode(&rec); err != nil {
+			t.Fatalf("invalid JSON line: %v", err)
+		}
+		records = append(records, rec)
+	}
+
+	wantEvents := []string{EventLoginSuccess, EventLoginDenied, EventRefreshReplay, EventRevoke}
+	if len(records) != len(wantEvents) {
+		t.Fatalf("got %d records, want %d", len(records), len(wantEvents))
+	}
+	for i, rec := range records {
+		if rec.Event != wantEvents[i] {
+			t.Errorf("record %d event = %q, want %q", i, rec.Event, wantEvents[i])
+		}
+		if rec.Cluster != "prod" || rec.ClientIP != "192.0.2.10" || rec.RequestID != "req-1" || rec.Time.IsZero() {
+			t.Errorf("record %d = %+v, want cluster, client IP, request ID and time set", i, rec)
+		}
+	}
+	if records[0].User != "user@example.com" || len(records[0].Groups) != 1 {
+		t.Errorf("login record = %+v", records[0])
+	}
+	if records[2].SessionID != "sess-1" || records[2].Reason == "" {
+		t.Errorf("replay record = %+v", records[2])
+	}
+	if records[3].Actor != "admin@example.com" || records[3].User != "user@example.com" {
+		t.Errorf("revoke record = %+v", records[3])
+	}
+}
+
+func TestOpenJSONSink_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	sink, err := OpenJSONSink(path, "prod")
+	if err != nil {
+		t.Fatalf("OpenJSONSink() error = %v", err)
+	}
+	sink.Emit(context.Background(), Event{Type: EventLoginSuccess, User: "user@example.com"})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		t.Fatalf("file does not hold a JSON record: %v\n%s", err, data)
+	}
+	if rec.Event != EventLoginSuccess || rec.Cluster != "prod" {
+		t.Errorf("record = %+v", rec)
+	}
+}
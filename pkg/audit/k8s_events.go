@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// Kubernetes Event reasons written by EventSink.
+const (
+	ReasonLogin       = "KauthLogin"
+	ReasonLoginDenied = "KauthLoginDenied"
+)
+
+// eventTimeout bounds the API call so a slow API server cannot stall the
+// login callback for long.
+const eventTimeout = 5 * time.Second
+
+// EventSink records logins as Kubernetes Events so `kubectl get events`
+// shows auth activity. Events involve the kauth namespace itself, since a
+// login is not tied to any object kauth owns beyond its OAuthSession.
+type EventSink struct {
+	events    corev1client.EventsGetter
+	namespace string
+}
+
+// NewEventSink returns a sink writing Events to namespace.
+func NewEventSink(events corev1client.EventsGetter, namespace string) *EventSink {
+	return &EventSink{events: events, namespace: namespace}
+}
+
+// Emit implements Sink. Only login outcomes are recorded; refreshes would
+// drown them out. Failures are logged, never returned to the request.
+func (s *EventSink) Emit(ctx context.Context, e Event) {
+	var reason, eventType, message string
+	switch e.Type {
+	case EventLoginSuccess:
+		reason, eventType = ReasonLogin, corev1.EventTypeNormal
+		message = fmt.Sprintf("%s logged in to %s", e.User, e.Cluster)
+		if len(e.Groups) > 0 {
+			message += fmt.Sprintf(" (groups: %s)", strings.Join(e.Groups, ", "))
+		}
+	case EventLoginFailure, EventLoginDenied, EventAuthzDeny:
+		reason, eventType = ReasonLoginDenied, corev1.EventTypeWarning
+		message = fmt.Sprintf("%s denied: %s", e.User, e.Reason)
+	default:
+		return
+	}
+	if e.RemoteAddr != "" {
+		message += fmt.Sprintf(" from %s", e.RemoteAddr)
+	}
+
+	ts := metav1.NewTime(e.Time)
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      s.namespace + "." + strconv.FormatInt(e.Time.UnixNano(), 16),
+			Namespace: s.namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Namespace",
+			Name:       s.namespace,
+		},
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: "kauth"},
+		ReportingController: "kauth.io/kauth",
+		FirstTimestamp:      ts,
+		LastTimestamp:       ts,
+		Count:               1,
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), eventTimeout)
+	defer cancel()
+	if _, err := s.events.Events(s.namespace).Create(ctx, event, metav1.CreateOptions{}); err != nil {
+		slog.WarnContext(ctx, "failed to record audit event", "reason", reason, "error", err)
+	}
+}
@@ -0,0 +1,49 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestEventSink_Login(t *testing.T) {
+	client := fake.NewClientset()
+	AddSink(NewEventSink(client.CoreV1(), "kauth"))
+	t.Cleanup(func() { sinks = nil })
+
+	req := httptest.NewRequest(http.MethodGet, "/callback", nil)
+	ctx := context.Background()
+	LoginSuccess(ctx, req, "user@example.com", "prod", []string{"admins"})
+	AuthorizationDeny(ctx, req, "intruder@example.com", []string{"guests"}, []string{"admins"})
+	RefreshSuccess(ctx, req, "user@example.com", nil)
+
+	events, err := client.CoreV1().Events("kauth").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(events.Items) != 2 {
+		t.Fatalf("got %d events, want 2 (refreshes are not recorded)", len(events.Items))
+	}
+
+	byReason := map[string]corev1.Event{}
+	for _, e := range events.Items {
+		byReason[e.Reason] = e
+	}
+	login, ok := byReason[ReasonLogin]
+	if !ok || login.Type != corev1.EventTypeNormal || !strings.Contains(login.Message, "user@example.com logged in to prod") {
+		t.Errorf("login event = %+v", login)
+	}
+	if login.InvolvedObject.Kind != "Namespace" || login.InvolvedObject.Name != "kauth" {
+		t.Errorf("involved object = %+v, want the kauth namespace", login.InvolvedObject)
+	}
+	denied, ok := byReason[ReasonLoginDenied]
+	if !ok || denied.Type != corev1.EventTypeWarning || !strings.Contains(denied.Message, "intruder@example.com") {
+		t.Errorf("denied event = %+v", denied)
+	}
+}
@@ -0,0 +1,149 @@
+// Package clock abstracts the current time and timers so expiry logic and
+// long-lived streams can be tested without sleeping or minting tokens with
+// negative TTLs.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock reports the current time and creates timers running on it.
+type Clock interface {
+	Now() time.Time
+
+	// NewTicker returns a channel that receives the time every d, and a
+	// function that stops it, as time.NewTicker.
+	NewTicker(d time.Duration) (<-chan time.Time, func())
+
+	// After returns a channel that receives the time once d has passed,
+	// as time.After.
+	After(d time.Duration) <-chan time.Time
+}
+
+// Real is the system clock.
+type Real struct{}
+
+// Now returns time.Now().
+func (Real) Now() time.Time { return time.Now() }
+
+// NewTicker wraps time.NewTicker.
+func (Real) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	t := time.NewTicker(d)
+	return t.C, t.Stop
+}
+
+// After returns time.After(d).
+func (Real) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// FakeClock is a Clock that only moves when told to. Its timers fire as Set
+// and Advance move it past their deadlines. It is safe for concurrent use.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*waiter
+}
+
+// waiter is a pending After timer (period 0) or ticker.
+type waiter struct {
+	at     time.Time
+	period time.Duration
+	ch     chan time.Time
+}
+
+// NewFakeClock returns a FakeClock reading now.
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+// Now returns the clock's current time.
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// NewTicker returns a ticker firing each time the clock passes another
+// multiple of d. Like time.Ticker, it drops ticks the reader is not ready
+// for.
+func (c *FakeClock) NewTicker(d time.Duration) (<-chan time.Time, func()) {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{at: c.now.Add(d), period: d, ch: make(chan time.Time, 1)}
+	c.waiters = append(c.waiters, w)
+	return w.ch, func() { c.remove(w) }
+}
+
+// After returns a channel that receives the clock's time once it has
+// advanced by d.
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w := &waiter{at: c.now.Add(d), ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- c.now
+		return w.ch
+	}
+	c.waiters = append(c.waiters, w)
+	return w.ch
+}
+
+// Waiters returns how many After timers and tickers are pending, so a test
+// can wait for the code under test to start its timers before advancing.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+// Set moves the clock to t.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+	c.fire()
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.fire()
+}
+
+// fire delivers to every waiter due by now. c.mu must be held.
+func (c *FakeClock) fire() {
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(c.now) {
+			pending = append(pending, w)
+			continue
+		}
+		select {
+		case w.ch <- c.now:
+		default:
+		}
+		if w.period > 0 {
+			for !w.at.After(c.now) {
+				w.at = w.at.Add(w.period)
+			}
+			pending = append(pending, w)
+		}
+	}
+	c.waiters = pending
+}
+
+func (c *FakeClock) remove(w *waiter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i, other := range c.waiters {
+		if other == w {
+			c.waiters = append(c.waiters[:i], c.waiters[i+1:]...)
+			return
+		}
+	}
+}
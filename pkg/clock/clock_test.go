@@ -0,0 +1,93 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	if got := c.Now(); !got.Equal(start) {
+		t.Errorf("Now() = %v, want %v", got, start)
+	}
+	c.Advance(time.Hour)
+	if got, want := c.Now(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("Now() after Advance = %v, want %v", got, want)
+	}
+	c.Set(start)
+	if got := c.Now(); !got.Equal(start) {
+		t.Errorf("Now() after Set = %v, want %v", got, start)
+	}
+}
+
+func TestReal(t *testing.T) {
+	before := time.Now()
+	got := Real{}.Now()
+	if got.Before(before) || got.After(time.Now()) {
+		t.Errorf("Real.Now() = %v, not the current time", got)
+	}
+}
+
+func TestFakeClock_After(t *testing.T) {
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	c := NewFakeClock(start)
+
+	ch := c.After(time.Minute)
+	if c.Waiters() != 1 {
+		t.Fatalf("Waiters() = %d, want 1", c.Waiters())
+	}
+	c.Advance(59 * time.Second)
+	select {
+	case <-ch:
+		t.Fatal("After fired early")
+	default:
+	}
+	c.Advance(time.Second)
+	select {
+	case got := <-ch:
+		if want := start.Add(time.Minute); !got.Equal(want) {
+			t.Errorf("After sent %v, want %v", got, want)
+		}
+	default:
+		t.Fatal("After did not fire")
+	}
+	if c.Waiters() != 0 {
+		t.Errorf("Waiters() after firing = %d, want 0", c.Waiters())
+	}
+}
+
+func TestFakeClock_NewTicker(t *testing.T) {
+	c := NewFakeClock(time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC))
+
+	ch, stop := c.NewTicker(time.Second)
+	for i := range 3 {
+		c.Advance(time.Second)
+		select {
+		case <-ch:
+		default:
+			t.Fatalf("tick %d not delivered", i+1)
+		}
+	}
+
+	// Ticks the reader misses are dropped, not queued.
+	c.Advance(5 * time.Second)
+	<-ch
+	select {
+	case <-ch:
+		t.Error("missed ticks were queued")
+	default:
+	}
+
+	stop()
+	if c.Waiters() != 0 {
+		t.Errorf("Waiters() after stop = %d, want 0", c.Waiters())
+	}
+	c.Advance(time.Second)
+	select {
+	case <-ch:
+		t.Error("stopped ticker fired")
+	default:
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"slices"
 	"strings"
 
+	"kauth/pkg/apierror"
 	"kauth/pkg/oauth"
 )
 
@@ -24,25 +25,25 @@ func RequireAuth(getProvider func() *oauth.Provider, next http.HandlerFunc) http
 	return func(w http.ResponseWriter, r *http.Request) {
 		provider := getProvider()
 		if provider == nil {
-			http.Error(w, "Service temporarily unavailable", http.StatusServiceUnavailable)
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeUnavailable, "Service temporarily unavailable")
 			return
 		}
 
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
-			http.Error(w, "Missing Authorization header", http.StatusUnauthorized)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Missing Authorization header")
 			return
 		}
 
 		rawToken, ok := strings.CutPrefix(authHeader, "Bearer ")
 		if !ok {
-			http.Error(w, "Invalid Authorization header", http.StatusUnauthorized)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Invalid Authorization header")
 			return
 		}
 
 		idToken, err := provider.VerifyIDToken(r.Context(), rawToken)
 		if err != nil {
-			http.Error(w, "Invalid or expired token", http.StatusUnauthorized)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid or expired token")
 			return
 		}
 
@@ -50,13 +51,13 @@ func RequireAuth(getProvider func() *oauth.Provider, next http.HandlerFunc) http
 			Email  string   `json:"email"`
 			Groups []string `json:"groups"`
 		}
-		if err := idToken.Claims(&claims); err != nil {
-			http.Error(w, "Failed to extract claims", http.StatusInternalServerError)
+		if err := provider.Claims(idToken, &claims); err != nil {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to extract claims")
 			return
 		}
 
 		if claims.Email == "" {
-			http.Error(w, "Token must contain email claim", http.StatusUnauthorized)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Token must contain email claim")
 			return
 		}
 
@@ -3,14 +3,23 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"mime"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"kauth/pkg/apierror"
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
 	"kauth/pkg/oauth"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"gopkg.in/yaml.v3"
 )
 
 // OIDCClaims represents the common claims structure from OIDC tokens
@@ -20,6 +29,157 @@ type OIDCClaims struct {
 	Name              string   `json:"name"`
 	Sub               string   `json:"sub"`
 	PreferredUsername string   `json:"preferred_username"`
+
+	// EmailVerified is nil if the IdP sent no email_verified claim.
+	EmailVerified *claimBool `json:"email_verified"`
+
+	// raw holds every claim, for Identity lookups of claims not named above.
+	raw map[string]any
+}
+
+// DefaultUsernameClaim is the claim identifying users unless USERNAME_CLAIM
+// names another.
+const DefaultUsernameClaim = "email"
+
+// Identity returns the value of claim, the USERNAME_CLAIM that identifies
+// the user in refresh tokens and kubeconfigs. It is empty if the token has
+// no such string claim.
+func (c *OIDCClaims) Identity(claim string) string {
+	switch claim {
+	case "", DefaultUsernameClaim:
+		return c.Email
+	case "sub":
+		return c.Sub
+	case "preferred_username":
+		return c.PreferredUsername
+	case "name":
+		return c.Name
+	}
+	s, _ := c.raw[claim].(string)
+	return s
+}
+
+// claimBool is a boolean claim that also accepts "true"/"false" strings,
+// which some IdPs (e.g. Cognito) send for email_verified.
+type claimBool bool
+
+func (b *claimBool) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean claim %q", s)
+		}
+		*b = claimBool(v)
+		return nil
+	}
+	var v bool
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*b = claimBool(v)
+	return nil
+}
+
+// REQUIRE_VERIFIED_EMAIL modes.
+const (
+	VerifiedEmailOff     = "false"  // email_verified is ignored
+	VerifiedEmailRequire = "true"   // email_verified=false is refused; a missing claim is allowed
+	VerifiedEmailStrict  = "strict" // only email_verified=true is allowed
+)
+
+// emailUnverifiedReason is the audit reason for a refused unverified email.
+const emailUnverifiedReason = "email_unverified"
+
+// groupNotAllowedReason is the audit reason for a refresh refused because
+// the user has left every allowed group since logging in.
+const groupNotAllowedReason = "group_not_allowed"
+
+// emailVerified reports whether claims pass the REQUIRE_VERIFIED_EMAIL mode.
+func emailVerified(claims *OIDCClaims, mode string) bool {
+	switch mode {
+	case VerifiedEmailRequire:
+		return claims.EmailVerified == nil || bool(*claims.EmailVerified)
+	case VerifiedEmailStrict:
+		return claims.EmailVerified != nil && bool(*claims.EmailVerified)
+	}
+	return true
+}
+
+// claimMismatchReason is the audit reason for a token failing
+// REQUIRED_CLAIMS.
+const claimMismatchReason = "claim_mismatch"
+
+// RequiredClaims maps ID token claims to the values they must have; a
+// claim with several values accepts any of them. Values are kept as
+// strings, so true matches both the JSON boolean and the string "true".
+type RequiredClaims map[string][]string
+
+// ParseRequiredClaims parses REQUIRED_CLAIMS, a JSON object mapping each
+// claim to a string, bool or number, or a list of them, e.g.
+// {"tenant": "acme", "mfa": true, "acr": ["gold", "silver"]}. An empty
+// string requires nothing.
+func ParseRequiredClaims(s string) (RequiredClaims, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var raw map[string]any
+	if err := json.Unmarshal([]byte(s), &raw); err != nil {
+		return nil, fmt.Errorf("must be a JSON object: %w", err)
+	}
+	required := make(RequiredClaims, len(raw))
+	for claim, value := range raw {
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("claim %q lists no values", claim)
+		}
+		for _, v := range values {
+			str, ok := claimString(v)
+			if !ok {
+				return nil, fmt.Errorf("claim %q: value %v is not a string, bool or number", claim, v)
+			}
+			required[claim] = append(required[claim], str)
+		}
+	}
+	return required, nil
+}
+
+// mismatch returns the first required claim, in name order, that claims
+// lacks or holds no accepted value in, or "" if every one matches. A list
+// claim (such as amr) matches if any of its elements is accepted.
+func (rc RequiredClaims) mismatch(claims map[string]any) string {
+	for _, claim := range slices.Sorted(maps.Keys(rc)) {
+		values, ok := claims[claim].([]any)
+		if !ok {
+			values = []any{claims[claim]}
+		}
+		if !slices.ContainsFunc(values, func(v any) bool {
+			str, ok := claimString(v)
+			return ok && slices.Contains(rc[claim], str)
+		}) {
+			return claim
+		}
+	}
+	return ""
+}
+
+// claimString formats a scalar claim value for comparison. Objects,
+// lists and null are not comparable.
+func claimString(v any) (string, bool) {
+	switch v := v.(type) {
+	case string:
+		return v, true
+	case bool:
+		return strconv.FormatBool(v), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case json.Number:
+		return v.String(), true
+	}
+	return "", false
 }
 
 // KubeconfigGenerator generates kubeconfig YAML
@@ -27,6 +187,63 @@ type KubeconfigGenerator struct {
 	ClusterName   string
 	ClusterServer string
 	ClusterCA     string
+
+	// ClusterProxyURL, if set, is the cluster's proxy-url: the HTTP(S) or
+	// SOCKS5 proxy kubectl reaches the API server through.
+	ClusterProxyURL string
+
+	// ClusterTLSServerName, if set, is the cluster's tls-server-name: the
+	// name the API server certificate is checked against instead of the
+	// URL's host.
+	ClusterTLSServerName string
+
+	// ServerURL is the kauth base URL, passed to get-token as
+	// KAUTH_SERVER_URL so each context names the server it authenticates
+	// against rather than relying solely on the token cache.
+	ServerURL string
+
+	// UsernamePrefix is prepended to the kubeconfig user and context names
+	// so they read as the username the API server sees with
+	// --oidc-username-prefix. It does not change the credential.
+	UsernamePrefix string
+}
+
+// DefaultMaxGroups is the default cap on user groups considered during
+// authorization.
+const DefaultMaxGroups = 1000
+
+// groupSet is a set of group names for O(1) membership checks.
+type groupSet map[string]struct{}
+
+func newGroupSet(groups []string) groupSet {
+	s := make(groupSet, len(groups))
+	for _, g := range groups {
+		s[g] = struct{}{}
+	}
+	return s
+}
+
+// containsAny reports whether any of groups is in the set. Only the first
+// limit groups are considered (limit <= 0 means no cap), which bounds the
+// cost of tokens from an IdP that returns tens of thousands of groups;
+// truncated reports whether any were skipped.
+func (s groupSet) containsAny(groups []string, limit int) (found, truncated bool) {
+	if limit > 0 && len(groups) > limit {
+		groups = groups[:limit]
+		truncated = true
+	}
+	for _, g := range groups {
+		if _, ok := s[g]; ok {
+			return true, truncated
+		}
+	}
+	return false, truncated
+}
+
+// secondsUntil returns the whole seconds from now until t, or 0 if t has
+// passed.
+func secondsUntil(t, now time.Time) int64 {
+	return max(int64(t.Sub(now).Seconds()), 0)
 }
 
 // writeJSON writes v as JSON with Content-Type set. Encoding errors are logged but not returned.
@@ -37,48 +254,186 @@ func writeJSON(w http.ResponseWriter, v any) {
 	}
 }
 
+// allowMethod reports whether r uses one of methods. If not, it answers 405
+// with an Allow header listing them. As with http.ServeMux patterns, allowing
+// GET allows HEAD.
+func allowMethod(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if slices.Contains(methods, http.MethodGet) {
+		methods = append(slices.Clip(methods), http.MethodHead)
+	}
+	if slices.Contains(methods, r.Method) {
+		return true
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	apierror.Write(w, http.StatusMethodNotAllowed, apierror.CodeMethodNotAllowed, "Method not allowed")
+	return false
+}
+
 // decodeJSON decodes the request body as JSON into v.
 func decodeJSON(r *http.Request, v any) error {
 	return json.NewDecoder(r.Body).Decode(v)
 }
 
-// Generate creates a kubeconfig for the given user
-func (kg *KubeconfigGenerator) Generate(email, username string) string {
+// isJSONContentType reports whether r declares a JSON body. A request
+// without a Content-Type passes when allowMissing is set.
+func isJSONContentType(r *http.Request, allowMissing bool) bool {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return allowMissing
+	}
+	mediaType, _, err := mime.ParseMediaType(ct)
+	return err == nil && mediaType == "application/json"
+}
+
+// bodyTooLarge reports whether err came from reading past the
+// middleware.MaxBodySize limit.
+func bodyTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// writeDecodeError answers a request whose body decodeJSON rejected: 413 if
+// it was over the size limit, 400 otherwise.
+func writeDecodeError(w http.ResponseWriter, err error) {
+	if bodyTooLarge(err) {
+		apierror.Write(w, http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Request body too large")
+		return
+	}
+	apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Invalid request body")
+}
+
+// kubeconfig is the subset of the kubeconfig format Generate writes.
+type kubeconfig struct {
+	APIVersion     string         `yaml:"apiVersion"`
+	Kind           string         `yaml:"kind"`
+	Clusters       []namedCluster `yaml:"clusters"`
+	Users          []namedUser    `yaml:"users"`
+	Contexts       []namedContext `yaml:"contexts"`
+	CurrentContext string         `yaml:"current-context"`
+}
+
+type namedCluster struct {
+	Name    string  `yaml:"name"`
+	Cluster cluster `yaml:"cluster"`
+}
+
+type cluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	ProxyURL                 string `yaml:"proxy-url,omitempty"`
+	TLSServerName            string `yaml:"tls-server-name,omitempty"`
+}
+
+type namedUser struct {
+	Name string `yaml:"name"`
+	User user   `yaml:"user"`
+}
+
+type user struct {
+	Exec execConfig `yaml:"exec"`
+}
+
+type execConfig struct {
+	APIVersion      string   `yaml:"apiVersion"`
+	Command         string   `yaml:"command"`
+	Args            []string `yaml:"args"`
+	Env             []envVar `yaml:"env,omitempty"`
+	InteractiveMode string   `yaml:"interactiveMode"`
+}
+
+type envVar struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+type namedContext struct {
+	Name    string      `yaml:"name"`
+	Context kubeContext `yaml:"context"`
+}
+
+type kubeContext struct {
+	Cluster   string `yaml:"cluster"`
+	User      string `yaml:"user"`
+	Namespace string `yaml:"namespace"`
+}
+
+// Generate creates a kubeconfig for the user identified by identity (the
+// USERNAME_CLAIM value), naming the context after username if set.
+func (kg *KubeconfigGenerator) Generate(identity, username string) (string, error) {
+	return kg.generate(identity, username)
+}
+
+// GenerateWithCredential is Generate with the cluster credential webhookToken
+// in the exec env (KAUTH_TOKEN, as kauth login --token-in-kubeconfig writes
+// it), so the kubeconfig works without a token cache until expiry.
+func (kg *KubeconfigGenerator) GenerateWithCredential(identity, username, webhookToken string, expiry time.Time) (string, error) {
+	env := []envVar{{Name: "KAUTH_TOKEN", Value: webhookToken}}
+	if !expiry.IsZero() {
+		env = append(env, envVar{Name: "KAUTH_TOKEN_EXPIRY", Value: expiry.UTC().Format(time.RFC3339)})
+	}
+	return kg.generate(identity, username, env...)
+}
+
+func (kg *KubeconfigGenerator) generate(identity, username string, extraEnv ...envVar) (string, error) {
 	if username == "" {
-		if local, _, ok := strings.Cut(email, "@"); ok {
+		if local, _, ok := strings.Cut(identity, "@"); ok {
 			username = local
 		} else {
-			username = email
+			username = identity
 		}
 	}
-	contextName := fmt.Sprintf("%s@%s", username, kg.ClusterName)
-	return fmt.Sprintf(`apiVersion: v1
-kind: Config
-clusters:
-- name: %s
-  cluster:
-    server: %s
-    certificate-authority-data: %s
-users:
-- name: %s
-  user:
-    exec:
-      apiVersion: client.authentication.k8s.io/v1
-      command: kauth
-      args:
-      - get-token
-      interactiveMode: Never
-contexts:
-- name: %s
-  context:
-    cluster: %s
-    user: %s
-    namespace: default
-current-context: %s
-`, kg.ClusterName, kg.ClusterServer, kg.ClusterCA,
-		email,
-		contextName, kg.ClusterName, email,
-		contextName)
+	contextName := fmt.Sprintf("%s%s@%s", kg.UsernamePrefix, username, kg.ClusterName)
+	userName := kg.UsernamePrefix + identity
+
+	var env []envVar
+	if kg.ServerURL != "" {
+		env = []envVar{{Name: "KAUTH_SERVER_URL", Value: kg.ServerURL}}
+	}
+	env = append(env, extraEnv...)
+
+	kc := kubeconfig{
+		APIVersion:     "v1",
+		Kind:           "Config",
+		CurrentContext: contextName,
+		Clusters: []namedCluster{{
+			Name: kg.ClusterName,
+			Cluster: cluster{
+				Server:                   kg.ClusterServer,
+				CertificateAuthorityData: kg.ClusterCA,
+				ProxyURL:                 kg.ClusterProxyURL,
+				TLSServerName:            kg.ClusterTLSServerName,
+			},
+		}},
+		Users: []namedUser{{
+			Name: userName,
+			User: user{Exec: execConfig{
+				APIVersion:      "client.authentication.k8s.io/v1",
+				Command:         "kauth",
+				Args:            []string{"get-token"},
+				Env:             env,
+				InteractiveMode: "Never",
+			}},
+		}},
+		Contexts: []namedContext{{
+			Name:    contextName,
+			Context: kubeContext{Cluster: kg.ClusterName, User: userName, Namespace: "default"},
+		}},
+	}
+	data, err := yaml.Marshal(&kc)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal kubeconfig: %w", err)
+	}
+	return string(data), nil
+}
+
+// sessionIdentity returns the identity a session's kubeconfig is issued
+// for: Spec.UserID, or Status.Email for sessions created before it held the
+// USERNAME_CLAIM value.
+func sessionIdentity(sess *v1alpha1.OAuthSession) string {
+	if sess.Spec.UserID != "" {
+		return sess.Spec.UserID
+	}
+	return sess.Status.Email
 }
 
 // VerifyAndExtractClaims verifies an ID token and extracts claims
@@ -89,10 +444,13 @@ func VerifyAndExtractClaims(ctx context.Context, provider *oauth.Provider, idTok
 	}
 
 	var claims OIDCClaims
-	if err := verified.Claims(&claims); err != nil {
+	if err := provider.Claims(verified, &claims); err != nil {
 		slog.WarnContext(ctx, "failed to extract claims from ID token", "error", err)
 		return nil, nil, fmt.Errorf("failed to extract claims: %w", err)
 	}
+	if err := provider.Claims(verified, &claims.raw); err != nil {
+		return nil, nil, fmt.Errorf("failed to extract claims: %w", err)
+	}
 
 	return &claims, verified, nil
 }
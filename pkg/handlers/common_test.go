@@ -0,0 +1,361 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+	"kauth/pkg/oauth"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestKubeconfigGenerator_Generate(t *testing.T) {
+	type execEnv struct {
+		Name  string `yaml:"name"`
+		Value string `yaml:"value"`
+	}
+	type generated struct {
+		Users []struct {
+			Name string `yaml:"name"`
+			User struct {
+				Exec struct {
+					Command string    `yaml:"command"`
+					Args    []string  `yaml:"args"`
+					Env     []execEnv `yaml:"env"`
+				} `yaml:"exec"`
+			} `yaml:"user"`
+		} `yaml:"users"`
+		CurrentContext string `yaml:"current-context"`
+	}
+
+	tests := []struct {
+		name      string
+		serverURL string
+		wantEnv   []execEnv
+	}{
+		{
+			name:      "server URL exported to exec plugin",
+			serverURL: "https://kauth.example.com",
+			wantEnv:   []execEnv{{Name: "KAUTH_SERVER_URL", Value: "https://kauth.example.com"}},
+		},
+		{
+			name: "no env without server URL",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kg := &KubeconfigGenerator{
+				ClusterName:   "prod",
+				ClusterServer: "https://k8s.example.com",
+				ClusterCA:     "Q0E=",
+				ServerURL:     tt.serverURL,
+			}
+
+			var kc generated
+			data, err := kg.Generate("alice@example.com", "")
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+				t.Fatalf("Generate() produced invalid YAML: %v", err)
+			}
+
+			if len(kc.Users) != 1 {
+				t.Fatalf("got %d users, want 1", len(kc.Users))
+			}
+			exec := kc.Users[0].User.Exec
+			if exec.Command != "kauth" || len(exec.Args) != 1 || exec.Args[0] != "get-token" {
+				t.Errorf("exec = %+v, want kauth get-token", exec)
+			}
+			if len(exec.Env) != len(tt.wantEnv) {
+				t.Fatalf("exec env = %+v, want %+v", exec.Env, tt.wantEnv)
+			}
+			for i := range tt.wantEnv {
+				if exec.Env[i] != tt.wantEnv[i] {
+					t.Errorf("exec env[%d] = %+v, want %+v", i, exec.Env[i], tt.wantEnv[i])
+				}
+			}
+			if kc.CurrentContext != "alice@prod" {
+				t.Errorf("current-context = %q, want %q", kc.CurrentContext, "alice@prod")
+			}
+		})
+	}
+}
+
+func TestKubeconfigGenerator_GenerateClusterOptions(t *testing.T) {
+	type clusterEntry struct {
+		Server        string `yaml:"server"`
+		ProxyURL      string `yaml:"proxy-url"`
+		TLSServerName string `yaml:"tls-server-name"`
+	}
+	type generated struct {
+		Clusters []struct {
+			Cluster clusterEntry `yaml:"cluster"`
+		} `yaml:"clusters"`
+	}
+
+	tests := []struct {
+		name string
+		kg   KubeconfigGenerator
+		want clusterEntry
+	}{
+		{name: "none", want: clusterEntry{Server: "https://10.0.0.1:6443"}},
+		{name: "proxy", kg: KubeconfigGenerator{ClusterProxyURL: "socks5://proxy.example.com:1080"}, want: clusterEntry{Server: "https://10.0.0.1:6443", ProxyURL: "socks5://proxy.example.com:1080"}},
+		{name: "tls server name", kg: KubeconfigGenerator{ClusterTLSServerName: "k8s.example.com"}, want: clusterEntry{Server: "https://10.0.0.1:6443", TLSServerName: "k8s.example.com"}},
+		{name: "both", kg: KubeconfigGenerator{ClusterProxyURL: "http://proxy:3128", ClusterTLSServerName: "k8s.example.com"}, want: clusterEntry{Server: "https://10.0.0.1:6443", ProxyURL: "http://proxy:3128", TLSServerName: "k8s.example.com"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kg := tt.kg
+			kg.ClusterName, kg.ClusterServer = "prod", "https://10.0.0.1:6443"
+			var kc generated
+			data, err := kg.Generate("alice@example.com", "")
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+				t.Fatalf("Generate() produced invalid YAML: %v", err)
+			}
+			if len(kc.Clusters) != 1 || kc.Clusters[0].Cluster != tt.want {
+				t.Errorf("clusters = %+v, want %+v", kc.Clusters, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeconfigGenerator_GenerateNames(t *testing.T) {
+	tests := []struct {
+		name        string
+		prefix      string
+		identity    string
+		username    string
+		wantUser    string
+		wantContext string
+	}{
+		{name: "email", identity: "alice@example.com", wantUser: "alice@example.com", wantContext: "alice@prod"},
+		{name: "preferred username", identity: "alice@example.com", username: "al", wantUser: "alice@example.com", wantContext: "al@prod"},
+		{name: "sub", identity: "248289761001", wantUser: "248289761001", wantContext: "248289761001@prod"},
+		{name: "prefixed email", prefix: "oidc:", identity: "alice@example.com", wantUser: "oidc:alice@example.com", wantContext: "oidc:alice@prod"},
+		{name: "prefixed sub", prefix: "oidc:", identity: "248289761001", wantUser: "oidc:248289761001", wantContext: "oidc:248289761001@prod"},
+		{name: "yaml syntax in claims", identity: "a: \"b\" #c\n- d", username: "[al]", wantUser: "a: \"b\" #c\n- d", wantContext: "[al]@prod"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kg := &KubeconfigGenerator{ClusterName: "prod", ClusterServer: "https://k8s.example.com", UsernamePrefix: tt.prefix}
+
+			var kc struct {
+				Users []struct {
+					Name string `yaml:"name"`
+				} `yaml:"users"`
+				Contexts []struct {
+					Name    string `yaml:"name"`
+					Context struct {
+						User string `yaml:"user"`
+					} `yaml:"context"`
+				} `yaml:"contexts"`
+				CurrentContext string `yaml:"current-context"`
+			}
+			data, err := kg.Generate(tt.identity, tt.username)
+			if err != nil {
+				t.Fatalf("Generate() error = %v", err)
+			}
+			if err := yaml.Unmarshal([]byte(data), &kc); err != nil {
+				t.Fatalf("Generate() produced invalid YAML: %v", err)
+			}
+
+			if len(kc.Users) != 1 || kc.Users[0].Name != tt.wantUser {
+				t.Errorf("users = %+v, want one named %q", kc.Users, tt.wantUser)
+			}
+			if len(kc.Contexts) != 1 || kc.Contexts[0].Name != tt.wantContext || kc.Contexts[0].Context.User != tt.wantUser {
+				t.Errorf("contexts = %+v, want %q using user %q", kc.Contexts, tt.wantContext, tt.wantUser)
+			}
+			if kc.CurrentContext != tt.wantContext {
+				t.Errorf("current-context = %q, want %q", kc.CurrentContext, tt.wantContext)
+			}
+		})
+	}
+}
+
+func TestOIDCClaims_Identity(t *testing.T) {
+	raw := []byte(`{
+		"sub": "248289761001",
+		"email": "alice@example.com",
+		"preferred_username": "alice",
+		"upn": "alice@corp.example.com",
+		"employee_id": 42,
+		"https://myapp/claims": {"uid": "a-1"}
+	}`)
+	var claims OIDCClaims
+	if err := oauth.DecodeClaims(raw, "https://myapp/claims", &claims); err != nil {
+		t.Fatalf("DecodeClaims: %v", err)
+	}
+	if err := oauth.DecodeClaims(raw, "https://myapp/claims", &claims.raw); err != nil {
+		t.Fatalf("DecodeClaims raw: %v", err)
+	}
+
+	tests := []struct {
+		claim string
+		want  string
+	}{
+		{claim: "", want: "alice@example.com"},
+		{claim: "email", want: "alice@example.com"},
+		{claim: "sub", want: "248289761001"},
+		{claim: "preferred_username", want: "alice"},
+		{claim: "upn", want: "alice@corp.example.com"},
+		{claim: "uid", want: "a-1"},
+		{claim: "employee_id", want: ""},
+		{claim: "missing", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.claim, func(t *testing.T) {
+			if got := claims.Identity(tt.claim); got != tt.want {
+				t.Errorf("Identity(%q) = %q, want %q", tt.claim, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionIdentity(t *testing.T) {
+	sess := &v1alpha1.OAuthSession{
+		Spec:   v1alpha1.OAuthSessionSpec{UserID: "248289761001"},
+		Status: v1alpha1.OAuthSessionStatus{Email: "alice@example.com"},
+	}
+	if got := sessionIdentity(sess); got != "248289761001" {
+		t.Errorf("sessionIdentity() = %q, want the user ID", got)
+	}
+
+	// Sessions from before the user ID held the identity fall back to email.
+	sess.Spec.UserID = ""
+	if got := sessionIdentity(sess); got != "alice@example.com" {
+		t.Errorf("sessionIdentity() = %q, want the email", got)
+	}
+}
+
+func TestHandlers_MethodNotAllowed(t *testing.T) {
+	// Zero-value handlers: the method check must come before anything that
+	// would touch their dependencies.
+	login := &LoginHandler{}
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		method    string
+		wantAllow string
+	}{
+		{name: "info", handler: HandleInfo("c", "https://k8s", "", "", "", "https://idp", "kauth", "https://kauth"), method: http.MethodPost, wantAllow: "GET, HEAD"},
+		{name: "login", handler: login.HandleLogin, method: http.MethodPost, wantAllow: "GET, HEAD"},
+		{name: "start-login", handler: login.HandleStartLogin, method: http.MethodPost, wantAllow: "GET, HEAD"},
+		{name: "watch", handler: login.HandleWatch, method: http.MethodDelete, wantAllow: "GET, HEAD"},
+		{name: "callback", handler: login.HandleCallback, method: http.MethodPost, wantAllow: "GET, HEAD"},
+		{name: "exchange", handler: login.HandleExchange, method: http.MethodGet, wantAllow: "POST"},
+		{name: "refresh", handler: (&RefreshHandler{}).HandleRefresh, method: http.MethodGet, wantAllow: "POST"},
+		{name: "revoke", handler: (&RevokeHandler{}).HandleRevoke, method: http.MethodGet, wantAllow: "POST"},
+		{name: "sessions", handler: (&SessionsHandler{}).HandleListSessions, method: http.MethodPost, wantAllow: "GET, HEAD"},
+		{name: "token review", handler: (&WebhookHandler{}).HandleTokenReview, method: http.MethodGet, wantAllow: "POST"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			tt.handler(rr, httptest.NewRequest(tt.method, "/", nil))
+
+			if rr.Code != http.StatusMethodNotAllowed {
+				t.Errorf("status = %d, want 405", rr.Code)
+			}
+			if got := rr.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestEmailVerified(t *testing.T) {
+	tests := []struct {
+		name       string
+		claims     string
+		wantOff    bool
+		wantTrue   bool
+		wantStrict bool
+	}{
+		{name: "verified", claims: `{"email_verified":true}`, wantOff: true, wantTrue: true, wantStrict: true},
+		{name: "unverified", claims: `{"email_verified":false}`, wantOff: true},
+		{name: "missing", claims: `{}`, wantOff: true, wantTrue: true},
+		{name: "verified as string", claims: `{"email_verified":"true"}`, wantOff: true, wantTrue: true, wantStrict: true},
+		{name: "unverified as string", claims: `{"email_verified":"false"}`, wantOff: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims OIDCClaims
+			if err := json.Unmarshal([]byte(tt.claims), &claims); err != nil {
+				t.Fatalf("decode claims: %v", err)
+			}
+			for mode, want := range map[string]bool{
+				VerifiedEmailOff:     tt.wantOff,
+				VerifiedEmailRequire: tt.wantTrue,
+				VerifiedEmailStrict:  tt.wantStrict,
+			} {
+				if got := emailVerified(&claims, mode); got != want {
+					t.Errorf("emailVerified(%s, mode %s) = %v, want %v", tt.claims, mode, got, want)
+				}
+			}
+		})
+	}
+
+	var claims OIDCClaims
+	if err := json.Unmarshal([]byte(`{"email_verified":"maybe"}`), &claims); err == nil {
+		t.Error("decoding email_verified \"maybe\" succeeded")
+	}
+}
+
+func TestRequiredClaims(t *testing.T) {
+	required, err := ParseRequiredClaims(`{"tenant": "acme", "mfa": true, "level": 2, "acr": ["gold", "silver"]}`)
+	if err != nil {
+		t.Fatalf("ParseRequiredClaims() error = %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		claims string
+		want   string
+	}{
+		{name: "match", claims: `{"tenant": "acme", "mfa": true, "level": 2, "acr": "silver"}`},
+		{name: "match with coerced types", claims: `{"tenant": "acme", "mfa": "true", "level": "2", "acr": "gold"}`},
+		{name: "list claim containing a value", claims: `{"tenant": "acme", "mfa": true, "level": 2.0, "acr": ["bronze", "gold"]}`},
+		{name: "mismatch", claims: `{"tenant": "other", "mfa": true, "level": 2, "acr": "gold"}`, want: "tenant"},
+		{name: "mismatched bool", claims: `{"tenant": "acme", "mfa": false, "level": 2, "acr": "gold"}`, want: "mfa"},
+		{name: "missing claim", claims: `{"tenant": "acme", "level": 2, "acr": "gold"}`, want: "mfa"},
+		{name: "object is not comparable", claims: `{"tenant": {"name": "acme"}, "mfa": true, "level": 2, "acr": "gold"}`, want: "tenant"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims map[string]any
+			if err := json.Unmarshal([]byte(tt.claims), &claims); err != nil {
+				t.Fatalf("decode claims: %v", err)
+			}
+			if got := required.mismatch(claims); got != tt.want {
+				t.Errorf("mismatch(%s) = %q, want %q", tt.claims, got, tt.want)
+			}
+		})
+	}
+
+	var none RequiredClaims
+	if got := none.mismatch(map[string]any{}); got != "" {
+		t.Errorf("no required claims: mismatch = %q, want none", got)
+	}
+}
+
+func TestParseRequiredClaims_Invalid(t *testing.T) {
+	for _, s := range []string{`tenant=acme`, `["acme"]`, `{"tenant": {"name": "acme"}}`, `{"acr": []}`, `{"tenant": null}`} {
+		if _, err := ParseRequiredClaims(s); err == nil {
+			t.Errorf("ParseRequiredClaims(%s) succeeded, want error", s)
+		}
+	}
+}
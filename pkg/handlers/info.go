@@ -6,6 +6,9 @@ import "net/http"
 type InfoResponse struct {
 	ClusterName   string `json:"cluster_name"`
 	ClusterServer string `json:"cluster_server"`
+	ClusterCA     string `json:"cluster_ca,omitempty"` // base64 PEM, as in certificate-authority-data
+	ClusterProxy  string `json:"cluster_proxy_url,omitempty"`
+	ClusterTLSSNI string `json:"cluster_tls_server_name,omitempty"`
 	IssuerURL     string `json:"issuer_url"`
 	ClientID      string `json:"client_id"`
 	LoginURL      string `json:"login_url"`
@@ -13,11 +16,17 @@ type InfoResponse struct {
 }
 
 // HandleInfo returns cluster configuration
-func HandleInfo(clusterName, clusterServer, issuerURL, clientID, baseURL string) http.HandlerFunc {
+func HandleInfo(clusterName, clusterServer, clusterCA, clusterProxyURL, clusterTLSServerName, issuerURL, clientID, baseURL string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
 		info := InfoResponse{
 			ClusterName:   clusterName,
 			ClusterServer: clusterServer,
+			ClusterCA:     clusterCA,
+			ClusterProxy:  clusterProxyURL,
+			ClusterTLSSNI: clusterTLSServerName,
 			IssuerURL:     issuerURL,
 			ClientID:      clientID,
 			LoginURL:      baseURL + "/login",
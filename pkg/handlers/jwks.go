@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"encoding/base64"
+	"net/http"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// HandleJWKS serves pub as a JSON Web Key Set so third parties can check
+// that a kauth token (v3 envelope) was signed by this server. Token payloads
+// stay encrypted; the signature only proves origin.
+func HandleJWKS(pub ed25519.PublicKey) (http.HandlerFunc, error) {
+	key := jose.JSONWebKey{Key: pub, Algorithm: string(jose.EdDSA), Use: "sig"}
+	thumbprint, err := key.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+	key.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	set := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key}}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethod(w, r, http.MethodGet) {
+			return
+		}
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		writeJSON(w, set)
+	}, nil
+}
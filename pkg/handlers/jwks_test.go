@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+func TestHandleJWKS(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := HandleJWKS(pub)
+	if err != nil {
+		t.Fatalf("HandleJWKS() error = %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodGet, "/jwks.json", nil))
+
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(rr.Body.Bytes(), &set); err != nil {
+		t.Fatalf("response is not a JWKS: %v\n%s", err, rr.Body.String())
+	}
+	if len(set.Keys) != 1 {
+		t.Fatalf("got %d keys, want 1", len(set.Keys))
+	}
+	key := set.Keys[0]
+	if got, ok := key.Key.(ed25519.PublicKey); !ok || !got.Equal(pub) {
+		t.Errorf("key = %v, want the Ed25519 public key", key.Key)
+	}
+	if key.KeyID == "" || key.Algorithm != "EdDSA" || key.Use != "sig" {
+		t.Errorf("kid/alg/use = %q/%q/%q", key.KeyID, key.Algorithm, key.Use)
+	}
+}
@@ -1,24 +1,34 @@
 package handlers
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"log/slog"
 	"net/http"
-	"slices"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"kauth/pkg/apierror"
 	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
 	"kauth/pkg/audit"
+	"kauth/pkg/clock"
 	"kauth/pkg/jwt"
+	"kauth/pkg/metrics"
+	"kauth/pkg/middleware"
 	"kauth/pkg/oauth"
 	"kauth/pkg/session"
 
+	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 
@@ -32,19 +42,68 @@ type LoginHandler struct {
 	kubeconfigGen   *KubeconfigGenerator
 	sessionTTL      time.Duration
 	refreshTokenTTL time.Duration
+	absoluteTTL     time.Duration // cap on a session's total lifetime across rotations (0 = none)
 	allowedGroups   []string
+	allowedSet      groupSet // allowedGroups as a set, built once at construction
+	maxGroups       int
+
+	// requireVerifiedEmail is the REQUIRE_VERIFIED_EMAIL mode
+	requireVerifiedEmail string
+
+	// requiredClaims are the REQUIRED_CLAIMS every ID token must match
+	requiredClaims RequiredClaims
+
+	// usernameClaim is the USERNAME_CLAIM identifying users
+	usernameClaim string
+
+	// successTemplate replaces the built-in success page when set
+	successTemplate *template.Template
 
 	// CRD client for distributed session storage
-	sessionClient *session.Client
+	sessionClient loginSessionStore
+	informer      sessionInformer
+
+	// pending counts logins in progress; /start-login is refused once it
+	// reaches maxPending (0 = no cap)
+	pending         *pendingSessions
+	maxPending      int
+	cleanupInterval time.Duration
+
+	// uniqueUsers feeds the kauth_unique_users gauge
+	uniqueUsers *uniqueUsers
 
 	// Local SSE listeners (in-memory, per-pod)
 	sseListeners map[string][]chan StatusResponse
 	sseMutex     sync.RWMutex
+
+	// /watch stream timing; a zero keepaliveInterval means the default and
+	// a zero watchMaxDuration means no limit
+	keepaliveInterval time.Duration
+	watchMaxDuration  time.Duration
+
+	// clock supplies the current time for expiry checks and the /watch
+	// timers
+	clock clock.Clock
+}
+
+// loginSessionStore is the subset of *session.Client the login flow needs.
+type loginSessionStore interface {
+	Create(ctx context.Context, sessionID, verifier, userID string) (*v1alpha1.OAuthSession, error)
+	Get(ctx context.Context, sessionID string) (*v1alpha1.OAuthSession, error)
+	UpdateStatus(ctx context.Context, sessionID string, status v1alpha1.OAuthSessionStatus) error
+	UpdateUserID(ctx context.Context, sessionID, userID string) error
+	Delete(ctx context.Context, sessionID string) error
+	ExpireInactiveSessions(ctx context.Context, ttl time.Duration) error
+	CleanupOldSessions(ctx context.Context, ttl time.Duration) error
 }
 
 type StartLoginResponse struct {
 	SessionToken string `json:"session_token"` // JWT containing state & verifier
 	LoginURL     string `json:"login_url"`
+
+	// Nonce is the nonce in LoginURL. CLIs that run the IdP flow
+	// themselves send it to the IdP and post the result to /exchange.
+	Nonce string `json:"nonce"`
 }
 
 type StatusResponse struct {
@@ -55,79 +114,226 @@ type StatusResponse struct {
 	WebhookToken  string    `json:"webhook_token,omitempty"`
 	SessionExpiry time.Time `json:"session_expiry,omitempty"`
 	Error         string    `json:"error,omitempty"`
+
+	RefreshTokenExpiresIn int64 `json:"refresh_token_expires_in,omitempty"` // Seconds until RefreshToken expires
+	SessionExpiresIn      int64 `json:"session_expires_in,omitempty"`       // Seconds until the absolute session TTL (0 = no cap)
+
+	// Warning is shown to the user after login, e.g. when the session
+	// cannot be renewed because the IdP issued no refresh token.
+	Warning string `json:"warning,omitempty"`
 }
 
-func NewLoginHandler(
-	provider *oauth.Provider,
-	jwtManager *jwt.Manager,
-	clusterName, clusterServer, clusterCA string,
-	sessionTTL, refreshTokenTTL time.Duration,
-	allowedGroups []string,
-	sessionClient *session.Client,
-) *LoginHandler {
+// noRefreshTokenWarning is StatusResponse.Warning for a session whose IdP
+// issued no refresh token: kauth refresh cannot renew it, so it ends at
+// expiry (the zero time if unknown).
+func noRefreshTokenWarning(expiry time.Time) string {
+	const msg = "The identity provider did not issue a refresh token, so this session cannot be renewed."
+	if expiry.IsZero() {
+		return msg + " Run kauth login again when it expires."
+	}
+	return msg + " Run kauth login again before " + expiry.UTC().Format("2006-01-02 15:04 MST") + "."
+}
+
+// LoginHandlerOptions configures NewLoginHandler.
+type LoginHandlerOptions struct {
+	Provider      *oauth.Provider
+	JWTManager    *jwt.Manager
+	SessionClient *session.Client
+
+	// Kubeconfig describes the cluster and server written into issued
+	// kubeconfigs.
+	Kubeconfig KubeconfigGenerator
+
+	SessionTTL         time.Duration
+	RefreshTokenTTL    time.Duration
+	AbsoluteSessionTTL time.Duration // cap on a session's total lifetime across rotations (0 = none)
+
+	AllowedGroups        []string
+	MaxGroups            int
+	RequireVerifiedEmail string
+	RequiredClaims       RequiredClaims
+	UsernameClaim        string
+
+	MaxPendingSessions     int
+	CleanupInterval        time.Duration
+	WatchKeepaliveInterval time.Duration
+	WatchMaxDuration       time.Duration
+
+	// SuccessTemplate, if set, replaces the default login success page.
+	SuccessTemplate *template.Template
+
+	// Clock defaults to the system clock.
+	Clock clock.Clock
+}
+
+func NewLoginHandler(opts LoginHandlerOptions) *LoginHandler {
+	kubeconfigGen := opts.Kubeconfig
+	clk := opts.Clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
 	h := &LoginHandler{
-		provider:   provider,
-		jwtManager: jwtManager,
-		kubeconfigGen: &KubeconfigGenerator{
-			ClusterName:   clusterName,
-			ClusterServer: clusterServer,
-			ClusterCA:     clusterCA,
-		},
-		sessionTTL:      sessionTTL,
-		refreshTokenTTL: refreshTokenTTL,
-		allowedGroups:   allowedGroups,
-		sessionClient:   sessionClient,
-		sseListeners:    make(map[string][]chan StatusResponse),
+		provider:        opts.Provider,
+		jwtManager:      opts.JWTManager,
+		kubeconfigGen:   &kubeconfigGen,
+		sessionTTL:      opts.SessionTTL,
+		refreshTokenTTL: opts.RefreshTokenTTL,
+		absoluteTTL:     opts.AbsoluteSessionTTL,
+		allowedGroups:   opts.AllowedGroups,
+		allowedSet:      newGroupSet(opts.AllowedGroups),
+		maxGroups:       opts.MaxGroups,
+		sessionClient:   opts.SessionClient,
+
+		requireVerifiedEmail: opts.RequireVerifiedEmail,
+		requiredClaims:       opts.RequiredClaims,
+		usernameClaim:        opts.UsernameClaim,
+		informer:             opts.SessionClient.NewInformer(0),
+		pending:              newPendingSessions(),
+		uniqueUsers:          newUniqueUsers(),
+		maxPending:           opts.MaxPendingSessions,
+		cleanupInterval:      opts.CleanupInterval,
+		successTemplate:      opts.SuccessTemplate,
+		sseListeners:         make(map[string][]chan StatusResponse),
+
+		keepaliveInterval: opts.WatchKeepaliveInterval,
+		watchMaxDuration:  opts.WatchMaxDuration,
+		clock:             clk,
 	}
 
 	// Start watching for session updates from CRD
 	go h.watchSessions()
 
-	// Cleanup old sessions periodically (30 second TTL)
+	// Cleanup old sessions periodically
 	go h.cleanupSessions()
 
 	return h
 }
 
+// loginCookieName is the cookie carrying the session token of a login
+// started at /login. Such a login keeps no verifier in its OAuthSession, so
+// /callback reads the PKCE verifier from the cookie instead.
+const loginCookieName = "kauth_login"
+
 func (h *LoginHandler) HandleStartLogin(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	sessionID, sessionToken, authURL, ok := h.startLogin(w, r, true)
+	if !ok {
+		return
+	}
+	resp := StartLoginResponse{
+		SessionToken: sessionToken,
+		LoginURL:     authURL,
+		Nonce:        h.jwtManager.Nonce(sessionID),
+	}
+	writeJSON(w, resp)
+}
+
+// HandleLogin starts a login and redirects the browser to the IdP, so a
+// plain link can log a user in without the CLI. The PKCE verifier travels
+// only in the login cookie, and /callback ends the login by offering the
+// browser a kubeconfig rather than handing it to a waiting CLI.
+func (h *LoginHandler) HandleLogin(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	_, sessionToken, authURL, ok := h.startLogin(w, r, false)
+	if !ok {
+		return
+	}
+	// SameSite=Lax: the cookie must survive the top-level redirect back
+	// from the IdP.
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    sessionToken,
+		Path:     "/callback",
+		MaxAge:   int(h.sessionTTL.Seconds()),
+		Secure:   r.TLS != nil || strings.HasPrefix(h.kubeconfigGen.ServerURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+// startLogin creates a login session and returns its ID (the OAuth state),
+// its session token and the IdP URL to send the user to. The PKCE verifier is
+// stored in the session only if storeVerifier is set; otherwise the session
+// token is the sole copy. On failure it writes the error response and
+// returns ok false.
+func (h *LoginHandler) startLogin(w http.ResponseWriter, r *http.Request, storeVerifier bool) (sessionID, sessionToken, authURL string, ok bool) {
+	// Every login creates an OAuthSession that lives until it completes or
+	// is cleaned up, so cap how many can be in flight.
+	if h.maxPending > 0 && h.pending.len() >= h.maxPending {
+		slog.WarnContext(r.Context(), "start-login: too many pending sessions", "max_pending_sessions", h.maxPending)
+		w.Header().Set("Retry-After", strconv.Itoa(int(h.cleanupInterval.Seconds())))
+		apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeTooManyLogins, "Too many logins in progress, try again later")
+		return "", "", "", false
+	}
+
 	// Generate session ID and PKCE verifier
-	sessionID := generateRandomString(32)
+	sessionID = generateRandomString(32)
 	verifier := oauth2.GenerateVerifier()
 
 	// Create stateless session token (JWT)
 	sessionToken, err := h.jwtManager.CreateSessionToken(sessionID, verifier, h.sessionTTL)
 	if err != nil {
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
-		return
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create session")
+		return "", "", "", false
 	}
 
 	// Store session in CRD (distributed across all pods)
 	ctx := r.Context()
-	_, err = h.sessionClient.Create(ctx, sessionID, verifier, "")
+	storedVerifier := ""
+	if storeVerifier {
+		storedVerifier = verifier
+	}
+	_, err = h.sessionClient.Create(ctx, sessionID, storedVerifier, "")
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to create session CRD", "error", err)
-		http.Error(w, "Failed to create session", http.StatusInternalServerError)
-		return
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create session")
+		return "", "", "", false
 	}
+	// Count it now rather than when the watch delivers it, so a burst
+	// against one replica is capped immediately.
+	h.pending.add(sessionID, h.clock.Now())
 
-	// Create OAuth URL with state
-	authURL := h.provider.OAuth2Config.AuthCodeURL(
+	// Create OAuth URL with state, and a nonce bound to it (see jwt.Manager.Nonce)
+	authURL = h.provider.AuthCodeURL(
 		sessionID,
+		verifier,
 		oauth2.AccessTypeOffline,
-		oauth2.S256ChallengeOption(verifier),
+		oidc.Nonce(h.jwtManager.Nonce(sessionID)),
 	)
+	return sessionID, sessionToken, authURL, true
+}
 
-	resp := StartLoginResponse{
-		SessionToken: sessionToken,
-		LoginURL:     authURL,
+// cookieVerifier returns the PKCE verifier from the /login cookie if it holds
+// a valid session token for state, and clears the cookie. A cookie left over
+// from a different login is ignored.
+func (h *LoginHandler) cookieVerifier(w http.ResponseWriter, r *http.Request, state string) string {
+	c, err := r.Cookie(loginCookieName)
+	if err != nil {
+		return ""
 	}
-	writeJSON(w, resp)
+	sessionToken, err := h.jwtManager.ValidateSessionToken(c.Value)
+	if err != nil || sessionToken.SessionID != state {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookieName, Path: "/callback", MaxAge: -1})
+	return sessionToken.Verifier
 }
 
 func (h *LoginHandler) HandleWatch(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+
 	sessionToken := r.URL.Query().Get("session_token")
 	if sessionToken == "" {
-		http.Error(w, "No session_token specified", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "No session_token specified")
 		return
 	}
 
@@ -136,9 +342,9 @@ func (h *LoginHandler) HandleWatch(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		slog.WarnContext(r.Context(), "watch: failed to validate session token", "error", err)
 		if errors.Is(err, jwt.ErrExpiredToken) {
-			http.Error(w, "Session expired", http.StatusUnauthorized)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeSessionExpired, "Session expired")
 		} else {
-			http.Error(w, "Invalid session token", http.StatusUnauthorized)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid session token")
 		}
 		return
 	}
@@ -150,7 +356,7 @@ func (h *LoginHandler) HandleWatch(w http.ResponseWriter, r *http.Request) {
 	flusher, ok := w.(http.Flusher)
 	if !ok {
 		slog.ErrorContext(ctx, "watch: streaming not supported")
-		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Streaming unsupported")
 		return
 	}
 
@@ -184,9 +390,9 @@ func (h *LoginHandler) HandleWatch(w http.ResponseWriter, r *http.Request) {
 	crdSession, err := h.sessionClient.Get(ctx, sessionID)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
-			http.Error(w, "Session not found or expired", http.StatusNotFound)
+			apierror.Write(w, http.StatusNotFound, apierror.CodeSessionNotFound, "Session not found or expired")
 		} else {
-			http.Error(w, "Failed to get session", http.StatusInternalServerError)
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to get session")
 		}
 		return
 	}
@@ -196,9 +402,19 @@ func (h *LoginHandler) HandleWatch(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
+	metrics.SSEConnections.Inc()
+	metrics.SSEActiveListeners.Inc()
+	defer metrics.SSEActiveListeners.Dec()
+
 	// If already active, send immediately.
 	if crdSession.Status.Phase == v1alpha1.SessionActive {
-		kubeconfig := h.kubeconfigGen.Generate(crdSession.Status.Email, crdSession.Status.Username)
+		kubeconfig, err := h.kubeconfigGen.Generate(sessionIdentity(crdSession), crdSession.Status.Username)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to generate kubeconfig", "session", sessionID[:min(8, len(sessionID))], "error", err)
+			h.sendFinalStatus(w, flusher, &StatusResponse{Ready: false, Error: "Failed to generate kubeconfig"})
+			metrics.SSEDisconnects.WithLabel(metrics.DisconnectCompleted).Inc()
+			return
+		}
 		status := StatusResponse{
 			Ready:        true,
 			Kubeconfig:   kubeconfig,
@@ -206,90 +422,195 @@ func (h *LoginHandler) HandleWatch(w http.ResponseWriter, r *http.Request) {
 			SessionID:    crdSession.Spec.SessionID,
 			WebhookToken: crdSession.Status.WebhookToken,
 		}
-		if crdSession.Status.WebhookToken != "" {
-			if wt, err := h.jwtManager.DecodeWebhookToken(crdSession.Status.WebhookToken); err == nil {
-				status.SessionExpiry = wt.ExpiresAt
-			}
-		}
-		h.sendFinalStatus(w, &status)
+		h.setExpiries(&status, h.clock.Now())
+		h.sendFinalStatus(w, flusher, &status)
+		metrics.SSEDisconnects.WithLabel(metrics.DisconnectCompleted).Inc()
 		return
 	}
 
 	// If there's an error, send immediately.
 	if crdSession.Status.Error != "" {
-		h.sendFinalStatus(w, &StatusResponse{Ready: false, Error: crdSession.Status.Error})
+		h.sendFinalStatus(w, flusher, &StatusResponse{Ready: false, Error: crdSession.Status.Error})
+		metrics.SSEDisconnects.WithLabel(metrics.DisconnectCompleted).Inc()
 		return
 	}
 
-	// Send a keepalive every 5 seconds. This must stay well below any
-	// intermediate proxy idle timeout (e.g. Envoy's connectionIdleTimeout)
-	// so the long-lived stream is never reaped while waiting for login.
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
+	// Send a keepalive every keepaliveInterval (default 5 seconds). This
+	// must stay well below any intermediate proxy idle timeout (e.g. Envoy's
+	// connectionIdleTimeout) so the long-lived stream is never reaped while
+	// waiting for login.
+	keepalive := h.keepaliveInterval
+	if keepalive <= 0 {
+		keepalive = DefaultWatchKeepaliveInterval
+	}
+	ticker, stopTicker := h.clock.NewTicker(keepalive)
+	defer stopTicker()
+
+	// End streams abandoned by a closed terminal or browser tab rather than
+	// holding the goroutine until the client goes away.
+	var deadline <-chan time.Time
+	if h.watchMaxDuration > 0 {
+		deadline = h.clock.After(h.watchMaxDuration)
+	}
 
 	for {
 		select {
 		case status := <-listener:
-			data, _ := json.Marshal(status)
-			_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
-			flusher.Flush()
+			h.sendFinalStatus(w, flusher, &status)
+			metrics.SSEDisconnects.WithLabel(metrics.DisconnectCompleted).Inc()
 			return
-		case <-ticker.C:
-			_, _ = fmt.Fprintf(w, ": keepalive\n\n")
+		case <-deadline:
+			h.sendFinalStatus(w, flusher, &StatusResponse{Ready: false, Error: WatchTimeoutMessage})
+			metrics.SSEDisconnects.WithLabel(metrics.DisconnectTimeout).Inc()
+			return
+		case <-ticker:
+			if _, err := fmt.Fprintf(w, ": keepalive\n\n"); err != nil {
+				metrics.SSEDisconnects.WithLabel(metrics.DisconnectKeepaliveFail).Inc()
+				return
+			}
 			flusher.Flush()
 		case <-r.Context().Done():
+			metrics.SSEDisconnects.WithLabel(metrics.DisconnectClient).Inc()
 			return
 		}
 	}
 }
 
-func (h *LoginHandler) sendFinalStatus(w http.ResponseWriter, status *StatusResponse) {
+// Defaults for the /watch stream.
+const (
+	DefaultWatchKeepaliveInterval = 5 * time.Second
+	DefaultWatchMaxDuration       = 15 * time.Minute
+)
+
+// MaxWatchKeepaliveInterval is the longest allowed /watch keepalive period.
+// The CLI reconnects after 30s without a line, so this leaves room for two
+// keepalives to be delayed before a healthy stream is dropped.
+const MaxWatchKeepaliveInterval = 10 * time.Second
+
+// WatchTimeoutMessage is the error sent when a /watch stream reaches its
+// maximum duration before the login completes.
+const WatchTimeoutMessage = "login timed out"
+
+// setExpiries fills the expiry fields of status from its webhook and refresh
+// tokens, and warns if the refresh token carries no IdP refresh token.
+func (h *LoginHandler) setExpiries(status *StatusResponse, now time.Time) {
+	if status.WebhookToken != "" {
+		if wt, err := h.jwtManager.DecodeWebhookToken(status.WebhookToken); err == nil {
+			status.SessionExpiry = wt.ExpiresAt
+		}
+	}
+	if status.RefreshToken != "" {
+		if rt, err := h.jwtManager.DecodeRefreshToken(status.RefreshToken); err == nil {
+			status.RefreshTokenExpiresIn = secondsUntil(rt.ExpiresAt, now)
+			if h.absoluteTTL > 0 {
+				status.SessionExpiresIn = secondsUntil(rt.SessionStart().Add(h.absoluteTTL), now)
+			}
+			if rt.OIDCRefreshToken == "" {
+				status.Warning = noRefreshTokenWarning(status.SessionExpiry)
+			}
+		}
+	}
+}
+
+// sessionWarning returns the Warning of a StatusResponse for a session
+// holding refreshToken and webhookToken, for the success page.
+func (h *LoginHandler) sessionWarning(refreshToken, webhookToken string) string {
+	status := StatusResponse{RefreshToken: refreshToken, WebhookToken: webhookToken}
+	h.setExpiries(&status, h.clock.Now())
+	return status.Warning
+}
+
+// sendFinalStatus writes status as the stream's last SSE event and flushes
+// it, so the CLI sees the result before the handler returns and the
+// connection closes.
+func (h *LoginHandler) sendFinalStatus(w http.ResponseWriter, flusher http.Flusher, status *StatusResponse) {
 	data, _ := json.Marshal(status)
-	_, _ = fmt.Fprintf(w, "data: %s\n\n", data)
-	if f, ok := w.(http.Flusher); ok {
-		f.Flush()
+	if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+		slog.Warn("watch: failed to write final status", "error", err)
+		return
 	}
+	flusher.Flush()
 }
 
 func (h *LoginHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		renderErrorPage(w, http.StatusMethodNotAllowed, callbackErrInvalidRequest)
+		return
+	}
+	if len(r.URL.RawQuery) > maxCallbackQuerySize {
+		renderErrorPage(w, http.StatusRequestURITooLong, callbackErrInvalidRequest)
+		return
+	}
+
 	state := r.URL.Query().Get("state")
 	if state == "" {
-		http.Error(w, "Missing state", http.StatusBadRequest)
+		renderErrorPage(w, http.StatusBadRequest, callbackErrInvalidRequest)
 		return
 	}
 
 	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
 	defer cancel()
+	clientIP := middleware.ClientIP(r)
 
 	// Get session from CRD to retrieve verifier
 	crdSession, err := h.sessionClient.Get(ctx, state)
 	if err != nil {
 		if apierrors.IsNotFound(err) {
-			http.Error(w, "Session not found or expired", http.StatusBadRequest)
+			renderErrorPage(w, http.StatusBadRequest, callbackErrSessionExpired)
 		} else {
-			http.Error(w, "Failed to get session", http.StatusInternalServerError)
+			renderErrorPage(w, http.StatusInternalServerError, callbackErrInternal)
 		}
 		return
 	}
 
+	// A second callback for the same state (browser refresh, double submit)
+	// must not re-exchange the already-spent code or overwrite the result the
+	// first callback stored. Report the outcome of the first one instead. A
+	// callback that races past this check still cannot overwrite the result:
+	// UpdateStatus refuses a failure over a settled session.
+	switch {
+	case crdSession.Status.Phase == v1alpha1.SessionActive:
+		slog.InfoContext(ctx, "callback: session already completed", "session", state[:min(8, len(state))])
+		h.renderSuccessPage(w, crdSession.Status.Email, h.sessionWarning(crdSession.Status.RefreshToken, crdSession.Status.WebhookToken))
+		return
+	case crdSession.Status.Phase == v1alpha1.SessionRevoked || crdSession.Status.Phase == v1alpha1.SessionExpired:
+		renderErrorPage(w, http.StatusBadRequest, callbackErrSessionExpired)
+		return
+	case crdSession.Status.Error != "":
+		renderErrorPage(w, http.StatusBadRequest, callbackErrAlreadyFailed)
+		return
+	}
+
+	// A login started at /login keeps its verifier in the browser's cookie
+	// and has no CLI watching for the result.
 	verifier := crdSession.Spec.Verifier
+	browserLogin := verifier == ""
+	if browserLogin {
+		verifier = h.cookieVerifier(w, r, state)
+	}
 	if verifier == "" {
 		_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
 			Phase: v1alpha1.SessionPending,
 			Error: "Invalid session",
 		})
-		http.Error(w, "Invalid session", http.StatusInternalServerError)
+		renderErrorPage(w, http.StatusInternalServerError, callbackErrInternal)
 		return
 	}
 
 	// Handle OAuth errors
 	if errParam := r.URL.Query().Get("error"); errParam != "" {
-		errDesc := r.URL.Query().Get("error_description")
+		// Both values come from whoever sent the browser here, not
+		// necessarily the IdP, so they are bounded and stripped of control
+		// characters before reaching logs and the CLI.
+		errParam = sanitizeReflected(errParam, maxCallbackErrorLen)
+		errDesc := sanitizeReflected(r.URL.Query().Get("error_description"), maxCallbackErrorDescriptionLen)
+		slog.WarnContext(ctx, "callback: IdP returned an error", "error", errParam, "error_description", errDesc, "session", state[:min(8, len(state))], "client_ip", clientIP)
 		_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
 			Phase: v1alpha1.SessionPending,
 			Error: fmt.Sprintf("%s: %s", errParam, errDesc),
 		})
-		http.Error(w, errParam, http.StatusBadRequest)
+		renderErrorPage(w, http.StatusBadRequest, callbackErrIdPDenied)
 		return
 	}
 
@@ -299,25 +620,20 @@ func (h *LoginHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 			Phase: v1alpha1.SessionPending,
 			Error: "No authorization code returned",
 		})
-		http.Error(w, "No code returned", http.StatusBadRequest)
+		renderErrorPage(w, http.StatusBadRequest, callbackErrIdPDenied)
 		return
 	}
 
-	httpClient := oauth.NewMetricsHTTPClient("token_exchange")
-	ctxWithClient := context.WithValue(ctx, oauth2.HTTPClient, httpClient)
-
-	token, err := h.provider.OAuth2Config.Exchange(
-		ctxWithClient,
-		code,
-		oauth2.VerifierOption(verifier),
-	)
+	// The exchange and the verification below each get their own deadline
+	// (OIDC_EXCHANGE_TIMEOUT, OIDC_VERIFY_TIMEOUT) within the callback's.
+	token, err := h.provider.Exchange(ctx, code, oauth2.VerifierOption(verifier))
 	if err != nil {
 		slog.ErrorContext(ctx, "token exchange failed", "error", err)
 		_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
 			Phase: v1alpha1.SessionPending,
 			Error: "Token exchange failed",
 		})
-		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		renderErrorPage(w, http.StatusInternalServerError, callbackErrAuthFailed)
 		return
 	}
 
@@ -327,30 +643,74 @@ func (h *LoginHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 			Phase: v1alpha1.SessionPending,
 			Error: "No ID token returned",
 		})
-		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		renderErrorPage(w, http.StatusInternalServerError, callbackErrAuthFailed)
 		return
 	}
 
-	claims, _, err := VerifyAndExtractClaims(ctx, h.provider, idToken)
+	claims, verified, err := VerifyAndExtractClaims(ctx, h.provider, idToken)
 	if err != nil {
-		slog.ErrorContext(ctx, "ID token verification failed", "error", err)
+		slog.ErrorContext(ctx, "ID token verification failed", "error", err, "client_ip", clientIP)
+		_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
+			Phase: v1alpha1.SessionPending,
+			Error: "Token verification failed",
+		})
+		renderErrorPage(w, http.StatusInternalServerError, callbackErrAuthFailed)
+		return
+	}
+
+	// The ID token must carry the nonce derived from this callback's state;
+	// otherwise it was issued for a different login.
+	if err := h.jwtManager.VerifyNonce(state, verified.Nonce); err != nil {
+		slog.WarnContext(ctx, "ID token nonce does not match state", "user", claims.Email, "session", state[:min(8, len(state))], "client_ip", clientIP)
 		_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
 			Phase: v1alpha1.SessionPending,
 			Error: "Token verification failed",
 		})
-		http.Error(w, "Authentication failed", http.StatusInternalServerError)
+		renderErrorPage(w, http.StatusBadRequest, callbackErrAuthFailed)
+		return
+	}
+
+	identity := claims.Identity(h.usernameClaim)
+	if identity == "" {
+		slog.WarnContext(ctx, "ID token has no username claim", "claim", h.usernameClaim, "sub", claims.Sub, "client_ip", clientIP)
+		_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
+			Phase: v1alpha1.SessionPending,
+			Error: "Token has no " + h.usernameClaim + " claim",
+		})
+		renderErrorPage(w, http.StatusBadRequest, callbackErrAuthFailed)
+		return
+	}
+
+	if !emailVerified(claims, h.requireVerifiedEmail) {
+		audit.LoginDenied(ctx, r, claims.Email, claims.Groups, emailUnverifiedReason)
+		_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
+			Phase: v1alpha1.SessionPending,
+			Error: "Email address is not verified",
+		})
+		renderErrorPage(w, http.StatusForbidden, callbackErrEmailUnverified)
+		return
+	}
+
+	if claim := h.requiredClaims.mismatch(claims.raw); claim != "" {
+		audit.LoginDenied(ctx, r, claims.Email, claims.Groups, claimMismatchReason)
+		slog.WarnContext(ctx, "login denied: required claim not matched", "user", claims.Email, "claim", claim, "client_ip", clientIP)
+		_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
+			Phase: v1alpha1.SessionPending,
+			Error: "Token claim " + claim + " does not have a required value",
+		})
+		renderErrorPage(w, http.StatusForbidden, callbackErrClaimMismatch)
 		return
 	}
 
 	// Validate group membership if required
 	if len(h.allowedGroups) > 0 {
 		if !h.isUserAuthorized(claims.Groups) {
-			audit.AuthorizationDeny(ctx, r, claims.Email, claims.Groups, h.allowedGroups)
+			audit.LoginDenied(ctx, r, claims.Email, claims.Groups, "not a member of an allowed group")
 			_ = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
 				Phase: v1alpha1.SessionPending,
 				Error: "User is not a member of allowed groups",
 			})
-			http.Error(w, "Forbidden: user not in allowed groups", http.StatusForbidden)
+			renderErrorPage(w, http.StatusForbidden, callbackErrForbidden)
 			return
 		}
 		audit.AuthorizationAllow(ctx, r, claims.Email, claims.Groups)
@@ -359,6 +719,7 @@ func (h *LoginHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	// Log successful authentication
 	audit.LoginSuccess(ctx, r, claims.Email, h.kubeconfigGen.ClusterName, claims.Groups)
 	slog.InfoContext(ctx, "Authentication successful",
+		"client_ip", clientIP,
 		"user", claims.Email,
 		"name", claims.Name,
 		"sub", claims.Sub,
@@ -368,7 +729,7 @@ func (h *LoginHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 
 	// Create refresh token (contains OIDC refresh token encrypted)
 	refreshToken, err := h.jwtManager.CreateRefreshToken(
-		claims.Email,
+		identity,
 		token.RefreshToken,
 		state,
 		0,
@@ -379,7 +740,7 @@ func (h *LoginHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 			Phase: v1alpha1.SessionPending,
 			Error: "Failed to create refresh token",
 		})
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		renderErrorPage(w, http.StatusInternalServerError, callbackErrInternal)
 		return
 	}
 
@@ -389,10 +750,16 @@ func (h *LoginHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 			Phase: v1alpha1.SessionPending,
 			Error: "Failed to create webhook token",
 		})
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		renderErrorPage(w, http.StatusInternalServerError, callbackErrInternal)
 		return
 	}
 
+	// Set the user ID first: the kubeconfig sent to watchers once the
+	// session turns active is issued for it.
+	if err := h.sessionClient.UpdateUserID(ctx, state, identity); err != nil {
+		slog.WarnContext(ctx, "failed to set session user ID", "session", state[:8], "error", err)
+	}
+
 	err = h.sessionClient.UpdateStatus(ctx, state, v1alpha1.OAuthSessionStatus{
 		Phase:        v1alpha1.SessionActive,
 		Email:        claims.Email,
@@ -403,167 +770,512 @@ func (h *LoginHandler) HandleCallback(w http.ResponseWriter, r *http.Request) {
 	})
 	if err != nil {
 		slog.ErrorContext(ctx, "failed to update session status", "error", err)
-		http.Error(w, "Internal error", http.StatusInternalServerError)
+		renderErrorPage(w, http.StatusInternalServerError, callbackErrInternal)
 		return
 	}
 
-	if err := h.sessionClient.UpdateUserID(ctx, state, claims.Email); err != nil {
-		slog.WarnContext(ctx, "failed to set session user ID", "session", state[:8], "error", err)
+	if browserLogin {
+		h.renderBrowserLoginPage(w, identity, claims.PreferredUsername, refreshToken, webhookToken)
+		return
 	}
+	h.renderSuccessPage(w, claims.Email, h.sessionWarning(refreshToken, webhookToken))
+}
 
-	// Render success page
-	w.Header().Set("Content-Type", "text/html")
-	_ = hh.Doctype(
+// renderBrowserLoginPage ends a login started at /login. No CLI is waiting
+// for the session, so the page offers a kubeconfig carrying the cluster
+// credential for the user to save.
+func (h *LoginHandler) renderBrowserLoginPage(w http.ResponseWriter, identity, username, refreshToken, webhookToken string) {
+	status := StatusResponse{RefreshToken: refreshToken, WebhookToken: webhookToken}
+	h.setExpiries(&status, h.clock.Now())
+	kubeconfig, err := h.kubeconfigGen.GenerateWithCredential(identity, username, webhookToken, status.SessionExpiry)
+	if err != nil {
+		slog.Error("failed to generate kubeconfig for browser login", "error", err)
+		renderErrorPage(w, http.StatusInternalServerError, callbackErrInternal)
+		return
+	}
+	renderKubeconfigPage(w, kubeconfig, status.SessionExpiry)
+}
+
+// ExchangeRequest is the /exchange body: tokens the CLI obtained from the IdP
+// itself (kauth login --flow browser or device), and the session token from
+// the /start-login that began the login.
+type ExchangeRequest struct {
+	SessionToken string `json:"session_token"`
+	IDToken      string `json:"id_token"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// HandleExchange completes a login started with /start-login using tokens
+// the CLI obtained directly from the IdP, for users whose environment blocks
+// the server's redirect flow. The ID token must carry the nonce /start-login
+// returned, which ties it to a login this server started; the session is
+// single-use like a callback's. A refresh token is redeemed once with the
+// IdP before it is stored, so only a live one for the same subject is
+// accepted. The response is the same final status /watch sends.
+func (h *LoginHandler) HandleExchange(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	var req ExchangeRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeDecodeError(w, err)
+		return
+	}
+	if req.IDToken == "" || req.SessionToken == "" {
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Missing id_token or session_token")
+		return
+	}
+
+	// Bounded by REQUEST_TIMEOUT, with OIDC_VERIFY_TIMEOUT and
+	// OIDC_EXCHANGE_TIMEOUT applied to the IdP calls within it.
+	ctx := r.Context()
+	clientIP := middleware.ClientIP(r)
+
+	sessionJWT, err := h.jwtManager.ValidateSessionToken(req.SessionToken)
+	if err != nil {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid or expired session token")
+		return
+	}
+	sessionID := sessionJWT.SessionID
+	crdSession, err := h.sessionClient.Get(ctx, sessionID)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			apierror.Write(w, http.StatusNotFound, apierror.CodeSessionNotFound, "Login session not found or expired")
+		} else {
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to load session")
+		}
+		return
+	}
+	if crdSession.Status.Phase != v1alpha1.SessionPending || crdSession.Status.Error != "" {
+		apierror.Write(w, http.StatusConflict, apierror.CodeInvalidRequest, "Login session already completed")
+		return
+	}
+
+	claims, verified, err := VerifyAndExtractClaims(ctx, h.provider, req.IDToken)
+	if err != nil {
+		slog.WarnContext(ctx, "exchange: ID token verification failed", "error", err, "client_ip", clientIP)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid or expired token")
+		return
+	}
+	// As in the callback: an ID token without the nonce derived from this
+	// session's state was not issued for this login.
+	if err := h.jwtManager.VerifyNonce(sessionID, verified.Nonce); err != nil {
+		slog.WarnContext(ctx, "exchange: ID token nonce does not match session", "user", claims.Email, "session", sessionID[:min(8, len(sessionID))], "client_ip", clientIP)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "ID token was not issued for this login")
+		return
+	}
+	identity := claims.Identity(h.usernameClaim)
+	if identity == "" {
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Token must contain "+h.usernameClaim+" claim")
+		return
+	}
+	if !emailVerified(claims, h.requireVerifiedEmail) {
+		audit.LoginDenied(ctx, r, claims.Email, claims.Groups, emailUnverifiedReason)
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "Email address is not verified")
+		return
+	}
+	if claim := h.requiredClaims.mismatch(claims.raw); claim != "" {
+		audit.LoginDenied(ctx, r, claims.Email, claims.Groups, claimMismatchReason)
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "Token claim "+claim+" does not have a required value")
+		return
+	}
+
+	if len(h.allowedGroups) > 0 {
+		if !h.isUserAuthorized(claims.Groups) {
+			audit.LoginDenied(ctx, r, claims.Email, claims.Groups, "not a member of an allowed group")
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "User is not a member of allowed groups")
+			return
+		}
+		audit.AuthorizationAllow(ctx, r, claims.Email, claims.Groups)
+	}
+
+	oidcRefreshToken, err := h.redeemRefreshToken(ctx, req.RefreshToken, claims.Sub)
+	if err != nil {
+		slog.WarnContext(ctx, "exchange: refresh token rejected", "user", claims.Email, "error", err, "client_ip", clientIP)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid refresh token")
+		return
+	}
+
+	refreshToken, err := h.jwtManager.CreateRefreshToken(identity, oidcRefreshToken, sessionID, 0, h.refreshTokenTTL)
+	if err != nil {
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create refresh token")
+		return
+	}
+	webhookToken, err := h.jwtManager.CreateWebhookToken(sessionID, h.refreshTokenTTL)
+	if err != nil {
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create webhook token")
+		return
+	}
+
+	if err := h.sessionClient.UpdateUserID(ctx, sessionID, identity); err != nil {
+		slog.WarnContext(ctx, "exchange: failed to set session user ID", "session", sessionID[:min(8, len(sessionID))], "error", err)
+	}
+	err = h.sessionClient.UpdateStatus(ctx, sessionID, v1alpha1.OAuthSessionStatus{
+		Phase:        v1alpha1.SessionActive,
+		Email:        claims.Email,
+		Username:     claims.PreferredUsername,
+		RefreshToken: refreshToken,
+		Groups:       claims.Groups,
+		WebhookToken: webhookToken,
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "exchange: failed to update session status", "error", err)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create session")
+		return
+	}
+
+	audit.LoginSuccess(ctx, r, claims.Email, h.kubeconfigGen.ClusterName, claims.Groups)
+	slog.InfoContext(ctx, "Authentication successful via token exchange",
+		"client_ip", clientIP,
+		"user", claims.Email,
+		"sub", claims.Sub,
+		"groups", claims.Groups,
+		"cluster", h.kubeconfigGen.ClusterName,
+	)
+
+	kubeconfig, err := h.kubeconfigGen.Generate(identity, claims.PreferredUsername)
+	if err != nil {
+		slog.ErrorContext(ctx, "exchange: failed to generate kubeconfig", "error", err)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to generate kubeconfig")
+		return
+	}
+	status := StatusResponse{
+		Ready:        true,
+		Kubeconfig:   kubeconfig,
+		RefreshToken: refreshToken,
+		SessionID:    sessionID,
+		WebhookToken: webhookToken,
+	}
+	h.setExpiries(&status, h.clock.Now())
+	writeJSON(w, status)
+}
+
+// redeemRefreshToken refreshes with refreshToken once, proving the IdP
+// still honours it for subject, and returns the refresh token to store:
+// the rotated one, or the original if the IdP does not rotate. An empty
+// refreshToken is returned as is.
+func (h *LoginHandler) redeemRefreshToken(ctx context.Context, refreshToken, subject string) (string, error) {
+	if refreshToken == "" {
+		return "", nil
+	}
+	token, err := h.provider.Refresh(ctx, refreshToken)
+	if err != nil {
+		return "", err
+	}
+	if idToken, ok := token.Extra("id_token").(string); ok && idToken != "" {
+		claims, _, err := VerifyAndExtractClaims(ctx, h.provider, idToken)
+		if err != nil {
+			return "", err
+		}
+		if claims.Sub != subject {
+			return "", fmt.Errorf("refresh token belongs to subject %q, not %q", claims.Sub, subject)
+		}
+	}
+	return token.RefreshToken, nil
+}
+
+// renderSuccessPage writes the HTML page shown in the browser once the OAuth
+// flow has completed, using the custom template if one was configured.
+// warning, if set, is the session's StatusResponse.Warning.
+func (h *LoginHandler) renderSuccessPage(w http.ResponseWriter, email, warning string) {
+	if h.successTemplate == nil {
+		renderDefaultSuccessPage(w, warning)
+		return
+	}
+
+	var clusterName string
+	if h.kubeconfigGen != nil {
+		clusterName = h.kubeconfigGen.ClusterName
+	}
+
+	// Render into a buffer so a failing template does not leave the browser
+	// with half a page.
+	var buf bytes.Buffer
+	if err := h.successTemplate.Execute(&buf, SuccessPageData{ClusterName: clusterName, UserEmail: email, Warning: warning}); err != nil {
+		slog.Error("failed to render success template, using built-in page", "error", err)
+		renderDefaultSuccessPage(w, warning)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(buf.Bytes())
+}
+
+// statusPageCSS styles the built-in success and error pages.
+const statusPageCSS = `
+	* {
+		margin: 0;
+		padding: 0;
+		box-sizing: border-box;
+	}
+	body {
+		font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
+		background: linear-gradient(135deg, #1a1a2e 0%, #16213e 100%);
+		min-height: 100vh;
+		display: flex;
+		align-items: center;
+		justify-content: center;
+		color: #e0e0e0;
+	}
+	.container {
+		max-width: 500px;
+		width: 100%;
+		padding: 40px;
+		text-align: center;
+	}
+	.success-icon {
+		width: 80px;
+		height: 80px;
+		margin: 0 auto 30px;
+		border-radius: 50%;
+		background: linear-gradient(135deg, #00d2ff 0%, #3a7bd5 100%);
+		display: flex;
+		align-items: center;
+		justify-content: center;
+		animation: scaleIn 0.5s ease-out;
+	}
+	.error-icon {
+		background: linear-gradient(135deg, #ff6b6b 0%, #c0392b 100%);
+	}
+	.success-icon svg {
+		width: 50px;
+		height: 50px;
+		stroke: white;
+		stroke-width: 3;
+		stroke-linecap: round;
+		stroke-linejoin: round;
+		fill: none;
+		animation: drawCheck 0.5s ease-out 0.3s forwards;
+		stroke-dasharray: 50;
+		stroke-dashoffset: 50;
+	}
+	@keyframes scaleIn {
+		from {
+			transform: scale(0);
+			opacity: 0;
+		}
+		to {
+			transform: scale(1);
+			opacity: 1;
+		}
+	}
+	@keyframes drawCheck {
+		to {
+			stroke-dashoffset: 0;
+		}
+	}
+	h1 {
+		color: #ffffff;
+		font-size: 28px;
+		margin-bottom: 15px;
+		font-weight: 600;
+	}
+	p {
+		color: #b0b0b0;
+		font-size: 16px;
+		line-height: 1.6;
+		margin-bottom: 15px;
+	}
+	.info {
+		background: rgba(255, 255, 255, 0.05);
+		border: 1px solid rgba(255, 255, 255, 0.1);
+		border-radius: 8px;
+		padding: 20px;
+		margin: 30px 0;
+	}
+	.info p {
+		color: #90caf9;
+		font-size: 14px;
+		margin: 0;
+	}
+	.info.warning p {
+		color: #ffd54f;
+	}
+	.progress-container {
+		width: 100%;
+		height: 4px;
+		background: rgba(255, 255, 255, 0.1);
+		border-radius: 2px;
+		overflow: hidden;
+		margin-top: 30px;
+	}
+	.progress-bar {
+		height: 100%;
+		background: linear-gradient(90deg, #00d2ff 0%, #3a7bd5 100%);
+		border-radius: 2px;
+		animation: progress 5s linear forwards;
+	}
+	@keyframes progress {
+		from {
+			width: 100%;
+		}
+		to {
+			width: 0%;
+		}
+	}
+	.timer {
+		color: #808080;
+		font-size: 12px;
+		margin-top: 10px;
+	}
+	.download {
+		display: inline-block;
+		padding: 10px 20px;
+		border-radius: 6px;
+		background: linear-gradient(135deg, #00d2ff 0%, #3a7bd5 100%);
+		color: #ffffff;
+		text-decoration: none;
+		font-weight: 600;
+	}
+	.kubeconfig {
+		margin-top: 20px;
+		padding: 15px;
+		max-height: 300px;
+		overflow: auto;
+		text-align: left;
+		font-size: 12px;
+		background: rgba(0, 0, 0, 0.3);
+		border-radius: 8px;
+	}
+`
+
+// statusPage lays out a built-in page: a centred container with an icon,
+// heading and message, followed by extra body nodes.
+func statusPage(title string, head []c.Node, iconClass, iconSVG, heading, message string, body ...c.Node) c.Node {
+	return hh.Doctype(
 		hh.HTML(
 			hh.Head(
 				hh.Meta(c.Attr("charset", "UTF-8")),
 				hh.Meta(c.Attr("name", "viewport"), c.Attr("content", "width=device-width, initial-scale=1.0")),
-				hh.TitleEl(c.Text("Authentication Successful")),
-				hh.StyleEl(c.Raw(`
-					* {
-						margin: 0;
-						padding: 0;
-						box-sizing: border-box;
-					}
-					body {
-						font-family: -apple-system, BlinkMacSystemFont, 'Segoe UI', Roboto, Oxygen, Ubuntu, Cantarell, sans-serif;
-						background: linear-gradient(135deg, #1a1a2e 0%, #16213e 100%);
-						min-height: 100vh;
-						display: flex;
-						align-items: center;
-						justify-content: center;
-						color: #e0e0e0;
-					}
-					.container {
-						max-width: 500px;
-						width: 100%;
-						padding: 40px;
-						text-align: center;
-					}
-					.success-icon {
-						width: 80px;
-						height: 80px;
-						margin: 0 auto 30px;
-						border-radius: 50%;
-						background: linear-gradient(135deg, #00d2ff 0%, #3a7bd5 100%);
-						display: flex;
-						align-items: center;
-						justify-content: center;
-						animation: scaleIn 0.5s ease-out;
-					}
-					.success-icon svg {
-						width: 50px;
-						height: 50px;
-						stroke: white;
-						stroke-width: 3;
-						stroke-linecap: round;
-						stroke-linejoin: round;
-						fill: none;
-						animation: drawCheck 0.5s ease-out 0.3s forwards;
-						stroke-dasharray: 50;
-						stroke-dashoffset: 50;
-					}
-					@keyframes scaleIn {
-						from {
-							transform: scale(0);
-							opacity: 0;
-						}
-						to {
-							transform: scale(1);
-							opacity: 1;
-						}
-					}
-					@keyframes drawCheck {
-						to {
-							stroke-dashoffset: 0;
-						}
-					}
-					h1 {
-						color: #ffffff;
-						font-size: 28px;
-						margin-bottom: 15px;
-						font-weight: 600;
-					}
-					p {
-						color: #b0b0b0;
-						font-size: 16px;
-						line-height: 1.6;
-						margin-bottom: 15px;
-					}
-					.info {
-						background: rgba(255, 255, 255, 0.05);
-						border: 1px solid rgba(255, 255, 255, 0.1);
-						border-radius: 8px;
-						padding: 20px;
-						margin: 30px 0;
-					}
-					.info p {
-						color: #90caf9;
-						font-size: 14px;
-						margin: 0;
-					}
-					.progress-container {
-						width: 100%;
-						height: 4px;
-						background: rgba(255, 255, 255, 0.1);
-						border-radius: 2px;
-						overflow: hidden;
-						margin-top: 30px;
-					}
-					.progress-bar {
-						height: 100%;
-						background: linear-gradient(90deg, #00d2ff 0%, #3a7bd5 100%);
-						border-radius: 2px;
-						animation: progress 5s linear forwards;
-					}
-					@keyframes progress {
-						from {
-							width: 100%;
-						}
-						to {
-							width: 0%;
-						}
-					}
-					.timer {
-						color: #808080;
-						font-size: 12px;
-						margin-top: 10px;
-					}
-				`)),
-				hh.Script(c.Raw(`
-					let timeLeft = 5;
-					const timerEl = document.getElementById('timer');
-
-					const countdown = setInterval(function() {
-						timeLeft--;
-						if (timerEl) {
-							timerEl.textContent = timeLeft;
-						}
-						if (timeLeft <= 0) {
-							clearInterval(countdown);
-							window.close();
-						}
-					}, 1000);
-				`)),
+				hh.TitleEl(c.Text(title)),
+				hh.StyleEl(c.Raw(statusPageCSS)),
+				c.Group(head),
 			),
 			hh.Body(
 				hh.Div(c.Attr("class", "container"),
-					hh.Div(c.Attr("class", "success-icon"),
-						c.Raw(`<svg viewBox="0 0 50 50"><path d="M 10 25 L 20 35 L 40 15"></path></svg>`),
-					),
-					hh.H1(c.Text("Authentication Successful!")),
-					hh.P(c.Text("You can close this window and return to your terminal.")),
-					hh.Div(c.Attr("class", "progress-container"),
-						hh.Div(c.Attr("class", "progress-bar")),
-					),
-					hh.Div(c.Attr("class", "timer"),
-						c.Text("Window closes in "),
-						hh.Span(c.Attr("id", "timer"), c.Text("5")),
-						c.Text(" seconds"),
+					hh.Div(c.Attr("class", iconClass),
+						c.Raw(iconSVG),
 					),
+					hh.H1(c.Text(heading)),
+					hh.P(c.Text(message)),
+					c.Group(body),
 				),
 			),
 		),
+	)
+}
+
+// renderDefaultSuccessPage writes the built-in success page, showing
+// warning, if set, above the countdown.
+func renderDefaultSuccessPage(w http.ResponseWriter, warning string) {
+	w.Header().Set("Content-Type", "text/html")
+	_ = statusPage("Authentication Successful",
+		[]c.Node{hh.Script(c.Raw(`
+			let timeLeft = 5;
+			const timerEl = document.getElementById('timer');
+
+			const countdown = setInterval(function() {
+				timeLeft--;
+				if (timerEl) {
+					timerEl.textContent = timeLeft;
+				}
+				if (timeLeft <= 0) {
+					clearInterval(countdown);
+					window.close();
+				}
+			}, 1000);
+		`))},
+		"success-icon", `<svg viewBox="0 0 50 50"><path d="M 10 25 L 20 35 L 40 15"></path></svg>`,
+		"Authentication Successful!",
+		"You can close this window and return to your terminal.",
+		c.If(warning != "", hh.Div(c.Attr("class", "info warning"), hh.P(c.Text(warning)))),
+		hh.Div(c.Attr("class", "progress-container"),
+			hh.Div(c.Attr("class", "progress-bar")),
+		),
+		hh.Div(c.Attr("class", "timer"),
+			c.Text("Window closes in "),
+			hh.Span(c.Attr("id", "timer"), c.Text("5")),
+			c.Text(" seconds"),
+		),
+	).Render(w)
+}
+
+// renderKubeconfigPage writes the built-in page ending a browser-only login:
+// the kubeconfig to download, valid until expiry (unknown if zero).
+func renderKubeconfigPage(w http.ResponseWriter, kubeconfig string, expiry time.Time) {
+	validity := "Log in again when it expires."
+	if !expiry.IsZero() {
+		validity = "It works until " + expiry.UTC().Format("2006-01-02 15:04 MST") + "; log in again after that."
+	}
+	// The page carries a credential.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/html")
+	_ = statusPage("Authentication Successful", nil,
+		"success-icon", `<svg viewBox="0 0 50 50"><path d="M 10 25 L 20 35 L 40 15"></path></svg>`,
+		"Authentication Successful!",
+		"Save this kubeconfig to use the cluster with kubectl, which runs kauth get-token from it. "+validity,
+		hh.Div(c.Attr("class", "info warning"), hh.P(c.Text("It contains your credential: anyone who can read the file can use the cluster as you."))),
+		hh.A(hh.Href("data:application/yaml;base64,"+base64.StdEncoding.EncodeToString([]byte(kubeconfig))),
+			c.Attr("class", "download"), c.Attr("download", "kubeconfig"), c.Text("Download kubeconfig")),
+		hh.Pre(c.Attr("class", "kubeconfig"), c.Text(kubeconfig)),
+	).Render(w)
+}
+
+// Failure categories shown on the callback error page. They describe what
+// went wrong without exposing internal error details.
+const (
+	callbackErrInvalidRequest  = "The login link is invalid."
+	callbackErrSessionExpired  = "This login session was not found or has expired."
+	callbackErrAlreadyFailed   = "Authentication already failed for this login session."
+	callbackErrIdPDenied       = "The identity provider did not complete the login."
+	callbackErrAuthFailed      = "Authentication with the identity provider failed."
+	callbackErrForbidden       = "Your account is not a member of a group allowed to use this cluster."
+	callbackErrEmailUnverified = "Your email address has not been verified with the identity provider."
+	callbackErrClaimMismatch   = "Your account does not meet this cluster's access requirements."
+	callbackErrInternal        = "An internal error occurred."
+)
+
+// Limits on the callback query. A real IdP redirect carries a code and
+// state well under maxCallbackQuerySize; error and error_description are
+// reflected into logs and the session status, so they are cut shorter.
+const (
+	maxCallbackQuerySize           = 8 << 10
+	maxCallbackErrorLen            = 64
+	maxCallbackErrorDescriptionLen = 256
+)
+
+// sanitizeReflected drops control characters (newlines, ANSI escapes) from
+// an untrusted value and truncates it to at most maxLen runes.
+func sanitizeReflected(s string, maxLen int) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			continue
+		}
+		if n == maxLen {
+			b.WriteString("…")
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+	return b.String()
+}
+
+// renderErrorPage writes the built-in page shown in the browser when the
+// OAuth callback fails. message should be one of the callbackErr categories.
+func renderErrorPage(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = statusPage("Authentication Failed", nil,
+		"success-icon error-icon", `<svg viewBox="0 0 50 50"><path d="M 15 15 L 35 35 M 35 15 L 15 35"></path></svg>`,
+		"Authentication Failed",
+		message,
+		hh.Div(c.Attr("class", "info"),
+			hh.P(c.Text("Return to your terminal for details, then run kauth login to try again.")),
+		),
 	).Render(w)
 }
 
@@ -581,11 +1293,9 @@ func (h *LoginHandler) isUserAuthorized(userGroups []string) bool {
 	}
 
 	// Check if user has any of the allowed groups
-	for _, userGroup := range userGroups {
-		if slices.Contains(h.allowedGroups, userGroup) {
-			return true
-		}
+	found, truncated := h.allowedSet.containsAny(userGroups, h.maxGroups)
+	if truncated {
+		slog.Warn("user group list truncated for authorization", "groups", len(userGroups), "max_groups", h.maxGroups)
 	}
-
-	return false
+	return found
 }
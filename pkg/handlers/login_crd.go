@@ -3,161 +3,96 @@ package handlers
 import (
 	"context"
 	"log/slog"
-	"net/http"
-	"time"
 
 	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
-
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/watch"
+	"kauth/pkg/session"
 )
 
-// watchIdleTimeout is how long to wait without any event (including bookmarks)
-// before treating the stream as stalled and reconnecting. VPN middleboxes can
-// half-close the TCP socket without EOF, so the range loop would block forever
-// without this safety net. Bookmarks arrive at most every ~60 s on a healthy
-// stream; 90 s gives enough headroom to avoid false positives.
-const watchIdleTimeout = 90 * time.Second
+// sessionInformer is the subset of *session.Informer watchSessions needs.
+type sessionInformer interface {
+	AddEventHandler(h session.EventHandler) error
+	Run(stopCh <-chan struct{})
+}
 
+// watchSessions feeds OAuthSession changes from the informer to the pending
+// count and to local /watch listeners. The informer relists after any
+// disconnect, so a session completed while the stream was down is still
+// delivered, and the listener notified, once it reconnects.
 func (h *LoginHandler) watchSessions() {
-	var resourceVersion string
-	first := true
+	err := h.informer.AddEventHandler(session.EventHandler{
+		OnUpdate: h.sessionUpdated,
+		OnDelete: func(s *v1alpha1.OAuthSession) { h.pending.remove(s.Spec.SessionID) },
+	})
+	if err != nil {
+		slog.Error("Failed to watch OAuthSession CRDs", "error", err)
+		return
+	}
+	slog.Info("Started watching OAuthSession CRDs")
+	h.informer.Run(make(chan struct{}))
+}
 
-	for {
-		ctx := context.Background()
-		watcher, err := h.sessionClient.Watch(ctx, resourceVersion)
-		if err != nil {
-			slog.Error("Failed to start session watch", "error", err)
-			time.Sleep(5 * time.Second)
-			continue
-		}
+// sessionUpdated handles an added or modified session.
+func (h *LoginHandler) sessionUpdated(sess *v1alpha1.OAuthSession) {
+	h.pending.observe(sess)
+	h.uniqueUsers.observe(sess)
 
-		if first {
-			slog.Info("Started watching OAuthSession CRDs")
-			first = false
-		} else {
-			slog.Info("Session watch restarted", "resourceVersion", resourceVersion)
-		}
+	if sess.Status.Phase != v1alpha1.SessionActive && sess.Status.Error == "" {
+		return
+	}
+	sessionID := sess.Spec.SessionID
 
-		idleTimer := time.NewTimer(watchIdleTimeout)
-	eventLoop:
-		for {
-			select {
-			case event, ok := <-watcher.ResultChan():
-				if !ok {
-					break eventLoop
-				}
-				if !idleTimer.Stop() {
-					select {
-					case <-idleTimer.C:
-					default:
-					}
-				}
-				idleTimer.Reset(watchIdleTimeout)
-
-				if event.Type == watch.Error {
-					if status, ok := event.Object.(*metav1.Status); ok {
-						slog.Error("Session watch error", "code", status.Code, "message", status.Message)
-						if status.Code == http.StatusGone {
-							resourceVersion = ""
-						}
-					} else {
-						slog.Error("Session watch error", "event", event.Object)
-					}
-					watcher.Stop()
-					break eventLoop
-				}
-
-				if event.Type == watch.Bookmark {
-					if obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(event.Object); err == nil {
-						if rv, ok := obj["metadata"].(map[string]any)["resourceVersion"].(string); ok && rv != "" {
-							resourceVersion = rv
-						}
-					}
-					continue
-				}
-
-				if event.Type == watch.Modified || event.Type == watch.Added {
-					unstructuredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(event.Object)
-					if err != nil {
-						slog.Error("Failed to convert session to unstructured", "error", err)
-						continue
-					}
-
-					if rv, ok := unstructuredMap["metadata"].(map[string]any)["resourceVersion"].(string); ok && rv != "" {
-						resourceVersion = rv
-					}
-
-					var session v1alpha1.OAuthSession
-					if err = runtime.DefaultUnstructuredConverter.FromUnstructured(unstructuredMap, &session); err != nil {
-						slog.Error("Failed to convert session from unstructured", "error", err)
-						continue
-					}
-
-					if session.Status.Phase == v1alpha1.SessionActive || session.Status.Error != "" {
-						sessionID := session.Spec.SessionID
-
-						h.sseMutex.Lock()
-						src := h.sseListeners[sessionID]
-						listeners := make([]chan StatusResponse, len(src))
-						copy(listeners, src)
-						h.sseMutex.Unlock()
-
-						slog.Info("Session went Active, checking for local listeners", "session", sessionID[:min(8, len(sessionID))], "listeners", len(listeners))
-
-						if len(listeners) > 0 {
-							var kubeconfig string
-							if session.Status.Phase == v1alpha1.SessionActive && session.Status.Email != "" {
-								kubeconfig = h.kubeconfigGen.Generate(session.Status.Email, session.Status.Username)
-							}
-
-							status := StatusResponse{
-								Ready:        session.Status.Phase == v1alpha1.SessionActive,
-								Kubeconfig:   kubeconfig,
-								RefreshToken: session.Status.RefreshToken,
-								SessionID:    session.Spec.SessionID,
-								WebhookToken: session.Status.WebhookToken,
-								Error:        session.Status.Error,
-							}
-							if session.Status.WebhookToken != "" {
-								if wt, err := h.jwtManager.DecodeWebhookToken(session.Status.WebhookToken); err == nil {
-									status.SessionExpiry = wt.ExpiresAt
-								}
-							}
-
-							slog.Info("Notifying local listeners for session", "session", sessionID[:min(8, len(sessionID))], "count", len(listeners))
-
-							for _, listener := range listeners {
-								select {
-								case listener <- status:
-								default:
-								}
-							}
-						}
-					}
-				}
-
-			case <-idleTimer.C:
-				slog.Debug("Session watch idle, reconnecting")
-				watcher.Stop()
-				break eventLoop
-			}
+	h.sseMutex.Lock()
+	src := h.sseListeners[sessionID]
+	listeners := make([]chan StatusResponse, len(src))
+	copy(listeners, src)
+	h.sseMutex.Unlock()
+
+	if len(listeners) == 0 {
+		return
+	}
+
+	var kubeconfig string
+	if sess.Status.Phase == v1alpha1.SessionActive && sessionIdentity(sess) != "" {
+		var err error
+		if kubeconfig, err = h.kubeconfigGen.Generate(sessionIdentity(sess), sess.Status.Username); err != nil {
+			slog.Error("Failed to generate kubeconfig", "session", sessionID[:min(8, len(sessionID))], "error", err)
+			return
 		}
-		idleTimer.Stop()
+	}
 
-		slog.Debug("Session watch closed, restarting...")
-		time.Sleep(1 * time.Second)
+	status := StatusResponse{
+		Ready:        sess.Status.Phase == v1alpha1.SessionActive,
+		Kubeconfig:   kubeconfig,
+		RefreshToken: sess.Status.RefreshToken,
+		SessionID:    sess.Spec.SessionID,
+		WebhookToken: sess.Status.WebhookToken,
+		Error:        sess.Status.Error,
+	}
+	h.setExpiries(&status, h.clock.Now())
+
+	slog.Info("Notifying local listeners for session", "session", sessionID[:min(8, len(sessionID))], "count", len(listeners))
+
+	for _, listener := range listeners {
+		select {
+		case listener <- status:
+		default:
+		}
 	}
 }
 
 func (h *LoginHandler) cleanupSessions() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
+	ticks, stop := h.clock.NewTicker(h.cleanupInterval)
+	defer stop()
 
-	for range ticker.C {
+	for range ticks {
 		ctx := context.Background()
 
+		// Pending sessions older than this have been (or are about to be)
+		// deleted by CleanupOldSessions below.
+		now := h.clock.Now()
+		h.pending.prune(now.Add(-h.sessionTTL - h.cleanupInterval))
+		h.uniqueUsers.prune(now)
+
 		err := h.sessionClient.ExpireInactiveSessions(ctx, h.refreshTokenTTL)
 		if err != nil {
 			slog.Error("Failed to expire inactive sessions", "error", err)
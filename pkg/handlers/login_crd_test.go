@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+	"kauth/pkg/clock"
+	"kauth/pkg/session"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// fakeInformer replays events to the registered handler when Run starts,
+// as a real informer does with its initial list.
+type fakeInformer struct {
+	handler session.EventHandler
+	updates []*v1alpha1.OAuthSession
+	deletes []*v1alpha1.OAuthSession
+}
+
+func (f *fakeInformer) AddEventHandler(h session.EventHandler) error {
+	f.handler = h
+	return nil
+}
+
+func (f *fakeInformer) Run(stopCh <-chan struct{}) {
+	for _, s := range f.updates {
+		f.handler.OnUpdate(s)
+	}
+	for _, s := range f.deletes {
+		f.handler.OnDelete(s)
+	}
+	<-stopCh
+}
+
+func TestWatchSessions_NotifiesListeners(t *testing.T) {
+	// Identified by USERNAME_CLAIM=sub, without an email claim.
+	completed := &v1alpha1.OAuthSession{
+		ObjectMeta: metav1.ObjectMeta{Name: "session-1234", ResourceVersion: "42"},
+		Spec:       v1alpha1.OAuthSessionSpec{SessionID: "session-1234", UserID: "user-1"},
+		Status:     v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive},
+	}
+	abandoned := &v1alpha1.OAuthSession{
+		Spec:   v1alpha1.OAuthSessionSpec{SessionID: "session-5678", CreatedAt: metav1.Now()},
+		Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+	}
+
+	listener := make(chan StatusResponse, 1)
+	h := &LoginHandler{
+		informer: &fakeInformer{
+			updates: []*v1alpha1.OAuthSession{abandoned, completed},
+			deletes: []*v1alpha1.OAuthSession{abandoned},
+		},
+		kubeconfigGen: &KubeconfigGenerator{ClusterName: "prod", ClusterServer: "https://k8s.example.com"},
+		sseListeners:  map[string][]chan StatusResponse{"session-1234": {listener}},
+		pending:       newPendingSessions(),
+		uniqueUsers:   newUniqueUsers(),
+		clock:         clock.Real{},
+	}
+	go h.watchSessions()
+
+	select {
+	case status := <-listener:
+		if !status.Ready || status.Kubeconfig == "" {
+			t.Errorf("status = %+v, want ready with kubeconfig", status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener not notified of the completed session")
+	}
+
+	deadline := time.After(5 * time.Second)
+	for h.pending.len() != 0 {
+		select {
+		case <-deadline:
+			t.Fatalf("pending = %d after delete, want 0", h.pending.len())
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
+
+// cleanupStore records the TTLs the cleanup loop passes to the store.
+type cleanupStore struct {
+	fakeLoginStore
+	expired chan time.Duration
+	cleaned chan time.Duration
+}
+
+func (s *cleanupStore) ExpireInactiveSessions(_ context.Context, ttl time.Duration) error {
+	s.expired <- ttl
+	return nil
+}
+
+func (s *cleanupStore) CleanupOldSessions(_ context.Context, ttl time.Duration) error {
+	s.cleaned <- ttl
+	return nil
+}
+
+func TestCleanupSessions_RunsOnClockTicks(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clk := clock.NewFakeClock(start)
+	store := &cleanupStore{expired: make(chan time.Duration, 1), cleaned: make(chan time.Duration, 1)}
+	h := &LoginHandler{
+		sessionClient:   store,
+		sessionTTL:      5 * time.Minute,
+		refreshTokenTTL: 24 * time.Hour,
+		cleanupInterval: 30 * time.Second,
+		pending:         newPendingSessions(),
+		uniqueUsers:     newUniqueUsers(),
+		clock:           clk,
+	}
+	h.pending.add("stale", start.Add(-time.Hour))
+	h.pending.add("fresh", start)
+	go h.cleanupSessions()
+
+	deadline := time.After(5 * time.Second)
+	for clk.Waiters() == 0 {
+		select {
+		case <-deadline:
+			t.Fatal("cleanup loop did not start its ticker")
+		case <-time.After(time.Millisecond):
+		}
+	}
+	select {
+	case <-store.expired:
+		t.Fatal("cleanup ran before the clock reached the interval")
+	default:
+	}
+
+	clk.Advance(30 * time.Second)
+	select {
+	case ttl := <-store.expired:
+		if ttl != h.refreshTokenTTL {
+			t.Errorf("ExpireInactiveSessions ttl = %v, want %v", ttl, h.refreshTokenTTL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ExpireInactiveSessions not called after the interval")
+	}
+	select {
+	case ttl := <-store.cleaned:
+		if ttl != h.sessionTTL {
+			t.Errorf("CleanupOldSessions ttl = %v, want %v", ttl, h.sessionTTL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CleanupOldSessions not called after the interval")
+	}
+	if h.pending.len() != 1 {
+		t.Errorf("pending = %d after cleanup, want 1 (the fresh session)", h.pending.len())
+	}
+}
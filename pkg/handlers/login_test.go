@@ -1,10 +1,41 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+	"kauth/pkg/clock"
+	"kauth/pkg/metrics"
+	"kauth/pkg/oauth"
+	"kauth/pkg/session"
+
+	"golang.org/x/oauth2"
 )
 
+// newAuthzHandler builds a LoginHandler with only its authorization fields
+// set, as NewLoginHandler would.
+func newAuthzHandler(allowedGroups []string, maxGroups int) *LoginHandler {
+	return &LoginHandler{
+		allowedGroups: allowedGroups,
+		allowedSet:    newGroupSet(allowedGroups),
+		maxGroups:     maxGroups,
+	}
+}
+
 func TestLoginHandler_isUserAuthorized(t *testing.T) {
 	tests := []struct {
 		name          string
@@ -100,9 +131,7 @@ func TestLoginHandler_isUserAuthorized(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			h := &LoginHandler{
-				allowedGroups: tt.allowedGroups,
-			}
+			h := newAuthzHandler(tt.allowedGroups, 0)
 
 			got := h.isUserAuthorized(tt.userGroups)
 			if got != tt.want {
@@ -115,27 +144,21 @@ func TestLoginHandler_isUserAuthorized(t *testing.T) {
 
 func TestLoginHandler_isUserAuthorizedEdgeCases(t *testing.T) {
 	t.Run("nil allowed groups - allows all", func(t *testing.T) {
-		h := &LoginHandler{
-			allowedGroups: nil,
-		}
+		h := newAuthzHandler(nil, 0)
 		if !h.isUserAuthorized([]string{"any-group"}) {
 			t.Errorf("nil allowedGroups should allow all users")
 		}
 	})
 
 	t.Run("empty strings in groups", func(t *testing.T) {
-		h := &LoginHandler{
-			allowedGroups: []string{""},
-		}
+		h := newAuthzHandler([]string{""}, 0)
 		if !h.isUserAuthorized([]string{""}) {
 			t.Errorf("empty string should match empty string")
 		}
 	})
 
 	t.Run("special characters in group names", func(t *testing.T) {
-		h := &LoginHandler{
-			allowedGroups: []string{"group/admin", "group:developers"},
-		}
+		h := newAuthzHandler([]string{"group/admin", "group:developers"}, 0)
 		if !h.isUserAuthorized([]string{"group/admin"}) {
 			t.Errorf("special characters should be matched exactly")
 		}
@@ -145,9 +168,7 @@ func TestLoginHandler_isUserAuthorizedEdgeCases(t *testing.T) {
 	})
 
 	t.Run("unicode characters in group names", func(t *testing.T) {
-		h := &LoginHandler{
-			allowedGroups: []string{"管理者", "разработчики"},
-		}
+		h := newAuthzHandler([]string{"管理者", "разработчики"}, 0)
 		if !h.isUserAuthorized([]string{"管理者"}) {
 			t.Errorf("unicode characters should be matched exactly")
 		}
@@ -155,9 +176,7 @@ func TestLoginHandler_isUserAuthorizedEdgeCases(t *testing.T) {
 
 	t.Run("very long group names", func(t *testing.T) {
 		longGroup := string(make([]byte, 10000))
-		h := &LoginHandler{
-			allowedGroups: []string{longGroup},
-		}
+		h := newAuthzHandler([]string{longGroup}, 0)
 		if !h.isUserAuthorized([]string{longGroup}) {
 			t.Errorf("long group names should be matched")
 		}
@@ -173,12 +192,1049 @@ func TestLoginHandler_isUserAuthorizedPerformance(t *testing.T) {
 
 	userGroups := []string{"group-999"} // Last group
 
-	h := &LoginHandler{
-		allowedGroups: allowedGroups,
-	}
+	h := newAuthzHandler(allowedGroups, 0)
 
 	// Should still complete quickly
 	if !h.isUserAuthorized(userGroups) {
 		t.Errorf("should find group-999 in allowed groups")
 	}
+
+	t.Run("pathological user group count", func(t *testing.T) {
+		// 50k user groups against 1000 allowed groups: a nested scan would
+		// be 50M comparisons per login; the set keeps it linear.
+		manyUserGroups := make([]string, 50000)
+		for i := range manyUserGroups {
+			manyUserGroups[i] = fmt.Sprintf("idp-group-%d", i)
+		}
+		manyUserGroups[len(manyUserGroups)-1] = "group-500"
+
+		h := newAuthzHandler(allowedGroups, 0)
+
+		start := time.Now()
+		if !h.isUserAuthorized(manyUserGroups) {
+			t.Errorf("should find group-500 at the end of an uncapped group list")
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("isUserAuthorized took %v for 50k groups", elapsed)
+		}
+	})
+}
+
+func TestLoginHandler_isUserAuthorizedMaxGroups(t *testing.T) {
+	userGroups := []string{"a", "b", "c", "admins"}
+
+	tests := []struct {
+		name      string
+		maxGroups int
+		want      bool
+	}{
+		{name: "no cap", maxGroups: 0, want: true},
+		{name: "cap covers match", maxGroups: 4, want: true},
+		{name: "match beyond cap is ignored", maxGroups: 3, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := newAuthzHandler([]string{"admins"}, tt.maxGroups)
+			if got := h.isUserAuthorized(userGroups); got != tt.want {
+				t.Errorf("isUserAuthorized() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGroupSet_ContainsAny(t *testing.T) {
+	set := newGroupSet([]string{"admins", "developers"})
+
+	if found, truncated := set.containsAny([]string{"x", "developers"}, 0); !found || truncated {
+		t.Errorf("containsAny() = %v, %v; want true, false", found, truncated)
+	}
+	if found, _ := set.containsAny([]string{"Admins"}, 0); found {
+		t.Error("containsAny() matched case-insensitively, want exact match")
+	}
+	if found, truncated := set.containsAny([]string{"x", "y", "admins"}, 2); found || !truncated {
+		t.Errorf("containsAny() = %v, %v; want false, true", found, truncated)
+	}
+	if found, _ := newGroupSet(nil).containsAny([]string{"admins"}, 0); found {
+		t.Error("empty set should contain nothing")
+	}
+}
+
+// fakeLoginStore implements loginSessionStore for callback tests. Status
+// updates follow the same transition rules as session.Client.
+type fakeLoginStore struct {
+	mu            sync.Mutex
+	session       *v1alpha1.OAuthSession
+	statusUpdates int
+}
+
+// Create stores a new pending session unless the test supplied one.
+func (f *fakeLoginStore) Create(_ context.Context, sessionID, verifier, userID string) (*v1alpha1.OAuthSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.session == nil {
+		f.session = &v1alpha1.OAuthSession{
+			Spec:   v1alpha1.OAuthSessionSpec{SessionID: sessionID, Verifier: verifier, UserID: userID},
+			Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+		}
+	}
+	return f.session, nil
+}
+
+func (f *fakeLoginStore) Get(_ context.Context, _ string) (*v1alpha1.OAuthSession, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	s := *f.session
+	return &s, nil
+}
+
+func (f *fakeLoginStore) UpdateStatus(_ context.Context, _ string, status v1alpha1.OAuthSessionStatus) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := session.CheckStatusTransition(f.session.Status, status); err != nil {
+		return err
+	}
+	f.statusUpdates++
+	f.session.Status = status
+	return nil
+}
+
+func (f *fakeLoginStore) UpdateUserID(_ context.Context, _, _ string) error { return nil }
+
+func (f *fakeLoginStore) Delete(_ context.Context, _ string) error { return nil }
+
+func (f *fakeLoginStore) ExpireInactiveSessions(_ context.Context, _ time.Duration) error { return nil }
+
+func (f *fakeLoginStore) CleanupOldSessions(_ context.Context, _ time.Duration) error { return nil }
+
+func TestHandleExchange_RejectsBadRequests(t *testing.T) {
+	// provider is nil: a request that got as far as verification would panic.
+	h := &LoginHandler{sessionClient: &fakeLoginStore{}}
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{name: "wrong method", method: http.MethodGet, want: http.StatusMethodNotAllowed},
+		{name: "invalid JSON", method: http.MethodPost, body: "{", want: http.StatusBadRequest},
+		{name: "missing id_token", method: http.MethodPost, body: `{"session_token":"s","refresh_token":"r"}`, want: http.StatusBadRequest},
+		{name: "missing session_token", method: http.MethodPost, body: `{"id_token":"i"}`, want: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/exchange", strings.NewReader(tt.body))
+			rr := httptest.NewRecorder()
+			h.HandleExchange(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleCallback_CompletedSessionIsIdempotent(t *testing.T) {
+	store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+		Spec: v1alpha1.OAuthSessionSpec{SessionID: "state-123", Verifier: "verifier"},
+		Status: v1alpha1.OAuthSessionStatus{
+			Phase:        v1alpha1.SessionActive,
+			Email:        "user@example.com",
+			RefreshToken: "original-refresh-token",
+		},
+	}}
+	// provider is nil: any attempt to re-exchange the code would panic.
+	h := &LoginHandler{jwtManager: newTestJWTManager(t), sessionClient: store, clock: clock.Real{}}
+
+	for i := range 2 {
+		req := httptest.NewRequest(http.MethodGet, "/callback?state=state-123&code=spent-code", nil)
+		rr := httptest.NewRecorder()
+		h.HandleCallback(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("callback %d: status = %d, want 200", i+1, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), "Authentication Successful") {
+			t.Errorf("callback %d: expected success page, got %q", i+1, rr.Body.String())
+		}
+	}
+
+	if store.statusUpdates != 0 {
+		t.Errorf("status updated %d times, want 0", store.statusUpdates)
+	}
+	if store.session.Status.RefreshToken != "original-refresh-token" {
+		t.Errorf("refresh token overwritten: %q", store.session.Status.RefreshToken)
+	}
+}
+
+// racingStore interleaves two callbacks for the same state the way that
+// used to lose a completed login: both read the pending session before
+// either writes, and the losing callback's failure is written only after the
+// winner stored Active.
+type racingStore struct {
+	*fakeLoginStore
+	read   sync.WaitGroup
+	active chan struct{}
+}
+
+func (s *racingStore) Get(ctx context.Context, sessionID string) (*v1alpha1.OAuthSession, error) {
+	sess, err := s.fakeLoginStore.Get(ctx, sessionID)
+	s.read.Done()
+	s.read.Wait()
+	return sess, err
+}
+
+func (s *racingStore) UpdateStatus(ctx context.Context, sessionID string, status v1alpha1.OAuthSessionStatus) error {
+	if status.Phase == v1alpha1.SessionActive {
+		defer close(s.active)
+	} else {
+		select {
+		case <-s.active:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return s.fakeLoginStore.UpdateStatus(ctx, sessionID, status)
+}
+
+func TestHandleCallback_ConcurrentCallbacksKeepActive(t *testing.T) {
+	idp := newStubIdP(t)
+	jm := newTestJWTManager(t)
+	store := &racingStore{
+		fakeLoginStore: &fakeLoginStore{session: &v1alpha1.OAuthSession{
+			Spec:   v1alpha1.OAuthSessionSpec{SessionID: "state-123", Verifier: "verifier"},
+			Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+		}},
+		active: make(chan struct{}),
+	}
+	store.read.Add(2)
+	idp.setClaims(map[string]any{"email": "user@example.com", "nonce": jm.Nonce("state-123")})
+	h := &LoginHandler{
+		provider:        idp.provider(t),
+		jwtManager:      jm,
+		kubeconfigGen:   &KubeconfigGenerator{ClusterName: "prod", ClusterServer: "https://k8s.example.com"},
+		refreshTokenTTL: time.Hour,
+		usernameClaim:   DefaultUsernameClaim,
+		sessionClient:   store,
+		clock:           clock.Real{},
+	}
+
+	codes := make(chan int, 2)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			h.HandleCallback(rr, httptest.NewRequest(http.MethodGet, "/callback?state=state-123&code=auth-code", nil))
+			codes <- rr.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	var ok int
+	for code := range codes {
+		if code == http.StatusOK {
+			ok++
+		}
+	}
+	if ok != 1 {
+		t.Errorf("%d callbacks succeeded, want exactly 1", ok)
+	}
+	got, _ := store.fakeLoginStore.Get(context.Background(), "state-123")
+	if got.Status.Phase != v1alpha1.SessionActive || got.Status.Error != "" {
+		t.Errorf("status = %q/%q, want Active without error", got.Status.Phase, got.Status.Error)
+	}
+}
+
+func TestHandleCallback_SuccessPageWarnsWithoutRefreshToken(t *testing.T) {
+	jm := newTestJWTManager(t)
+	refreshToken, err := jm.CreateRefreshToken("user@example.com", "", "state-123", 0, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+	store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+		Spec: v1alpha1.OAuthSessionSpec{SessionID: "state-123", Verifier: "verifier"},
+		Status: v1alpha1.OAuthSessionStatus{
+			Phase:        v1alpha1.SessionActive,
+			Email:        "user@example.com",
+			RefreshToken: refreshToken,
+		},
+	}}
+	h := &LoginHandler{jwtManager: jm, sessionClient: store, clock: clock.Real{}}
+
+	rr := httptest.NewRecorder()
+	h.HandleCallback(rr, httptest.NewRequest(http.MethodGet, "/callback?state=state-123&code=spent-code", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	if !strings.Contains(rr.Body.String(), "did not issue a refresh token") {
+		t.Errorf("success page does not warn about the missing refresh token: %q", rr.Body.String())
+	}
+}
+
+func TestHandleCallback_CustomSuccessTemplate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "success.html")
+	if err := os.WriteFile(path, []byte(`<p>Welcome {{.UserEmail}} to {{.ClusterName}}</p>`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := LoadSuccessTemplate(path)
+	if err != nil {
+		t.Fatalf("LoadSuccessTemplate: %v", err)
+	}
+
+	store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+		Spec:   v1alpha1.OAuthSessionSpec{SessionID: "state-123", Verifier: "verifier"},
+		Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, Email: "<user>@example.com"},
+	}}
+	h := &LoginHandler{
+		kubeconfigGen:   &KubeconfigGenerator{ClusterName: "prod"},
+		sessionClient:   store,
+		successTemplate: tmpl,
+		clock:           clock.Real{},
+	}
+
+	rr := httptest.NewRecorder()
+	h.HandleCallback(rr, httptest.NewRequest(http.MethodGet, "/callback?state=state-123&code=spent-code", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+	if got, want := rr.Body.String(), "<p>Welcome &lt;user&gt;@example.com to prod</p>"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestLoadSuccessTemplate(t *testing.T) {
+	if tmpl, err := LoadSuccessTemplate(""); tmpl != nil || err != nil {
+		t.Errorf("empty path: got (%v, %v), want (nil, nil)", tmpl, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "broken.html")
+	if err := os.WriteFile(path, []byte(`{{.UserEmail`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSuccessTemplate(path); err == nil {
+		t.Error("expected parse error for malformed template")
+	}
+}
+
+func TestHandleStartLogin_NonceBoundToState(t *testing.T) {
+	jm := newTestJWTManager(t)
+	h := &LoginHandler{
+		provider: &oauth.Provider{OAuth2Config: &oauth2.Config{
+			ClientID: "kauth",
+			Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+		}},
+		jwtManager:    jm,
+		sessionTTL:    time.Minute,
+		sessionClient: &fakeLoginStore{},
+		pending:       newPendingSessions(),
+		clock:         clock.Real{},
+	}
+
+	rr := httptest.NewRecorder()
+	h.HandleStartLogin(rr, httptest.NewRequest(http.MethodGet, "/start-login", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", rr.Code)
+	}
+
+	var resp StartLoginResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	loginURL, err := url.Parse(resp.LoginURL)
+	if err != nil {
+		t.Fatalf("parse login URL: %v", err)
+	}
+	state, nonce := loginURL.Query().Get("state"), loginURL.Query().Get("nonce")
+	if state == "" || nonce == "" {
+		t.Fatalf("login URL missing state or nonce: %s", resp.LoginURL)
+	}
+	if err := jm.VerifyNonce(state, nonce); err != nil {
+		t.Errorf("nonce not bound to state: %v", err)
+	}
+}
+
+func TestHandleStartLogin_MaxPendingSessions(t *testing.T) {
+	h := &LoginHandler{
+		provider: &oauth.Provider{OAuth2Config: &oauth2.Config{
+			ClientID: "kauth",
+			Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+		}},
+		jwtManager:      newTestJWTManager(t),
+		sessionTTL:      time.Minute,
+		sessionClient:   &fakeLoginStore{},
+		pending:         newPendingSessions(),
+		maxPending:      3,
+		cleanupInterval: 30 * time.Second,
+		clock:           clock.Real{},
+	}
+
+	for i := range h.maxPending {
+		rr := httptest.NewRecorder()
+		h.HandleStartLogin(rr, httptest.NewRequest(http.MethodGet, "/start-login", nil))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("login %d: status = %d, want 200", i+1, rr.Code)
+		}
+	}
+	if got := metrics.PendingSessions.Value(); got != 3 {
+		t.Errorf("kauth_pending_sessions = %d, want 3", got)
+	}
+
+	rr := httptest.NewRecorder()
+	h.HandleStartLogin(rr, httptest.NewRequest(http.MethodGet, "/start-login", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d at the cap, want 503", rr.Code)
+	}
+	if rr.Header().Get("Retry-After") != "30" {
+		t.Errorf("Retry-After = %q, want 30", rr.Header().Get("Retry-After"))
+	}
+
+	// A completed login frees a slot, and so does a failed one, which stays
+	// Pending with an error.
+	for _, tt := range []struct {
+		name   string
+		status v1alpha1.OAuthSessionStatus
+	}{
+		{name: "completed", status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive}},
+		{name: "failed", status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending, Error: "Token exchange failed"}},
+	} {
+		for id := range h.pending.created {
+			h.pending.observe(&v1alpha1.OAuthSession{
+				Spec:   v1alpha1.OAuthSessionSpec{SessionID: id},
+				Status: tt.status,
+			})
+			break
+		}
+		rr = httptest.NewRecorder()
+		h.HandleStartLogin(rr, httptest.NewRequest(http.MethodGet, "/start-login", nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("status = %d after a login %s, want 200", rr.Code, tt.name)
+		}
+	}
+
+	h.pending.prune(time.Now().Add(time.Minute))
+	if got := metrics.PendingSessions.Value(); got != 0 {
+		t.Errorf("kauth_pending_sessions = %d after prune, want 0", got)
+	}
+}
+
+func TestHandleCallback_FailedSessionIsNotRetried(t *testing.T) {
+	store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+		Spec: v1alpha1.OAuthSessionSpec{SessionID: "state-123", Verifier: "verifier"},
+		Status: v1alpha1.OAuthSessionStatus{
+			Phase: v1alpha1.SessionPending,
+			Error: "Token exchange failed",
+		},
+	}}
+	h := &LoginHandler{sessionClient: store}
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?state=state-123&code=spent-code", nil)
+	rr := httptest.NewRecorder()
+	h.HandleCallback(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rr.Code)
+	}
+	if store.statusUpdates != 0 {
+		t.Errorf("status updated %d times, want 0", store.statusUpdates)
+	}
+}
+
+func TestHandleCallback_ErrorPage(t *testing.T) {
+	store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+		Spec:   v1alpha1.OAuthSessionSpec{SessionID: "state-123", Verifier: "verifier"},
+		Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+	}}
+	h := &LoginHandler{sessionClient: store}
+
+	req := httptest.NewRequest(http.MethodGet, "/callback?state=state-123&error=access_denied&error_description=secret+upstream+detail", nil)
+	rr := httptest.NewRecorder()
+	h.HandleCallback(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want text/html", ct)
+	}
+	body := rr.Body.String()
+	for _, want := range []string{"Authentication Failed", callbackErrIdPDenied, "kauth login"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("error page missing %q", want)
+		}
+	}
+	if strings.Contains(body, "secret upstream detail") {
+		t.Error("error page leaks the IdP error description")
+	}
+
+	// The terminal still learns the full reason through the session status.
+	if got := store.session.Status.Error; got != "access_denied: secret upstream detail" {
+		t.Errorf("session error = %q, want IdP error and description", got)
+	}
+}
+
+func TestHandleCallback_SanitizesIdPError(t *testing.T) {
+	store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+		Spec:   v1alpha1.OAuthSessionSpec{SessionID: "state-123", Verifier: "verifier"},
+		Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+	}}
+	h := &LoginHandler{sessionClient: store}
+
+	q := url.Values{
+		"state":             {"state-123"},
+		"error":             {"access_denied\nlevel=ERROR msg=forged"},
+		"error_description": {strings.Repeat("x", 5000) + "\x1b[31m"},
+	}
+	rr := httptest.NewRecorder()
+	h.HandleCallback(rr, httptest.NewRequest(http.MethodGet, "/callback?"+q.Encode(), nil))
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want 400", rr.Code)
+	}
+	got := store.session.Status.Error
+	if strings.ContainsAny(got, "\n\x1b") {
+		t.Errorf("session error contains control characters: %q", got)
+	}
+	if !strings.HasPrefix(got, "access_deniedlevel=ERROR msg=forged: ") {
+		t.Errorf("session error = %.60q..., want the stripped error first", got)
+	}
+	if n := utf8.RuneCountInString(got); n > maxCallbackErrorLen+maxCallbackErrorDescriptionLen+4 {
+		t.Errorf("session error is %d runes, want it capped", n)
+	}
+}
+
+func TestHandleCallback_OversizedQuery(t *testing.T) {
+	store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+		Spec: v1alpha1.OAuthSessionSpec{SessionID: "state-123", Verifier: "verifier"},
+	}}
+	h := &LoginHandler{sessionClient: store}
+
+	rr := httptest.NewRecorder()
+	h.HandleCallback(rr, httptest.NewRequest(http.MethodGet, "/callback?state=state-123&error=x&error_description="+strings.Repeat("a", maxCallbackQuerySize), nil))
+
+	if rr.Code != http.StatusRequestURITooLong {
+		t.Errorf("status = %d, want 414", rr.Code)
+	}
+	if store.statusUpdates != 0 {
+		t.Errorf("status updated %d times, want 0", store.statusUpdates)
+	}
+}
+
+func TestSanitizeReflected(t *testing.T) {
+	tests := []struct {
+		in   string
+		max  int
+		want string
+	}{
+		{in: "plain", max: 10, want: "plain"},
+		{in: "a\r\nb\tc\x00d", max: 10, want: "abcd"},
+		{in: "héllo wörld", max: 5, want: "héllo…"},
+		{in: "\xff\xfebad", max: 10, want: "bad"},
+	}
+	for _, tt := range tests {
+		if got := sanitizeReflected(tt.in, tt.max); got != tt.want {
+			t.Errorf("sanitizeReflected(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+	}
+}
+
+func TestHandleWatch_SSEMetrics(t *testing.T) {
+	jm := newTestJWTManager(t)
+	sessionToken, err := jm.CreateSessionToken("state-123", "verifier", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateSessionToken: %v", err)
+	}
+
+	t.Run("connect and complete", func(t *testing.T) {
+		store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+			Spec:   v1alpha1.OAuthSessionSpec{SessionID: "state-123"},
+			Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, Email: "user@example.com"},
+		}}
+		h := &LoginHandler{
+			jwtManager:    jm,
+			kubeconfigGen: &KubeconfigGenerator{ClusterName: "test"},
+			sessionClient: store,
+			sseListeners:  make(map[string][]chan StatusResponse),
+			clock:         clock.Real{},
+		}
+
+		connections := metrics.SSEConnections.Value()
+		completed := metrics.SSEDisconnects.WithLabel(metrics.DisconnectCompleted).Value()
+
+		req := httptest.NewRequest(http.MethodGet, "/watch?session_token="+sessionToken, nil)
+		rr := httptest.NewRecorder()
+		h.HandleWatch(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200", rr.Code)
+		}
+		if got := metrics.SSEConnections.Value() - connections; got != 1 {
+			t.Errorf("connections delta = %d, want 1", got)
+		}
+		if got := metrics.SSEDisconnects.WithLabel(metrics.DisconnectCompleted).Value() - completed; got != 1 {
+			t.Errorf("completed disconnects delta = %d, want 1", got)
+		}
+		if got := metrics.SSEActiveListeners.Value(); got != 0 {
+			t.Errorf("active listeners = %d, want 0", got)
+		}
+	})
+
+	t.Run("client disconnect", func(t *testing.T) {
+		store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+			Spec:   v1alpha1.OAuthSessionSpec{SessionID: "state-123"},
+			Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+		}}
+		h := &LoginHandler{
+			jwtManager:    jm,
+			sessionClient: store,
+			sseListeners:  make(map[string][]chan StatusResponse),
+			clock:         clock.Real{},
+		}
+
+		clientDisconnects := metrics.SSEDisconnects.WithLabel(metrics.DisconnectClient).Value()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		req := httptest.NewRequest(http.MethodGet, "/watch?session_token="+sessionToken, nil).WithContext(ctx)
+		done := make(chan struct{})
+		go func() {
+			h.HandleWatch(httptest.NewRecorder(), req)
+			close(done)
+		}()
+
+		deadline := time.After(2 * time.Second)
+		for metrics.SSEActiveListeners.Value() != 1 {
+			select {
+			case <-deadline:
+				t.Fatal("listener never became active")
+			case <-time.After(time.Millisecond):
+			}
+		}
+		cancel()
+		<-done
+
+		if got := metrics.SSEDisconnects.WithLabel(metrics.DisconnectClient).Value() - clientDisconnects; got != 1 {
+			t.Errorf("client disconnects delta = %d, want 1", got)
+		}
+		if got := metrics.SSEActiveListeners.Value(); got != 0 {
+			t.Errorf("active listeners = %d, want 0", got)
+		}
+	})
+}
+
+// flushRecorder records what had been written each time Flush is called.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (r *flushRecorder) Flush() {
+	r.flushed = append(r.flushed, r.Body.String())
+	r.ResponseRecorder.Flush()
+}
+
+func TestHandleWatch_FlushesFinalStatus(t *testing.T) {
+	jm := newTestJWTManager(t)
+	sessionToken, err := jm.CreateSessionToken("state-123", "verifier", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateSessionToken: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		status v1alpha1.OAuthSessionStatus
+		notify *StatusResponse
+		want   string
+	}{
+		{
+			name:   "already active",
+			status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, Email: "user@example.com"},
+			want:   `"ready":true`,
+		},
+		{
+			name:   "already failed",
+			status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending, Error: "denied"},
+			want:   `"error":"denied"`,
+		},
+		{
+			name:   "completed while watching",
+			status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+			notify: &StatusResponse{Ready: true, WebhookToken: "tok"},
+			want:   `"webhook_token":"tok"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &LoginHandler{
+				jwtManager:    jm,
+				kubeconfigGen: &KubeconfigGenerator{ClusterName: "test"},
+				sessionClient: &fakeLoginStore{session: &v1alpha1.OAuthSession{
+					Spec:   v1alpha1.OAuthSessionSpec{SessionID: "state-123"},
+					Status: tt.status,
+				}},
+				sseListeners: make(map[string][]chan StatusResponse),
+				clock:        clock.Real{},
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/watch?session_token="+sessionToken, nil)
+			rr := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+			done := make(chan struct{})
+			go func() {
+				h.HandleWatch(rr, req)
+				close(done)
+			}()
+
+			if tt.notify != nil {
+				deadline := time.After(2 * time.Second)
+				for {
+					h.sseMutex.RLock()
+					listeners := h.sseListeners["state-123"]
+					h.sseMutex.RUnlock()
+					if len(listeners) > 0 {
+						listeners[0] <- *tt.notify
+						break
+					}
+					select {
+					case <-deadline:
+						t.Fatal("listener never registered")
+					case <-time.After(time.Millisecond):
+					}
+				}
+			}
+			<-done
+
+			if len(rr.flushed) == 0 {
+				t.Fatal("final status was never flushed")
+			}
+			last := rr.flushed[len(rr.flushed)-1]
+			if last != rr.Body.String() {
+				t.Errorf("unflushed output after last Flush: %q", strings.TrimPrefix(rr.Body.String(), last))
+			}
+			if !strings.Contains(last, "data: ") || !strings.Contains(last, tt.want) {
+				t.Errorf("flushed output %q does not contain %s", last, tt.want)
+			}
+		})
+	}
+}
+
+// signalFlushRecorder signals on flushes each time Flush is called.
+type signalFlushRecorder struct {
+	*httptest.ResponseRecorder
+	flushes chan struct{}
+}
+
+func (r *signalFlushRecorder) Flush() {
+	r.ResponseRecorder.Flush()
+	select {
+	case r.flushes <- struct{}{}:
+	default:
+	}
+}
+
+func TestHandleWatch_KeepaliveAndMaxDuration(t *testing.T) {
+	jm := newTestJWTManager(t)
+	sessionToken, err := jm.CreateSessionToken("state-123", "verifier", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateSessionToken: %v", err)
+	}
+	store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+		Spec:   v1alpha1.OAuthSessionSpec{SessionID: "state-123"},
+		Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+	}}
+	clk := clock.NewFakeClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	h := &LoginHandler{
+		jwtManager:        jm,
+		sessionClient:     store,
+		sseListeners:      make(map[string][]chan StatusResponse),
+		keepaliveInterval: 2 * time.Second,
+		watchMaxDuration:  time.Minute,
+		clock:             clk,
+	}
+
+	timeouts := metrics.SSEDisconnects.WithLabel(metrics.DisconnectTimeout).Value()
+
+	req := httptest.NewRequest(http.MethodGet, "/watch?session_token="+sessionToken, nil)
+	rr := &signalFlushRecorder{ResponseRecorder: httptest.NewRecorder(), flushes: make(chan struct{}, 8)}
+	done := make(chan struct{})
+	go func() {
+		h.HandleWatch(rr, req)
+		close(done)
+	}()
+
+	deadline := time.After(2 * time.Second)
+	for clk.Waiters() < 2 {
+		select {
+		case <-deadline:
+			t.Fatal("watch never started its timers")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// Nothing fires before the keepalive interval.
+	clk.Advance(time.Second)
+	select {
+	case <-rr.flushes:
+		t.Fatal("keepalive sent before the interval")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	clk.Advance(time.Second)
+	select {
+	case <-rr.flushes:
+	case <-time.After(2 * time.Second):
+		t.Fatal("no keepalive after the interval")
+	}
+
+	clk.Advance(time.Minute)
+	<-done
+
+	body := rr.Body.String()
+	if !strings.Contains(body, ": keepalive\n\n") {
+		t.Errorf("body %q has no keepalive comment", body)
+	}
+	if !strings.Contains(body, WatchTimeoutMessage) {
+		t.Errorf("body %q has no timeout event", body)
+	}
+	if got := metrics.SSEDisconnects.WithLabel(metrics.DisconnectTimeout).Value() - timeouts; got != 1 {
+		t.Errorf("timeout disconnects delta = %d, want 1", got)
+	}
+	if clk.Waiters() != 0 {
+		t.Errorf("watch left %d timers running", clk.Waiters())
+	}
+}
+
+// nestedLoopAuthorized is the previous O(userGroups × allowedGroups) check,
+// kept for benchmark comparison.
+func nestedLoopAuthorized(allowedGroups, userGroups []string) bool {
+	for _, userGroup := range userGroups {
+		if slices.Contains(allowedGroups, userGroup) {
+			return true
+		}
+	}
+	return false
+}
+
+func BenchmarkIsUserAuthorized(b *testing.B) {
+	allowedGroups := make([]string, 200)
+	for i := range allowedGroups {
+		allowedGroups[i] = fmt.Sprintf("allowed-%d", i)
+	}
+	userGroups := make([]string, 2000)
+	for i := range userGroups {
+		userGroups[i] = fmt.Sprintf("user-%d", i)
+	}
+	userGroups[len(userGroups)-1] = "allowed-199"
+
+	b.Run("nested loop", func(b *testing.B) {
+		for b.Loop() {
+			nestedLoopAuthorized(allowedGroups, userGroups)
+		}
+	})
+
+	b.Run("set", func(b *testing.B) {
+		h := newAuthzHandler(allowedGroups, 0)
+		for b.Loop() {
+			h.isUserAuthorized(userGroups)
+		}
+	})
+}
+
+func TestHandleLogin_RedirectsWithCookie(t *testing.T) {
+	jm := newTestJWTManager(t)
+	store := &fakeLoginStore{}
+	h := &LoginHandler{
+		provider: &oauth.Provider{OAuth2Config: &oauth2.Config{
+			ClientID: "kauth",
+			Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+		}},
+		jwtManager:    jm,
+		kubeconfigGen: &KubeconfigGenerator{ServerURL: "https://kauth.example.com"},
+		sessionTTL:    time.Minute,
+		sessionClient: store,
+		pending:       newPendingSessions(),
+		clock:         clock.Real{},
+	}
+
+	rr := httptest.NewRecorder()
+	h.HandleLogin(rr, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("status = %d, want 302", rr.Code)
+	}
+
+	location, err := url.Parse(rr.Header().Get("Location"))
+	if err != nil || location.Host != "idp.example.com" {
+		t.Fatalf("Location = %q, want the IdP auth URL", rr.Header().Get("Location"))
+	}
+	state := location.Query().Get("state")
+
+	var cookie *http.Cookie
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == loginCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil {
+		t.Fatal("no login cookie set")
+	}
+	if !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode || cookie.Path != "/callback" {
+		t.Errorf("cookie = %+v, want HttpOnly, Secure, SameSite=Lax, Path=/callback", cookie)
+	}
+	if cookie.MaxAge != 60 {
+		t.Errorf("cookie MaxAge = %d, want 60", cookie.MaxAge)
+	}
+	sessionToken, err := jm.ValidateSessionToken(cookie.Value)
+	if err != nil {
+		t.Fatalf("cookie is not a valid session token: %v", err)
+	}
+	if sessionToken.SessionID != state || sessionToken.Verifier == "" {
+		t.Errorf("cookie session = %+v, want session %q with a verifier", sessionToken, state)
+	}
+	if store.session.Spec.Verifier != "" {
+		t.Errorf("session stores verifier %q, want it only in the cookie", store.session.Spec.Verifier)
+	}
+}
+
+func TestHandleLogin_CallbackWithCookie(t *testing.T) {
+	idp := newStubIdP(t)
+	jm := newTestJWTManager(t)
+	store := &fakeLoginStore{}
+	h := &LoginHandler{
+		provider:        idp.provider(t),
+		jwtManager:      jm,
+		kubeconfigGen:   &KubeconfigGenerator{ClusterName: "prod", ClusterServer: "https://k8s.example.com", ServerURL: "https://kauth.example.com"},
+		sessionTTL:      time.Minute,
+		refreshTokenTTL: time.Hour,
+		usernameClaim:   DefaultUsernameClaim,
+		sessionClient:   store,
+		pending:         newPendingSessions(),
+		clock:           clock.Real{},
+	}
+
+	rr := httptest.NewRecorder()
+	h.HandleLogin(rr, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if rr.Code != http.StatusFound {
+		t.Fatalf("/login status = %d, want 302", rr.Code)
+	}
+	location, _ := url.Parse(rr.Header().Get("Location"))
+	state := location.Query().Get("state")
+	idp.setClaims(map[string]any{"email": "user@example.com", "nonce": jm.Nonce(state)})
+
+	callback := func(cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/callback?state="+state+"&code=auth-code", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rr := httptest.NewRecorder()
+		h.HandleCallback(rr, req)
+		return rr
+	}
+
+	t.Run("without the cookie", func(t *testing.T) {
+		if rr := callback(nil); rr.Code != http.StatusInternalServerError {
+			t.Errorf("status = %d, want 500", rr.Code)
+		}
+		store.session.Status = v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending}
+	})
+
+	t.Run("with the cookie", func(t *testing.T) {
+		cookies := rr.Result().Cookies()
+		sessionToken, err := jm.ValidateSessionToken(cookies[0].Value)
+		if err != nil {
+			t.Fatalf("ValidateSessionToken: %v", err)
+		}
+
+		rr := callback(cookies)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("status = %d, want 200 (body %s)", rr.Code, rr.Body)
+		}
+		if got := idp.codeVerifier(); got != sessionToken.Verifier {
+			t.Errorf("code_verifier sent to IdP = %q, want the cookie's %q", got, sessionToken.Verifier)
+		}
+		if store.session.Status.Phase != v1alpha1.SessionActive {
+			t.Errorf("session phase = %q, want Active", store.session.Status.Phase)
+		}
+		if rr.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("Cache-Control = %q, want no-store", rr.Header().Get("Cache-Control"))
+		}
+		body := html.UnescapeString(rr.Body.String())
+		for _, want := range []string{"Download kubeconfig", "server: https://k8s.example.com", "KAUTH_TOKEN", store.session.Status.WebhookToken} {
+			if !strings.Contains(body, want) {
+				t.Errorf("page does not contain %q", want)
+			}
+		}
+	})
+}
+
+func TestHandleExchange_BindsToStartedLogin(t *testing.T) {
+	idp := newStubIdP(t)
+	jm := newTestJWTManager(t)
+	const sessionID = "state-123"
+	sessionToken, err := jm.CreateSessionToken(sessionID, "verifier", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateSessionToken: %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		nonce         string
+		phase         v1alpha1.SessionPhase
+		rejectRefresh bool
+		wantStatus    int
+	}{
+		{name: "nonce of the started login", nonce: jm.Nonce(sessionID), phase: v1alpha1.SessionPending, wantStatus: http.StatusOK},
+		{name: "no nonce", phase: v1alpha1.SessionPending, wantStatus: http.StatusUnauthorized},
+		{name: "nonce of another login", nonce: jm.Nonce("state-456"), phase: v1alpha1.SessionPending, wantStatus: http.StatusUnauthorized},
+		{name: "login already completed", nonce: jm.Nonce(sessionID), phase: v1alpha1.SessionActive, wantStatus: http.StatusConflict},
+		{name: "refresh token rejected by IdP", nonce: jm.Nonce(sessionID), phase: v1alpha1.SessionPending, rejectRefresh: true, wantStatus: http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.setClaims(map[string]any{"email": "user@example.com", "nonce": tt.nonce})
+			idp.rejectRefresh.Store(tt.rejectRefresh)
+			store := &fakeLoginStore{session: &v1alpha1.OAuthSession{
+				Spec:   v1alpha1.OAuthSessionSpec{SessionID: sessionID, Verifier: "verifier"},
+				Status: v1alpha1.OAuthSessionStatus{Phase: tt.phase},
+			}}
+			h := &LoginHandler{
+				provider:        idp.provider(t),
+				jwtManager:      jm,
+				sessionClient:   store,
+				kubeconfigGen:   &KubeconfigGenerator{ClusterName: "prod", ClusterServer: "https://k8s.example.com"},
+				refreshTokenTTL: time.Hour,
+				clock:           clock.Real{},
+			}
+
+			body, _ := json.Marshal(ExchangeRequest{SessionToken: sessionToken, IDToken: idp.idToken(t), RefreshToken: "oidc-refresh-1"})
+			req := httptest.NewRequest(http.MethodPost, "/exchange", strings.NewReader(string(body)))
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			h.HandleExchange(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if store.statusUpdates != 0 {
+					t.Errorf("session updated %d times on a rejected exchange", store.statusUpdates)
+				}
+				return
+			}
+			if store.session.Status.Phase != v1alpha1.SessionActive {
+				t.Errorf("session phase = %q, want Active", store.session.Status.Phase)
+			}
+			// The stored refresh token wraps the one the IdP issued when
+			// the client's was redeemed, not the client's own.
+			rt, err := jm.DecodeRefreshToken(store.session.Status.RefreshToken)
+			if err != nil {
+				t.Fatalf("DecodeRefreshToken: %v", err)
+			}
+			if rt.OIDCRefreshToken != "oidc-refresh-2" || rt.SessionID != sessionID {
+				t.Errorf("stored refresh token wraps %q for session %q, want oidc-refresh-2 for %q", rt.OIDCRefreshToken, rt.SessionID, sessionID)
+			}
+		})
+	}
 }
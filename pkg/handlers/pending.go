@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+	"kauth/pkg/metrics"
+)
+
+// DefaultMaxPendingSessions is the default cap on logins in progress.
+const DefaultMaxPendingSessions = 1000
+
+// DefaultSessionCleanupInterval is how often stale sessions are expired and
+// deleted by default.
+const DefaultSessionCleanupInterval = 30 * time.Second
+
+// pendingSessions tracks logins still in progress, keyed by session ID with
+// their creation time. It is fed by the session informer, and every replica
+// watches every session, so its size is cluster-wide.
+// Entries older than the session TTL are also pruned periodically as a
+// backstop; CleanupOldSessions deletes such sessions anyway.
+type pendingSessions struct {
+	mu      sync.Mutex
+	created map[string]time.Time
+}
+
+func newPendingSessions() *pendingSessions {
+	return &pendingSessions{created: make(map[string]time.Time)}
+}
+
+// observe records s if it is pending and forgets it otherwise. A failed
+// login stays in the Pending phase with an error set, but is over.
+func (p *pendingSessions) observe(s *v1alpha1.OAuthSession) {
+	phase := s.Status.Phase
+	if (phase == "" || phase == v1alpha1.SessionPending) && s.Status.Error == "" {
+		p.add(s.Spec.SessionID, s.Spec.CreatedAt.Time)
+	} else {
+		p.remove(s.Spec.SessionID)
+	}
+}
+
+func (p *pendingSessions) add(sessionID string, created time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.created[sessionID] = created
+	metrics.PendingSessions.Set(int64(len(p.created)))
+}
+
+func (p *pendingSessions) remove(sessionID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.created, sessionID)
+	metrics.PendingSessions.Set(int64(len(p.created)))
+}
+
+// prune forgets sessions created before cutoff.
+func (p *pendingSessions) prune(cutoff time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, created := range p.created {
+		if created.Before(cutoff) {
+			delete(p.created, id)
+		}
+	}
+	metrics.PendingSessions.Set(int64(len(p.created)))
+}
+
+func (p *pendingSessions) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.created)
+}
@@ -6,28 +6,66 @@ import (
 	"fmt"
 	"log/slog"
 	"net/http"
-	"slices"
 	"time"
 
+	"kauth/pkg/apierror"
 	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
 	"kauth/pkg/audit"
+	"kauth/pkg/clock"
 	"kauth/pkg/jwt"
+	"kauth/pkg/middleware"
 	"kauth/pkg/oauth"
 	"kauth/pkg/session"
 
-	"golang.org/x/oauth2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 )
 
+// refreshSessionStore is the subset of *session.Client the refresh flow
+// needs.
+type refreshSessionStore interface {
+	Get(ctx context.Context, sessionID string) (*v1alpha1.OAuthSession, error)
+	ValidateSession(ctx context.Context, sessionID string, expectedPhase v1alpha1.SessionPhase) error
+	UpdateLastUsed(ctx context.Context, sessionID string) error
+	Rotate(ctx context.Context, sessionID string, check func(*v1alpha1.OAuthSession) error, update func(*v1alpha1.OAuthSessionStatus)) error
+}
+
 type RefreshHandler struct {
 	provider        *oauth.Provider
 	jwtManager      *jwt.Manager
-	sessionClient   *session.Client
+	sessionClient   refreshSessionStore
 	kubeconfigGen   *KubeconfigGenerator
 	refreshTokenTTL time.Duration
-	rotationWindow  int      // max rotation counter lag to accept (replay-attack window)
-	allowedGroups   []string // if non-empty, user must belong to at least one group
+	absoluteTTL     time.Duration // cap on a session's total lifetime across rotations (0 = none)
+	rotationWindow  int           // max rotation counter lag to accept (replay-attack window)
+	allowedGroups   []string      // if non-empty, user must belong to at least one group
+	allowedSet      groupSet      // allowedGroups as a set, built once at construction
+	maxGroups       int           // cap on user groups considered during authorization
+
+	requireContentType   bool   // reject requests without a Content-Type (not just non-JSON ones)
+	requireVerifiedEmail string // REQUIRE_VERIFIED_EMAIL mode (VerifiedEmailOff etc.)
+	requiredClaims       RequiredClaims
+	usernameClaim        string // USERNAME_CLAIM identifying users (DefaultUsernameClaim etc.)
+
+	clock clock.Clock // current time for expiry checks
+}
+
+// isUserAuthorized checks if the refreshed claims still belong to any
+// allowed group.
+func (h *RefreshHandler) isUserAuthorized(ctx context.Context, claims *OIDCClaims) bool {
+	if len(h.allowedGroups) == 0 {
+		return true
+	}
+	found, truncated := h.allowedSet.containsAny(claims.Groups, h.maxGroups)
+	if truncated {
+		slog.WarnContext(ctx, "refresh: user group list truncated for authorization", "user", claims.Email, "groups", len(claims.Groups), "max_groups", h.maxGroups)
+	}
+	return found
 }
 
+// SessionExpiredMessage is the /refresh error body when a session has reached
+// its absolute TTL. The CLI matches on it to tell the user to log in again.
+const SessionExpiredMessage = "Session expired, please run kauth login"
+
 type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token"`
 }
@@ -38,68 +76,119 @@ type RefreshResponse struct {
 	ExpiresIn    int64  `json:"expires_in"`    // ID token expiry in seconds
 	TokenType    string `json:"token_type"`    // Always "Bearer"
 	Kubeconfig   string `json:"kubeconfig"`    // Updated kubeconfig
+
+	RotationCounter int `json:"rotation_counter"` // Rotation counter of the new refresh token
+
+	RefreshTokenExpiresIn int64 `json:"refresh_token_expires_in"`     // Seconds until the new refresh token expires
+	SessionExpiresIn      int64 `json:"session_expires_in,omitempty"` // Seconds until the absolute session TTL (0 = no cap)
+}
+
+// RefreshHandlerOptions configures NewRefreshHandler.
+type RefreshHandlerOptions struct {
+	Provider      *oauth.Provider
+	JWTManager    *jwt.Manager
+	SessionClient *session.Client
+
+	// Kubeconfig describes the cluster and server written into issued
+	// kubeconfigs.
+	Kubeconfig KubeconfigGenerator
+
+	RefreshTokenTTL    time.Duration
+	AbsoluteSessionTTL time.Duration // cap on a session's total lifetime across rotations (0 = none)
+	RotationWindow     int
+
+	AllowedGroups        []string
+	MaxGroups            int
+	RequireContentType   bool
+	RequireVerifiedEmail string
+	RequiredClaims       RequiredClaims
+	UsernameClaim        string
+
+	// Clock defaults to the system clock.
+	Clock clock.Clock
 }
 
-func NewRefreshHandler(
-	provider *oauth.Provider,
-	jwtManager *jwt.Manager,
-	sessionClient *session.Client,
-	clusterName, clusterServer, clusterCA string,
-	refreshTokenTTL time.Duration,
-	rotationWindow int,
-	allowedGroups []string,
-) *RefreshHandler {
+func NewRefreshHandler(opts RefreshHandlerOptions) *RefreshHandler {
+	kubeconfigGen := opts.Kubeconfig
+	clk := opts.Clock
+	if clk == nil {
+		clk = clock.Real{}
+	}
 	return &RefreshHandler{
-		provider:      provider,
-		jwtManager:    jwtManager,
-		sessionClient: sessionClient,
-		kubeconfigGen: &KubeconfigGenerator{
-			ClusterName:   clusterName,
-			ClusterServer: clusterServer,
-			ClusterCA:     clusterCA,
-		},
-		refreshTokenTTL: refreshTokenTTL,
-		rotationWindow:  rotationWindow,
-		allowedGroups:   allowedGroups,
+		provider:        opts.Provider,
+		jwtManager:      opts.JWTManager,
+		sessionClient:   opts.SessionClient,
+		kubeconfigGen:   &kubeconfigGen,
+		refreshTokenTTL: opts.RefreshTokenTTL,
+		absoluteTTL:     opts.AbsoluteSessionTTL,
+		rotationWindow:  opts.RotationWindow,
+		allowedGroups:   opts.AllowedGroups,
+		allowedSet:      newGroupSet(opts.AllowedGroups),
+		maxGroups:       opts.MaxGroups,
+
+		requireContentType:   opts.RequireContentType,
+		requireVerifiedEmail: opts.RequireVerifiedEmail,
+		requiredClaims:       opts.RequiredClaims,
+		usernameClaim:        opts.UsernameClaim,
+		clock:                clk,
 	}
 }
 
 func (h *RefreshHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	if !isJSONContentType(r, !h.requireContentType) {
+		apierror.Write(w, http.StatusUnsupportedMediaType, apierror.CodeUnsupportedMedia, "Content-Type must be application/json")
 		return
 	}
 
 	var req RefreshRequest
 	if err := decodeJSON(r, &req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeDecodeError(w, err)
 		return
 	}
 
 	if req.RefreshToken == "" {
-		http.Error(w, "Missing refresh_token", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Missing refresh_token")
 		return
 	}
 
 	ctx := r.Context()
+	clientIP := middleware.ClientIP(r)
 
 	// Validate and decrypt refresh token
 	refreshToken, err := h.jwtManager.ValidateRefreshToken(req.RefreshToken)
 	if err != nil {
 		switch {
 		case errors.Is(err, jwt.ErrExpiredToken):
-			slog.WarnContext(ctx, "refresh: token expired")
-			http.Error(w, "Refresh token expired", http.StatusUnauthorized)
+			slog.WarnContext(ctx, "refresh: token expired", "client_ip", clientIP)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeTokenExpired, "Refresh token expired")
 		case errors.Is(err, jwt.ErrInvalidSignature):
-			slog.WarnContext(ctx, "refresh: invalid signature")
-			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			slog.WarnContext(ctx, "refresh: invalid signature", "client_ip", clientIP)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidSignature, "Invalid refresh token")
+		case errors.Is(err, jwt.ErrTokenPredatesCutoff):
+			slog.InfoContext(ctx, "refresh: token predates MIN_TOKEN_ISSUED_AT", "client_ip", clientIP)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeSessionExpired, SessionExpiredMessage)
+		case errors.Is(err, jwt.ErrWrongAudience):
+			slog.WarnContext(ctx, "refresh: token issued for a different deployment", "client_ip", clientIP)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid refresh token")
 		default:
-			slog.WarnContext(ctx, "refresh: invalid token", "error", err)
-			http.Error(w, "Invalid refresh token", http.StatusUnauthorized)
+			slog.WarnContext(ctx, "refresh: invalid token", "error", err, "client_ip", clientIP)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeInvalidToken, "Invalid refresh token")
 		}
 		return
 	}
 
+	// Rotation keeps a session alive only up to the absolute TTL; after that
+	// the user must log in again.
+	now := h.clock.Now()
+	if err := refreshToken.CheckSessionAge(h.absoluteTTL, now); err != nil {
+		slog.InfoContext(ctx, "refresh: session reached absolute TTL", "user", refreshToken.UserEmail, "session_start", refreshToken.SessionStart(), "absolute_ttl", h.absoluteTTL, "client_ip", clientIP)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeSessionExpired, SessionExpiredMessage)
+		return
+	}
+
 	slog.DebugContext(ctx, "refresh attempt", "user", refreshToken.UserEmail, "rotation_counter", refreshToken.RotationCounter, "session", refreshToken.SessionID)
 
 	// Refresh the OIDC token using the provider
@@ -112,43 +201,26 @@ func (h *RefreshHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 		// activity and does not race to expire a session that is actively in use.
 		_ = h.sessionClient.UpdateLastUsed(ctx, refreshToken.SessionID)
 		if err := h.sessionClient.ValidateSession(ctx, refreshToken.SessionID, v1alpha1.SessionActive); err != nil {
-			slog.WarnContext(ctx, "refresh: session invalid", "user", refreshToken.UserEmail, "error", err)
-			http.Error(w, "Session is no longer active", http.StatusUnauthorized)
+			slog.WarnContext(ctx, "refresh: session invalid", "user", refreshToken.UserEmail, "error", err, "client_ip", clientIP)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeSessionInactive, "Session is no longer active")
 			return
 		}
 
-		// Replay-attack check: the session CRD stores the latest valid refresh token.
-		// If the incoming counter is behind the stored counter, a rotated-away token
-		// is being replayed.
-		if sess, err := h.sessionClient.Get(ctx, refreshToken.SessionID); err == nil && sess.Status.RefreshToken != "" {
-			if stored, err := h.jwtManager.DecodeRefreshToken(sess.Status.RefreshToken); err == nil {
-				if refreshToken.RotationCounter < stored.RotationCounter ||
-					refreshToken.RotationCounter > stored.RotationCounter+h.rotationWindow {
-					slog.WarnContext(ctx, "refresh: replay attack detected",
-						"user", refreshToken.UserEmail,
-						"incoming_counter", refreshToken.RotationCounter,
-						"stored_counter", stored.RotationCounter,
-					)
-					http.Error(w, "Token replay detected", http.StatusUnauthorized)
-					return
-				}
+		// Replay-attack check before calling the IdP; Rotate repeats it
+		// atomically when the new token is stored.
+		if sess, err := h.sessionClient.Get(ctx, refreshToken.SessionID); err == nil {
+			var replay *replayError
+			if errors.As(h.checkRotation(sess, refreshToken.RotationCounter), &replay) {
+				h.rejectReplay(w, r, refreshToken, replay)
+				return
 			}
 		}
 	}
 
-	// Create oauth2 token from stored refresh token
-	oldToken := &oauth2.Token{
-		RefreshToken: refreshToken.OIDCRefreshToken,
-	}
-
-	httpClient := oauth.NewMetricsHTTPClient("token_refresh")
-	ctxWithClient := context.WithValue(ctx, oauth2.HTTPClient, httpClient)
-
-	// Use the provider to refresh
-	newToken, err := h.provider.OAuth2Config.TokenSource(ctxWithClient, oldToken).Token()
+	newToken, err := h.provider.Refresh(ctx, refreshToken.OIDCRefreshToken)
 	if err != nil {
-		slog.WarnContext(ctx, "refresh: OIDC token refresh failed", "user", refreshToken.UserEmail, "error", err)
-		http.Error(w, "Failed to refresh token", http.StatusUnauthorized)
+		slog.WarnContext(ctx, "refresh: OIDC token refresh failed", "user", refreshToken.UserEmail, "error", err, "client_ip", clientIP)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeIdPError, "Failed to refresh token")
 		return
 	}
 
@@ -156,88 +228,185 @@ func (h *RefreshHandler) HandleRefresh(w http.ResponseWriter, r *http.Request) {
 	idToken, ok := newToken.Extra("id_token").(string)
 	if !ok {
 		slog.ErrorContext(ctx, "refresh: no ID token in response", "user", refreshToken.UserEmail)
-		http.Error(w, "No ID token in refresh response", http.StatusInternalServerError)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeIdPError, "No ID token in refresh response")
 		return
 	}
 
 	// Verify the new ID token and extract claims
 	claims, _, err := VerifyAndExtractClaims(ctx, h.provider, idToken)
 	if err != nil {
-		slog.WarnContext(ctx, "refresh: ID token verification failed", "user", refreshToken.UserEmail, "error", err)
-		http.Error(w, "Token verification failed", http.StatusInternalServerError)
+		slog.WarnContext(ctx, "refresh: ID token verification failed", "user", refreshToken.UserEmail, "error", err, "client_ip", clientIP)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeIdPError, "Token verification failed")
 		return
 	}
 
-	// Verify the user email matches (security check)
-	if claims.Email != refreshToken.UserEmail {
-		slog.WarnContext(ctx, "refresh: user mismatch", "token_user", refreshToken.UserEmail, "claimed_email", claims.Email)
-		http.Error(w, "Token user mismatch", http.StatusUnauthorized)
+	// Verify the user matches (security check). The refresh token holds the
+	// USERNAME_CLAIM value it was issued for.
+	identity := claims.Identity(h.usernameClaim)
+	if identity != refreshToken.UserEmail {
+		slog.WarnContext(ctx, "refresh: user mismatch", "token_user", refreshToken.UserEmail, "claimed_user", identity, "claim", h.usernameClaim, "client_ip", clientIP)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUserMismatch, "Token user mismatch")
 		return
 	}
 
-	// Re-check group membership so that users removed from allowed groups
-	// cannot continue refreshing indefinitely until session expiry.
-	if len(h.allowedGroups) > 0 {
-		authorized := false
-		for _, g := range claims.Groups {
-			if slices.Contains(h.allowedGroups, g) {
-				authorized = true
-				break
-			}
-		}
-		if !authorized {
-			audit.AuthorizationDeny(ctx, r, claims.Email, claims.Groups, h.allowedGroups)
-			slog.WarnContext(ctx, "refresh: user no longer in allowed groups", "user", claims.Email, "groups", claims.Groups)
-			http.Error(w, "Forbidden: user not in allowed groups", http.StatusForbidden)
-			return
-		}
+	if !emailVerified(claims, h.requireVerifiedEmail) {
+		audit.LoginDenied(ctx, r, claims.Email, claims.Groups, emailUnverifiedReason)
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "Email address is not verified")
+		return
 	}
 
-	// Create new rotated refresh token with incremented counter
-	newRefreshToken, err := h.jwtManager.CreateRefreshToken(
-		claims.Email,
+	// Claims such as a tenant or MFA flag can change at the IdP between
+	// refreshes, so REQUIRED_CLAIMS is checked every time.
+	if claim := h.requiredClaims.mismatch(claims.raw); claim != "" {
+		audit.LoginDenied(ctx, r, claims.Email, claims.Groups, claimMismatchReason)
+		slog.WarnContext(ctx, "refresh: required claim not matched", "user", claims.Email, "claim", claim, "client_ip", clientIP)
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "Token claim "+claim+" does not have a required value")
+		return
+	}
+
+	// Re-check group membership against the fresh claims so that users
+	// removed from allowed groups cannot continue refreshing indefinitely
+	// until session expiry.
+	if !h.isUserAuthorized(ctx, claims) {
+		audit.AuthorizationDeny(ctx, r, claims.Email, claims.Groups, h.allowedGroups)
+		audit.RefreshFailure(ctx, r, groupNotAllowedReason, claims.Email)
+		slog.WarnContext(ctx, "refresh: user no longer in allowed groups", "user", claims.Email, "groups", claims.Groups, "client_ip", clientIP)
+		apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "Forbidden: user not in allowed groups")
+		return
+	}
+
+	// Create new rotated refresh token with incremented counter, expiring no
+	// later than the session's absolute TTL
+	rotationCounter := refreshToken.RotationCounter + 1
+	ttl := h.refreshTokenTTL
+	if h.absoluteTTL > 0 {
+		ttl = min(ttl, refreshToken.SessionStart().Add(h.absoluteTTL).Sub(now))
+	}
+	newRefreshToken, err := h.jwtManager.RotateRefreshToken(
+		refreshToken,
+		identity,
 		newToken.RefreshToken,
-		refreshToken.SessionID,
-		refreshToken.RotationCounter+1,
-		h.refreshTokenTTL,
+		ttl,
 	)
 	if err != nil {
 		slog.ErrorContext(ctx, "refresh: failed to create refresh token", "user", claims.Email, "error", err)
-		http.Error(w, "Failed to create new refresh token", http.StatusInternalServerError)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to create new refresh token")
 		return
 	}
 
-	// Update session with new refresh token
+	// Store the new refresh token. This is a compare-and-swap on the session
+	// so that two replicas refreshing the same token concurrently cannot
+	// both succeed: the loser sees the advanced counter and is rejected.
 	if refreshToken.SessionID != "" {
-		_ = h.sessionClient.UpdateStatus(ctx, refreshToken.SessionID, v1alpha1.OAuthSessionStatus{
-			Phase:        v1alpha1.SessionActive,
-			Email:        claims.Email,
-			Username:     claims.PreferredUsername,
-			RefreshToken: newRefreshToken,
-			Groups:       claims.Groups,
-		})
+		err := h.sessionClient.Rotate(ctx, refreshToken.SessionID,
+			func(sess *v1alpha1.OAuthSession) error {
+				return h.checkRotation(sess, refreshToken.RotationCounter)
+			},
+			func(status *v1alpha1.OAuthSessionStatus) {
+				status.Email = claims.Email
+				status.Username = claims.PreferredUsername
+				status.RefreshToken = newRefreshToken
+				status.Groups = claims.Groups
+				status.RotationCounter = rotationCounter
+			},
+		)
+		var replay *replayError
+		switch {
+		case errors.As(err, &replay):
+			h.rejectReplay(w, r, refreshToken, replay)
+			return
+		case apierrors.IsNotFound(err) || errors.Is(err, session.ErrSessionNotActive):
+			// Deleted, revoked or expired since ValidateSession above.
+			slog.WarnContext(ctx, "refresh: session ended during refresh", "user", claims.Email, "error", err, "client_ip", clientIP)
+			apierror.Write(w, http.StatusUnauthorized, apierror.CodeSessionInactive, "Session is no longer active")
+			return
+		case err != nil:
+			// Issuing tokens the session did not record would leave it out
+			// of step with the client.
+			slog.ErrorContext(ctx, "refresh: failed to store rotated refresh token", "user", claims.Email, "error", err)
+			apierror.Write(w, http.StatusServiceUnavailable, apierror.CodeInternal, "Failed to store refresh token")
+			return
+		}
 	}
 
 	expiresIn := int64(0)
 	if !newToken.Expiry.IsZero() {
-		expiresIn = int64(time.Until(newToken.Expiry).Seconds())
+		expiresIn = int64(newToken.Expiry.Sub(now).Seconds())
+	}
+	var sessionExpiresIn int64
+	if h.absoluteTTL > 0 {
+		sessionExpiresIn = secondsUntil(refreshToken.SessionStart().Add(h.absoluteTTL), now)
 	}
 
+	audit.RefreshSuccess(ctx, r, claims.Email, claims.Groups)
 	slog.InfoContext(ctx, "refresh: success",
+		"client_ip", clientIP,
 		"user", claims.Email,
 		"name", claims.Name,
 		"sub", claims.Sub,
 		"groups", claims.Groups,
-		"rotation_counter", refreshToken.RotationCounter+1,
+		"rotation_counter", rotationCounter,
 		"cluster", h.kubeconfigGen.ClusterName,
 		"expires_in", fmt.Sprintf("%ds", expiresIn),
 	)
 
+	kubeconfig, err := h.kubeconfigGen.Generate(identity, claims.PreferredUsername)
+	if err != nil {
+		slog.ErrorContext(ctx, "refresh: failed to generate kubeconfig", "error", err)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to generate kubeconfig")
+		return
+	}
 	writeJSON(w, RefreshResponse{
 		IDToken:      idToken,
 		RefreshToken: newRefreshToken,
 		ExpiresIn:    expiresIn,
 		TokenType:    "Bearer",
-		Kubeconfig:   h.kubeconfigGen.Generate(claims.Email, claims.PreferredUsername),
+		Kubeconfig:   kubeconfig,
+
+		RotationCounter: rotationCounter,
+
+		RefreshTokenExpiresIn: int64(ttl.Seconds()),
+		SessionExpiresIn:      sessionExpiresIn,
 	})
 }
+
+// replayError reports a refresh token whose rotation counter is outside the
+// window accepted for its session.
+type replayError struct {
+	incoming, stored int
+}
+
+func (e *replayError) Error() string {
+	return fmt.Sprintf("refresh token replayed: counter %d, session at %d", e.incoming, e.stored)
+}
+
+// checkRotation accepts an incoming rotation counter if it is no older than
+// the session's and at most rotationWindow ahead. Sessions written before
+// the counter was stored fall back to the counter in their refresh token.
+func (h *RefreshHandler) checkRotation(sess *v1alpha1.OAuthSession, incoming int) error {
+	stored := sess.Status.RotationCounter
+	if stored == 0 && sess.Status.RefreshToken != "" {
+		tok, err := h.jwtManager.DecodeRefreshToken(sess.Status.RefreshToken)
+		if err != nil {
+			return nil
+		}
+		stored = tok.RotationCounter
+	}
+	if incoming < stored || incoming > stored+h.rotationWindow {
+		return &replayError{incoming: incoming, stored: stored}
+	}
+	return nil
+}
+
+// rejectReplay audits and refuses a replayed refresh token.
+func (h *RefreshHandler) rejectReplay(w http.ResponseWriter, r *http.Request, refreshToken *jwt.RefreshToken, replay *replayError) {
+	ctx := r.Context()
+	audit.RefreshReplay(ctx, r, refreshToken.UserEmail, refreshToken.SessionID, replay.incoming, replay.stored)
+	slog.WarnContext(ctx, "refresh: replay attack detected",
+		"client_ip", middleware.ClientIP(r),
+		"user", refreshToken.UserEmail,
+		"incoming_counter", replay.incoming,
+		"stored_counter", replay.stored,
+	)
+	apierror.Write(w, http.StatusUnauthorized, apierror.CodeTokenReplay, "Token replay detected")
+}
@@ -0,0 +1,492 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kauth/pkg/apierror"
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+	"kauth/pkg/clock"
+	"kauth/pkg/jwt"
+	"kauth/pkg/oauth"
+	"kauth/pkg/session"
+
+	"github.com/go-jose/go-jose/v4"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+func TestHandleRefresh_AbsoluteSessionTTL(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	absoluteTTL := 30 * 24 * time.Hour
+	clk := clock.NewFakeClock(start.Add(absoluteTTL + time.Minute))
+	jm := newTestJWTManager(t, jwt.WithClock(clk))
+
+	// The session started just over the absolute TTL ago; its latest
+	// rotation is recent, so the refresh token itself is still valid.
+	prev := &jwt.RefreshToken{
+		UserEmail:        "user@example.com",
+		RotationCounter:  12,
+		OriginalIssuedAt: start,
+	}
+	refreshToken, err := jm.RotateRefreshToken(prev, prev.UserEmail, "oidc-refresh", time.Hour)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+
+	// provider and sessionClient are nil: reaching the IdP would panic.
+	h := &RefreshHandler{jwtManager: jm, refreshTokenTTL: 7 * 24 * time.Hour, absoluteTTL: absoluteTTL, clock: clk}
+
+	body, _ := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+	rr := httptest.NewRecorder()
+	h.HandleRefresh(rr, httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(string(body))))
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want 401", rr.Code)
+	}
+	var errResp apierror.Response
+	if err := json.Unmarshal(rr.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("body is not a JSON error: %v", err)
+	}
+	if errResp.Code != apierror.CodeSessionExpired || errResp.Message != SessionExpiredMessage {
+		t.Errorf("body = %+v, want %s / %q", errResp, apierror.CodeSessionExpired, SessionExpiredMessage)
+	}
+}
+
+func TestHandleRefresh_BodyTooLarge(t *testing.T) {
+	// jwtManager, provider and sessionClient are nil: the body must be
+	// rejected before any of them is used.
+	h := &RefreshHandler{}
+
+	body := `{"refresh_token":"` + strings.Repeat("x", 1<<20) + `"}`
+	req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	req.Body = http.MaxBytesReader(rr, req.Body, 64<<10)
+	h.HandleRefresh(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want 413", rr.Code)
+	}
+	var errResp apierror.Response
+	if err := json.Unmarshal(rr.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("body is not a JSON error: %v", err)
+	}
+	if errResp.Code != apierror.CodeRequestTooLarge {
+		t.Errorf("code = %q, want %q", errResp.Code, apierror.CodeRequestTooLarge)
+	}
+}
+
+func TestHandleRefresh_ContentType(t *testing.T) {
+	tests := []struct {
+		name               string
+		contentType        string
+		requireContentType bool
+		wantStatus         int
+	}{
+		{name: "text/plain", contentType: "text/plain", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "form", contentType: "application/x-www-form-urlencoded", wantStatus: http.StatusUnsupportedMediaType},
+		{name: "missing, allowed", wantStatus: http.StatusBadRequest},
+		{name: "missing, required", requireContentType: true, wantStatus: http.StatusUnsupportedMediaType},
+		{name: "json with charset", contentType: "application/json; charset=utf-8", wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// An empty refresh_token stops the request with 400 once it
+			// gets past the Content-Type check.
+			h := &RefreshHandler{requireContentType: tt.requireContentType}
+			req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(`{}`))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rr := httptest.NewRecorder()
+			h.HandleRefresh(rr, req)
+
+			if rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rr.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestSetExpiries(t *testing.T) {
+	jm := newTestJWTManager(t)
+	now := time.Now()
+	absoluteTTL := 30 * 24 * time.Hour
+
+	prev := &jwt.RefreshToken{UserEmail: "user@example.com", OriginalIssuedAt: now.Add(-29 * 24 * time.Hour)}
+	refreshToken, err := jm.RotateRefreshToken(prev, prev.UserEmail, "oidc-refresh", 7*24*time.Hour)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+
+	h := &LoginHandler{jwtManager: jm, absoluteTTL: absoluteTTL, clock: clock.Real{}}
+	status := &StatusResponse{Ready: true, RefreshToken: refreshToken}
+	h.setExpiries(status, now)
+
+	// The refresh token has a week left but the session only a day.
+	if got, want := status.RefreshTokenExpiresIn, int64((7 * 24 * time.Hour).Seconds()); got < want-5 || got > want {
+		t.Errorf("RefreshTokenExpiresIn = %d, want ~%d", got, want)
+	}
+	if got, want := status.SessionExpiresIn, int64((24 * time.Hour).Seconds()); got < want-5 || got > want {
+		t.Errorf("SessionExpiresIn = %d, want ~%d", got, want)
+	}
+
+	h.absoluteTTL = 0
+	status = &StatusResponse{Ready: true, RefreshToken: refreshToken}
+	h.setExpiries(status, now)
+	if status.SessionExpiresIn != 0 {
+		t.Errorf("SessionExpiresIn = %d without an absolute TTL, want 0", status.SessionExpiresIn)
+	}
+}
+
+func TestCheckRotation(t *testing.T) {
+	jm := newTestJWTManager(t)
+	legacyToken, err := jm.RotateRefreshToken(&jwt.RefreshToken{UserEmail: "user@example.com", RotationCounter: 4}, "user@example.com", "oidc-refresh", time.Hour)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken: %v", err)
+	}
+	h := &RefreshHandler{jwtManager: jm, rotationWindow: 2, clock: clock.Real{}}
+
+	tests := []struct {
+		name       string
+		status     v1alpha1.OAuthSessionStatus
+		incoming   int
+		wantReplay bool
+	}{
+		{name: "current", status: v1alpha1.OAuthSessionStatus{RotationCounter: 3}, incoming: 3},
+		{name: "within window", status: v1alpha1.OAuthSessionStatus{RotationCounter: 3}, incoming: 5},
+		{name: "behind", status: v1alpha1.OAuthSessionStatus{RotationCounter: 3}, incoming: 2, wantReplay: true},
+		{name: "too far ahead", status: v1alpha1.OAuthSessionStatus{RotationCounter: 3}, incoming: 6, wantReplay: true},
+		{name: "legacy session uses token counter", status: v1alpha1.OAuthSessionStatus{RefreshToken: legacyToken}, incoming: 5},
+		{name: "legacy session replay", status: v1alpha1.OAuthSessionStatus{RefreshToken: legacyToken}, incoming: 4, wantReplay: true},
+		{name: "no stored token", incoming: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := h.checkRotation(&v1alpha1.OAuthSession{Status: tt.status}, tt.incoming)
+			if (err != nil) != tt.wantReplay {
+				t.Errorf("checkRotation() error = %v, wantReplay %v", err, tt.wantReplay)
+			}
+		})
+	}
+}
+
+// stubIdP is an OIDC provider whose token endpoint answers every grant,
+// refreshes included, with an ID token carrying the current claims, unless
+// rejectRefresh is set. Like a real IdP it redeems each code only once.
+type stubIdP struct {
+	srv      *httptest.Server
+	key      *rsa.PrivateKey
+	mu       sync.Mutex
+	claims   map[string]any
+	redeemed map[string]bool
+
+	rejectRefresh atomic.Bool
+
+	// verifier is the code_verifier of the last code exchange.
+	verifier string
+}
+
+func newStubIdP(t *testing.T) *stubIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &stubIdP{key: key, redeemed: make(map[string]bool)}
+	idp.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"issuer":                                idp.srv.URL,
+				"authorization_endpoint":                idp.srv.URL + "/auth",
+				"token_endpoint":                        idp.srv.URL + "/token",
+				"jwks_uri":                              idp.srv.URL + "/keys",
+				"id_token_signing_alg_values_supported": []string{"RS256"},
+			})
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			if r.FormValue("grant_type") == "refresh_token" && idp.rejectRefresh.Load() {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			if r.FormValue("grant_type") == "authorization_code" {
+				idp.mu.Lock()
+				spent := idp.redeemed[r.FormValue("code")]
+				idp.redeemed[r.FormValue("code")] = true
+				idp.verifier = r.FormValue("code_verifier")
+				idp.mu.Unlock()
+				if spent {
+					w.WriteHeader(http.StatusBadRequest)
+					_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+					return
+				}
+			}
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"access_token":  "access",
+				"token_type":    "Bearer",
+				"refresh_token": "oidc-refresh-2",
+				"expires_in":    3600,
+				"id_token":      idp.idToken(t),
+			})
+		case "/keys":
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &idp.key.PublicKey, Algorithm: "RS256", Use: "sig"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+// setClaims sets the claims, beyond iss, aud, sub and the timestamps, of
+// ID tokens issued from now on.
+func (idp *stubIdP) setClaims(claims map[string]any) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.claims = claims
+}
+
+// codeVerifier returns the code_verifier of the last code exchange.
+func (idp *stubIdP) codeVerifier() string {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	return idp.verifier
+}
+
+func (idp *stubIdP) idToken(t *testing.T) string {
+	t.Helper()
+	claims := map[string]any{
+		"iss": idp.srv.URL,
+		"aud": "kauth",
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	}
+	idp.mu.Lock()
+	maps.Copy(claims, idp.claims)
+	idp.mu.Unlock()
+	payload, _ := json.Marshal(claims)
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: idp.key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jws, err := signer.Sign(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func (idp *stubIdP) provider(t *testing.T) *oauth.Provider {
+	t.Helper()
+	p, err := oauth.NewProvider(context.Background(), oauth.Config{IssuerURL: idp.srv.URL, ClientID: "kauth", HTTPClient: idp.srv.Client()})
+	if err != nil {
+		t.Fatalf("NewProvider() error = %v", err)
+	}
+	return p
+}
+
+// newStubRefreshHandler returns a RefreshHandler backed by idp, and a
+// session-less refresh token for user@example.com to present to it.
+func newStubRefreshHandler(t *testing.T, idp *stubIdP, allowedGroups []string) (*RefreshHandler, string) {
+	t.Helper()
+	jm := newTestJWTManager(t)
+	refreshToken, err := jm.CreateRefreshToken("user@example.com", "oidc-refresh", "", 0, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+	h := &RefreshHandler{
+		provider:        idp.provider(t),
+		jwtManager:      jm,
+		kubeconfigGen:   &KubeconfigGenerator{ClusterName: "prod", ClusterServer: "https://k8s.example.com"},
+		refreshTokenTTL: time.Hour,
+		allowedGroups:   allowedGroups,
+		allowedSet:      newGroupSet(allowedGroups),
+		clock:           clock.Real{},
+	}
+	return h, refreshToken
+}
+
+func postRefresh(h *RefreshHandler, refreshToken string) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(RefreshRequest{RefreshToken: refreshToken})
+	req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	h.HandleRefresh(rr, req)
+	return rr
+}
+
+func TestHandleRefresh_RechecksAllowedGroups(t *testing.T) {
+	idp := newStubIdP(t)
+	h, refreshToken := newStubRefreshHandler(t, idp, []string{"admins"})
+
+	// Logged in as a member of admins, which the IdP still reports.
+	idp.setClaims(map[string]any{"email": "user@example.com", "groups": []string{"admins"}})
+	if rr := postRefresh(h, refreshToken); rr.Code != http.StatusOK {
+		t.Fatalf("refresh while allowed: status = %d, want 200 (body %s)", rr.Code, rr.Body)
+	}
+
+	// Since removed from admins in the IdP.
+	idp.setClaims(map[string]any{"email": "user@example.com", "groups": []string{"developers"}})
+	rr := postRefresh(h, refreshToken)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("refresh after removal: status = %d, want 403 (body %s)", rr.Code, rr.Body)
+	}
+	var errResp apierror.Response
+	if err := json.Unmarshal(rr.Body.Bytes(), &errResp); err != nil {
+		t.Fatalf("body is not a JSON error: %v", err)
+	}
+	if errResp.Code != apierror.CodeForbidden {
+		t.Errorf("code = %q, want %q", errResp.Code, apierror.CodeForbidden)
+	}
+}
+
+func TestHandleRefresh_RequiredClaims(t *testing.T) {
+	idp := newStubIdP(t)
+	h, refreshToken := newStubRefreshHandler(t, idp, nil)
+	h.requiredClaims = RequiredClaims{"tenant": {"acme"}, "mfa": {"true"}}
+
+	tests := []struct {
+		name       string
+		claims     map[string]any
+		wantStatus int
+	}{
+		{name: "match", claims: map[string]any{"email": "user@example.com", "tenant": "acme", "mfa": true}, wantStatus: http.StatusOK},
+		{name: "mismatch", claims: map[string]any{"email": "user@example.com", "tenant": "other", "mfa": true}, wantStatus: http.StatusForbidden},
+		{name: "missing claim", claims: map[string]any{"email": "user@example.com", "tenant": "acme"}, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp.setClaims(tt.claims)
+			if rr := postRefresh(h, refreshToken); rr.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d (body %s)", rr.Code, tt.wantStatus, rr.Body)
+			}
+		})
+	}
+}
+
+// fakeRefreshStore implements refreshSessionStore with an Active session
+// whose Rotate fails with rotateErr.
+type fakeRefreshStore struct {
+	rotateErr error
+}
+
+func (f *fakeRefreshStore) Get(_ context.Context, sessionID string) (*v1alpha1.OAuthSession, error) {
+	return &v1alpha1.OAuthSession{
+		Spec:   v1alpha1.OAuthSessionSpec{SessionID: sessionID},
+		Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive},
+	}, nil
+}
+
+func (f *fakeRefreshStore) ValidateSession(_ context.Context, _ string, _ v1alpha1.SessionPhase) error {
+	return nil
+}
+
+func (f *fakeRefreshStore) UpdateLastUsed(_ context.Context, _ string) error { return nil }
+
+func (f *fakeRefreshStore) Rotate(_ context.Context, _ string, _ func(*v1alpha1.OAuthSession) error, _ func(*v1alpha1.OAuthSessionStatus)) error {
+	return f.rotateErr
+}
+
+func TestHandleRefresh_RotateFailure(t *testing.T) {
+	idp := newStubIdP(t)
+	idp.setClaims(map[string]any{"email": "user@example.com"})
+	h, _ := newStubRefreshHandler(t, idp, nil)
+	refreshToken, err := h.jwtManager.CreateRefreshToken("user@example.com", "oidc-refresh", "session-1", 0, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+
+	gr := schema.GroupResource{Group: "kauth.io", Resource: "oauthsessions"}
+	tests := []struct {
+		name       string
+		rotateErr  error
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "stored", rotateErr: nil, wantStatus: http.StatusOK},
+		{name: "session deleted", rotateErr: fmt.Errorf("failed to get session: %w", apierrors.NewNotFound(gr, "session-1")), wantStatus: http.StatusUnauthorized, wantCode: apierror.CodeSessionInactive},
+		{name: "session revoked", rotateErr: fmt.Errorf("%w: session is Revoked", session.ErrSessionNotActive), wantStatus: http.StatusUnauthorized, wantCode: apierror.CodeSessionInactive},
+		{name: "API server error", rotateErr: errors.New("failed to update status: etcdserver: request timed out"), wantStatus: http.StatusServiceUnavailable, wantCode: apierror.CodeInternal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.sessionClient = &fakeRefreshStore{rotateErr: tt.rotateErr}
+			rr := postRefresh(h, refreshToken)
+			if rr.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d (body %s)", rr.Code, tt.wantStatus, rr.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var errResp apierror.Response
+			if err := json.Unmarshal(rr.Body.Bytes(), &errResp); err != nil {
+				t.Fatalf("body is not a JSON error: %v", err)
+			}
+			if errResp.Code != tt.wantCode {
+				t.Errorf("code = %q, want %q", errResp.Code, tt.wantCode)
+			}
+			if strings.Contains(rr.Body.String(), "refresh_token") {
+				t.Errorf("tokens issued despite the failed rotation: %s", rr.Body)
+			}
+		})
+	}
+}
+
+func TestSetExpiries_NoRefreshTokenWarning(t *testing.T) {
+	jm := newTestJWTManager(t)
+	h := &LoginHandler{jwtManager: jm, clock: clock.Real{}}
+	now := time.Now()
+
+	webhookToken, err := jm.CreateWebhookToken("session-1", 7*24*time.Hour)
+	if err != nil {
+		t.Fatalf("CreateWebhookToken: %v", err)
+	}
+	withIdP, err := jm.CreateRefreshToken("user@example.com", "oidc-refresh", "session-1", 0, 7*24*time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+	withoutIdP, err := jm.CreateRefreshToken("user@example.com", "", "session-1", 0, 7*24*time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken: %v", err)
+	}
+
+	status := &StatusResponse{Ready: true, RefreshToken: withIdP, WebhookToken: webhookToken}
+	h.setExpiries(status, now)
+	if status.Warning != "" {
+		t.Errorf("Warning = %q with an IdP refresh token, want none", status.Warning)
+	}
+
+	status = &StatusResponse{Ready: true, RefreshToken: withoutIdP, WebhookToken: webhookToken}
+	h.setExpiries(status, now)
+	if want := noRefreshTokenWarning(status.SessionExpiry); status.SessionExpiry.IsZero() || status.Warning != want {
+		t.Errorf("Warning = %q, want %q", status.Warning, want)
+	}
+	if !strings.Contains(status.Warning, status.SessionExpiry.UTC().Format("2006-01-02 15:04")) {
+		t.Errorf("Warning %q does not name the session expiry %v", status.Warning, status.SessionExpiry)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"time"
 
+	"kauth/pkg/apierror"
 	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
 	"kauth/pkg/audit"
 	"kauth/pkg/session"
@@ -33,25 +34,24 @@ func NewRevokeHandler(sessionClient *session.Client, adminGroups []string) *Revo
 }
 
 func (h *RevokeHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if !allowMethod(w, r, http.MethodPost) {
 		return
 	}
 
 	caller := getCaller(r.Context())
 	if caller == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Unauthorized")
 		return
 	}
 
 	var req RevokeRequest
 	if err := decodeJSON(r, &req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeDecodeError(w, err)
 		return
 	}
 
 	if req.SessionID == "" && req.UserEmail == "" {
-		http.Error(w, "Either session_id or user_email is required", http.StatusBadRequest)
+		apierror.Write(w, http.StatusBadRequest, apierror.CodeInvalidRequest, "Either session_id or user_email is required")
 		return
 	}
 
@@ -68,7 +68,7 @@ func (h *RevokeHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 		s, err := h.sessionClient.Get(ctx, req.SessionID)
 		if err != nil {
 			slog.WarnContext(ctx, "revoke: session not found", "session_id", req.SessionID, "error", err)
-			http.Error(w, "Session not found", http.StatusNotFound)
+			apierror.Write(w, http.StatusNotFound, apierror.CodeSessionNotFound, "Session not found")
 			return
 		}
 		singleSess = s
@@ -78,7 +78,7 @@ func (h *RevokeHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 				"caller", caller.Email,
 				"owner", singleSess.Status.Email,
 			)
-			http.Error(w, "Forbidden: not your session", http.StatusForbidden)
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "Forbidden: not your session")
 			return
 		}
 	}
@@ -88,7 +88,7 @@ func (h *RevokeHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 				"target_user", req.UserEmail,
 				"caller", caller.Email,
 			)
-			http.Error(w, "Forbidden: admin access required", http.StatusForbidden)
+			apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "Forbidden: admin access required")
 			return
 		}
 	}
@@ -98,15 +98,11 @@ func (h *RevokeHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 	if singleSess != nil {
 		if err := h.sessionClient.Revoke(ctx, req.SessionID); err != nil {
 			slog.ErrorContext(ctx, "revoke: failed to revoke session", "session_id", req.SessionID, "error", err)
-			http.Error(w, "Failed to revoke session", http.StatusInternalServerError)
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to revoke session")
 			return
 		}
 		revoked = 1
-		audit.Log(ctx, r, "session_revoked",
-			"session_id", req.SessionID,
-			"owner", singleSess.Status.Email,
-			"caller", caller.Email,
-		)
+		audit.Revoke(ctx, r, caller.Email, singleSess.Status.Email, req.SessionID, 1)
 		slog.InfoContext(ctx, "revoke: session revoked", "session_id", req.SessionID, "owner", singleSess.Status.Email, "by", caller.Email)
 	}
 
@@ -115,7 +111,7 @@ func (h *RevokeHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 		sessions, err := h.sessionClient.GetByUser(ctx, req.UserEmail)
 		if err != nil {
 			slog.ErrorContext(ctx, "revoke: failed to list user sessions", "user_email", req.UserEmail, "error", err)
-			http.Error(w, "Failed to find user sessions", http.StatusInternalServerError)
+			apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to find user sessions")
 			return
 		}
 
@@ -133,11 +129,7 @@ func (h *RevokeHandler) HandleRevoke(w http.ResponseWriter, r *http.Request) {
 			revoked++
 		}
 
-		audit.Log(ctx, r, "sessions_revoked",
-			"user_email", req.UserEmail,
-			"count", revoked,
-			"caller", caller.Email,
-		)
+		audit.Revoke(ctx, r, caller.Email, req.UserEmail, "", revoked)
 		slog.InfoContext(ctx, "revoke: user sessions revoked", "user_email", req.UserEmail, "count", revoked, "by", caller.Email)
 	}
 
@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"time"
 
+	"kauth/pkg/apierror"
 	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
 	"kauth/pkg/session"
 )
@@ -38,14 +39,13 @@ func NewSessionsHandler(sessionClient *session.Client, adminGroups []string) *Se
 }
 
 func (h *SessionsHandler) HandleListSessions(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if !allowMethod(w, r, http.MethodGet) {
 		return
 	}
 
 	caller := getCaller(r.Context())
 	if caller == nil {
-		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		apierror.Write(w, http.StatusUnauthorized, apierror.CodeUnauthorized, "Unauthorized")
 		return
 	}
 
@@ -73,7 +73,7 @@ func (h *SessionsHandler) HandleListSessions(w http.ResponseWriter, r *http.Requ
 	}
 
 	if err != nil {
-		http.Error(w, "Failed to list sessions", http.StatusInternalServerError)
+		apierror.Write(w, http.StatusInternalServerError, apierror.CodeInternal, "Failed to list sessions")
 		return
 	}
 
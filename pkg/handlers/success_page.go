@@ -0,0 +1,31 @@
+package handlers
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+)
+
+// SuccessPageData is the data passed to a custom success-page template.
+type SuccessPageData struct {
+	ClusterName string // Cluster the user logged in to
+	UserEmail   string // Email claim of the authenticated user
+	Warning     string // Caveat about the session, e.g. that it cannot be renewed; usually empty
+}
+
+// LoadSuccessTemplate parses the html/template at path for use as the login
+// success page. An empty path returns nil, selecting the built-in page.
+func LoadSuccessTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read success template: %w", err)
+	}
+	tmpl, err := template.New("success").Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse success template %s: %w", path, err)
+	}
+	return tmpl, nil
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"sync"
+	"time"
+
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+	"kauth/pkg/metrics"
+)
+
+// uniqueUserWindows are the trailing windows reported as the time_window
+// label of kauth_unique_users.
+var uniqueUserWindows = []struct {
+	label  string
+	window time.Duration
+}{
+	{"1h", time.Hour},
+	{"24h", 24 * time.Hour},
+}
+
+// uniqueUsers tracks each user's latest completed login, keyed by email,
+// and publishes the distinct count per window to metrics.UniqueUsers. Like
+// pendingSessions it is fed by the session informer, which sees every
+// replica's sessions and relists them on start, so the count is
+// cluster-wide and survives restarts.
+type uniqueUsers struct {
+	mu        sync.Mutex
+	lastLogin map[string]time.Time
+}
+
+func newUniqueUsers() *uniqueUsers {
+	return &uniqueUsers{lastLogin: make(map[string]time.Time)}
+}
+
+// observe records the login of s if it has completed.
+func (u *uniqueUsers) observe(s *v1alpha1.OAuthSession) {
+	if s.Status.Phase != v1alpha1.SessionActive || s.Status.Email == "" || s.Status.CompletedAt == nil {
+		return
+	}
+	u.record(s.Status.Email, s.Status.CompletedAt.Time, time.Now())
+}
+
+// record notes a login by email at, then refreshes the gauges as of now.
+func (u *uniqueUsers) record(email string, at, now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if at.After(u.lastLogin[email]) {
+		u.lastLogin[email] = at
+	}
+	u.publishLocked(now)
+}
+
+// prune drops logins older than the longest window and refreshes the
+// gauges as of now.
+func (u *uniqueUsers) prune(now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.publishLocked(now)
+}
+
+func (u *uniqueUsers) publishLocked(now time.Time) {
+	counts := make([]int64, len(uniqueUserWindows))
+	longest := uniqueUserWindows[len(uniqueUserWindows)-1].window
+	for email, at := range u.lastLogin {
+		age := now.Sub(at)
+		if age > longest {
+			delete(u.lastLogin, email)
+			continue
+		}
+		for i, w := range uniqueUserWindows {
+			if age <= w.window {
+				counts[i]++
+			}
+		}
+	}
+	for i, w := range uniqueUserWindows {
+		metrics.UniqueUsers.WithLabel(w.label).Set(counts[i])
+	}
+}
@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+	"kauth/pkg/metrics"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestUniqueUsers(t *testing.T) {
+	now := time.Now()
+	u := newUniqueUsers()
+	gauge := func(window string) int64 { return metrics.UniqueUsers.WithLabel(window).Value() }
+
+	login := func(id, email string, at time.Time) *v1alpha1.OAuthSession {
+		completed := metav1.NewTime(at)
+		return &v1alpha1.OAuthSession{
+			Spec:   v1alpha1.OAuthSessionSpec{SessionID: id},
+			Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, Email: email, CompletedAt: &completed},
+		}
+	}
+
+	// Two logins by the same user are one unique user.
+	u.observe(login("s1", "alice@example.com", now.Add(-10*time.Minute)))
+	u.observe(login("s2", "alice@example.com", now.Add(-time.Minute)))
+	if gauge("1h") != 1 || gauge("24h") != 1 {
+		t.Errorf("unique users = %d/%d, want 1/1", gauge("1h"), gauge("24h"))
+	}
+
+	// Pending sessions and other users.
+	u.observe(&v1alpha1.OAuthSession{Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending, Email: "carol@example.com"}})
+	u.observe(login("s3", "bob@example.com", now.Add(-3*time.Hour)))
+	if gauge("1h") != 1 || gauge("24h") != 2 {
+		t.Errorf("unique users = %d/%d, want 1/2", gauge("1h"), gauge("24h"))
+	}
+
+	// A day later both have aged out of every window.
+	u.prune(now.Add(25 * time.Hour))
+	if gauge("1h") != 0 || gauge("24h") != 0 {
+		t.Errorf("unique users after a day = %d/%d, want 0/0", gauge("1h"), gauge("24h"))
+	}
+	if len(u.lastLogin) != 0 {
+		t.Errorf("lastLogin has %d entries after pruning, want 0", len(u.lastLogin))
+	}
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"context"
+	"errors"
 	"log/slog"
 	"net/http"
 	"time"
@@ -45,12 +46,17 @@ func NewWebhookHandler(jwtManager *jwt.Manager, sessionClient *session.Client) *
 // a malformed request itself yields a non-200 status.
 func (h *WebhookHandler) HandleTokenReview(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
 	var req authnv1.TokenReview
 	if err := decodeJSON(r, &req); err != nil {
+		if bodyTooLarge(err) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
@@ -90,10 +96,14 @@ func (h *WebhookHandler) HandleTokenReview(w http.ResponseWriter, r *http.Reques
 }
 
 // authenticate decrypts the webhook token, looks up the session CRD, and
-// returns the user's email and groups on success. On failure it returns a
+// returns the user's identity (the USERNAME_CLAIM value the session was
+// issued for, as in its kubeconfig) and groups on success. On failure it returns a
 // short reason string (for audit/logging only; not surfaced to the API server).
 func (h *WebhookHandler) authenticate(ctx context.Context, rawToken string) (username string, groups []string, reason string) {
 	cred, err := h.jwtManager.ValidateWebhookToken(rawToken)
+	if errors.Is(err, jwt.ErrTokenPredatesCutoff) {
+		return "", nil, "webhook token predates cutoff"
+	}
 	if err != nil {
 		return "", nil, "invalid webhook token"
 	}
@@ -107,5 +117,9 @@ func (h *WebhookHandler) authenticate(ctx context.Context, rawToken string) (use
 		return "", nil, "session not active"
 	}
 
-	return sess.Status.Email, sess.Status.Groups, ""
+	identity := sessionIdentity(sess)
+	if identity == "" {
+		return "", nil, "session has no user identity"
+	}
+	return identity, sess.Status.Groups, ""
 }
@@ -8,6 +8,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
 	"kauth/pkg/jwt"
@@ -44,11 +45,11 @@ func revokedSession(email string) *v1alpha1.OAuthSession {
 	}
 }
 
-func newTestJWTManager(t *testing.T) *jwt.Manager {
+func newTestJWTManager(t *testing.T, opts ...jwt.Option) *jwt.Manager {
 	t.Helper()
 	sigKey := make([]byte, 32)
 	encKey := make([]byte, 32)
-	m, err := jwt.NewManager(sigKey, encKey)
+	m, err := jwt.NewManager(sigKey, encKey, opts...)
 	if err != nil {
 		t.Fatalf("NewManager: %v", err)
 	}
@@ -103,6 +104,28 @@ func TestHandleTokenReview_Authentication(t *testing.T) {
 			wantUsername:  email,
 			wantGroupsLen: 2,
 		},
+		{
+			name:  "username is the session's identity, not its email",
+			token: validToken,
+			session: &fakeSessionGetter{session: &v1alpha1.OAuthSession{
+				Spec:   v1alpha1.OAuthSessionSpec{UserID: "user-1"},
+				Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, Email: email, Groups: groups},
+			}},
+			wantAuthd:     true,
+			wantUsername:  "user-1",
+			wantGroupsLen: 2,
+		},
+		{
+			name:  "session without an email uses its identity",
+			token: validToken,
+			session: &fakeSessionGetter{session: &v1alpha1.OAuthSession{
+				Spec:   v1alpha1.OAuthSessionSpec{UserID: "user-1"},
+				Status: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, Groups: groups},
+			}},
+			wantAuthd:     true,
+			wantUsername:  "user-1",
+			wantGroupsLen: 2,
+		},
 		{
 			name:      "valid token with revoked session",
 			token:     validToken,
@@ -167,6 +190,26 @@ func TestHandleTokenReview_Authentication(t *testing.T) {
 	}
 }
 
+func TestHandleTokenReview_RejectsCredentialsBeforeCutoff(t *testing.T) {
+	jm := newTestJWTManager(t)
+	token, err := jm.CreateWebhookToken("sess-abc", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateWebhookToken: %v", err)
+	}
+	h := &WebhookHandler{jwtManager: jm, sessionClient: &fakeSessionGetter{session: activeSession("user@example.com", nil)}}
+
+	if resp := decodeReview(t, postTokenReview(t, h, token)); !resp.Status.Authenticated {
+		t.Fatal("credential rejected before the cutoff was set")
+	}
+
+	// The kill switch logs out the cluster credential as well as the
+	// refresh token, without waiting for it to expire.
+	jm.SetMinIssuedAt(time.Now().Add(time.Second))
+	if resp := decodeReview(t, postTokenReview(t, h, token)); resp.Status.Authenticated {
+		t.Error("credential from before the cutoff authenticated")
+	}
+}
+
 func TestHandleTokenReview_WrongMethod(t *testing.T) {
 	h := &WebhookHandler{jwtManager: newTestJWTManager(t), sessionClient: &fakeSessionGetter{}}
 	req := httptest.NewRequest(http.MethodGet, "/webhook/token-review", nil)
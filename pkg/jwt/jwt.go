@@ -1,8 +1,11 @@
 package jwt
 
 import (
+	"bytes"
+	"compress/flate"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -11,19 +14,30 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sync/atomic"
 	"time"
+
+	"kauth/pkg/clock"
+
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 var (
-	ErrInvalidToken     = errors.New("invalid token")
-	ErrExpiredToken     = errors.New("token expired")
-	ErrInvalidSignature = errors.New("invalid signature")
+	ErrInvalidToken        = errors.New("invalid token")
+	ErrExpiredToken        = errors.New("token expired")
+	ErrInvalidSignature    = errors.New("invalid signature")
+	ErrWrongAudience       = errors.New("token issued for a different issuer or audience")
+	ErrNonceMismatch       = errors.New("nonce does not match state")
+	ErrSessionExpired      = errors.New("session exceeded its maximum lifetime")
+	ErrTokenPredatesCutoff = errors.New("token issued before the configured cutoff")
 )
 
 // SessionToken contains OAuth flow state (encrypted, signed)
 type SessionToken struct {
 	SessionID string    `json:"sessionID"`
 	Verifier  string    `json:"verifier"`
+	Issuer    string    `json:"issuer,omitempty"`
+	Audience  string    `json:"audience,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
@@ -32,7 +46,11 @@ type SessionToken struct {
 // presents to the kauth webhook. It contains only the session ID; the webhook
 // decrypts it and looks up the CRD for current status (email, groups, phase).
 type WebhookCredential struct {
-	SessionID string    `json:"sessionID"`
+	SessionID string `json:"sessionID"`
+	// IssuedAt is when the login that minted the credential completed.
+	// Credentials from before it was recorded have the zero time, so any
+	// MinIssuedAt cutoff rejects them.
+	IssuedAt  time.Time `json:"issued_at,omitzero"`
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
@@ -42,39 +60,248 @@ type RefreshToken struct {
 	OIDCRefreshToken string    `json:"oidc_refresh_token"`
 	RotationCounter  int       `json:"rotation_counter"`
 	SessionID        string    `json:"session_id"`
+	Issuer           string    `json:"issuer,omitempty"`
+	Audience         string    `json:"audience,omitempty"`
 	IssuedAt         time.Time `json:"issued_at"`
 	ExpiresAt        time.Time `json:"expires_at"`
+
+	// OriginalIssuedAt is when the login that started this chain of
+	// rotations happened. It is carried unchanged through rotations so the
+	// session's total lifetime can be capped.
+	OriginalIssuedAt time.Time `json:"original_issued_at,omitzero"`
+}
+
+// SessionStart returns when the login behind this refresh token happened.
+// Tokens minted before OriginalIssuedAt existed fall back to IssuedAt.
+func (r *RefreshToken) SessionStart() time.Time {
+	if r.OriginalIssuedAt.IsZero() {
+		return r.IssuedAt
+	}
+	return r.OriginalIssuedAt
+}
+
+// CheckSessionAge returns ErrSessionExpired if more than maxAge has passed
+// between SessionStart and now. maxAge 0 means no limit.
+func (r *RefreshToken) CheckSessionAge(maxAge time.Duration, now time.Time) error {
+	if maxAge > 0 && now.Sub(r.SessionStart()) > maxAge {
+		return ErrSessionExpired
+	}
+	return nil
 }
 
+// Algorithm names the AEAD used to encrypt token payloads.
+type Algorithm string
+
+const (
+	// AlgorithmAESGCM is AES-256-GCM, fastest on hardware with AES-NI.
+	AlgorithmAESGCM Algorithm = "aes-gcm"
+	// AlgorithmChaCha20Poly1305 is faster and constant-time on CPUs
+	// without AES acceleration, such as some ARM edge nodes.
+	AlgorithmChaCha20Poly1305 Algorithm = "chacha20poly1305"
+)
+
+// Algorithm IDs written as the first byte of the encrypted envelope so tokens
+// self-describe which cipher sealed them.
+const (
+	algIDAESGCM           byte = 0x01
+	algIDChaCha20Poly1305 byte = 0x02
+)
+
 // Manager handles JWT creation and validation
 type Manager struct {
 	signingKey    []byte
 	encryptionKey []byte
+
+	// algorithm seals new tokens. Tokens sealed with any supported algorithm
+	// remain valid, so switching algorithms does not log users out.
+	algorithm Algorithm
+
+	// issuer and audience are stamped into session and refresh tokens and
+	// required to match on validation, so a signing key shared between two
+	// deployments cannot be used to replay tokens across them.
+	issuer   string
+	audience string
+	// unscopedUntil, if set, is when tokens minted before issuer and
+	// audience were stamped stop being accepted.
+	unscopedUntil time.Time
+
+	// compress enables DEFLATE compression of token payloads before
+	// encryption. Decoding handles both forms regardless of this setting.
+	compress bool
+
+	// signer, if set, signs new tokens with Ed25519 (v3 envelopes) so
+	// holders of the public key can check a token came from this server.
+	// HMAC-signed tokens stay valid, so enabling it does not log users out.
+	signer ed25519.PrivateKey
+
+	// minIssuedAt, if set, rejects session, refresh and webhook tokens from
+	// logins before it: a kill switch that logs everyone out without
+	// rotating keys.
+	// It can change at runtime (SetMinIssuedAt).
+	minIssuedAt atomic.Pointer[time.Time]
+
+	// clock supplies the time tokens are issued and checked at.
+	clock clock.Clock
+}
+
+// ClockSkew is how far in the future a token's issue time may be, to allow
+// for clock differences between replicas.
+const ClockSkew = time.Minute
+
+// Option configures optional Manager behaviour.
+type Option func(*Manager)
+
+// WithIssuer sets the issuer (typically the server's base URL) stamped into
+// and required on session and refresh tokens.
+func WithIssuer(issuer string) Option {
+	return func(m *Manager) { m.issuer = issuer }
+}
+
+// WithAudience sets the audience (typically the cluster name) stamped into
+// and required on session and refresh tokens.
+func WithAudience(audience string) Option {
+	return func(m *Manager) { m.audience = audience }
+}
+
+// WithUnscopedTokensUntil accepts session and refresh tokens that carry no
+// issuer or audience, minted before tokens were scoped to a deployment,
+// until t. It lets an upgrade keep existing logins: a refresh token lives at
+// most one refresh TTL, and rotating it stamps the issuer and audience. t must
+// be a fixed point in time, not one derived from startup, or every restart
+// would reopen the window.
+func WithUnscopedTokensUntil(t time.Time) Option {
+	return func(m *Manager) { m.unscopedUntil = t }
+}
+
+// WithCompression compresses token payloads before encryption whenever that
+// makes them smaller. Refresh tokens embed the provider's refresh token, which
+// for some IdPs is a multi-kilobyte JWT that would otherwise push the kauth
+// token past common header and URL limits.
+func WithCompression() Option {
+	return func(m *Manager) { m.compress = true }
+}
+
+// WithAlgorithm selects the AEAD used for new tokens (default aes-gcm).
+func WithAlgorithm(alg Algorithm) Option {
+	return func(m *Manager) { m.algorithm = alg }
+}
+
+// WithEd25519Signer signs new tokens with key instead of HMAC. The matching
+// public key is returned by PublicKey for publishing as a JWKS.
+func WithEd25519Signer(key ed25519.PrivateKey) Option {
+	return func(m *Manager) { m.signer = key }
+}
+
+// WithMinIssuedAt rejects session and refresh tokens and webhook credentials
+// issued before t with ErrTokenPredatesCutoff. For refresh tokens this is
+// the time of the original login, so rotating does not carry a session past
+// it. The zero time disables it.
+func WithMinIssuedAt(t time.Time) Option {
+	return func(m *Manager) { m.SetMinIssuedAt(t) }
+}
+
+// WithClock sets the clock tokens are issued and checked against (default:
+// the system clock).
+func WithClock(c clock.Clock) Option {
+	return func(m *Manager) { m.clock = c }
 }
 
 // NewManager creates a new JWT manager
 // signingKey: 32+ bytes for HMAC-SHA256
-// encryptionKey: 32 bytes for AES-256
-func NewManager(signingKey, encryptionKey []byte) (*Manager, error) {
+// encryptionKey: 32 bytes for AES-256 or ChaCha20-Poly1305
+func NewManager(signingKey, encryptionKey []byte, opts ...Option) (*Manager, error) {
 	if len(signingKey) < 32 {
 		return nil, errors.New("signing key must be at least 32 bytes")
 	}
-	if len(encryptionKey) != 32 {
-		return nil, errors.New("encryption key must be exactly 32 bytes for AES-256")
-	}
 
-	return &Manager{
+	m := &Manager{
 		signingKey:    signingKey,
 		encryptionKey: encryptionKey,
-	}, nil
+		algorithm:     AlgorithmAESGCM,
+		clock:         clock.Real{},
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	switch m.algorithm {
+	case AlgorithmAESGCM:
+		if len(encryptionKey) != 32 {
+			return nil, errors.New("encryption key must be exactly 32 bytes for AES-256")
+		}
+	case AlgorithmChaCha20Poly1305:
+		if len(encryptionKey) != chacha20poly1305.KeySize {
+			return nil, fmt.Errorf("encryption key must be exactly %d bytes for ChaCha20-Poly1305", chacha20poly1305.KeySize)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", m.algorithm)
+	}
+	if m.signer != nil && len(m.signer) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("Ed25519 signing key must be %d bytes", ed25519.PrivateKeySize)
+	}
+	return m, nil
+}
+
+// PublicKey returns the Ed25519 public key that verifies tokens signed by
+// this manager, or nil if tokens are HMAC-signed.
+func (m *Manager) PublicKey() ed25519.PublicKey {
+	if m.signer == nil {
+		return nil
+	}
+	return m.signer.Public().(ed25519.PublicKey)
+}
+
+// SetMinIssuedAt changes the cutoff set by WithMinIssuedAt. Tokens already
+// validated are unaffected; every later validation uses the new cutoff.
+func (m *Manager) SetMinIssuedAt(t time.Time) {
+	if t.IsZero() {
+		m.minIssuedAt.Store(nil)
+		return
+	}
+	m.minIssuedAt.Store(&t)
+}
+
+// MinIssuedAt returns the current cutoff, or the zero time if there is none.
+func (m *Manager) MinIssuedAt() time.Time {
+	if t := m.minIssuedAt.Load(); t != nil {
+		return *t
+	}
+	return time.Time{}
+}
+
+// checkIssuedAt rejects tokens issued more than ClockSkew in the future
+// (ErrInvalidToken) and logins that predate the cutoff
+// (ErrTokenPredatesCutoff). A login exactly at the cutoff is accepted.
+func (m *Manager) checkIssuedAt(issuedAt, loginAt, now time.Time) error {
+	if issuedAt.After(now.Add(ClockSkew)) {
+		return ErrInvalidToken
+	}
+	if cutoff := m.minIssuedAt.Load(); cutoff != nil && loginAt.Before(*cutoff) {
+		return ErrTokenPredatesCutoff
+	}
+	return nil
+}
+
+// checkAudience verifies that a token was issued by this deployment, or is
+// an unscoped token still within WithUnscopedTokensUntil.
+func (m *Manager) checkAudience(issuer, audience string) error {
+	if issuer == "" && audience == "" && m.clock.Now().Before(m.unscopedUntil) {
+		return nil
+	}
+	if issuer != m.issuer || audience != m.audience {
+		return ErrWrongAudience
+	}
+	return nil
 }
 
 // CreateSessionToken creates an encrypted and signed session token
 func (m *Manager) CreateSessionToken(sessionID, verifier string, ttl time.Duration) (string, error) {
-	now := time.Now()
+	now := m.clock.Now()
 	session := SessionToken{
 		SessionID: sessionID,
 		Verifier:  verifier,
+		Issuer:    m.issuer,
+		Audience:  m.audience,
 		CreatedAt: now,
 		ExpiresAt: now.Add(ttl),
 	}
@@ -85,46 +312,40 @@ func (m *Manager) CreateSessionToken(sessionID, verifier string, ttl time.Durati
 		return "", fmt.Errorf("failed to marshal session: %w", err)
 	}
 
-	// Encrypt
-	encrypted, err := m.encrypt(data)
+	// Encrypt and sign
+	token, err := m.seal(data)
 	if err != nil {
 		return "", fmt.Errorf("failed to encrypt session: %w", err)
 	}
 
-	// Sign
-	signed := m.sign(encrypted)
-
-	return base64.URLEncoding.EncodeToString(signed), nil
+	return token, nil
 }
 
 // ValidateSessionToken validates and decrypts a session token
 func (m *Manager) ValidateSessionToken(token string) (*SessionToken, error) {
-	// Decode base64
-	signed, err := base64.URLEncoding.DecodeString(token)
-	if err != nil {
-		return nil, ErrInvalidToken
-	}
-
-	// Verify signature
-	encrypted, err := m.verify(signed)
+	// Verify and decrypt
+	data, err := m.unseal(token, "session")
 	if err != nil {
 		return nil, err
 	}
 
-	// Decrypt
-	data, err := m.decrypt(encrypted)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt session: %w", err)
-	}
-
 	// Unmarshal
 	var session SessionToken
 	if err := json.Unmarshal(data, &session); err != nil {
 		return nil, ErrInvalidToken
 	}
 
+	if err := m.checkAudience(session.Issuer, session.Audience); err != nil {
+		return nil, err
+	}
+
+	now := m.clock.Now()
+	if err := m.checkIssuedAt(session.CreatedAt, session.CreatedAt, now); err != nil {
+		return nil, err
+	}
+
 	// Check expiry
-	if time.Now().After(session.ExpiresAt) {
+	if now.After(session.ExpiresAt) {
 		return nil, ErrExpiredToken
 	}
 
@@ -133,15 +354,36 @@ func (m *Manager) ValidateSessionToken(token string) (*SessionToken, error) {
 
 // CreateRefreshToken creates an encrypted and signed refresh token
 func (m *Manager) CreateRefreshToken(userEmail, oidcRefreshToken, sessionID string, rotationCounter int, ttl time.Duration) (string, error) {
-	now := time.Now()
-	refresh := RefreshToken{
+	now := m.clock.Now()
+	return m.sealRefreshToken(RefreshToken{
 		UserEmail:        userEmail,
 		OIDCRefreshToken: oidcRefreshToken,
 		RotationCounter:  rotationCounter,
 		SessionID:        sessionID,
 		IssuedAt:         now,
 		ExpiresAt:        now.Add(ttl),
-	}
+		OriginalIssuedAt: now,
+	})
+}
+
+// RotateRefreshToken creates the successor of prev: same session, rotation
+// counter incremented, and prev's SessionStart carried over.
+func (m *Manager) RotateRefreshToken(prev *RefreshToken, userEmail, oidcRefreshToken string, ttl time.Duration) (string, error) {
+	now := m.clock.Now()
+	return m.sealRefreshToken(RefreshToken{
+		UserEmail:        userEmail,
+		OIDCRefreshToken: oidcRefreshToken,
+		RotationCounter:  prev.RotationCounter + 1,
+		SessionID:        prev.SessionID,
+		IssuedAt:         now,
+		ExpiresAt:        now.Add(ttl),
+		OriginalIssuedAt: prev.SessionStart(),
+	})
+}
+
+func (m *Manager) sealRefreshToken(refresh RefreshToken) (string, error) {
+	refresh.Issuer = m.issuer
+	refresh.Audience = m.audience
 
 	// Marshal to JSON
 	data, err := json.Marshal(refresh)
@@ -149,34 +391,23 @@ func (m *Manager) CreateRefreshToken(userEmail, oidcRefreshToken, sessionID stri
 		return "", fmt.Errorf("failed to marshal refresh token: %w", err)
 	}
 
-	// Encrypt
-	encrypted, err := m.encrypt(data)
+	// Encrypt and sign
+	token, err := m.seal(data)
 	if err != nil {
 		return "", fmt.Errorf("failed to encrypt refresh token: %w", err)
 	}
 
-	// Sign
-	signed := m.sign(encrypted)
-
-	return base64.URLEncoding.EncodeToString(signed), nil
+	return token, nil
 }
 
 // DecodeRefreshToken decodes and decrypts a refresh token without checking expiry.
 // Use ValidateRefreshToken for normal validation; this is for comparing rotation
 // counters against a stored (possibly expired) token.
 func (m *Manager) DecodeRefreshToken(token string) (*RefreshToken, error) {
-	signed, err := base64.URLEncoding.DecodeString(token)
-	if err != nil {
-		return nil, ErrInvalidToken
-	}
-	encrypted, err := m.verify(signed)
+	data, err := m.unseal(token, "refresh token")
 	if err != nil {
 		return nil, err
 	}
-	data, err := m.decrypt(encrypted)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt refresh token: %w", err)
-	}
 	var refresh RefreshToken
 	if err := json.Unmarshal(data, &refresh); err != nil {
 		return nil, ErrInvalidToken
@@ -190,7 +421,14 @@ func (m *Manager) ValidateRefreshToken(token string) (*RefreshToken, error) {
 	if err != nil {
 		return nil, err
 	}
-	if time.Now().After(refresh.ExpiresAt) {
+	if err := m.checkAudience(refresh.Issuer, refresh.Audience); err != nil {
+		return nil, err
+	}
+	now := m.clock.Now()
+	if err := m.checkIssuedAt(refresh.IssuedAt, refresh.SessionStart(), now); err != nil {
+		return nil, err
+	}
+	if now.After(refresh.ExpiresAt) {
 		return nil, ErrExpiredToken
 	}
 	return refresh, nil
@@ -200,9 +438,11 @@ func (m *Manager) ValidateRefreshToken(token string) (*RefreshToken, error) {
 // the session ID. The API server presents this opaque blob to the kauth webhook,
 // which decrypts it and performs a CRD lookup for current session status.
 func (m *Manager) CreateWebhookToken(sessionID string, ttl time.Duration) (string, error) {
+	now := m.clock.Now()
 	cred := WebhookCredential{
 		SessionID: sessionID,
-		ExpiresAt: time.Now().Add(ttl),
+		IssuedAt:  now,
+		ExpiresAt: now.Add(ttl),
 	}
 
 	data, err := json.Marshal(cred)
@@ -210,30 +450,22 @@ func (m *Manager) CreateWebhookToken(sessionID string, ttl time.Duration) (strin
 		return "", fmt.Errorf("failed to marshal webhook credential: %w", err)
 	}
 
-	encrypted, err := m.encrypt(data)
+	token, err := m.seal(data)
 	if err != nil {
 		return "", fmt.Errorf("failed to encrypt webhook credential: %w", err)
 	}
 
-	return base64.URLEncoding.EncodeToString(m.sign(encrypted)), nil
+	return token, nil
 }
 
 // DecodeWebhookToken decrypts and decodes a webhook credential without checking
 // expiry. Use ValidateWebhookToken for request authentication; this is for
 // extracting the ExpiresAt to propagate to clients.
 func (m *Manager) DecodeWebhookToken(token string) (*WebhookCredential, error) {
-	signed, err := base64.URLEncoding.DecodeString(token)
-	if err != nil {
-		return nil, ErrInvalidToken
-	}
-	encrypted, err := m.verify(signed)
+	data, err := m.unseal(token, "webhook credential")
 	if err != nil {
 		return nil, err
 	}
-	data, err := m.decrypt(encrypted)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decrypt webhook credential: %w", err)
-	}
 	var cred WebhookCredential
 	if err := json.Unmarshal(data, &cred); err != nil {
 		return nil, ErrInvalidToken
@@ -248,99 +480,323 @@ func (m *Manager) ValidateWebhookToken(token string) (*WebhookCredential, error)
 	if err != nil {
 		return nil, err
 	}
-	if time.Now().After(cred.ExpiresAt) {
+	now := m.clock.Now()
+	if err := m.checkIssuedAt(cred.IssuedAt, cred.IssuedAt, now); err != nil {
+		return nil, err
+	}
+	if now.After(cred.ExpiresAt) {
 		return nil, ErrExpiredToken
 	}
 	return cred, nil
 }
 
-// encrypt encrypts data using AES-GCM
-func (m *Manager) encrypt(plaintext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(m.encryptionKey)
+// Token envelopes.
+//
+// v1 (legacy): HMAC(32) || payload, with the HMAC over the payload only.
+// v2:          version(1) | keyID(1) | flags(1) || HMAC(32) || payload, with
+// the HMAC over the header and payload so flags cannot be flipped.
+// v3:          as v2, but with an Ed25519 signature(64) in place of the HMAC,
+// so the public key served at /jwks.json can verify it.
+//
+// payload is the output of encrypt. v1 plaintexts are bare JSON; v2 and v3
+// plaintexts are described by the header.
+const (
+	envelopeV1 byte = 0x01
+	envelopeV2 byte = 0x02
+	envelopeV3 byte = 0x03
+
+	headerSize = 3
+
+	// currentKeyID is the only key ID tokens are signed with or accepted
+	// under.
+	currentKeyID byte = 0
+
+	// flagCompressed marks a DEFLATE-compressed plaintext.
+	flagCompressed byte = 1 << 0
+)
+
+// header is the authenticated prefix of a v2 envelope.
+type header struct {
+	version byte
+	// keyID identifies the signing/encryption key pair. Only key 0 exists
+	// today; the field lets key rotation land without another format bump.
+	keyID byte
+	flags byte
+}
+
+func (h header) bytes() []byte {
+	return []byte{h.version, h.keyID, h.flags}
+}
+
+// seal compresses (if enabled and worthwhile), encrypts, signs and encodes a
+// token payload.
+func (m *Manager) seal(plaintext []byte) (string, error) {
+	h := header{version: envelopeV2}
+	if m.signer != nil {
+		h.version = envelopeV3
+	}
+	if m.compress {
+		if compressed, ok := deflate(plaintext); ok {
+			plaintext = compressed
+			h.flags |= flagCompressed
+		}
+	}
+
+	encrypted, err := m.encrypt(plaintext)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(m.sign(h, encrypted)), nil
+}
+
+// unseal reverses seal, accepting v1 and v2 (HMAC) envelopes and, while an
+// Ed25519 key is configured, v3 envelopes, which carry an Ed25519 signature
+// in place of the HMAC. kind names the token type in decryption errors.
+func (m *Manager) unseal(token, kind string) ([]byte, error) {
+	signed, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	h, encrypted, err := m.verify(signed)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	plaintext, err := m.decrypt(encrypted)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt %s: %w", kind, err)
+	}
+
+	if h.flags&flagCompressed != 0 {
+		return inflate(plaintext)
+	}
+	return plaintext, nil
+}
+
+// maxPayloadSize bounds decompressed payloads.
+const maxPayloadSize = 1 << 20
+
+// deflate compresses data, reporting false if that would not shrink it.
+func deflate(data []byte) ([]byte, bool) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return nil, false
+	}
+	if _, err := fw.Write(data); err != nil {
+		return nil, false
+	}
+	if err := fw.Close(); err != nil {
+		return nil, false
+	}
+	if buf.Len() >= len(data) {
+		return nil, false
+	}
+	return buf.Bytes(), true
+}
+
+// inflate decompresses data produced by deflate.
+func inflate(data []byte) ([]byte, error) {
+	fr := flate.NewReader(bytes.NewReader(data))
+	defer func() { _ = fr.Close() }()
+	out, err := io.ReadAll(io.LimitReader(fr, maxPayloadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress payload: %w", err)
+	}
+	if len(out) > maxPayloadSize {
+		return nil, errors.New("decompressed payload too large")
+	}
+	return out, nil
+}
+
+// aead returns the cipher for an algorithm ID.
+func (m *Manager) aead(id byte) (cipher.AEAD, error) {
+	switch id {
+	case algIDAESGCM:
+		block, err := aes.NewCipher(m.encryptionKey)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case algIDChaCha20Poly1305:
+		return chacha20poly1305.New(m.encryptionKey)
+	default:
+		return nil, fmt.Errorf("unknown algorithm id %#x", id)
+	}
+}
+
+// encrypt seals data with the manager's algorithm. The output is
+// algID || nonce || ciphertext.
+func (m *Manager) encrypt(plaintext []byte) ([]byte, error) {
+	id := algIDAESGCM
+	if m.algorithm == AlgorithmChaCha20Poly1305 {
+		id = algIDChaCha20Poly1305
+	}
+	aead, err := m.aead(id)
 	if err != nil {
 		return nil, err
 	}
 
 	// Generate nonce
-	nonce := make([]byte, gcm.NonceSize())
+	nonce := make([]byte, aead.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 
 	// Encrypt and authenticate
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-	return ciphertext, nil
+	out := make([]byte, 1, 1+len(nonce)+len(plaintext)+aead.Overhead())
+	out[0] = id
+	out = append(out, nonce...)
+	return aead.Seal(out, nonce, plaintext, nil), nil
 }
 
-// decrypt decrypts data using AES-GCM
+// decrypt opens data produced by encrypt with whichever algorithm its
+// header names.
 func (m *Manager) decrypt(ciphertext []byte) ([]byte, error) {
-	block, err := aes.NewCipher(m.encryptionKey)
+	if len(ciphertext) == 0 {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	plaintext, err := m.open(ciphertext[0], ciphertext[1:])
 	if err != nil {
-		return nil, err
+		// Tokens issued before the algorithm byte existed are AES-GCM and
+		// start directly with the random nonce, whose first byte may happen
+		// to look like an algorithm ID. AEAD authentication makes a wrong
+		// guess fail rather than return garbage, so fall back on failure.
+		legacy, legacyErr := m.open(algIDAESGCM, ciphertext)
+		if legacyErr != nil {
+			return nil, err
+		}
+		plaintext = legacy
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	return plaintext, nil
+}
+
+// open decrypts nonce || ciphertext with the given algorithm.
+func (m *Manager) open(id byte, data []byte) ([]byte, error) {
+	aead, err := m.aead(id)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(ciphertext) < gcm.NonceSize() {
+	if len(data) < aead.NonceSize() {
 		return nil, errors.New("ciphertext too short")
 	}
 
 	// Extract nonce and ciphertext
-	nonce := ciphertext[:gcm.NonceSize()]
-	ciphertext = ciphertext[gcm.NonceSize():]
+	nonce := data[:aead.NonceSize()]
+	data = data[aead.NonceSize():]
 
 	// Decrypt and verify
-	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return nil, err
-	}
-
-	return plaintext, nil
+	return aead.Open(nil, nonce, data, nil)
 }
 
-// sign creates HMAC-SHA256 signature
-func (m *Manager) sign(data []byte) []byte {
-	h := hmac.New(sha256.New, m.signingKey)
-	h.Write(data)
-	signature := h.Sum(nil)
-
-	// Prepend signature to data
-	signed := make([]byte, len(signature)+len(data))
-	copy(signed, signature)
-	copy(signed[len(signature):], data)
-
-	return signed
+// sign builds a v2 envelope, header || HMAC-SHA256(header || data) || data,
+// or for v3 the same with an Ed25519 signature in place of the HMAC.
+func (m *Manager) sign(h header, data []byte) []byte {
+	hdr := h.bytes()
+	var signature []byte
+	if h.version == envelopeV3 {
+		signature = ed25519.Sign(m.signer, append(hdr[:len(hdr):len(hdr)], data...))
+	} else {
+		signature = m.mac(hdr, data)
+	}
+
+	signed := make([]byte, 0, len(hdr)+len(signature)+len(data))
+	signed = append(signed, hdr...)
+	signed = append(signed, signature...)
+	return append(signed, data...)
 }
 
-// verify verifies HMAC-SHA256 signature
-func (m *Manager) verify(signed []byte) ([]byte, error) {
+// verify authenticates a v3, v2 or v1 envelope and returns its header and
+// data. v1 envelopes have no header and are reported as version envelopeV1.
+// An authentic v2 or v3 envelope naming a key other than currentKeyID is
+// rejected rather than read with the current key.
+func (m *Manager) verify(signed []byte) (header, []byte, error) {
+	// v3 envelopes are only accepted while the Ed25519 key is configured;
+	// like v2, a failed check falls through to v1.
+	if pub := m.PublicKey(); pub != nil && len(signed) >= headerSize+ed25519.SignatureSize && signed[0] == envelopeV3 {
+		h := header{version: signed[0], keyID: signed[1], flags: signed[2]}
+		signature := signed[headerSize : headerSize+ed25519.SignatureSize]
+		data := signed[headerSize+ed25519.SignatureSize:]
+		message := append(signed[:headerSize:headerSize], data...)
+		if ed25519.Verify(pub, message, signature) {
+			return checkKeyID(h, data)
+		}
+	}
+
+	// A v1 envelope starts with a random HMAC byte that may equal
+	// envelopeV2, so a failed v2 check falls through to v1. Both checks
+	// are HMAC comparisons, so a forgery cannot pass either.
+	if len(signed) >= headerSize+sha256.Size && signed[0] == envelopeV2 {
+		h := header{version: signed[0], keyID: signed[1], flags: signed[2]}
+		signature := signed[headerSize : headerSize+sha256.Size]
+		data := signed[headerSize+sha256.Size:]
+		if hmac.Equal(signature, m.mac(signed[:headerSize], data)) {
+			return checkKeyID(h, data)
+		}
+	}
+
 	if len(signed) < sha256.Size {
-		return nil, ErrInvalidSignature
+		return header{}, nil, ErrInvalidSignature
 	}
 
 	// Extract signature and data
 	signature := signed[:sha256.Size]
 	data := signed[sha256.Size:]
 
-	// Compute expected signature
+	// Constant-time comparison
+	if !hmac.Equal(signature, m.mac(nil, data)) {
+		return header{}, nil, ErrInvalidSignature
+	}
+
+	return header{version: envelopeV1}, data, nil
+}
+
+// checkKeyID passes through a verified envelope signed under currentKeyID.
+func checkKeyID(h header, data []byte) (header, []byte, error) {
+	if h.keyID != currentKeyID {
+		return header{}, nil, ErrInvalidSignature
+	}
+	return h, data, nil
+}
+
+// mac computes HMAC-SHA256 over hdr || data.
+func (m *Manager) mac(hdr, data []byte) []byte {
 	h := hmac.New(sha256.New, m.signingKey)
+	h.Write(hdr)
 	h.Write(data)
-	expectedSignature := h.Sum(nil)
+	return h.Sum(nil)
+}
 
-	// Constant-time comparison
-	if !hmac.Equal(signature, expectedSignature) {
-		return nil, ErrInvalidSignature
-	}
+// nonceDomain separates nonce MACs from token signatures made with the same key.
+const nonceDomain = "kauth-oidc-nonce\x00"
+
+// Nonce derives the OIDC nonce for an authorization request from its state:
+// base64url(HMAC-SHA256(signingKey, "kauth-oidc-nonce\x00" || state)).
+//
+// The IdP echoes the nonce inside the signed ID token, and the callback
+// receives the state in the query string. Recomputing the nonce from the
+// state ties the two together, so a callback cannot pair an attacker-chosen
+// state with an ID token obtained for a different login. Only holders of the
+// signing key can produce a valid pair.
+func (m *Manager) Nonce(state string) string {
+	h := hmac.New(sha256.New, m.signingKey)
+	h.Write([]byte(nonceDomain))
+	h.Write([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
 
-	return data, nil
+// VerifyNonce reports ErrNonceMismatch unless nonce was derived from state
+// by Nonce.
+func (m *Manager) VerifyNonce(state, nonce string) error {
+	if !hmac.Equal([]byte(nonce), []byte(m.Nonce(state))) {
+		return ErrNonceMismatch
+	}
+	return nil
 }
 
 // GenerateRandomKey generates a cryptographically secure random key
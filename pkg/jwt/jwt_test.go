@@ -1,11 +1,16 @@
 package jwt
 
 import (
+	"crypto/ed25519"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"strings"
 	"testing"
 	"time"
+
+	"kauth/pkg/clock"
 )
 
 func TestNewManager(t *testing.T) {
@@ -246,19 +251,22 @@ func TestSignVerify(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Sign
-			signed := mgr.sign(tt.data)
+			signed := mgr.sign(header{version: envelopeV2}, tt.data)
 
-			// Verify signature is prepended (32 bytes HMAC-SHA256)
-			if len(signed) != 32+len(tt.data) {
-				t.Errorf("sign() length = %d, want %d", len(signed), 32+len(tt.data))
+			// Verify header and signature are prepended (3 bytes + 32 bytes HMAC-SHA256)
+			if len(signed) != headerSize+32+len(tt.data) {
+				t.Errorf("sign() length = %d, want %d", len(signed), headerSize+32+len(tt.data))
 			}
 
 			// Verify
-			verified, err := mgr.verify(signed)
+			h, verified, err := mgr.verify(signed)
 			if err != nil {
 				t.Errorf("verify() error = %v", err)
 				return
 			}
+			if h.version != envelopeV2 {
+				t.Errorf("verify() version = %d, want %d", h.version, envelopeV2)
+			}
 
 			// Verify data matches original
 			if string(verified) != string(tt.data) {
@@ -297,8 +305,8 @@ func TestVerifyInvalidSignature(t *testing.T) {
 		{
 			name: "tampered signature",
 			signed: func() []byte {
-				s := mgr.sign([]byte("test"))
-				s[0] ^= 1 // Flip a bit in signature
+				s := mgr.sign(header{version: envelopeV2}, []byte("test"))
+				s[headerSize] ^= 1 // Flip a bit in signature
 				return s
 			}(),
 			wantErr: ErrInvalidSignature,
@@ -306,17 +314,40 @@ func TestVerifyInvalidSignature(t *testing.T) {
 		{
 			name: "tampered data",
 			signed: func() []byte {
-				s := mgr.sign([]byte("test"))
+				s := mgr.sign(header{version: envelopeV2}, []byte("test"))
 				s[len(s)-1] ^= 1 // Flip a bit in data
 				return s
 			}(),
 			wantErr: ErrInvalidSignature,
 		},
+		{
+			name: "tampered compression flag",
+			signed: func() []byte {
+				s := mgr.sign(header{version: envelopeV2}, []byte("test"))
+				s[2] ^= flagCompressed
+				return s
+			}(),
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name: "tampered key id",
+			signed: func() []byte {
+				s := mgr.sign(header{version: envelopeV2}, []byte("test"))
+				s[1] = 7
+				return s
+			}(),
+			wantErr: ErrInvalidSignature,
+		},
+		{
+			name:    "unknown key id",
+			signed:  mgr.sign(header{version: envelopeV2, keyID: 7}, []byte("test")),
+			wantErr: ErrInvalidSignature,
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := mgr.verify(tt.signed)
+			_, _, err := mgr.verify(tt.signed)
 			if err != tt.wantErr {
 				t.Errorf("verify() error = %v, want %v", err, tt.wantErr)
 			}
@@ -335,9 +366,9 @@ func TestVerifyWithDifferentKey(t *testing.T) {
 	mgr1, _ := NewManager(key1, encKey)
 	mgr2, _ := NewManager(key2, encKey)
 
-	signed := mgr1.sign([]byte("test"))
+	signed := mgr1.sign(header{version: envelopeV2}, []byte("test"))
 
-	_, err := mgr2.verify(signed)
+	_, _, err := mgr2.verify(signed)
 	if err != ErrInvalidSignature {
 		t.Errorf("verify() with different key error = %v, want %v", err, ErrInvalidSignature)
 	}
@@ -410,17 +441,23 @@ func TestValidateSessionToken(t *testing.T) {
 	})
 
 	t.Run("expired token", func(t *testing.T) {
-		state := "test-state"
-		verifier := "test-verifier"
-		ttl := -1 * time.Minute // Already expired
+		clk := clock.NewFakeClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+		mgr, err := NewManager(signingKey, encryptionKey, WithClock(clk))
+		if err != nil {
+			t.Fatalf("NewManager() error = %v", err)
+		}
 
-		token, err := mgr.CreateSessionToken(state, verifier, ttl)
+		token, err := mgr.CreateSessionToken("test-state", "test-verifier", time.Minute)
 		if err != nil {
 			t.Fatalf("CreateSessionToken() error = %v", err)
 		}
 
-		_, err = mgr.ValidateSessionToken(token)
-		if err != ErrExpiredToken {
+		clk.Advance(time.Minute)
+		if _, err := mgr.ValidateSessionToken(token); err != nil {
+			t.Errorf("ValidateSessionToken() at expiry error = %v, want nil", err)
+		}
+		clk.Advance(time.Nanosecond)
+		if _, err := mgr.ValidateSessionToken(token); err != ErrExpiredToken {
 			t.Errorf("ValidateSessionToken() error = %v, want %v", err, ErrExpiredToken)
 		}
 	})
@@ -529,13 +566,23 @@ func TestValidateRefreshToken(t *testing.T) {
 	})
 
 	t.Run("expired token", func(t *testing.T) {
-		token, err := mgr.CreateRefreshToken("user@example.com", "oidc-token", "test-session", 1, -1*time.Hour)
+		clk := clock.NewFakeClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+		mgr, err := NewManager(signingKey, encryptionKey, WithClock(clk))
+		if err != nil {
+			t.Fatalf("NewManager() error = %v", err)
+		}
+
+		token, err := mgr.CreateRefreshToken("user@example.com", "oidc-token", "test-session", 1, time.Hour)
 		if err != nil {
 			t.Fatalf("CreateRefreshToken() error = %v", err)
 		}
 
-		_, err = mgr.ValidateRefreshToken(token)
-		if err != ErrExpiredToken {
+		clk.Advance(time.Hour)
+		if _, err := mgr.ValidateRefreshToken(token); err != nil {
+			t.Errorf("ValidateRefreshToken() at expiry error = %v, want nil", err)
+		}
+		clk.Advance(time.Nanosecond)
+		if _, err := mgr.ValidateRefreshToken(token); err != ErrExpiredToken {
 			t.Errorf("ValidateRefreshToken() error = %v, want %v", err, ErrExpiredToken)
 		}
 	})
@@ -651,3 +698,639 @@ func TestTokensAreIndependent(t *testing.T) {
 		// This is acceptable - the unmarshal will fail due to different JSON fields
 	}
 }
+
+func TestTokensScopedToDeployment(t *testing.T) {
+	signingKey := make([]byte, 32)
+	encryptionKey := make([]byte, 32)
+	rand.Read(signingKey)
+	rand.Read(encryptionKey)
+
+	// Two deployments sharing the same keys (e.g. copy-pasted config).
+	clusterA, err := NewManager(signingKey, encryptionKey, WithIssuer("https://kauth.a.example.com"), WithAudience("cluster-a"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	clusterB, err := NewManager(signingKey, encryptionKey, WithIssuer("https://kauth.b.example.com"), WithAudience("cluster-b"))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	t.Run("refresh token accepted by issuing deployment", func(t *testing.T) {
+		token, err := clusterA.CreateRefreshToken("user@example.com", "oidc-refresh", "session-1", 0, time.Hour)
+		if err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+		refresh, err := clusterA.ValidateRefreshToken(token)
+		if err != nil {
+			t.Fatalf("ValidateRefreshToken() error = %v", err)
+		}
+		if refresh.Issuer != "https://kauth.a.example.com" || refresh.Audience != "cluster-a" {
+			t.Errorf("issuer/audience = %q/%q, want https://kauth.a.example.com/cluster-a", refresh.Issuer, refresh.Audience)
+		}
+	})
+
+	t.Run("refresh token rejected by other deployment", func(t *testing.T) {
+		token, err := clusterA.CreateRefreshToken("user@example.com", "oidc-refresh", "session-1", 0, time.Hour)
+		if err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+		if _, err := clusterB.ValidateRefreshToken(token); err != ErrWrongAudience {
+			t.Errorf("ValidateRefreshToken() error = %v, want %v", err, ErrWrongAudience)
+		}
+	})
+
+	t.Run("session token rejected by other deployment", func(t *testing.T) {
+		token, err := clusterA.CreateSessionToken("state", "verifier", time.Hour)
+		if err != nil {
+			t.Fatalf("CreateSessionToken() error = %v", err)
+		}
+		if _, err := clusterA.ValidateSessionToken(token); err != nil {
+			t.Errorf("ValidateSessionToken() same deployment error = %v", err)
+		}
+		if _, err := clusterB.ValidateSessionToken(token); err != ErrWrongAudience {
+			t.Errorf("ValidateSessionToken() error = %v, want %v", err, ErrWrongAudience)
+		}
+	})
+
+	t.Run("unscoped token rejected by scoped deployment", func(t *testing.T) {
+		unscoped, err := NewManager(signingKey, encryptionKey)
+		if err != nil {
+			t.Fatalf("NewManager() error = %v", err)
+		}
+		token, err := unscoped.CreateRefreshToken("user@example.com", "oidc-refresh", "session-1", 0, time.Hour)
+		if err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+		if _, err := clusterA.ValidateRefreshToken(token); err != ErrWrongAudience {
+			t.Errorf("ValidateRefreshToken() error = %v, want %v", err, ErrWrongAudience)
+		}
+	})
+
+	t.Run("unscoped token accepted during the upgrade window", func(t *testing.T) {
+		clk := clock.NewFakeClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+		unscoped, err := NewManager(signingKey, encryptionKey, WithClock(clk))
+		if err != nil {
+			t.Fatalf("NewManager() error = %v", err)
+		}
+		upgraded, err := NewManager(signingKey, encryptionKey, WithClock(clk),
+			WithIssuer("https://kauth.a.example.com"), WithAudience("cluster-a"),
+			WithUnscopedTokensUntil(clk.Now().Add(48*time.Hour)))
+		if err != nil {
+			t.Fatalf("NewManager() error = %v", err)
+		}
+		refresh, err := unscoped.CreateRefreshToken("user@example.com", "oidc-refresh", "session-1", 0, 72*time.Hour)
+		if err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+		session, err := unscoped.CreateSessionToken("state", "verifier", 72*time.Hour)
+		if err != nil {
+			t.Fatalf("CreateSessionToken() error = %v", err)
+		}
+
+		if _, err := upgraded.ValidateRefreshToken(refresh); err != nil {
+			t.Errorf("ValidateRefreshToken() error = %v", err)
+		}
+		if _, err := upgraded.ValidateSessionToken(session); err != nil {
+			t.Errorf("ValidateSessionToken() error = %v", err)
+		}
+
+		clk.Advance(48 * time.Hour)
+		if _, err := upgraded.ValidateRefreshToken(refresh); err != ErrWrongAudience {
+			t.Errorf("ValidateRefreshToken() after window error = %v, want %v", err, ErrWrongAudience)
+		}
+		if _, err := upgraded.ValidateSessionToken(session); err != ErrWrongAudience {
+			t.Errorf("ValidateSessionToken() after window error = %v, want %v", err, ErrWrongAudience)
+		}
+	})
+
+	t.Run("unscoped token rejected after the cutoff by a restarted manager", func(t *testing.T) {
+		clk := clock.NewFakeClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+		cutoff := clk.Now().Add(24 * time.Hour)
+		unscoped, err := NewManager(signingKey, encryptionKey, WithClock(clk))
+		if err != nil {
+			t.Fatalf("NewManager() error = %v", err)
+		}
+		refresh, err := unscoped.CreateRefreshToken("user@example.com", "oidc-refresh", "session-1", 0, 72*time.Hour)
+		if err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+
+		clk.Advance(48 * time.Hour)
+		restarted, err := NewManager(signingKey, encryptionKey, WithClock(clk),
+			WithIssuer("https://kauth.a.example.com"), WithAudience("cluster-a"),
+			WithUnscopedTokensUntil(cutoff))
+		if err != nil {
+			t.Fatalf("NewManager() error = %v", err)
+		}
+		if _, err := restarted.ValidateRefreshToken(refresh); err != ErrWrongAudience {
+			t.Errorf("ValidateRefreshToken() error = %v, want %v", err, ErrWrongAudience)
+		}
+	})
+
+	t.Run("other deployment's token rejected during the upgrade window", func(t *testing.T) {
+		upgraded, err := NewManager(signingKey, encryptionKey,
+			WithIssuer("https://kauth.b.example.com"), WithAudience("cluster-b"),
+			WithUnscopedTokensUntil(time.Now().Add(time.Hour)))
+		if err != nil {
+			t.Fatalf("NewManager() error = %v", err)
+		}
+		token, err := clusterA.CreateRefreshToken("user@example.com", "oidc-refresh", "session-1", 0, time.Hour)
+		if err != nil {
+			t.Fatalf("CreateRefreshToken() error = %v", err)
+		}
+		if _, err := upgraded.ValidateRefreshToken(token); err != ErrWrongAudience {
+			t.Errorf("ValidateRefreshToken() error = %v, want %v", err, ErrWrongAudience)
+		}
+	})
+}
+
+func TestRefreshTokenCompression(t *testing.T) {
+	signingKey := make([]byte, 32)
+	encryptionKey := make([]byte, 32)
+	rand.Read(signingKey)
+	rand.Read(encryptionKey)
+
+	plain, err := NewManager(signingKey, encryptionKey)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	compressed, err := NewManager(signingKey, encryptionKey, WithCompression())
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	// Stand-in for a multi-kilobyte IdP refresh token with repetitive claims.
+	claims := base64.RawURLEncoding.EncodeToString([]byte(strings.Repeat(`{"groups":["platform-admins","developers"],"scope":"openid email profile offline_access"}`, 60)))
+	oidcToken := "eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9." + claims + ".c2lnbmF0dXJl"
+
+	plainToken, err := plain.CreateRefreshToken("user@example.com", oidcToken, "session-1", 0, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken() error = %v", err)
+	}
+	compressedToken, err := compressed.CreateRefreshToken("user@example.com", oidcToken, "session-1", 0, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken() error = %v", err)
+	}
+
+	if len(compressedToken) >= len(plainToken) {
+		t.Errorf("compressed token length = %d, want less than %d", len(compressedToken), len(plainToken))
+	}
+
+	// Either manager can read either form.
+	for name, tc := range map[string]struct {
+		mgr   *Manager
+		token string
+	}{
+		"compressed by compressing manager":   {compressed, compressedToken},
+		"compressed by plain manager":         {plain, compressedToken},
+		"uncompressed by compressing manager": {compressed, plainToken},
+	} {
+		t.Run(name, func(t *testing.T) {
+			got, err := tc.mgr.ValidateRefreshToken(tc.token)
+			if err != nil {
+				t.Fatalf("ValidateRefreshToken() error = %v", err)
+			}
+			if got.OIDCRefreshToken != oidcToken {
+				t.Error("OIDCRefreshToken did not survive the round-trip")
+			}
+		})
+	}
+}
+
+func TestDeflateSkipsIncompressiblePayloads(t *testing.T) {
+	data := make([]byte, 256)
+	rand.Read(data)
+
+	if _, ok := deflate(data); ok {
+		t.Error("deflate() ok = true for incompressible data, want false")
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	signingKey := make([]byte, 32)
+	encryptionKey := make([]byte, 32)
+	rand.Read(signingKey)
+	rand.Read(encryptionKey)
+
+	managers := map[Algorithm]*Manager{}
+	for _, alg := range []Algorithm{AlgorithmAESGCM, AlgorithmChaCha20Poly1305} {
+		mgr, err := NewManager(signingKey, encryptionKey, WithAlgorithm(alg))
+		if err != nil {
+			t.Fatalf("NewManager(%s) error = %v", alg, err)
+		}
+		managers[alg] = mgr
+	}
+
+	for alg, mgr := range managers {
+		t.Run(string(alg), func(t *testing.T) {
+			plaintext := []byte(`{"sessionID":"abc"}`)
+			ciphertext, err := mgr.encrypt(plaintext)
+			if err != nil {
+				t.Fatalf("encrypt() error = %v", err)
+			}
+			decrypted, err := mgr.decrypt(ciphertext)
+			if err != nil {
+				t.Fatalf("decrypt() error = %v", err)
+			}
+			if string(decrypted) != string(plaintext) {
+				t.Errorf("decrypt() = %q, want %q", decrypted, plaintext)
+			}
+
+			// Tokens self-describe their cipher, so every manager can read them.
+			token, err := mgr.CreateSessionToken("session-1", "verifier", time.Hour)
+			if err != nil {
+				t.Fatalf("CreateSessionToken() error = %v", err)
+			}
+			for other, reader := range managers {
+				if _, err := reader.ValidateSessionToken(token); err != nil {
+					t.Errorf("%s manager ValidateSessionToken() error = %v", other, err)
+				}
+			}
+		})
+	}
+}
+
+func TestDecryptLegacyEnvelope(t *testing.T) {
+	signingKey := make([]byte, 32)
+	encryptionKey := make([]byte, 32)
+	rand.Read(signingKey)
+	rand.Read(encryptionKey)
+
+	mgr, err := NewManager(signingKey, encryptionKey, WithAlgorithm(AlgorithmChaCha20Poly1305))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	// Tokens issued before the algorithm byte were bare AES-GCM: nonce || ciphertext.
+	gcm, err := mgr.aead(algIDAESGCM)
+	if err != nil {
+		t.Fatalf("aead() error = %v", err)
+	}
+	plaintext := []byte(`{"sessionID":"legacy"}`)
+	for i := range 50 {
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		// Force some nonces to collide with algorithm IDs.
+		if i%2 == 0 {
+			nonce[0] = algIDChaCha20Poly1305
+		}
+		legacy := gcm.Seal(nonce, nonce, plaintext, nil)
+
+		decrypted, err := mgr.decrypt(legacy)
+		if err != nil {
+			t.Fatalf("decrypt() legacy error = %v", err)
+		}
+		if string(decrypted) != string(plaintext) {
+			t.Fatalf("decrypt() = %q, want %q", decrypted, plaintext)
+		}
+	}
+}
+
+func TestNewManagerAlgorithmValidation(t *testing.T) {
+	tests := []struct {
+		name          string
+		alg           Algorithm
+		encryptionKey []byte
+		errContains   string
+	}{
+		{"chacha short key", AlgorithmChaCha20Poly1305, make([]byte, 16), "exactly 32 bytes for ChaCha20-Poly1305"},
+		{"chacha long key", AlgorithmChaCha20Poly1305, make([]byte, 64), "exactly 32 bytes for ChaCha20-Poly1305"},
+		{"unknown algorithm", Algorithm("des"), make([]byte, 32), "unsupported algorithm"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewManager(make([]byte, 32), tt.encryptionKey, WithAlgorithm(tt.alg))
+			if err == nil || !strings.Contains(err.Error(), tt.errContains) {
+				t.Errorf("NewManager() error = %v, want error containing %q", err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestV1EnvelopeStillValidates(t *testing.T) {
+	signingKey := make([]byte, 32)
+	encryptionKey := make([]byte, 32)
+	rand.Read(signingKey)
+	rand.Read(encryptionKey)
+
+	mgr, err := NewManager(signingKey, encryptionKey)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	// Build a v1 token: HMAC(payload) || payload, no header.
+	data := []byte(`{"sessionID":"legacy","expires_at":"2999-01-01T00:00:00Z"}`)
+	encrypted, err := mgr.encrypt(data)
+	if err != nil {
+		t.Fatalf("encrypt() error = %v", err)
+	}
+	v1 := append(mgr.mac(nil, encrypted), encrypted...)
+	token := base64.URLEncoding.EncodeToString(v1)
+
+	cred, err := mgr.ValidateWebhookToken(token)
+	if err != nil {
+		t.Fatalf("ValidateWebhookToken() v1 error = %v", err)
+	}
+	if cred.SessionID != "legacy" {
+		t.Errorf("SessionID = %q, want %q", cred.SessionID, "legacy")
+	}
+
+	// New tokens use the v2 header.
+	newToken, err := mgr.CreateWebhookToken("s", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateWebhookToken() error = %v", err)
+	}
+	raw, _ := base64.URLEncoding.DecodeString(newToken)
+	if raw[0] != envelopeV2 {
+		t.Errorf("new token version = %d, want %d", raw[0], envelopeV2)
+	}
+}
+
+func TestEd25519Signer(t *testing.T) {
+	signingKey := make([]byte, 32)
+	encryptionKey := make([]byte, 32)
+	rand.Read(signingKey)
+	rand.Read(encryptionKey)
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hmacMgr, err := NewManager(signingKey, encryptionKey)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	edMgr, err := NewManager(signingKey, encryptionKey, WithEd25519Signer(priv))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	if !edMgr.PublicKey().Equal(pub) || hmacMgr.PublicKey() != nil {
+		t.Error("PublicKey() does not match the configured signer")
+	}
+
+	token, err := edMgr.CreateWebhookToken("s", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateWebhookToken() error = %v", err)
+	}
+	raw, _ := base64.URLEncoding.DecodeString(token)
+	if raw[0] != envelopeV3 {
+		t.Fatalf("token version = %d, want %d", raw[0], envelopeV3)
+	}
+	if _, err := edMgr.ValidateWebhookToken(token); err != nil {
+		t.Errorf("ValidateWebhookToken() error = %v", err)
+	}
+
+	// The public key alone verifies the envelope.
+	signature := raw[headerSize : headerSize+ed25519.SignatureSize]
+	message := append(raw[:headerSize:headerSize], raw[headerSize+ed25519.SignatureSize:]...)
+	if !ed25519.Verify(pub, message, signature) {
+		t.Error("ed25519.Verify() = false for a v3 token")
+	}
+
+	// Tampering breaks the signature.
+	raw[len(raw)-1] ^= 0xff
+	if _, err := edMgr.ValidateWebhookToken(base64.URLEncoding.EncodeToString(raw)); err == nil {
+		t.Error("ValidateWebhookToken() accepted a tampered v3 token")
+	}
+
+	// Without the key v3 tokens are rejected, and enabling it keeps
+	// HMAC-signed tokens valid.
+	if _, err := hmacMgr.ValidateWebhookToken(token); err == nil {
+		t.Error("HMAC-only manager accepted a v3 token")
+	}
+	old, err := hmacMgr.CreateWebhookToken("s", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateWebhookToken() error = %v", err)
+	}
+	if _, err := edMgr.ValidateWebhookToken(old); err != nil {
+		t.Errorf("ValidateWebhookToken() v2 token error = %v", err)
+	}
+
+	if _, err := NewManager(signingKey, encryptionKey, WithEd25519Signer(priv[:10])); err == nil {
+		t.Error("NewManager() accepted a short Ed25519 key")
+	}
+}
+
+func TestNonceBoundToState(t *testing.T) {
+	signingKey := make([]byte, 32)
+	encryptionKey := make([]byte, 32)
+	rand.Read(signingKey)
+	rand.Read(encryptionKey)
+
+	mgr, err := NewManager(signingKey, encryptionKey)
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	stateA, stateB := "state-a", "state-b"
+	nonceA, nonceB := mgr.Nonce(stateA), mgr.Nonce(stateB)
+
+	if nonceA == nonceB {
+		t.Fatal("Nonce() returned the same value for different states")
+	}
+	if got := mgr.Nonce(stateA); got != nonceA {
+		t.Errorf("Nonce() not deterministic: %q != %q", got, nonceA)
+	}
+
+	// Legitimate pair
+	if err := mgr.VerifyNonce(stateA, nonceA); err != nil {
+		t.Errorf("VerifyNonce() legitimate pair error = %v", err)
+	}
+
+	// Swapped pairs
+	if err := mgr.VerifyNonce(stateA, nonceB); err != ErrNonceMismatch {
+		t.Errorf("VerifyNonce() swapped pair error = %v, want %v", err, ErrNonceMismatch)
+	}
+	if err := mgr.VerifyNonce(stateB, nonceA); err != ErrNonceMismatch {
+		t.Errorf("VerifyNonce() swapped pair error = %v, want %v", err, ErrNonceMismatch)
+	}
+	if err := mgr.VerifyNonce(stateA, ""); err != ErrNonceMismatch {
+		t.Errorf("VerifyNonce() empty nonce error = %v, want %v", err, ErrNonceMismatch)
+	}
+
+	// A different signing key cannot produce a valid nonce
+	otherKey := make([]byte, 32)
+	rand.Read(otherKey)
+	other, _ := NewManager(otherKey, encryptionKey)
+	if err := mgr.VerifyNonce(stateA, other.Nonce(stateA)); err != ErrNonceMismatch {
+		t.Errorf("VerifyNonce() foreign key error = %v, want %v", err, ErrNonceMismatch)
+	}
+}
+
+func TestRefreshToken_CheckSessionAge(t *testing.T) {
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	maxAge := 30 * 24 * time.Hour
+
+	tests := []struct {
+		name   string
+		token  RefreshToken
+		maxAge time.Duration
+		now    time.Time
+		want   error
+	}{
+		{name: "fresh", token: RefreshToken{OriginalIssuedAt: start}, maxAge: maxAge, now: start.Add(time.Hour)},
+		{name: "exactly at limit", token: RefreshToken{OriginalIssuedAt: start}, maxAge: maxAge, now: start.Add(maxAge)},
+		{name: "just past limit", token: RefreshToken{OriginalIssuedAt: start}, maxAge: maxAge, now: start.Add(maxAge + time.Nanosecond), want: ErrSessionExpired},
+		{name: "no limit", token: RefreshToken{OriginalIssuedAt: start}, maxAge: 0, now: start.Add(10 * maxAge)},
+		{name: "legacy token uses IssuedAt", token: RefreshToken{IssuedAt: start}, maxAge: maxAge, now: start.Add(maxAge + time.Second), want: ErrSessionExpired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.token.CheckSessionAge(tt.maxAge, tt.now); got != tt.want {
+				t.Errorf("CheckSessionAge() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRotateRefreshToken_CarriesSessionStart(t *testing.T) {
+	mgr, err := NewManager(make([]byte, 32), make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	first, err := mgr.CreateRefreshToken("user@example.com", "oidc-1", "session-1", 0, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken() error = %v", err)
+	}
+	prev, err := mgr.ValidateRefreshToken(first)
+	if err != nil {
+		t.Fatalf("ValidateRefreshToken() error = %v", err)
+	}
+	if prev.OriginalIssuedAt.IsZero() || !prev.OriginalIssuedAt.Equal(prev.IssuedAt) {
+		t.Errorf("OriginalIssuedAt = %v, want IssuedAt %v", prev.OriginalIssuedAt, prev.IssuedAt)
+	}
+
+	// Pretend the session started long ago and has been rotated since.
+	prev.OriginalIssuedAt = prev.IssuedAt.Add(-20 * 24 * time.Hour)
+
+	rotated, err := mgr.RotateRefreshToken(prev, "user@example.com", "oidc-2", time.Hour)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken() error = %v", err)
+	}
+	next, err := mgr.ValidateRefreshToken(rotated)
+	if err != nil {
+		t.Fatalf("ValidateRefreshToken() error = %v", err)
+	}
+	if !next.OriginalIssuedAt.Equal(prev.OriginalIssuedAt) {
+		t.Errorf("OriginalIssuedAt = %v, want carried over %v", next.OriginalIssuedAt, prev.OriginalIssuedAt)
+	}
+	if next.RotationCounter != 1 || next.SessionID != "session-1" || next.OIDCRefreshToken != "oidc-2" {
+		t.Errorf("rotated token = %+v", next)
+	}
+}
+
+func TestIssuedAtChecks(t *testing.T) {
+	minIssuedAt := time.Now().Add(-time.Hour)
+	mgr, err := NewManager(make([]byte, 32), make([]byte, 32), WithMinIssuedAt(minIssuedAt))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+
+	sessionToken := func(t *testing.T, createdAt time.Time) string {
+		t.Helper()
+		data, err := json.Marshal(SessionToken{SessionID: "state", Verifier: "verifier", CreatedAt: createdAt, ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := mgr.seal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	refreshToken := func(t *testing.T, issuedAt, loginAt time.Time) string {
+		t.Helper()
+		token, err := mgr.sealRefreshToken(RefreshToken{UserEmail: "user@example.com", IssuedAt: issuedAt, OriginalIssuedAt: loginAt, ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	webhookToken := func(t *testing.T, issuedAt time.Time) string {
+		t.Helper()
+		data, err := json.Marshal(WebhookCredential{SessionID: "state", IssuedAt: issuedAt, ExpiresAt: time.Now().Add(time.Hour)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := mgr.seal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name           string
+		session        string
+		refresh        string
+		webhook        string
+		wantSessionErr error
+		wantRefreshErr error
+		wantWebhookErr error
+	}{
+		{name: "current", session: sessionToken(t, now), refresh: refreshToken(t, now, now), webhook: webhookToken(t, now)},
+		{name: "within clock skew", session: sessionToken(t, now.Add(ClockSkew/2)), refresh: refreshToken(t, now.Add(ClockSkew/2), now), webhook: webhookToken(t, now.Add(ClockSkew/2))},
+		{name: "future dated", session: sessionToken(t, now.Add(time.Hour)), refresh: refreshToken(t, now.Add(time.Hour), now), webhook: webhookToken(t, now.Add(time.Hour)), wantSessionErr: ErrInvalidToken, wantRefreshErr: ErrInvalidToken, wantWebhookErr: ErrInvalidToken},
+		{name: "too old", session: sessionToken(t, minIssuedAt.Add(-time.Minute)), refresh: refreshToken(t, minIssuedAt.Add(-time.Minute), minIssuedAt.Add(-time.Minute)), webhook: webhookToken(t, minIssuedAt.Add(-time.Minute)), wantSessionErr: ErrTokenPredatesCutoff, wantRefreshErr: ErrTokenPredatesCutoff, wantWebhookErr: ErrTokenPredatesCutoff},
+		// Rotating after the cutoff does not rescue a login from before it
+		{name: "rotated after cutoff", session: sessionToken(t, now), refresh: refreshToken(t, now, minIssuedAt.Add(-24*time.Hour)), webhook: webhookToken(t, now), wantRefreshErr: ErrTokenPredatesCutoff},
+		// Webhook credentials minted before IssuedAt was recorded
+		{name: "webhook without issued at", session: sessionToken(t, now), refresh: refreshToken(t, now, now), webhook: webhookToken(t, time.Time{}), wantWebhookErr: ErrTokenPredatesCutoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := mgr.ValidateSessionToken(tt.session); !errors.Is(err, tt.wantSessionErr) {
+				t.Errorf("ValidateSessionToken() error = %v, want %v", err, tt.wantSessionErr)
+			}
+			if _, err := mgr.ValidateRefreshToken(tt.refresh); !errors.Is(err, tt.wantRefreshErr) {
+				t.Errorf("ValidateRefreshToken() error = %v, want %v", err, tt.wantRefreshErr)
+			}
+			if _, err := mgr.ValidateWebhookToken(tt.webhook); !errors.Is(err, tt.wantWebhookErr) {
+				t.Errorf("ValidateWebhookToken() error = %v, want %v", err, tt.wantWebhookErr)
+			}
+		})
+	}
+}
+
+func TestMinIssuedAtBoundary(t *testing.T) {
+	mgr, err := NewManager(make([]byte, 32), make([]byte, 32))
+	if err != nil {
+		t.Fatalf("NewManager() error = %v", err)
+	}
+	loginAt := time.Now().Add(-time.Hour)
+	token, err := mgr.sealRefreshToken(RefreshToken{UserEmail: "user@example.com", IssuedAt: loginAt, OriginalIssuedAt: loginAt, ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cutoff  time.Time
+		wantErr error
+	}{
+		{name: "no cutoff"},
+		{name: "cutoff before login", cutoff: loginAt.Add(-time.Nanosecond)},
+		{name: "cutoff at login", cutoff: loginAt},
+		{name: "cutoff just after login", cutoff: loginAt.Add(time.Nanosecond), wantErr: ErrTokenPredatesCutoff},
+		{name: "cutoff bumped to now", cutoff: time.Now(), wantErr: ErrTokenPredatesCutoff},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The cutoff changes at runtime on the same manager
+			mgr.SetMinIssuedAt(tt.cutoff)
+			if !mgr.MinIssuedAt().Equal(tt.cutoff) {
+				t.Errorf("MinIssuedAt() = %v, want %v", mgr.MinIssuedAt(), tt.cutoff)
+			}
+			if _, err := mgr.ValidateRefreshToken(token); !errors.Is(err, tt.wantErr) {
+				t.Errorf("ValidateRefreshToken() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,275 @@
+// Package metrics provides a small set of process-wide counters and gauges
+// exposed in the Prometheus text exposition format. It intentionally avoids
+// the Prometheus client library to keep the dependency footprint small.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// SSE /watch listener lifecycle
+var (
+	SSEConnections = NewCounter("kauth_sse_connections_total",
+		"Total number of accepted /watch SSE connections.")
+	SSEDisconnects = NewCounterVec("kauth_sse_disconnects_total",
+		"Total number of closed /watch SSE connections by reason.", "reason")
+	SSEActiveListeners = NewGauge("kauth_sse_active_listeners",
+		"Number of /watch SSE connections currently open.")
+)
+
+// Logins in progress (OAuthSessions in the Pending phase)
+var PendingSessions = NewGauge("kauth_pending_sessions",
+	"Number of logins started but not yet completed, across all replicas.")
+
+// Distinct users who completed a login, by trailing time window
+var UniqueUsers = NewGaugeVec("kauth_unique_users",
+	"Number of distinct users who completed a login within the time window, across all replicas.", "time_window")
+
+// Requests from kauth-server to the OIDC provider, by operation
+var (
+	OIDCProviderRequests = NewCounterVec("kauth_oidc_provider_requests_total",
+		"Total number of HTTP requests to the OIDC provider by operation.", "operation")
+	OIDCProviderDuration = NewSummaryVec("kauth_oidc_provider_request_duration_seconds",
+		"Time spent on requests to the OIDC provider by operation.", "operation")
+)
+
+// Disconnect reasons for SSEDisconnects.
+const (
+	DisconnectClient        = "client"
+	DisconnectKeepaliveFail = "keepalive_fail"
+	DisconnectCompleted     = "completed"
+	DisconnectTimeout       = "timeout"
+)
+
+type collector interface {
+	write(w io.Writer, name string)
+}
+
+type entry struct {
+	name, help, kind string
+	c                collector
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []entry
+)
+
+func register(name, help, kind string, c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry = append(registry, entry{name: name, help: help, kind: kind, c: c})
+	sort.Slice(registry, func(i, j int) bool { return registry[i].name < registry[j].name })
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v atomic.Uint64
+}
+
+// NewCounter creates and registers a counter.
+func NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	register(name, help, "counter", c)
+	return c
+}
+
+// Inc increments the counter by one.
+func (c *Counter) Inc() { c.v.Add(1) }
+
+// Value returns the current count.
+func (c *Counter) Value() uint64 { return c.v.Load() }
+
+func (c *Counter) write(w io.Writer, name string) {
+	_, _ = fmt.Fprintf(w, "%s %d\n", name, c.Value())
+}
+
+// CounterVec is a set of counters partitioned by a single label.
+type CounterVec struct {
+	label    string
+	mu       sync.Mutex
+	counters map[string]*Counter
+}
+
+// NewCounterVec creates and registers a counter partitioned by label.
+func NewCounterVec(name, help, label string) *CounterVec {
+	v := &CounterVec{label: label, counters: make(map[string]*Counter)}
+	register(name, help, "counter", v)
+	return v
+}
+
+// WithLabel returns the counter for the given label value, creating it if needed.
+func (v *CounterVec) WithLabel(value string) *Counter {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	c, ok := v.counters[value]
+	if !ok {
+		c = &Counter{}
+		v.counters[value] = c
+	}
+	return c
+}
+
+func (v *CounterVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.counters))
+	for value := range v.counters {
+		values = append(values, value)
+	}
+	v.mu.Unlock()
+	sort.Strings(values)
+	for _, value := range values {
+		_, _ = fmt.Fprintf(w, "%s{%s=%q} %d\n", name, v.label, value, v.WithLabel(value).Value())
+	}
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v atomic.Int64
+}
+
+// NewGauge creates and registers a gauge.
+func NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	register(name, help, "gauge", g)
+	return g
+}
+
+// Inc increments the gauge by one.
+func (g *Gauge) Inc() { g.v.Add(1) }
+
+// Dec decrements the gauge by one.
+func (g *Gauge) Dec() { g.v.Add(-1) }
+
+// Set sets the gauge to n.
+func (g *Gauge) Set(n int64) { g.v.Store(n) }
+
+// Value returns the current gauge value.
+func (g *Gauge) Value() int64 { return g.v.Load() }
+
+func (g *Gauge) write(w io.Writer, name string) {
+	_, _ = fmt.Fprintf(w, "%s %d\n", name, g.Value())
+}
+
+// GaugeVec is a set of gauges partitioned by a single label.
+type GaugeVec struct {
+	label  string
+	mu     sync.Mutex
+	gauges map[string]*Gauge
+}
+
+// NewGaugeVec creates and registers a gauge partitioned by label.
+func NewGaugeVec(name, help, label string) *GaugeVec {
+	v := &GaugeVec{label: label, gauges: make(map[string]*Gauge)}
+	register(name, help, "gauge", v)
+	return v
+}
+
+// WithLabel returns the gauge for the given label value, creating it if needed.
+func (v *GaugeVec) WithLabel(value string) *Gauge {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	g, ok := v.gauges[value]
+	if !ok {
+		g = &Gauge{}
+		v.gauges[value] = g
+	}
+	return g
+}
+
+func (v *GaugeVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	values := make([]string, 0, len(v.gauges))
+	for value := range v.gauges {
+		values = append(values, value)
+	}
+	v.mu.Unlock()
+	sort.Strings(values)
+	for _, value := range values {
+		_, _ = fmt.Fprintf(w, "%s{%s=%q} %d\n", name, v.label, value, v.WithLabel(value).Value())
+	}
+}
+
+// SummaryVec tracks the count and sum of observations (e.g. durations),
+// partitioned by a single label. It exposes no quantiles.
+type SummaryVec struct {
+	label string
+	mu    sync.Mutex
+	stats map[string]*summary
+}
+
+type summary struct {
+	count uint64
+	sum   float64
+}
+
+// NewSummaryVec creates and registers a summary partitioned by label.
+func NewSummaryVec(name, help, label string) *SummaryVec {
+	v := &SummaryVec{label: label, stats: make(map[string]*summary)}
+	register(name, help, "summary", v)
+	return v
+}
+
+// Observe records a value for the given label value.
+func (v *SummaryVec) Observe(value string, x float64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	s, ok := v.stats[value]
+	if !ok {
+		s = &summary{}
+		v.stats[value] = s
+	}
+	s.count++
+	s.sum += x
+}
+
+// Count returns the number of observations for the given label value.
+func (v *SummaryVec) Count(value string) uint64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok := v.stats[value]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (v *SummaryVec) write(w io.Writer, name string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	values := make([]string, 0, len(v.stats))
+	for value := range v.stats {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+	for _, value := range values {
+		s := v.stats[value]
+		_, _ = fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", name, v.label, value, s.sum)
+		_, _ = fmt.Fprintf(w, "%s_count{%s=%q} %d\n", name, v.label, value, s.count)
+	}
+}
+
+// WriteText writes all registered metrics in the Prometheus text format.
+func WriteText(w io.Writer) {
+	registryMu.Lock()
+	entries := make([]entry, len(registry))
+	copy(entries, registry)
+	registryMu.Unlock()
+
+	for _, e := range entries {
+		_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", e.name, e.help, e.name, e.kind)
+		e.c.write(w, e.name)
+	}
+}
+
+// Handler serves the registered metrics for Prometheus scraping.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WriteText(w)
+	})
+}
@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler_ExposesRegisteredMetrics(t *testing.T) {
+	counter := NewCounter("kauth_test_counter_total", "Test counter.")
+	vec := NewCounterVec("kauth_test_vec_total", "Test counter vec.", "reason")
+	gauge := NewGauge("kauth_test_gauge", "Test gauge.")
+	gaugeVec := NewGaugeVec("kauth_test_gauge_vec", "Test gauge vec.", "window")
+	summary := NewSummaryVec("kauth_test_duration_seconds", "Test summary.", "op")
+
+	counter.Inc()
+	vec.WithLabel("b").Inc()
+	vec.WithLabel("a").Inc()
+	vec.WithLabel("a").Inc()
+	gauge.Inc()
+	gauge.Inc()
+	gauge.Dec()
+	gaugeVec.WithLabel("24h").Set(5)
+	gaugeVec.WithLabel("1h").Set(2)
+	summary.Observe("jwks", 0.25)
+	summary.Observe("jwks", 0.5)
+
+	rr := httptest.NewRecorder()
+	Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rr.Body.String()
+
+	for _, want := range []string{
+		"# TYPE kauth_test_counter_total counter\nkauth_test_counter_total 1\n",
+		"kauth_test_vec_total{reason=\"a\"} 2\nkauth_test_vec_total{reason=\"b\"} 1\n",
+		"# TYPE kauth_test_gauge gauge\nkauth_test_gauge 1\n",
+		"# TYPE kauth_test_gauge_vec gauge\nkauth_test_gauge_vec{window=\"1h\"} 2\nkauth_test_gauge_vec{window=\"24h\"} 5\n",
+		"# TYPE kauth_test_duration_seconds summary\nkauth_test_duration_seconds_sum{op=\"jwks\"} 0.75\nkauth_test_duration_seconds_count{op=\"jwks\"} 2\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q\n%s", want, body)
+		}
+	}
+}
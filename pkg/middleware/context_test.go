@@ -4,6 +4,12 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func TestRequestID_PopulatesContext(t *testing.T) {
@@ -53,3 +59,63 @@ func TestRequestID_ChainedWithRequestLogger(t *testing.T) {
 		t.Errorf("expected status 200, got %d", rr.Code)
 	}
 }
+
+func TestTracing_ContinuesIncomingTrace(t *testing.T) {
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	var inner trace.SpanContext
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		inner = trace.SpanContextFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := Tracing(mux)(mux)
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	req := httptest.NewRequest(http.MethodPost, "/sessions/abc123", nil)
+	req.Header.Set("traceparent", "00-"+traceID+"-00f067aa0ba902b7-01")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := inner.TraceID().String(); got != traceID {
+		t.Errorf("handler trace ID = %s, want %s from traceparent", got, traceID)
+	}
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("ended %d spans, want 1", len(spans))
+	}
+	if got := spans[0].Name(); got != "POST /sessions/{id}" {
+		t.Errorf("span name = %q, want the route pattern %q", got, "POST /sessions/{id}")
+	}
+	if got := spans[0].Parent().SpanID().String(); got != "00f067aa0ba902b7" {
+		t.Errorf("span parent = %s, want the incoming span", got)
+	}
+}
+
+func TestTracing_UnmatchedRequestNamedByMethod(t *testing.T) {
+	provider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(provider) })
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {})
+	handler := Tracing(mux)(mux)
+
+	req := httptest.NewRequest(http.MethodGet, "/no/such/path", nil)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("ended %d spans, want 1", len(spans))
+	}
+	if got := spans[0].Name(); got != http.MethodGet {
+		t.Errorf("span name = %q, want %q", got, http.MethodGet)
+	}
+}
@@ -8,11 +8,16 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"net/url"
 	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"kauth/pkg/apierror"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"golang.org/x/time/rate"
 )
 
@@ -20,6 +25,9 @@ type contextKey string
 
 const RequestIDKey = contextKey("request_id")
 
+// ClientIPKey holds the client IP resolved by ClientIPExtractor.Middleware.
+const ClientIPKey = contextKey("client_ip")
+
 // SecurityHeaders adds security headers to responses
 func SecurityHeaders(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -56,32 +64,92 @@ func HSTS(next http.Handler) http.Handler {
 
 // CORS handles Cross-Origin Resource Sharing
 func CORS(allowedOrigins []string) func(http.Handler) http.Handler {
-	return func(next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			origin := r.Header.Get("Origin")
-
-			// Check if origin is allowed
-			allowed := slices.Contains(allowedOrigins, "*") || slices.Contains(allowedOrigins, origin)
-
-			if allowed {
-				if origin == "" {
-					origin = "*"
-				}
-				w.Header().Set("Access-Control-Allow-Origin", origin)
-				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-				w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-				w.Header().Set("Access-Control-Max-Age", "86400")
-			}
+	return NewCORSPolicy(allowedOrigins).Middleware
+}
 
-			// Handle preflight
-			if r.Method == http.MethodOptions {
-				w.WriteHeader(http.StatusNoContent)
-				return
+// CORSPolicy is a CORS middleware whose allowed origins can be swapped at
+// runtime (e.g. on SIGHUP) without rebuilding the handler chain.
+type CORSPolicy struct {
+	origins atomic.Pointer[[]string]
+}
+
+// NewCORSPolicy creates a CORS policy allowing the given origins
+// (empty = none, ["*"] = all).
+func NewCORSPolicy(allowedOrigins []string) *CORSPolicy {
+	p := &CORSPolicy{}
+	p.SetOrigins(allowedOrigins)
+	return p
+}
+
+// SetOrigins atomically replaces the allowed origins.
+func (p *CORSPolicy) SetOrigins(allowedOrigins []string) {
+	origins := slices.Clone(allowedOrigins)
+	p.origins.Store(&origins)
+}
+
+// Origins returns the currently allowed origins.
+func (p *CORSPolicy) Origins() []string {
+	return slices.Clone(*p.origins.Load())
+}
+
+// Middleware applies the current policy. With no origins configured requests
+// pass through untouched, as if CORS were not installed.
+func (p *CORSPolicy) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowedOrigins := *p.origins.Load()
+		if len(allowedOrigins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		origin := r.Header.Get("Origin")
+
+		// Check if origin is allowed
+		allowed := slices.Contains(allowedOrigins, "*") || slices.Contains(allowedOrigins, origin)
+
+		if allowed {
+			if origin == "" {
+				origin = "*"
 			}
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			w.Header().Set("Access-Control-Max-Age", "86400")
+		}
+
+		// Handle preflight
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
 
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireAllowedOrigin rejects requests whose Origin header is not in the
+// allowed origins. CLI clients send no Origin and are unaffected, so this
+// keeps browser pages from calling CLI-only endpoints such as /refresh.
+func (p *CORSPolicy) RequireAllowedOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
 			next.ServeHTTP(w, r)
-		})
-	}
+			return
+		}
+
+		allowedOrigins := *p.origins.Load()
+		if !slices.Contains(allowedOrigins, "*") && !slices.Contains(allowedOrigins, origin) {
+			slog.WarnContext(r.Context(), "rejected browser request from disallowed origin",
+				"path", r.URL.Path,
+				"origin", origin,
+			)
+			apierror.Write(w, http.StatusForbidden, apierror.CodeOriginNotAllowed, "Forbidden: origin not allowed")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
 }
 
 type rateLimitVisitor struct {
@@ -119,6 +187,19 @@ func NewRateLimiter(rps float64, burst int, cleanup time.Duration, trustedProxie
 	return rl
 }
 
+// SetLimits changes the rate and burst for new and already-tracked visitors.
+func (rl *RateLimiter) SetLimits(rps float64, burst int) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	rl.rate = rate.Limit(rps)
+	rl.burst = burst
+	for _, v := range rl.visitors {
+		v.limiter.SetLimit(rl.rate)
+		v.limiter.SetBurst(rl.burst)
+	}
+}
+
 // getVisitor returns the rate limiter for a visitor, creating one if needed.
 func (rl *RateLimiter) getVisitor(ip string) *rate.Limiter {
 	rl.mu.Lock()
@@ -204,6 +285,30 @@ func (e *ClientIPExtractor) GetClientIP(r *http.Request) string {
 		}
 	}
 
+	return remoteHost(r)
+}
+
+// Middleware resolves the client IP once, honouring e's trusted proxies, and
+// stores it in the request context for ClientIP.
+func (e *ClientIPExtractor) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), ClientIPKey, e.GetClientIP(r))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ClientIP returns the client IP stored by ClientIPExtractor.Middleware.
+// Without that middleware it falls back to the connection's address rather
+// than forwarding headers, which any client can set.
+func ClientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(ClientIPKey).(string); ok {
+		return ip
+	}
+	return remoteHost(r)
+}
+
+// remoteHost returns r.RemoteAddr without its port.
+func remoteHost(r *http.Request) string {
 	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
 		return host
 	}
@@ -217,7 +322,7 @@ func (rl *RateLimiter) Middleware(next http.Handler) http.Handler {
 
 		limiter := rl.getVisitor(ip)
 		if !limiter.Allow() {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+			apierror.Write(w, http.StatusTooManyRequests, apierror.CodeRateLimited, "Rate limit exceeded")
 			return
 		}
 
@@ -244,6 +349,113 @@ func (rl *RateLimiter) cleanupLoop() {
 	}
 }
 
+// Timeout bounds total handler time. Requests get a context deadline of d and
+// a 503 if the handler overruns it. Paths in exempt (e.g. SSE streams, which
+// need to flush and stay open) are passed through untouched. d <= 0 disables
+// the timeout.
+func Timeout(d time.Duration, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if d <= 0 {
+			return next
+		}
+		timed := http.TimeoutHandler(next, d, "Request timed out")
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exempt, r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			timed.ServeHTTP(w, r)
+		})
+	}
+}
+
+// EnforceHTTPS redirects plain HTTP GET and HEAD requests with 301 to the
+// same path on the host of baseURL over https://. The Host header is not
+// used, so a forged one cannot turn the redirect into an open redirect.
+// Other methods are refused with 403 rather than redirected: their body
+// (e.g. a refresh token) has already crossed the network in the clear, and
+// following a redirect would hide that from the client.
+//
+// A request counts as HTTPS if it arrived over TLS or came through one of
+// ipExtractor's trusted proxies with X-Forwarded-Proto: https, as behind a
+// TLS-terminating ingress. Paths in exempt (e.g. probes scraped over plain
+// HTTP inside the cluster) are passed through untouched.
+func EnforceHTTPS(baseURL string, ipExtractor *ClientIPExtractor, exempt ...string) func(http.Handler) http.Handler {
+	origin := "https://"
+	if u, err := url.Parse(baseURL); err == nil {
+		origin += u.Host
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS != nil || slices.Contains(exempt, r.URL.Path) ||
+				(ipExtractor.isTrustedProxy(r) && strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https")) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			if r.Method != http.MethodGet && r.Method != http.MethodHead {
+				apierror.Write(w, http.StatusForbidden, apierror.CodeForbidden, "HTTPS required")
+				return
+			}
+			http.Redirect(w, r, origin+r.URL.RequestURI(), http.StatusMovedPermanently)
+		})
+	}
+}
+
+// Tracing starts a server span per request, continuing the trace named in
+// the request's traceparent header. Spans go to the global tracer provider,
+// so it is only worth adding once tracing.Setup has installed one.
+//
+// Spans are named after the routes pattern the request matches (the
+// r.Pattern its handler sees), not its path, so IDs in paths do not each
+// create a span name. Requests matching no route are named by method alone.
+func Tracing(routes *http.ServeMux) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return otelhttp.NewHandler(next, "kauth-server",
+			otelhttp.WithSpanNameFormatter(func(_ string, r *http.Request) string {
+				return spanName(routes, r)
+			}),
+		)
+	}
+}
+
+// spanName returns "METHOD pattern" for the route r matches in routes.
+func spanName(routes *http.ServeMux, r *http.Request) string {
+	_, pattern := routes.Handler(r)
+	if pattern == "" {
+		return r.Method
+	}
+	if strings.Contains(pattern, " ") {
+		return pattern
+	}
+	return r.Method + " " + pattern
+}
+
+// DefaultMaxBodyBytes is the default cap on request bodies. kauth's JSON
+// requests are a few KB at most.
+const DefaultMaxBodyBytes = 64 << 10
+
+// MaxBodySize caps request bodies at limit bytes. A request that declares a
+// larger Content-Length is refused with 413 before its body is read; any
+// other body fails on the read that crosses the limit (see
+// http.MaxBytesReader), which handlers turn into a 413. limit <= 0 disables
+// the cap.
+func MaxBodySize(limit int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if limit <= 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				apierror.Write(w, http.StatusRequestEntityTooLarge, apierror.CodeRequestTooLarge, "Request body too large")
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, limit)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 // RequestID adds a unique request ID to each request
 func RequestID(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
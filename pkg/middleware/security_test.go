@@ -1,8 +1,11 @@
 package middleware
 
 import (
+	"errors"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -180,6 +183,51 @@ func TestGetClientIP(t *testing.T) {
 	}
 }
 
+func TestClientIP(t *testing.T) {
+	trusted := NewClientIPExtractor([]string{"10.0.0.0/8"})
+
+	tests := []struct {
+		name          string
+		extractor     *ClientIPExtractor
+		xRealIP       string
+		xForwardedFor string
+		remoteAddr    string
+		want          string
+	}{
+		{name: "X-Real-IP from trusted proxy", extractor: trusted, xRealIP: "192.0.2.7", xForwardedFor: "198.51.100.1", remoteAddr: "10.1.2.3:443", want: "192.0.2.7"},
+		{name: "X-Forwarded-For from trusted proxy", extractor: trusted, xForwardedFor: "198.51.100.1, 10.0.0.9", remoteAddr: "10.1.2.3:443", want: "198.51.100.1"},
+		{name: "headers from untrusted client ignored", extractor: trusted, xRealIP: "192.0.2.7", xForwardedFor: "198.51.100.1", remoteAddr: "203.0.113.5:5555", want: "203.0.113.5"},
+		{name: "direct RemoteAddr", extractor: trusted, remoteAddr: "203.0.113.5:5555", want: "203.0.113.5"},
+		{name: "without middleware headers are ignored", xForwardedFor: "198.51.100.1", remoteAddr: "203.0.113.5:5555", want: "203.0.113.5"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xRealIP != "" {
+				req.Header.Set("X-Real-IP", tt.xRealIP)
+			}
+			if tt.xForwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", tt.xForwardedFor)
+			}
+
+			var got string
+			var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = ClientIP(r)
+			})
+			if tt.extractor != nil {
+				handler = tt.extractor.Middleware(handler)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Errorf("ClientIP() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
 func TestRateLimiter_BlocksWhenExceeded(t *testing.T) {
 	rl := NewRateLimiter(1, 1, time.Minute, nil)
 	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -308,3 +356,259 @@ func TestRateLimiter_TrustedProxyDifferentIPs(t *testing.T) {
 		t.Errorf("different IPs from trusted proxy should have separate limits, got %d", rr.Code)
 	}
 }
+
+func TestTimeout(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+			w.WriteHeader(http.StatusOK)
+		case <-r.Context().Done():
+		}
+	})
+	handler := Timeout(20*time.Millisecond, "/watch")(slow)
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+	}{
+		{name: "slow handler times out", path: "/refresh", wantStatus: http.StatusServiceUnavailable},
+		{name: "SSE path is exempt", path: "/watch", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestTimeout_Disabled(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Deadline(); ok {
+			t.Error("request has a deadline with timeout disabled")
+		}
+	})
+
+	Timeout(0)(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+}
+
+func TestMaxBodySize(t *testing.T) {
+	var readErr error
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = io.ReadAll(r.Body)
+	})
+	handler := MaxBodySize(16)(next)
+
+	t.Run("declared length over limit is refused unread", func(t *testing.T) {
+		called := false
+		h := MaxBodySize(16)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(strings.Repeat("x", 17))))
+		if rec.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("status = %d, want 413", rec.Code)
+		}
+		if called {
+			t.Error("handler ran for an oversized request")
+		}
+	})
+
+	t.Run("unknown length fails on read", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader(strings.Repeat("x", 1<<20)))
+		req.ContentLength = -1
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+		var maxErr *http.MaxBytesError
+		if !errors.As(readErr, &maxErr) {
+			t.Errorf("read error = %v, want *http.MaxBytesError", readErr)
+		}
+	})
+
+	t.Run("body within limit", func(t *testing.T) {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/refresh", strings.NewReader("{}")))
+		if readErr != nil {
+			t.Errorf("read error = %v", readErr)
+		}
+	})
+}
+
+func TestCORSPolicy_SetOriginsTakesEffect(t *testing.T) {
+	policy := NewCORSPolicy([]string{"https://a.example.com"})
+	handler := policy.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	allowedOrigin := func(origin string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Origin", origin)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Header().Get("Access-Control-Allow-Origin")
+	}
+
+	if got := allowedOrigin("https://b.example.com"); got != "" {
+		t.Fatalf("b allowed before reload: %q", got)
+	}
+
+	policy.SetOrigins([]string{"https://b.example.com"})
+
+	if got := allowedOrigin("https://b.example.com"); got != "https://b.example.com" {
+		t.Errorf("b not allowed after reload: %q", got)
+	}
+	if got := allowedOrigin("https://a.example.com"); got != "" {
+		t.Errorf("a still allowed after reload: %q", got)
+	}
+}
+
+func TestCORSPolicy_NoOriginsPassesThrough(t *testing.T) {
+	handler := NewCORSPolicy(nil).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	req := httptest.NewRequest(http.MethodOptions, "/", nil)
+	req.Header.Set("Origin", "https://a.example.com")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusTeapot {
+		t.Errorf("status = %d, want request passed to next handler", rr.Code)
+	}
+}
+
+func TestCORSPolicy_RequireAllowedOrigin(t *testing.T) {
+	policy := NewCORSPolicy([]string{"https://app.example.com"})
+	handler := policy.RequireAllowedOrigin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		origin string
+		want   int
+	}{
+		{name: "CLI request without origin", origin: "", want: http.StatusOK},
+		{name: "allowed origin", origin: "https://app.example.com", want: http.StatusOK},
+		{name: "foreign origin", origin: "https://evil.example.com", want: http.StatusForbidden},
+		{name: "opaque origin", origin: "null", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			if rr.Code != tt.want {
+				t.Errorf("status = %d, want %d", rr.Code, tt.want)
+			}
+		})
+	}
+
+	policy.SetOrigins(nil)
+	req := httptest.NewRequest(http.MethodPost, "/refresh", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status after clearing origins = %d, want 403", rr.Code)
+	}
+}
+
+func TestRateLimiter_SetLimits(t *testing.T) {
+	rl := NewRateLimiter(1, 1, time.Minute, nil)
+	handler := rl.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	serve := func() int {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if serve() != http.StatusOK || serve() != http.StatusTooManyRequests {
+		t.Fatal("expected the second request to be limited before SetLimits")
+	}
+
+	// Raising the limits applies to the already-tracked visitor too.
+	rl.SetLimits(1000, 10)
+	time.Sleep(5 * time.Millisecond)
+	for i := range 3 {
+		if code := serve(); code != http.StatusOK {
+			t.Fatalf("request %d after SetLimits = %d, want 200", i, code)
+		}
+	}
+}
+
+func TestEnforceHTTPS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := EnforceHTTPS("https://kauth.example.com", NewClientIPExtractor([]string{"10.0.0.0/8"}), "/health")(next)
+
+	tests := []struct {
+		name         string
+		method       string
+		host         string
+		path         string
+		remoteAddr   string
+		proto        string
+		wantStatus   int
+		wantLocation string
+	}{
+		{name: "plain GET redirects", method: http.MethodGet, path: "/info?x=1", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusMovedPermanently, wantLocation: "https://kauth.example.com/info?x=1"},
+		{name: "plain HEAD redirects", method: http.MethodHead, path: "/info", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusMovedPermanently, wantLocation: "https://kauth.example.com/info"},
+		{name: "redirect ignores the Host header", method: http.MethodGet, host: "evil.example.net", path: "/login", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusMovedPermanently, wantLocation: "https://kauth.example.com/login"},
+		{name: "plain POST is refused", method: http.MethodPost, path: "/refresh", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusForbidden},
+		{name: "plain DELETE is refused", method: http.MethodDelete, path: "/sessions/abc", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusForbidden},
+		{name: "trusted proxy forwarded https", method: http.MethodGet, path: "/info", remoteAddr: "10.0.0.1:1234", proto: "https", wantStatus: http.StatusOK},
+		{name: "trusted proxy forwarded http", method: http.MethodGet, path: "/info", remoteAddr: "10.0.0.1:1234", proto: "http", wantStatus: http.StatusMovedPermanently, wantLocation: "https://kauth.example.com/info"},
+		{name: "untrusted forwarded https", method: http.MethodGet, path: "/info", remoteAddr: "203.0.113.5:1234", proto: "https", wantStatus: http.StatusMovedPermanently, wantLocation: "https://kauth.example.com/info"},
+		{name: "exempt path", method: http.MethodGet, path: "/health", remoteAddr: "203.0.113.5:1234", wantStatus: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "http://kauth.example.com"+tt.path, nil)
+			if tt.host != "" {
+				req.Host = tt.host
+			}
+			req.RemoteAddr = tt.remoteAddr
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := rec.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+		})
+	}
+}
+
+func TestEnforceHTTPS_TLSPassesThrough(t *testing.T) {
+	called := false
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	req := httptest.NewRequest(http.MethodGet, "https://kauth.example.com/info", nil)
+	rec := httptest.NewRecorder()
+	EnforceHTTPS("https://kauth.example.com", NewClientIPExtractor(nil))(next).ServeHTTP(rec, req)
+
+	if !called || rec.Header().Get("Location") != "" {
+		t.Errorf("TLS request was redirected (status %d)", rec.Code)
+	}
+}
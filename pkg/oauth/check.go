@@ -0,0 +1,157 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+// discoveryDocument is the subset of the OIDC discovery document Check reports on.
+type discoveryDocument struct {
+	Issuer                 string   `json:"issuer"`
+	AuthURL                string   `json:"authorization_endpoint"`
+	TokenURL               string   `json:"token_endpoint"`
+	JWKSURL                string   `json:"jwks_uri"`
+	UserInfoURL            string   `json:"userinfo_endpoint"`
+	ScopesSupported        []string `json:"scopes_supported"`
+	GrantTypesSupported    []string `json:"grant_types_supported"`
+	CodeChallengeMethods   []string `json:"code_challenge_methods_supported"`
+	IDTokenSigningAlgs     []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported        []string `json:"claims_supported"`
+	EndSessionURL          string   `json:"end_session_endpoint"`
+	DeviceAuthorizationURL string   `json:"device_authorization_endpoint"`
+}
+
+// Check validates an OIDC configuration without serving traffic: it runs
+// discovery, fetches the JWKS, and verifies the client credentials by
+// redeeming a deliberately invalid authorization code (the IdP answers
+// invalid_grant for a known client and invalid_client otherwise). Findings
+// are written to w; the returned error describes the first hard failure.
+func Check(ctx context.Context, cfg Config, w io.Writer) error {
+	p, err := NewProvider(ctx, cfg)
+	if err != nil {
+		fmt.Fprintf(w, "✗ discovery: %v\n", err)
+		return err
+	}
+	fmt.Fprintf(w, "✓ discovery: %s\n", cfg.IssuerURL)
+
+	var doc discoveryDocument
+	if err := p.OIDCProvider.Claims(&doc); err != nil {
+		return fmt.Errorf("failed to decode discovery document: %w", err)
+	}
+	printEndpoints(w, doc)
+
+	keys, err := fetchJWKS(ctx, p.HTTPClient, doc.JWKSURL)
+	if err != nil {
+		fmt.Fprintf(w, "✗ jwks: %v\n", err)
+		return err
+	}
+	fmt.Fprintf(w, "✓ jwks: %d signing key(s)\n", keys)
+
+	if err := checkClientCredentials(p.ClientContext(ctx), p.OAuth2Config); err != nil {
+		fmt.Fprintf(w, "✗ client credentials: %v\n", err)
+		return err
+	}
+	fmt.Fprintf(w, "✓ client credentials: accepted for %s\n", cfg.ClientID)
+
+	printFeatures(w, doc, p.PKCEMethod)
+	return nil
+}
+
+func printEndpoints(w io.Writer, doc discoveryDocument) {
+	for _, e := range []struct{ name, url string }{
+		{"authorization", doc.AuthURL},
+		{"token", doc.TokenURL},
+		{"jwks", doc.JWKSURL},
+		{"userinfo", doc.UserInfoURL},
+		{"device", doc.DeviceAuthorizationURL},
+		{"end session", doc.EndSessionURL},
+	} {
+		if e.url != "" {
+			fmt.Fprintf(w, "    %-14s %s\n", e.name, e.url)
+		}
+	}
+}
+
+// printFeatures reports capabilities kauth relies on. Missing entries are
+// warnings only: many IdPs omit optional discovery fields.
+func printFeatures(w io.Writer, doc discoveryDocument, pkceMethod string) {
+	feature := func(name string, ok, unknown bool) {
+		switch {
+		case unknown:
+			fmt.Fprintf(w, "? %s: not advertised\n", name)
+		case ok:
+			fmt.Fprintf(w, "✓ %s\n", name)
+		default:
+			fmt.Fprintf(w, "! %s: not supported\n", name)
+		}
+	}
+
+	feature("PKCE "+pkceMethod, slices.Contains(doc.CodeChallengeMethods, pkceMethod), len(doc.CodeChallengeMethods) == 0)
+	feature("refresh_token grant", slices.Contains(doc.GrantTypesSupported, "refresh_token"), len(doc.GrantTypesSupported) == 0)
+	feature("offline_access scope", slices.Contains(doc.ScopesSupported, "offline_access"), len(doc.ScopesSupported) == 0)
+	feature("groups claim", slices.Contains(doc.ClaimsSupported, "groups"), len(doc.ClaimsSupported) == 0)
+	if len(doc.IDTokenSigningAlgs) > 0 {
+		fmt.Fprintf(w, "    ID token algorithms: %s\n", strings.Join(doc.IDTokenSigningAlgs, ", "))
+	}
+}
+
+func fetchJWKS(ctx context.Context, client *http.Client, jwksURL string) (int, error) {
+	if jwksURL == "" {
+		return 0, errors.New("discovery document has no jwks_uri")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to fetch %s: %w", jwksURL, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned status %d", jwksURL, resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&jwks); err != nil {
+		return 0, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+	if len(jwks.Keys) == 0 {
+		return 0, errors.New("JWKS contains no keys")
+	}
+	return len(jwks.Keys), nil
+}
+
+// checkClientCredentials redeems a bogus authorization code. The token
+// endpoint authenticates the client before looking at the code, so
+// invalid_grant means the credentials are good and invalid_client (or
+// unauthorized_client) means they are not.
+func checkClientCredentials(ctx context.Context, cfg *oauth2.Config) error {
+	_, err := cfg.Exchange(ctx, "kauth-check-invalid-code")
+	if err == nil {
+		return errors.New("token endpoint accepted a bogus authorization code")
+	}
+
+	var re *oauth2.RetrieveError
+	if !errors.As(err, &re) {
+		return fmt.Errorf("token endpoint unreachable: %w", err)
+	}
+	switch re.ErrorCode {
+	case "invalid_grant":
+		return nil
+	case "invalid_client", "unauthorized_client":
+		return fmt.Errorf("rejected by IdP (%s)", re.ErrorCode)
+	default:
+		return fmt.Errorf("unexpected token endpoint response (status %d, error %q)", re.Response.StatusCode, re.ErrorCode)
+	}
+}
@@ -0,0 +1,96 @@
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// stubIdP serves discovery, JWKS and a token endpoint that authenticates
+// the client "kauth"/"secret" and rejects every authorization code.
+func stubIdP(t *testing.T, jwks string) *httptest.Server {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"issuer":                           srv.URL,
+				"authorization_endpoint":           srv.URL + "/auth",
+				"token_endpoint":                   srv.URL + "/token",
+				"jwks_uri":                         srv.URL + "/keys",
+				"grant_types_supported":            []string{"authorization_code", "refresh_token"},
+				"code_challenge_methods_supported": []string{"S256"},
+			})
+		case "/keys":
+			_, _ = w.Write([]byte(jwks))
+		case "/token":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			id, secret, ok := r.BasicAuth()
+			if !ok {
+				id, secret = r.PostFormValue("client_id"), r.PostFormValue("client_secret")
+			}
+			if id != "kauth" || secret != "secret" {
+				_, _ = w.Write([]byte(`{"error":"invalid_client"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+const stubJWKS = `{"keys":[{"kty":"RSA","kid":"1","n":"AQAB","e":"AQAB"}]}`
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		secret     string
+		jwks       string
+		wantErr    bool
+		wantOutput string
+	}{
+		{name: "valid", secret: "secret", jwks: stubJWKS, wantOutput: "✓ client credentials"},
+		{name: "wrong secret", secret: "nope", jwks: stubJWKS, wantErr: true, wantOutput: "invalid_client"},
+		{name: "empty jwks", secret: "secret", jwks: `{"keys":[]}`, wantErr: true, wantOutput: "✗ jwks"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := stubIdP(t, tt.jwks)
+
+			var out bytes.Buffer
+			err := Check(context.Background(), Config{IssuerURL: srv.URL, ClientID: "kauth", ClientSecret: tt.secret}, &out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Check() error = %v, wantErr %v\n%s", err, tt.wantErr, out.String())
+			}
+			if !strings.Contains(out.String(), tt.wantOutput) {
+				t.Errorf("Check() output missing %q:\n%s", tt.wantOutput, out.String())
+			}
+			if !tt.wantErr && !strings.Contains(out.String(), srv.URL+"/token") {
+				t.Errorf("Check() output does not list the token endpoint:\n%s", out.String())
+			}
+		})
+	}
+}
+
+func TestCheck_DiscoveryFailure(t *testing.T) {
+	srv := httptest.NewServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	var out bytes.Buffer
+	if err := Check(context.Background(), Config{IssuerURL: srv.URL, ClientID: "kauth"}, &out); err == nil {
+		t.Fatal("Check() error = nil for an issuer without discovery, want error")
+	}
+	if !strings.Contains(out.String(), "✗ discovery") {
+		t.Errorf("Check() output = %q, want discovery failure", out.String())
+	}
+}
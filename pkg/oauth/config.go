@@ -1,12 +1,22 @@
 package oauth
 
 import (
+	"cmp"
 	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"kauth/pkg/metrics"
+	"kauth/pkg/tracing"
 
 	"github.com/coreos/go-oidc/v3/oidc"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/oauth2"
 )
 
@@ -17,6 +27,68 @@ type Config struct {
 	ClientSecret string
 	RedirectURL  string
 	Scopes       []string
+
+	// ClaimsPrefix is a top-level ID token claim holding a nested object of
+	// further claims, for IdPs that namespace custom claims
+	// (e.g. "https://myapp/claims"). Empty means claims are flat.
+	ClaimsPrefix string
+
+	// HTTPClient is used for every request to the IdP: discovery, JWKS,
+	// token exchange and refresh. Nil means the default transport. The
+	// provider wraps its transport for tracing and metrics, and applies
+	// DefaultHTTPTimeout if it sets no Timeout.
+	HTTPClient *http.Client
+
+	// JWKSRefreshInterval is how old cached signing keys may get before they
+	// are refreshed in the background (default: 1h). JWKSMinRefreshInterval
+	// is the minimum time between JWKS fetches triggered by tokens no cached
+	// key verifies (default: 1m).
+	JWKSRefreshInterval    time.Duration
+	JWKSMinRefreshInterval time.Duration
+
+	// PKCEMethod is the PKCE code_challenge_method: PKCEMethodS256 (default)
+	// or PKCEMethodPlain for IdPs that do not support S256.
+	PKCEMethod string
+
+	// AdditionalAudiences are accepted in an ID token's aud besides
+	// ClientID, e.g. the old client ID during a migration.
+	AdditionalAudiences []string
+
+	// ExchangeTimeout bounds an authorization code exchange and
+	// VerifyTimeout an ID token verification, including any JWKS fetch it
+	// triggers (defaults: DefaultExchangeTimeout, DefaultVerifyTimeout).
+	ExchangeTimeout time.Duration
+	VerifyTimeout   time.Duration
+}
+
+// Defaults for the per-operation IdP deadlines.
+const (
+	DefaultExchangeTimeout = 10 * time.Second
+	DefaultVerifyTimeout   = 10 * time.Second
+)
+
+// Operation labels for metrics.OIDCProviderDuration recorded by Provider,
+// also used in span names (oidc.<operation>).
+const (
+	OperationExchange = "exchange"
+	OperationVerify   = "verify"
+	OperationRefresh  = "refresh"
+)
+
+// PKCE code challenge methods (RFC 7636).
+const (
+	PKCEMethodS256  = "S256"
+	PKCEMethodPlain = "plain"
+)
+
+// ValidatePKCEMethod reports an error unless method is a supported PKCE
+// code_challenge_method.
+func ValidatePKCEMethod(method string) error {
+	switch method {
+	case PKCEMethodS256, PKCEMethodPlain:
+		return nil
+	}
+	return fmt.Errorf("unsupported PKCE method %q (use %s or %s)", method, PKCEMethodS256, PKCEMethodPlain)
 }
 
 // Provider wraps the OAuth2 config and OIDC provider
@@ -24,16 +96,49 @@ type Provider struct {
 	OAuth2Config    *oauth2.Config
 	OIDCProvider    *oidc.Provider
 	IDTokenVerifier *oidc.IDTokenVerifier
+	ClaimsPrefix    string
+	HTTPClient      *http.Client
+	PKCEMethod      string // PKCEMethodS256 or PKCEMethodPlain
+
+	// audiences, if set, replaces go-oidc's client ID check: an ID token
+	// must name at least one of them in aud.
+	audiences []string
+
+	// exchangeTimeout and verifyTimeout bound Exchange and VerifyIDToken
+	// independently of the caller's deadline; zero means none.
+	exchangeTimeout time.Duration
+	verifyTimeout   time.Duration
 }
 
 // NewProvider creates a new OAuth2/OIDC provider from configuration
 func NewProvider(ctx context.Context, cfg Config) (*Provider, error) {
-	// Discover OIDC provider
-	provider, err := oidc.NewProvider(ctx, cfg.IssuerURL)
+	pkceMethod := cmp.Or(cfg.PKCEMethod, PKCEMethodS256)
+	if err := ValidatePKCEMethod(pkceMethod); err != nil {
+		return nil, err
+	}
+
+	// Every request to the IdP, whichever client it came from, is traced
+	// and bounded.
+	httpClient := instrument(cfg.HTTPClient)
+
+	// Discover OIDC provider. The client in the context is also kept for
+	// JWKS refreshes during verification.
+	ctx, span := tracing.Start(ctx, "oidc.discovery", attribute.String("oidc.issuer", cfg.IssuerURL))
+	provider, err := oidc.NewProvider(oidc.ClientContext(ctx, withMetrics(httpClient, "discovery")), cfg.IssuerURL)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to discover OIDC provider at %s: %w", cfg.IssuerURL, err)
 	}
 
+	var discovery struct {
+		Issuer  string   `json:"issuer"`
+		JWKSURL string   `json:"jwks_uri"`
+		Algs    []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := provider.Claims(&discovery); err != nil {
+		return nil, fmt.Errorf("failed to decode OIDC discovery document: %w", err)
+	}
+
 	// Set default scopes if none provided
 	scopes := cfg.Scopes
 	if len(scopes) == 0 {
@@ -55,18 +160,80 @@ func NewProvider(ctx context.Context, cfg Config) (*Provider, error) {
 		Scopes:       scopes,
 	}
 
-	// Create ID token verifier
-	verifier := provider.Verifier(&oidc.Config{
-		ClientID: cfg.ClientID,
-	})
+	// Create ID token verifier backed by a cached key set, so verifications
+	// don't each hit the IdP's JWKS endpoint.
+	refreshInterval := cmp.Or(cfg.JWKSRefreshInterval, DefaultJWKSRefreshInterval)
+	minRefreshInterval := cmp.Or(cfg.JWKSMinRefreshInterval, DefaultJWKSMinRefreshInterval)
+	keySet := newCachingKeySet(discovery.JWKSURL, withMetrics(httpClient, "jwks"), refreshInterval, minRefreshInterval)
+	verifierConfig := &oidc.Config{
+		ClientID:             cfg.ClientID,
+		SupportedSigningAlgs: signingAlgs(discovery.Algs),
+	}
+	var audiences []string
+	if len(cfg.AdditionalAudiences) > 0 {
+		// go-oidc checks a single client ID; VerifyIDToken checks them all
+		audiences = append([]string{cfg.ClientID}, cfg.AdditionalAudiences...)
+		verifierConfig.SkipClientIDCheck = true
+	}
+	verifier := oidc.NewVerifier(discovery.Issuer, keySet, verifierConfig)
 
 	return &Provider{
 		OAuth2Config:    oauth2Config,
 		OIDCProvider:    provider,
 		IDTokenVerifier: verifier,
+		ClaimsPrefix:    cfg.ClaimsPrefix,
+		HTTPClient:      withMetrics(httpClient, "oidc"),
+		PKCEMethod:      pkceMethod,
+		audiences:       audiences,
+		exchangeTimeout: cmp.Or(cfg.ExchangeTimeout, DefaultExchangeTimeout),
+		verifyTimeout:   cmp.Or(cfg.VerifyTimeout, DefaultVerifyTimeout),
 	}, nil
 }
 
+// AuthCodeURL returns the IdP authorization URL for state with a PKCE
+// challenge for verifier in the provider's method, plus any extra options.
+// The token exchange sends the verifier itself (oauth2.VerifierOption)
+// whichever method was used, so nothing else depends on the method.
+func (p *Provider) AuthCodeURL(state, verifier string, opts ...oauth2.AuthCodeOption) string {
+	if p.PKCEMethod == PKCEMethodPlain {
+		opts = append(opts,
+			oauth2.SetAuthURLParam("code_challenge_method", PKCEMethodPlain),
+			oauth2.SetAuthURLParam("code_challenge", verifier),
+		)
+	} else {
+		opts = append(opts, oauth2.S256ChallengeOption(verifier))
+	}
+	return p.OAuth2Config.AuthCodeURL(state, opts...)
+}
+
+// signingAlgs filters the IdP's advertised ID token algorithms to the
+// asymmetric ones go-oidc verifies. An empty result lets go-oidc default to
+// RS256.
+func signingAlgs(advertised []string) []string {
+	supported := []string{
+		oidc.RS256, oidc.RS384, oidc.RS512,
+		oidc.ES256, oidc.ES384, oidc.ES512,
+		oidc.PS256, oidc.PS384, oidc.PS512,
+		oidc.EdDSA,
+	}
+	var algs []string
+	for _, alg := range advertised {
+		if slices.Contains(supported, alg) {
+			algs = append(algs, alg)
+		}
+	}
+	return algs
+}
+
+// ClientContext returns ctx carrying the provider's HTTP client, for
+// oauth2 token exchanges and refreshes.
+func (p *Provider) ClientContext(ctx context.Context) context.Context {
+	if p.HTTPClient == nil {
+		return ctx
+	}
+	return oidc.ClientContext(ctx, p.HTTPClient)
+}
+
 // GenerateState generates a cryptographically secure random state parameter
 func GenerateState() (string, error) {
 	b := make([]byte, 32)
@@ -76,11 +243,96 @@ func GenerateState() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
-// VerifyIDToken verifies and parses an ID token
+// Exchange trades an authorization code for tokens at the IdP's token
+// endpoint, within the provider's exchange timeout.
+func (p *Provider) Exchange(ctx context.Context, code string, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
+	ctx, done := p.operation(ctx, OperationExchange, p.exchangeTimeout)
+	token, err := p.OAuth2Config.Exchange(p.ClientContext(ctx), code, opts...)
+	done(err)
+	return token, err
+}
+
+// Refresh redeems an IdP refresh token for fresh tokens.
+func (p *Provider) Refresh(ctx context.Context, refreshToken string) (*oauth2.Token, error) {
+	ctx, done := p.operation(ctx, OperationRefresh, 0)
+	token, err := p.OAuth2Config.TokenSource(p.ClientContext(ctx), &oauth2.Token{RefreshToken: refreshToken}).Token()
+	done(err)
+	return token, err
+}
+
+// operation returns ctx bounded by timeout (if positive) and carrying an
+// oidc.<op> span, and a func that releases it, ends the span with the
+// operation's error and records the time taken under op in
+// metrics.OIDCProviderDuration.
+func (p *Provider) operation(ctx context.Context, op string, timeout time.Duration) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Start(ctx, "oidc."+op)
+	cancel := context.CancelFunc(func() {})
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	return ctx, func(err error) {
+		cancel()
+		tracing.End(span, err)
+		metrics.OIDCProviderDuration.Observe(op, time.Since(start).Seconds())
+	}
+}
+
+// VerifyIDToken verifies and parses an ID token within the provider's
+// verify timeout.
 func (p *Provider) VerifyIDToken(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
-	idToken, err := p.IDTokenVerifier.Verify(ctx, rawIDToken)
+	ctx, done := p.operation(ctx, OperationVerify, p.verifyTimeout)
+	idToken, err := p.verifyIDToken(ctx, rawIDToken)
+	done(err)
+	return idToken, err
+}
+
+func (p *Provider) verifyIDToken(ctx context.Context, rawIDToken string) (*oidc.IDToken, error) {
+	idToken, err := p.IDTokenVerifier.Verify(p.ClientContext(ctx), rawIDToken)
 	if err != nil {
 		return nil, fmt.Errorf("failed to verify ID token: %w", err)
 	}
+	if len(p.audiences) > 0 {
+		i := slices.IndexFunc(idToken.Audience, func(aud string) bool { return slices.Contains(p.audiences, aud) })
+		if i < 0 {
+			return nil, fmt.Errorf("failed to verify ID token: audience %q not in %q", idToken.Audience, p.audiences)
+		}
+		slog.DebugContext(ctx, "ID token audience accepted", "audience", idToken.Audience[i])
+	}
 	return idToken, nil
 }
+
+// Claims decodes a verified ID token's claims into v, honouring ClaimsPrefix.
+func (p *Provider) Claims(idToken *oidc.IDToken, v any) error {
+	var raw json.RawMessage
+	if err := idToken.Claims(&raw); err != nil {
+		return err
+	}
+	return DecodeClaims(raw, p.ClaimsPrefix, v)
+}
+
+// DecodeClaims unmarshals raw claims into v. If prefix is set and names a
+// top-level object, its fields are decoded over the flat claims, so nested
+// values win and claims the IdP leaves at the top level (e.g. email) still
+// apply.
+func DecodeClaims(raw []byte, prefix string, v any) error {
+	if err := json.Unmarshal(raw, v); err != nil {
+		return err
+	}
+	if prefix == "" {
+		return nil
+	}
+
+	var top map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &top); err != nil {
+		return err
+	}
+	nested, ok := top[prefix]
+	if !ok || string(nested) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(nested, v); err != nil {
+		return fmt.Errorf("failed to decode claims under %q: %w", prefix, err)
+	}
+	return nil
+}
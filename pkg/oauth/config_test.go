@@ -0,0 +1,270 @@
+package oauth
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"kauth/pkg/metrics"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/oauth2"
+)
+
+func TestDecodeClaims(t *testing.T) {
+	type claims struct {
+		Email             string   `json:"email"`
+		Groups            []string `json:"groups"`
+		PreferredUsername string   `json:"preferred_username"`
+	}
+
+	const namespaced = `{
+		"sub": "123",
+		"email": "alice@example.com",
+		"https://myapp/claims": {
+			"groups": ["platform", "admins"],
+			"preferred_username": "alice"
+		}
+	}`
+
+	tests := []struct {
+		name    string
+		raw     string
+		prefix  string
+		want    claims
+		wantErr bool
+	}{
+		{
+			name: "flat claims without prefix",
+			raw:  `{"email":"bob@example.com","groups":["dev"]}`,
+			want: claims{Email: "bob@example.com", Groups: []string{"dev"}},
+		},
+		{
+			name:   "namespaced claims merged over flat claims",
+			raw:    namespaced,
+			prefix: "https://myapp/claims",
+			want:   claims{Email: "alice@example.com", Groups: []string{"platform", "admins"}, PreferredUsername: "alice"},
+		},
+		{
+			name: "namespaced claims ignored without prefix",
+			raw:  namespaced,
+			want: claims{Email: "alice@example.com"},
+		},
+		{
+			name:   "nested value wins over flat value",
+			raw:    `{"groups":["flat"],"ns":{"groups":["nested"]}}`,
+			prefix: "ns",
+			want:   claims{Groups: []string{"nested"}},
+		},
+		{
+			name:   "missing prefix falls back to flat claims",
+			raw:    `{"email":"carol@example.com"}`,
+			prefix: "https://myapp/claims",
+			want:   claims{Email: "carol@example.com"},
+		},
+		{
+			name:    "prefix names a non-object",
+			raw:     `{"ns":"oops"}`,
+			prefix:  "ns",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got claims
+			err := DecodeClaims([]byte(tt.raw), tt.prefix, &got)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeClaims() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.Email != tt.want.Email || got.PreferredUsername != tt.want.PreferredUsername || !slices.Equal(got.Groups, tt.want.Groups) {
+				t.Errorf("DecodeClaims() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProviderAuthCodeURL_PKCEMethod(t *testing.T) {
+	const verifier = "test-verifier-0123456789-0123456789-0123456789"
+
+	tests := []struct {
+		method        string
+		wantMethod    string
+		wantChallenge string
+	}{
+		{method: "", wantMethod: PKCEMethodS256, wantChallenge: oauth2.S256ChallengeFromVerifier(verifier)},
+		{method: PKCEMethodS256, wantMethod: PKCEMethodS256, wantChallenge: oauth2.S256ChallengeFromVerifier(verifier)},
+		{method: PKCEMethodPlain, wantMethod: PKCEMethodPlain, wantChallenge: verifier},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantMethod+"/"+tt.method, func(t *testing.T) {
+			p := &Provider{
+				OAuth2Config: &oauth2.Config{
+					ClientID: "kauth",
+					Endpoint: oauth2.Endpoint{AuthURL: "https://idp.example.com/auth"},
+				},
+				PKCEMethod: tt.method,
+			}
+
+			authURL, err := url.Parse(p.AuthCodeURL("state", verifier, oauth2.AccessTypeOffline))
+			if err != nil {
+				t.Fatalf("parse auth URL: %v", err)
+			}
+			q := authURL.Query()
+			if got := q.Get("code_challenge_method"); got != tt.wantMethod {
+				t.Errorf("code_challenge_method = %q, want %q", got, tt.wantMethod)
+			}
+			if got := q.Get("code_challenge"); got != tt.wantChallenge {
+				t.Errorf("code_challenge = %q, want %q", got, tt.wantChallenge)
+			}
+			if q.Get("access_type") != "offline" || q.Get("state") != "state" {
+				t.Errorf("extra options dropped: %s", authURL)
+			}
+		})
+	}
+}
+
+func TestProvider_OperationTimeouts(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	tests := []struct {
+		name         string
+		slowToken    bool
+		slowJWKS     bool
+		wantExchange bool
+		wantVerify   bool
+	}{
+		{name: "fast IdP", wantExchange: true, wantVerify: true},
+		{name: "slow token endpoint", slowToken: true, wantVerify: true},
+		{name: "slow JWKS endpoint", slowJWKS: true, wantExchange: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idp := newJWKSIdP(t)
+			p, err := NewProvider(context.Background(), Config{
+				IssuerURL:       idp.srv.URL,
+				ClientID:        "kauth",
+				ExchangeTimeout: timeout,
+				VerifyTimeout:   timeout,
+			})
+			if err != nil {
+				t.Fatalf("NewProvider() error = %v", err)
+			}
+			if tt.slowToken {
+				idp.tokenDelay.Store(int64(10 * time.Second))
+			}
+			if tt.slowJWKS {
+				idp.jwksDelay.Store(int64(10 * time.Second))
+			}
+			exchanges := metrics.OIDCProviderDuration.Count(OperationExchange)
+			verifies := metrics.OIDCProviderDuration.Count(OperationVerify)
+
+			// Each operation gets its own budget: the caller's deadline
+			// would allow either to stall for 10s.
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			start := time.Now()
+			_, err = p.Exchange(ctx, "code")
+			if (err == nil) != tt.wantExchange {
+				t.Errorf("Exchange() error = %v, want success %v", err, tt.wantExchange)
+			}
+			_, err = p.VerifyIDToken(ctx, idp.idToken(t, idp.publishKey))
+			if (err == nil) != tt.wantVerify {
+				t.Errorf("VerifyIDToken() error = %v, want success %v", err, tt.wantVerify)
+			}
+			if elapsed := time.Since(start); elapsed > 5*timeout {
+				t.Errorf("exchange and verify took %v, want each bounded by %v", elapsed, timeout)
+			}
+
+			if got := metrics.OIDCProviderDuration.Count(OperationExchange) - exchanges; got != 1 {
+				t.Errorf("exchange observations grew by %d, want 1", got)
+			}
+			if got := metrics.OIDCProviderDuration.Count(OperationVerify) - verifies; got != 1 {
+				t.Errorf("verify observations grew by %d, want 1", got)
+			}
+		})
+	}
+}
+
+func TestProvider_OperationSpans(t *testing.T) {
+	global := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(global) })
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	otel.SetTracerProvider(tp)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "request")
+	idp := newJWKSIdP(t)
+	p, err := NewProvider(ctx, Config{IssuerURL: idp.srv.URL, ClientID: "kauth"})
+	if err != nil {
+		t.Fatalf("NewProvider() error = %v", err)
+	}
+	if _, err := p.Exchange(ctx, "code"); err != nil {
+		t.Fatalf("Exchange() error = %v", err)
+	}
+	if _, err := p.VerifyIDToken(ctx, "not-a-jwt"); err == nil {
+		t.Fatal("VerifyIDToken() accepted a malformed token")
+	}
+	if _, err := p.Refresh(ctx, "refresh-token"); err != nil {
+		t.Fatalf("Refresh() error = %v", err)
+	}
+	parent.End()
+
+	var got []string
+	operations := map[trace.SpanID]string{}
+	for _, span := range recorder.Ended() {
+		if !strings.HasPrefix(span.Name(), "oidc.") {
+			continue
+		}
+		got = append(got, span.Name())
+		operations[span.SpanContext().SpanID()] = span.Name()
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("span %s is not a child of the request span", span.Name())
+		}
+		if wantErr := span.Name() == "oidc.verify"; (span.Status().Code == codes.Error) != wantErr {
+			t.Errorf("span %s status = %v", span.Name(), span.Status())
+		}
+	}
+	want := []string{"oidc.discovery", "oidc.exchange", "oidc.verify", "oidc.refresh"}
+	if !slices.Equal(got, want) {
+		t.Errorf("spans = %v, want %v", got, want)
+	}
+
+	// The requests to the IdP are client spans under their operation.
+	traced := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanKind() == trace.SpanKindClient {
+			traced[operations[span.Parent().SpanID()]] = true
+		}
+	}
+	for _, op := range []string{"oidc.discovery", "oidc.exchange", "oidc.refresh"} {
+		if !traced[op] {
+			t.Errorf("no HTTP client span under %s", op)
+		}
+	}
+}
+
+func TestValidatePKCEMethod(t *testing.T) {
+	for _, method := range []string{PKCEMethodS256, PKCEMethodPlain} {
+		if err := ValidatePKCEMethod(method); err != nil {
+			t.Errorf("ValidatePKCEMethod(%q) error = %v", method, err)
+		}
+	}
+	for _, method := range []string{"", "s256", "S512"} {
+		if err := ValidatePKCEMethod(method); err == nil {
+			t.Errorf("ValidatePKCEMethod(%q) error = nil, want error", method)
+		}
+	}
+}
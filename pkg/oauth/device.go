@@ -4,85 +4,92 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
 	"golang.org/x/oauth2"
 )
 
-// StartDeviceFlow initiates an OAuth2 device authorization flow
-func (p *Provider) StartDeviceFlow(ctx context.Context) (*oauth2.Token, error) {
+// DefaultDeviceFlowTimeout caps how long StartDeviceFlow waits for the user,
+// however long the IdP keeps the device code valid.
+const DefaultDeviceFlowTimeout = 10 * time.Minute
+
+// StartDeviceFlow initiates an OAuth2 device authorization flow, writing the
+// verification URL and code for the user to out. opts are added to the
+// device authorization request (e.g. oidc.Nonce).
+func (p *Provider) StartDeviceFlow(ctx context.Context, out io.Writer, opts ...oauth2.AuthCodeOption) (*oauth2.Token, error) {
 	// Start device authorization
-	deviceAuth, err := p.OAuth2Config.DeviceAuth(ctx, oauth2.AccessTypeOffline)
+	deviceAuth, err := p.OAuth2Config.DeviceAuth(p.ClientContext(ctx), append([]oauth2.AuthCodeOption{oauth2.AccessTypeOffline}, opts...)...)
 	if err != nil {
 		return nil, fmt.Errorf("device authorization failed: %w", err)
 	}
 
 	// Display instructions to user
-	fmt.Printf("\n=== Device Authentication Required ===\n\n")
-	fmt.Printf("Please visit: %s\n", deviceAuth.VerificationURI)
-	fmt.Printf("And enter code: %s\n\n", deviceAuth.UserCode)
+	fmt.Fprintf(out, "\n=== Device Authentication Required ===\n\n")
+	fmt.Fprintf(out, "Please visit: %s\n", deviceAuth.VerificationURI)
+	fmt.Fprintf(out, "And enter code: %s\n\n", deviceAuth.UserCode)
 
 	if deviceAuth.VerificationURIComplete != "" {
-		fmt.Printf("Or visit this URL directly:\n%s\n\n", deviceAuth.VerificationURIComplete)
+		fmt.Fprintf(out, "Or visit this URL directly:\n%s\n\n", deviceAuth.VerificationURIComplete)
 	}
 
-	fmt.Printf("Waiting for authentication...\n")
+	if !deviceAuth.Expiry.IsZero() {
+		fmt.Fprintf(out, "The code expires in %s.\n", time.Until(deviceAuth.Expiry).Round(time.Second))
+	}
+	fmt.Fprintf(out, "Waiting for authentication...\n")
 
 	// Poll for token
-	return p.pollForDeviceToken(ctx, deviceAuth)
+	return p.pollForDeviceToken(ctx, out, deviceAuth)
 }
 
-// pollForDeviceToken polls the authorization server for token issuance
-func (p *Provider) pollForDeviceToken(ctx context.Context, deviceAuth *oauth2.DeviceAuthResponse) (*oauth2.Token, error) {
-	interval := time.Duration(deviceAuth.Interval) * time.Second
-	if interval == 0 {
-		interval = 5 * time.Second
+// deviceFlowTimeout is how long to poll for a device code expiring at
+// expiry: DefaultDeviceFlowTimeout, or less if the code expires sooner. A
+// zero expiry means the IdP did not say.
+func deviceFlowTimeout(expiry, now time.Time) time.Duration {
+	if expiry.IsZero() {
+		return DefaultDeviceFlowTimeout
 	}
+	return max(min(DefaultDeviceFlowTimeout, expiry.Sub(now)), 0)
+}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	timeout := time.NewTimer(10 * time.Minute)
-	defer timeout.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return nil, fmt.Errorf("device flow cancelled: %w", ctx.Err())
-
-		case <-timeout.C:
-			return nil, fmt.Errorf("device flow timeout - no authentication after 10 minutes")
+// pollForDeviceToken polls the authorization server for token issuance
+// until the user authorizes, the device code expires, the flow times out or
+// ctx is cancelled. DeviceAccessToken handles authorization_pending and
+// slow_down itself.
+func (p *Provider) pollForDeviceToken(ctx context.Context, out io.Writer, deviceAuth *oauth2.DeviceAuthResponse) (*oauth2.Token, error) {
+	timeout := deviceFlowTimeout(deviceAuth.Expiry, time.Now())
+	pollCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-		case <-ticker.C:
-			token, err := p.OAuth2Config.DeviceAccessToken(ctx, deviceAuth)
-			if err == nil {
-				fmt.Printf("\n✓ Authentication successful!\n\n")
-				return token, nil
-			}
+	token, err := p.OAuth2Config.DeviceAccessToken(p.ClientContext(pollCtx), deviceAuth)
+	if err == nil {
+		fmt.Fprintf(out, "\n✓ Authentication successful!\n\n")
+		return token, nil
+	}
 
-			// Handle specific OAuth2 error codes
-			var rerr *oauth2.RetrieveError
-			if errors.As(err, &rerr) {
-				switch rerr.ErrorCode {
-				case "authorization_pending":
-					// Still waiting for user to authorize
-					continue
-				case "slow_down":
-					// Server requested slower polling
-					interval += 5 * time.Second
-					ticker.Reset(interval)
-					continue
-				case "expired_token":
-					return nil, fmt.Errorf("device code expired - please try again")
-				case "access_denied":
-					return nil, fmt.Errorf("authentication was denied")
-				default:
-					return nil, fmt.Errorf("device flow error: %s - %s", rerr.ErrorCode, rerr.ErrorDescription)
-				}
-			}
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("device flow cancelled: %w", ctx.Err())
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		if timeout < DefaultDeviceFlowTimeout {
+			return nil, fmt.Errorf("device code expired - please try again")
+		}
+		return nil, fmt.Errorf("device flow timeout - no authentication after %s", DefaultDeviceFlowTimeout)
+	}
 
-			// Unknown error
-			return nil, fmt.Errorf("device flow error: %w", err)
+	// Handle specific OAuth2 error codes
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		switch rerr.ErrorCode {
+		case "expired_token":
+			return nil, fmt.Errorf("device code expired - please try again")
+		case "access_denied":
+			return nil, fmt.Errorf("authentication was denied")
+		default:
+			return nil, fmt.Errorf("device flow error: %s - %s", rerr.ErrorCode, rerr.ErrorDescription)
 		}
 	}
+
+	// Unknown error
+	return nil, fmt.Errorf("device flow error: %w", err)
 }
@@ -0,0 +1,143 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// deviceTokenEndpoint answers device code token requests with
+// authorization_pending for the first pending polls, then a token.
+// pending < 0 keeps it pending forever.
+func deviceTokenEndpoint(t *testing.T, pending int32) (*Provider, *atomic.Int32) {
+	t.Helper()
+	var polls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if n := polls.Add(1); pending < 0 || n <= pending {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"authorization_pending"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"access_token": "access",
+			"token_type":   "Bearer",
+			"id_token":     "id",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	// A fixed auth style keeps it to one request per poll; auto-detection
+	// retries a 400 with the other style.
+	return &Provider{OAuth2Config: &oauth2.Config{
+		ClientID: "kauth",
+		Endpoint: oauth2.Endpoint{TokenURL: srv.URL + "/token", AuthStyle: oauth2.AuthStyleInParams},
+	}}, &polls
+}
+
+func TestPollForDeviceToken_PendingThenSuccess(t *testing.T) {
+	p, polls := deviceTokenEndpoint(t, 1)
+
+	token, err := p.pollForDeviceToken(context.Background(), io.Discard, &oauth2.DeviceAuthResponse{
+		DeviceCode: "device-code",
+		Interval:   1,
+		Expiry:     time.Now().Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatalf("pollForDeviceToken() error = %v", err)
+	}
+	if token.Extra("id_token") != "id" {
+		t.Errorf("id_token = %v, want id", token.Extra("id_token"))
+	}
+	if got := polls.Load(); got != 2 {
+		t.Errorf("polled %d times, want 2", got)
+	}
+}
+
+func TestPollForDeviceToken_StopsAtExpiry(t *testing.T) {
+	p, _ := deviceTokenEndpoint(t, -1)
+
+	start := time.Now()
+	_, err := p.pollForDeviceToken(context.Background(), io.Discard, &oauth2.DeviceAuthResponse{
+		DeviceCode: "device-code",
+		Interval:   1,
+		Expiry:     time.Now().Add(1500 * time.Millisecond),
+	})
+	if err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("pollForDeviceToken() error = %v, want device code expired", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("polling went on for %v past the code's expiry", elapsed)
+	}
+}
+
+func TestPollForDeviceToken_Cancelled(t *testing.T) {
+	p, _ := deviceTokenEndpoint(t, -1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := p.pollForDeviceToken(ctx, io.Discard, &oauth2.DeviceAuthResponse{DeviceCode: "device-code", Interval: 1})
+	if err == nil || !strings.Contains(err.Error(), "cancelled") {
+		t.Errorf("pollForDeviceToken() error = %v, want cancelled", err)
+	}
+}
+
+func TestStartDeviceFlow_WritesInstructionsToOut(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/device" {
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"device_code":      "device-code",
+				"user_code":        "ABCD-EFGH",
+				"verification_uri": "https://idp.example.com/device",
+				"interval":         1,
+			})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "Bearer"})
+	}))
+	t.Cleanup(srv.Close)
+	p := &Provider{OAuth2Config: &oauth2.Config{
+		ClientID: "kauth",
+		Endpoint: oauth2.Endpoint{DeviceAuthURL: srv.URL + "/device", TokenURL: srv.URL + "/token", AuthStyle: oauth2.AuthStyleInParams},
+	}}
+
+	var out strings.Builder
+	if _, err := p.StartDeviceFlow(context.Background(), &out); err != nil {
+		t.Fatalf("StartDeviceFlow() error = %v", err)
+	}
+	for _, want := range []string{"https://idp.example.com/device", "ABCD-EFGH", "Authentication successful"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output %q does not contain %q", out.String(), want)
+		}
+	}
+}
+
+func TestDeviceFlowTimeout(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		expiry time.Time
+		want   time.Duration
+	}{
+		{name: "no expiry", want: DefaultDeviceFlowTimeout},
+		{name: "expires sooner", expiry: now.Add(5 * time.Minute), want: 5 * time.Minute},
+		{name: "expires later", expiry: now.Add(time.Hour), want: DefaultDeviceFlowTimeout},
+		{name: "already expired", expiry: now.Add(-time.Minute), want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := deviceFlowTimeout(tt.expiry, now); got != tt.want {
+				t.Errorf("deviceFlowTimeout() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
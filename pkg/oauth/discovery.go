@@ -0,0 +1,62 @@
+package oauth
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// DiscoveryRetry controls how NewProviderWithRetry retries OIDC discovery.
+type DiscoveryRetry struct {
+	Attempts     int           // Total attempts (values below 1 mean one attempt)
+	Timeout      time.Duration // Deadline for each attempt (0 = none)
+	InitialDelay time.Duration // Delay after the first failure, doubled each retry
+	MaxDelay     time.Duration // Upper bound for the delay (0 = unbounded)
+}
+
+// NewProviderWithRetry calls NewProvider until it succeeds, retrying with
+// exponential backoff so a briefly unreachable IdP (e.g. during a rolling
+// restart) does not fail startup. It gives up after retry.Attempts attempts
+// or when ctx is done, returning the last discovery error.
+func NewProviderWithRetry(ctx context.Context, cfg Config, retry DiscoveryRetry) (*Provider, error) {
+	attempts := max(retry.Attempts, 1)
+	delay := retry.InitialDelay
+
+	var lastErr error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		p, err := discoverOnce(ctx, cfg, retry.Timeout)
+		if err == nil {
+			return p, nil
+		}
+		lastErr = err
+
+		slog.Warn("Failed to connect to OIDC provider", "attempt", attempt, "max_attempts", attempts, "error", err)
+		if attempt == attempts {
+			break
+		}
+
+		slog.Info("Retrying OIDC connection", "delay", delay)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("OIDC discovery cancelled after %d attempts: %w", attempt, lastErr)
+		case <-time.After(delay):
+		}
+
+		delay *= 2
+		if retry.MaxDelay > 0 && delay > retry.MaxDelay {
+			delay = retry.MaxDelay
+		}
+	}
+
+	return nil, fmt.Errorf("OIDC discovery failed after %d attempts: %w", attempts, lastErr)
+}
+
+func discoverOnce(ctx context.Context, cfg Config, timeout time.Duration) (*Provider, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return NewProvider(ctx, cfg)
+}
@@ -0,0 +1,107 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyIssuer serves an OIDC discovery document after failing the first
+// failures requests with 503.
+func flakyIssuer(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/.well-known/openid-configuration" {
+			http.NotFound(w, r)
+			return
+		}
+		if calls.Add(1) <= failures {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/keys",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &calls
+}
+
+func TestNewProviderWithRetry_RecoversAfterFailures(t *testing.T) {
+	srv, calls := flakyIssuer(t, 3)
+
+	p, err := NewProviderWithRetry(context.Background(), Config{IssuerURL: srv.URL, ClientID: "kauth"}, DiscoveryRetry{
+		Attempts:     5,
+		Timeout:      time.Second,
+		InitialDelay: time.Millisecond,
+		MaxDelay:     5 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewProviderWithRetry() error = %v", err)
+	}
+	if got := p.OAuth2Config.Endpoint.TokenURL; got != srv.URL+"/token" {
+		t.Errorf("TokenURL = %q, want %q", got, srv.URL+"/token")
+	}
+	if got := calls.Load(); got != 4 {
+		t.Errorf("discovery requests = %d, want 4", got)
+	}
+}
+
+func TestNewProviderWithRetry_GivesUp(t *testing.T) {
+	srv, calls := flakyIssuer(t, 100)
+
+	_, err := NewProviderWithRetry(context.Background(), Config{IssuerURL: srv.URL}, DiscoveryRetry{
+		Attempts:     3,
+		InitialDelay: time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("NewProviderWithRetry() error = nil, want error")
+	}
+	if got := calls.Load(); got != 3 {
+		t.Errorf("discovery requests = %d, want 3", got)
+	}
+}
+
+func TestNewProviderWithRetry_AttemptTimeout(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	_, err := NewProviderWithRetry(context.Background(), Config{IssuerURL: srv.URL}, DiscoveryRetry{
+		Attempts:     2,
+		Timeout:      20 * time.Millisecond,
+		InitialDelay: time.Millisecond,
+	})
+	if err == nil {
+		t.Fatal("NewProviderWithRetry() error = nil against a hanging issuer, want error")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("NewProviderWithRetry() took %v, want per-attempt timeout to apply", elapsed)
+	}
+}
+
+func TestNewProviderWithRetry_ContextCancelled(t *testing.T) {
+	srv, _ := flakyIssuer(t, 100)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := NewProviderWithRetry(ctx, Config{IssuerURL: srv.URL}, DiscoveryRetry{
+		Attempts:     10,
+		InitialDelay: time.Hour,
+	})
+	if err == nil {
+		t.Fatal("NewProviderWithRetry() error = nil with cancelled context, want error")
+	}
+}
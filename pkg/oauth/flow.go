@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -14,41 +15,70 @@ import (
 
 // AuthCodeFlowResult holds the result of an authorization code flow
 type AuthCodeFlowResult struct {
-	Token *oauth2.Token
-	Error error
-	mu    sync.RWMutex
-	done  chan struct{}
+	Token  *oauth2.Token
+	Error  error
+	mu     sync.RWMutex
+	done   chan struct{} // closed once the result is set
+	finish sync.Once
 }
 
-// StartAuthCodeFlow initiates an OAuth2 authorization code flow with PKCE
-func (p *Provider) StartAuthCodeFlow(ctx context.Context, port int) (string, *AuthCodeFlowResult, error) {
+func newAuthCodeFlowResult() *AuthCodeFlowResult {
+	return &AuthCodeFlowResult{done: make(chan struct{})}
+}
+
+// DefaultCallbackHost is the host StartAuthCodeFlow's callback server binds
+// to and names in the redirect URI when none is given.
+const DefaultCallbackHost = "localhost"
+
+// StartAuthCodeFlow initiates an OAuth2 authorization code flow with PKCE,
+// receiving the callback on a local server at host:port. host defaults to
+// DefaultCallbackHost; 127.0.0.1 avoids surprises where localhost resolves
+// elsewhere (e.g. WSL). Port 0 lets the OS pick a free port, which needs an
+// IdP that accepts any loopback port in redirect URIs (RFC 8252). opts are
+// added to the authorization request (e.g. oidc.Nonce). It returns the
+// authorization URL and the redirect URI actually in use.
+func (p *Provider) StartAuthCodeFlow(ctx context.Context, host string, port int, opts ...oauth2.AuthCodeOption) (string, string, *AuthCodeFlowResult, error) {
 	// Generate state for CSRF protection
 	state, err := GenerateState()
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to generate state: %w", err)
+		return "", "", nil, fmt.Errorf("failed to generate state: %w", err)
 	}
 
 	// Generate PKCE verifier
 	verifier := oauth2.GenerateVerifier()
 
+	if host == "" {
+		host = DefaultCallbackHost
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return "", "", nil, fmt.Errorf("failed to start callback server: %w", err)
+	}
+	// With port 0 only the listener knows the port the IdP must redirect to.
+	port = listener.Addr().(*net.TCPAddr).Port
+	redirectURL := "http://" + net.JoinHostPort(host, strconv.Itoa(port)) + "/callback"
+	redirect := oauth2.SetAuthURLParam("redirect_uri", redirectURL)
+
 	// Create authorization URL
-	authURL := p.OAuth2Config.AuthCodeURL(
+	authURL := p.AuthCodeURL(
 		state,
-		oauth2.AccessTypeOffline, // Request refresh token
-		oauth2.S256ChallengeOption(verifier),
+		verifier,
+		append([]oauth2.AuthCodeOption{
+			oauth2.AccessTypeOffline, // Request refresh token
+			redirect,
+		}, opts...)...,
 	)
 
 	// Start callback server
-	result := &AuthCodeFlowResult{done: make(chan struct{})}
-	if err := p.startCallbackServer(ctx, port, state, verifier, result); err != nil {
-		return "", nil, fmt.Errorf("failed to start callback server: %w", err)
-	}
+	result := newAuthCodeFlowResult()
+	p.startCallbackServer(ctx, listener, state, verifier, redirect, result)
 
-	return authURL, result, nil
+	return authURL, redirectURL, result, nil
 }
 
-// startCallbackServer starts an HTTP server to handle OAuth callbacks
-func (p *Provider) startCallbackServer(ctx context.Context, port int, expectedState, verifier string, result *AuthCodeFlowResult) error {
+// startCallbackServer serves OAuth callbacks on listener. redirect repeats
+// the authorization request's redirect_uri in the token exchange.
+func (p *Provider) startCallbackServer(ctx context.Context, listener net.Listener, expectedState, verifier string, redirect oauth2.AuthCodeOption, result *AuthCodeFlowResult) {
 	var once sync.Once
 	codeChan := make(chan string, 1)
 	errChan := make(chan error, 1)
@@ -112,11 +142,6 @@ func (p *Provider) startCallbackServer(ctx context.Context, port int, expectedSt
 		})
 	})
 
-	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
-	if err != nil {
-		return fmt.Errorf("failed to start listener: %w", err)
-	}
-
 	server := &http.Server{
 		Handler:      mux,
 		ReadTimeout:  10 * time.Second,
@@ -143,11 +168,7 @@ func (p *Provider) startCallbackServer(ctx context.Context, port int, expectedSt
 		select {
 		case code := <-codeChan:
 			// Exchange authorization code for token
-			token, err := p.OAuth2Config.Exchange(
-				ctx,
-				code,
-				oauth2.VerifierOption(verifier),
-			)
+			token, err := p.Exchange(ctx, code, oauth2.VerifierOption(verifier), redirect)
 			if err != nil {
 				result.setError(fmt.Errorf("failed to exchange code for token: %w", err))
 				return
@@ -164,27 +185,42 @@ func (p *Provider) startCallbackServer(ctx context.Context, port int, expectedSt
 			result.setError(errors.New("authentication timeout - no callback received after 5 minutes"))
 		}
 	}()
-
-	return nil
 }
 
 func (r *AuthCodeFlowResult) setToken(token *oauth2.Token) {
-	r.mu.Lock()
-	r.Token = token
-	r.mu.Unlock()
-	close(r.done)
+	r.complete(token, nil)
 }
 
 func (r *AuthCodeFlowResult) setError(err error) {
-	r.mu.Lock()
-	r.Error = err
-	r.mu.Unlock()
-	close(r.done)
+	r.complete(nil, err)
+}
+
+// complete records the flow's outcome and wakes Wait. Only the first
+// outcome counts: a callback server failure and the callback itself may
+// both report one.
+func (r *AuthCodeFlowResult) complete(token *oauth2.Token, err error) {
+	r.finish.Do(func() {
+		r.mu.Lock()
+		r.Token, r.Error = token, err
+		r.mu.Unlock()
+		close(r.done)
+	})
 }
 
 // Wait blocks until the authentication flow completes and returns the token or error.
 func (r *AuthCodeFlowResult) Wait() (*oauth2.Token, error) {
-	<-r.done
+	return r.WaitContext(context.Background())
+}
+
+// WaitContext is Wait, returning ctx.Err() early if ctx is done first. The
+// flow itself keeps running until the context passed to StartAuthCodeFlow
+// ends or it times out.
+func (r *AuthCodeFlowResult) WaitContext(ctx context.Context) (*oauth2.Token, error) {
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 	return r.Token, r.Error
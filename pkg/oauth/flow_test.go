@@ -0,0 +1,117 @@
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestAuthCodeFlowResult_WaitReturnsPromptly(t *testing.T) {
+	result := newAuthCodeFlowResult()
+	set := make(chan time.Time, 1)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		set <- time.Now()
+		result.setToken(&oauth2.Token{AccessToken: "access"})
+	}()
+
+	token, err := result.Wait()
+	returned := time.Now()
+	if err != nil || token == nil || token.AccessToken != "access" {
+		t.Fatalf("Wait() = %v, %v, want the token", token, err)
+	}
+	// Polling would add up to its interval; a closed channel wakes Wait
+	// right away.
+	if delay := returned.Sub(<-set); delay > 50*time.Millisecond {
+		t.Errorf("Wait() returned %v after setToken", delay)
+	}
+}
+
+func TestAuthCodeFlowResult_FirstOutcomeWins(t *testing.T) {
+	result := newAuthCodeFlowResult()
+	result.setToken(&oauth2.Token{AccessToken: "access"})
+	result.setError(errors.New("callback server error"))
+
+	token, err := result.Wait()
+	if err != nil || token == nil {
+		t.Errorf("Wait() = %v, %v, want the first outcome (token)", token, err)
+	}
+}
+
+func TestAuthCodeFlowResult_WaitContextCancelled(t *testing.T) {
+	result := newAuthCodeFlowResult()
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+	}()
+
+	token, err := result.WaitContext(ctx)
+	if !errors.Is(err, context.Canceled) || token != nil {
+		t.Errorf("WaitContext() = %v, %v, want context.Canceled", token, err)
+	}
+
+	// The flow can still complete for a later waiter.
+	result.setToken(&oauth2.Token{AccessToken: "access"})
+	if token, err := result.WaitContext(context.Background()); err != nil || token == nil {
+		t.Errorf("WaitContext() after completion = %v, %v, want the token", token, err)
+	}
+}
+
+func TestStartAuthCodeFlow_ZeroPort(t *testing.T) {
+	var exchangedRedirect string
+	idp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		exchangedRedirect = r.PostForm.Get("redirect_uri")
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]any{"access_token": "access", "token_type": "Bearer"})
+	}))
+	defer idp.Close()
+	p := &Provider{OAuth2Config: &oauth2.Config{
+		ClientID:    "kauth",
+		RedirectURL: "http://localhost:8000/callback",
+		Endpoint:    oauth2.Endpoint{AuthURL: "https://idp.example.com/auth", TokenURL: idp.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	authURL, redirectURL, result, err := p.StartAuthCodeFlow(ctx, "127.0.0.1", 0)
+	if err != nil {
+		t.Fatalf("StartAuthCodeFlow() error = %v", err)
+	}
+	if !strings.HasPrefix(redirectURL, "http://127.0.0.1:") || strings.HasPrefix(redirectURL, "http://127.0.0.1:0/") {
+		t.Fatalf("redirect URL = %q, want the chosen port on 127.0.0.1", redirectURL)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("parse auth URL: %v", err)
+	}
+	if got := u.Query().Get("redirect_uri"); got != redirectURL {
+		t.Errorf("auth URL redirect_uri = %q, want %q", got, redirectURL)
+	}
+
+	resp, err := http.Get(redirectURL + "?code=code&state=" + url.QueryEscape(u.Query().Get("state")))
+	if err != nil {
+		t.Fatalf("callback request: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("callback status = %d, want 200", resp.StatusCode)
+	}
+
+	token, err := result.WaitContext(ctx)
+	if err != nil || token.AccessToken != "access" {
+		t.Fatalf("WaitContext() = %v, %v, want the token", token, err)
+	}
+	if exchangedRedirect != redirectURL {
+		t.Errorf("exchange redirect_uri = %q, want %q", exchangedRedirect, redirectURL)
+	}
+}
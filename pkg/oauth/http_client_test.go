@@ -0,0 +1,213 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tlsIssuer serves a discovery document over TLS with a self-signed
+// certificate and returns the server and a PEM file holding its CA.
+func tlsIssuer(t *testing.T) (*httptest.Server, string) {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/keys",
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, block, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, caFile
+}
+
+func TestNewProvider_CustomCA(t *testing.T) {
+	srv, caFile := tlsIssuer(t)
+
+	if _, err := NewProvider(context.Background(), Config{IssuerURL: srv.URL}); err == nil {
+		t.Fatal("NewProvider() with system roots succeeded against a private CA, want error")
+	}
+
+	client, err := NewHTTPClient(caFile, false, DefaultMinRSABits)
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error = %v", err)
+	}
+	p, err := NewProvider(context.Background(), Config{IssuerURL: srv.URL, HTTPClient: client})
+	if err != nil {
+		t.Fatalf("NewProvider() with OIDC CA file error = %v", err)
+	}
+	// Token requests go through the configured client, so they trust the CA.
+	resp, err := p.HTTPClient.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("provider HTTP client error = %v, want the OIDC CA trusted", err)
+	}
+	_ = resp.Body.Close()
+	if p.HTTPClient.Timeout != DefaultHTTPTimeout {
+		t.Errorf("provider HTTP client Timeout = %v, want %v", p.HTTPClient.Timeout, DefaultHTTPTimeout)
+	}
+}
+
+// rsaIssuer is like tlsIssuer but presents a self-signed certificate with an
+// RSA key of the given size.
+func rsaIssuer(t *testing.T, bits int) (*httptest.Server, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, bits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "idp"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var srv *httptest.Server
+	srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"issuer":                 srv.URL,
+			"authorization_endpoint": srv.URL + "/auth",
+			"token_endpoint":         srv.URL + "/token",
+			"jwks_uri":               srv.URL + "/keys",
+		})
+	}))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return srv, caFile
+}
+
+func TestNewProvider_MinRSABits(t *testing.T) {
+	weak, weakCA := rsaIssuer(t, 1024)
+	strong, strongCA := rsaIssuer(t, 2048)
+
+	tests := []struct {
+		name       string
+		srv        *httptest.Server
+		caFile     string
+		insecure   bool
+		minRSABits int
+		wantErr    bool
+	}{
+		{name: "weak key rejected", srv: weak, caFile: weakCA, minRSABits: DefaultMinRSABits, wantErr: true},
+		{name: "weak key rejected without verification", srv: weak, insecure: true, minRSABits: DefaultMinRSABits, wantErr: true},
+		{name: "weak key allowed when check disabled", srv: weak, caFile: weakCA, minRSABits: 0},
+		{name: "strong key accepted", srv: strong, caFile: strongCA, minRSABits: DefaultMinRSABits},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewHTTPClient(tt.caFile, tt.insecure, tt.minRSABits)
+			if err != nil {
+				t.Fatalf("NewHTTPClient() error = %v", err)
+			}
+			_, err = NewProvider(context.Background(), Config{IssuerURL: tt.srv.URL, HTTPClient: client})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewProvider() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !strings.Contains(err.Error(), "1024-bit RSA key") {
+				t.Errorf("NewProvider() error = %v, want weak key error", err)
+			}
+		})
+	}
+}
+
+func TestVerifyKeyStrength_DeprecatedSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verify := verifyKeyStrength(DefaultMinRSABits)
+
+	leaf := &x509.Certificate{
+		PublicKey:          &key.PublicKey,
+		SignatureAlgorithm: x509.SHA1WithRSA,
+		RawIssuer:          []byte("ca"),
+		RawSubject:         []byte("leaf"),
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{leaf}}); err == nil {
+		t.Error("SHA-1 signed leaf accepted, want error")
+	}
+
+	root := &x509.Certificate{
+		PublicKey:          &key.PublicKey,
+		SignatureAlgorithm: x509.SHA1WithRSA,
+		RawIssuer:          []byte("root"),
+		RawSubject:         []byte("root"),
+	}
+	if err := verify(tls.ConnectionState{PeerCertificates: []*x509.Certificate{root}}); err != nil {
+		t.Errorf("SHA-1 self-signed root rejected: %v", err)
+	}
+}
+
+func TestNewProvider_InsecureSkipVerify(t *testing.T) {
+	srv, _ := tlsIssuer(t)
+
+	client, err := NewHTTPClient("", true, DefaultMinRSABits)
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error = %v", err)
+	}
+	if _, err := NewProvider(context.Background(), Config{IssuerURL: srv.URL, HTTPClient: client}); err != nil {
+		t.Fatalf("NewProvider() with insecure client error = %v", err)
+	}
+}
+
+func TestNewHTTPClient_Errors(t *testing.T) {
+	if _, err := NewHTTPClient(filepath.Join(t.TempDir(), "missing.pem"), false, DefaultMinRSABits); err == nil {
+		t.Error("NewHTTPClient() error = nil for a missing CA file")
+	}
+
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHTTPClient(notPEM, false, DefaultMinRSABits); err == nil {
+		t.Error("NewHTTPClient() error = nil for a CA file without certificates")
+	}
+}
+
+func TestNewHTTPClient_KeepsProxyFromEnvironment(t *testing.T) {
+	client, err := NewHTTPClient("", true, DefaultMinRSABits)
+	if err != nil {
+		t.Fatalf("NewHTTPClient() error = %v", err)
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		t.Error("custom transport dropped proxy support (HTTPS_PROXY)")
+	}
+}
@@ -0,0 +1,163 @@
+package oauth
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-jose/go-jose/v4"
+)
+
+// Defaults for the JWKS cache.
+const (
+	DefaultJWKSRefreshInterval    = time.Hour
+	DefaultJWKSMinRefreshInterval = time.Minute
+)
+
+// cachingKeySet is an oidc.KeySet that keeps the provider's signing keys in
+// memory. Verifications never wait on the network while cached keys verify
+// the token: once the keys are older than refreshInterval they are refreshed
+// in the background. A token no cached key verifies (e.g. after key
+// rotation) triggers a synchronous refetch, but at most one per
+// minRefreshInterval, so a refresh storm of kubectl plugins cannot hammer
+// the IdP's JWKS endpoint.
+type cachingKeySet struct {
+	jwksURL            string
+	client             *http.Client
+	refreshInterval    time.Duration
+	minRefreshInterval time.Duration
+	now                func() time.Time
+
+	mu         sync.Mutex
+	keys       []crypto.PublicKey
+	fetchedAt  time.Time // last fetch attempt, successful or not
+	refreshing bool      // a background refresh is in flight
+	fetchMu    sync.Mutex
+}
+
+func newCachingKeySet(jwksURL string, client *http.Client, refreshInterval, minRefreshInterval time.Duration) *cachingKeySet {
+	return &cachingKeySet{
+		jwksURL:            jwksURL,
+		client:             client,
+		refreshInterval:    refreshInterval,
+		minRefreshInterval: minRefreshInterval,
+		now:                time.Now,
+	}
+}
+
+// VerifySignature implements oidc.KeySet.
+func (k *cachingKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	k.mu.Lock()
+	keys, age := k.keys, k.now().Sub(k.fetchedAt)
+	if len(keys) > 0 && age >= k.refreshInterval && !k.refreshing {
+		k.refreshing = true
+		go k.backgroundRefresh()
+	}
+	k.mu.Unlock()
+
+	if len(keys) > 0 {
+		if payload, err := (&oidc.StaticKeySet{PublicKeys: keys}).VerifySignature(ctx, jwt); err == nil {
+			return payload, nil
+		}
+	}
+
+	// No cached key verifies the token: the IdP may have rotated keys.
+	keys, err := k.refetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return (&oidc.StaticKeySet{PublicKeys: keys}).VerifySignature(ctx, jwt)
+}
+
+// refetch fetches the key set unless another fetch happened within
+// minRefreshInterval, in which case the cached keys are returned.
+func (k *cachingKeySet) refetch(ctx context.Context) ([]crypto.PublicKey, error) {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	k.mu.Lock()
+	if !k.fetchedAt.IsZero() && k.now().Sub(k.fetchedAt) < k.minRefreshInterval {
+		keys := k.keys
+		k.mu.Unlock()
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("no JWKS keys available (last fetch failed)")
+		}
+		return keys, nil
+	}
+	k.mu.Unlock()
+
+	return k.fetch(ctx)
+}
+
+func (k *cachingKeySet) backgroundRefresh() {
+	defer func() {
+		k.mu.Lock()
+		k.refreshing = false
+		k.mu.Unlock()
+	}()
+
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := k.fetch(ctx); err != nil {
+		slog.Warn("Background JWKS refresh failed, keeping cached keys", "error", err)
+	}
+}
+
+// fetch downloads the key set and replaces the cache. On failure the cached
+// keys are kept. Callers must hold fetchMu.
+func (k *cachingKeySet) fetch(ctx context.Context) ([]crypto.PublicKey, error) {
+	keys, err := k.download(ctx)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.fetchedAt = k.now()
+	if err != nil {
+		return nil, err
+	}
+	k.keys = keys
+	return keys, nil
+}
+
+func (k *cachingKeySet) download(ctx context.Context) ([]crypto.PublicKey, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, k.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: status %d", resp.StatusCode)
+	}
+
+	var set jose.JSONWebKeySet
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to parse JWKS: %w", err)
+	}
+
+	keys := make([]crypto.PublicKey, 0, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		if key.IsPublic() {
+			keys = append(keys, key.Key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS at %s contains no signing keys", k.jwksURL)
+	}
+	return keys, nil
+}
@@ -0,0 +1,252 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"kauth/pkg/metrics"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// jwksIdP is a stub IdP that signs ID tokens and counts JWKS fetches. The
+// published key can be swapped to simulate rotation, and the token and JWKS
+// endpoints slowed down to simulate a struggling IdP.
+type jwksIdP struct {
+	srv        *httptest.Server
+	jwksHits   atomic.Int32
+	mu         sync.Mutex
+	publishKey *rsa.PrivateKey
+
+	tokenDelay atomic.Int64 // time.Duration
+	jwksDelay  atomic.Int64 // time.Duration
+}
+
+// stall waits for d or until the client gives up on r.
+func stall(r *http.Request, d time.Duration) {
+	select {
+	case <-time.After(d):
+	case <-r.Context().Done():
+	}
+}
+
+func newJWKSIdP(t *testing.T) *jwksIdP {
+	t.Helper()
+	idp := &jwksIdP{publishKey: newRSAKey(t)}
+	idp.srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"issuer":                                idp.srv.URL,
+				"authorization_endpoint":                idp.srv.URL + "/auth",
+				"token_endpoint":                        idp.srv.URL + "/token",
+				"jwks_uri":                              idp.srv.URL + "/keys",
+				"id_token_signing_alg_values_supported": []string{"RS256", "HS256"},
+			})
+		case "/token":
+			// Reading the form lets the server notice a client giving up.
+			_ = r.ParseForm()
+			stall(r, time.Duration(idp.tokenDelay.Load()))
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"access_token": "access",
+				"token_type":   "Bearer",
+				"id_token":     idp.idToken(t, idp.publishKey),
+			})
+		case "/keys":
+			idp.jwksHits.Add(1)
+			stall(r, time.Duration(idp.jwksDelay.Load()))
+			idp.mu.Lock()
+			key := idp.publishKey
+			idp.mu.Unlock()
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, Algorithm: "RS256", Use: "sig"},
+			}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(idp.srv.Close)
+	return idp
+}
+
+func (idp *jwksIdP) rotate(key *rsa.PrivateKey) {
+	idp.mu.Lock()
+	idp.publishKey = key
+	idp.mu.Unlock()
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func (idp *jwksIdP) idToken(t *testing.T, key *rsa.PrivateKey) string {
+	t.Helper()
+	return idp.idTokenFor(t, key, "kauth")
+}
+
+// idTokenFor signs an ID token whose aud is aud (a string or []string).
+func (idp *jwksIdP) idTokenFor(t *testing.T, key *rsa.PrivateKey, aud any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, _ := json.Marshal(map[string]any{
+		"iss": idp.srv.URL,
+		"aud": aud,
+		"sub": "user-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+		"iat": time.Now().Unix(),
+	})
+	jws, err := signer.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := jws.CompactSerialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func TestVerifyIDToken_CachesJWKS(t *testing.T) {
+	idp := newJWKSIdP(t)
+	p, err := NewProvider(context.Background(), Config{IssuerURL: idp.srv.URL, ClientID: "kauth"})
+	if err != nil {
+		t.Fatalf("NewProvider() error = %v", err)
+	}
+
+	before := metrics.OIDCProviderRequests.WithLabel("jwks").Value()
+	token := idp.idToken(t, idp.publishKey)
+	for i := range 50 {
+		if _, err := p.VerifyIDToken(context.Background(), token); err != nil {
+			t.Fatalf("VerifyIDToken() #%d error = %v", i, err)
+		}
+	}
+
+	if got := idp.jwksHits.Load(); got != 1 {
+		t.Errorf("JWKS fetched %d times for 50 verifications, want 1", got)
+	}
+	if got := metrics.OIDCProviderRequests.WithLabel("jwks").Value() - before; got != 1 {
+		t.Errorf("jwks request metric grew by %d, want 1", got)
+	}
+}
+
+func TestVerifyIDToken_AdditionalAudiences(t *testing.T) {
+	idp := newJWKSIdP(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name       string
+		additional []string
+		aud        any
+		wantErr    bool
+	}{
+		{name: "client ID", aud: "kauth"},
+		{name: "other audience without additional audiences", aud: "old-kauth", wantErr: true},
+		{name: "additional audience", additional: []string{"old-kauth", "api"}, aud: "old-kauth"},
+		{name: "client ID with additional audiences", additional: []string{"old-kauth"}, aud: "kauth"},
+		{name: "one of several aud values", additional: []string{"api"}, aud: []string{"someone-else", "api"}},
+		{name: "unknown audience", additional: []string{"old-kauth", "api"}, aud: "someone-else", wantErr: true},
+		{name: "no known aud value", additional: []string{"api"}, aud: []string{"a", "b"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProvider(ctx, Config{IssuerURL: idp.srv.URL, ClientID: "kauth", AdditionalAudiences: tt.additional})
+			if err != nil {
+				t.Fatalf("NewProvider() error = %v", err)
+			}
+			_, err = p.VerifyIDToken(ctx, idp.idTokenFor(t, idp.publishKey, tt.aud))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("VerifyIDToken() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCachingKeySet_Rotation(t *testing.T) {
+	idp := newJWKSIdP(t)
+	oldKey := idp.publishKey
+	now := time.Now()
+
+	ks := newCachingKeySet(idp.srv.URL+"/keys", http.DefaultClient, time.Hour, time.Minute)
+	ks.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	if _, err := ks.VerifySignature(ctx, idp.idToken(t, oldKey)); err != nil {
+		t.Fatalf("VerifySignature() error = %v", err)
+	}
+
+	newKey := newRSAKey(t)
+	idp.rotate(newKey)
+	rotated := idp.idToken(t, newKey)
+
+	// Within the minimum interval an unknown key does not trigger a fetch.
+	if _, err := ks.VerifySignature(ctx, rotated); err == nil {
+		t.Error("VerifySignature() with a not-yet-fetched key succeeded")
+	}
+	if got := idp.jwksHits.Load(); got != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1 (refetch must be rate limited)", got)
+	}
+
+	// After it, the unknown key triggers exactly one refetch.
+	now = now.Add(2 * time.Minute)
+	for range 5 {
+		if _, err := ks.VerifySignature(ctx, rotated); err != nil {
+			t.Fatalf("VerifySignature() after rotation error = %v", err)
+		}
+	}
+	if got := idp.jwksHits.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func TestCachingKeySet_BackgroundRefresh(t *testing.T) {
+	idp := newJWKSIdP(t)
+	key := idp.publishKey
+	now := time.Now()
+
+	ks := newCachingKeySet(idp.srv.URL+"/keys", http.DefaultClient, time.Hour, time.Minute)
+	ks.now = func() time.Time { return now }
+	token := idp.idToken(t, key)
+
+	if _, err := ks.VerifySignature(context.Background(), token); err != nil {
+		t.Fatalf("VerifySignature() error = %v", err)
+	}
+
+	// Stale keys still verify immediately; the refresh happens asynchronously.
+	now = now.Add(2 * time.Hour)
+	if _, err := ks.VerifySignature(context.Background(), token); err != nil {
+		t.Fatalf("VerifySignature() with stale keys error = %v", err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for idp.jwksHits.Load() < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("stale keys were not refreshed in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSigningAlgs(t *testing.T) {
+	got := signingAlgs([]string{"RS256", "HS256", "none", "ES256"})
+	if len(got) != 2 || got[0] != "RS256" || got[1] != "ES256" {
+		t.Errorf("signingAlgs() = %v, want [RS256 ES256]", got)
+	}
+}
@@ -1,9 +1,14 @@
 package server
 
 import (
+	"crypto/x509"
 	"encoding/base64"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"time"
 )
 
 const (
@@ -16,9 +21,19 @@ const (
 // 1. CLUSTER_CA_DATA environment variable (base64 encoded)
 // 2. CLUSTER_CA_FILE environment variable (path to file)
 // 3. In-cluster CA at /var/run/secrets/kubernetes.io/serviceaccount/ca.crt
+//
+// The CA must be a valid PEM certificate bundle; anything else would produce
+// a kubeconfig that only fails later, at kubectl's TLS handshake.
 func GetClusterCA() (string, error) {
 	// Try CLUSTER_CA_DATA first (already base64 encoded)
 	if caData := os.Getenv("CLUSTER_CA_DATA"); caData != "" {
+		data, err := base64.StdEncoding.DecodeString(caData)
+		if err != nil {
+			return "", fmt.Errorf("CLUSTER_CA_DATA is not valid base64: %w", err)
+		}
+		if err := checkCABundle(data, "CLUSTER_CA_DATA"); err != nil {
+			return "", err
+		}
 		return caData, nil
 	}
 
@@ -28,13 +43,61 @@ func GetClusterCA() (string, error) {
 		if err != nil {
 			return "", fmt.Errorf("failed to read CA file %s: %w", caFile, err)
 		}
+		if err := checkCABundle(data, caFile); err != nil {
+			return "", err
+		}
 		return base64.StdEncoding.EncodeToString(data), nil
 	}
 
 	// Try in-cluster CA
 	if data, err := os.ReadFile(inClusterCAPath); err == nil {
+		if err := checkCABundle(data, inClusterCAPath); err != nil {
+			return "", err
+		}
 		return base64.StdEncoding.EncodeToString(data), nil
 	}
 
 	return "", fmt.Errorf("no cluster CA found - set CLUSTER_CA_DATA or CLUSTER_CA_FILE, or run in-cluster")
 }
+
+// checkCABundle parses data as a CA bundle and logs each certificate.
+func checkCABundle(data []byte, source string) error {
+	certs, err := ParseCABundle(data)
+	if err != nil {
+		return fmt.Errorf("invalid cluster CA from %s: %w", source, err)
+	}
+	for _, cert := range certs {
+		slog.Info("Cluster CA loaded", "source", source, "subject", cert.Subject.String(), "not_after", cert.NotAfter)
+		if time.Now().After(cert.NotAfter) {
+			slog.Warn("Cluster CA certificate has expired", "subject", cert.Subject.String(), "not_after", cert.NotAfter)
+		}
+	}
+	return nil
+}
+
+// ParseCABundle parses one or more PEM-encoded certificates. It fails if the
+// data contains no certificates or any block that is not a valid certificate.
+func ParseCABundle(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM certificates found")
+	}
+	return certs, nil
+}
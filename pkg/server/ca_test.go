@@ -0,0 +1,103 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testCAPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey() error = %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kubernetes"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate() error = %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestParseCABundle(t *testing.T) {
+	ca := testCAPEM(t)
+
+	tests := []struct {
+		name      string
+		data      []byte
+		wantCerts int
+		wantErr   bool
+	}{
+		{name: "single cert", data: ca, wantCerts: 1},
+		{name: "bundle", data: append(append([]byte{}, ca...), testCAPEM(t)...), wantCerts: 2},
+		{name: "garbage", data: []byte("not a certificate"), wantErr: true},
+		{name: "empty", data: nil, wantErr: true},
+		{name: "truncated", data: ca[:len(ca)/2], wantErr: true},
+		{name: "private key block", data: pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte{1}}), wantErr: true},
+		{name: "corrupt certificate body", data: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("junk")}), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certs, err := ParseCABundle(tt.data)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCABundle() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(certs) != tt.wantCerts {
+				t.Errorf("ParseCABundle() returned %d certs, want %d", len(certs), tt.wantCerts)
+			}
+		})
+	}
+}
+
+func TestGetClusterCA(t *testing.T) {
+	ca := testCAPEM(t)
+
+	t.Run("valid CLUSTER_CA_DATA", func(t *testing.T) {
+		encoded := base64.StdEncoding.EncodeToString(ca)
+		t.Setenv("CLUSTER_CA_DATA", encoded)
+		got, err := GetClusterCA()
+		if err != nil {
+			t.Fatalf("GetClusterCA() error = %v", err)
+		}
+		if got != encoded {
+			t.Errorf("GetClusterCA() = %q, want %q", got, encoded)
+		}
+	})
+
+	t.Run("garbage CLUSTER_CA_DATA", func(t *testing.T) {
+		t.Setenv("CLUSTER_CA_DATA", base64.StdEncoding.EncodeToString([]byte("garbage")))
+		if _, err := GetClusterCA(); err == nil {
+			t.Error("GetClusterCA() error = nil for garbage CA, want error")
+		}
+	})
+
+	t.Run("garbage CLUSTER_CA_FILE", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "ca.crt")
+		if err := os.WriteFile(path, []byte("-----BEGIN CERTIFICATE-----\ntruncated"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		t.Setenv("CLUSTER_CA_DATA", "")
+		t.Setenv("CLUSTER_CA_FILE", path)
+		if _, err := GetClusterCA(); err == nil {
+			t.Error("GetClusterCA() error = nil for truncated CA file, want error")
+		}
+	})
+}
@@ -1,6 +1,22 @@
 package server
 
-import "time"
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"kauth/pkg/handlers"
+	"kauth/pkg/jwt"
+	"kauth/pkg/middleware"
+	"kauth/pkg/oauth"
+	"kauth/pkg/validation"
+)
 
 // Config holds the server configuration
 type Config struct {
@@ -8,11 +24,47 @@ type Config struct {
 	IssuerURL    string
 	ClientID     string
 	ClientSecret string
+	ClaimsPrefix string // Top-level claim holding nested claims (e.g. "https://myapp/claims")
+
+	// AdditionalAudiences are ID token audiences accepted besides ClientID,
+	// e.g. during a client ID migration.
+	AdditionalAudiences []string
+
+	DiscoveryRetries int           // OIDC discovery attempts at startup (default: 60)
+	DiscoveryTimeout time.Duration // Deadline per discovery attempt (default: 10s)
+
+	ExchangeTimeout time.Duration // Deadline for an authorization code exchange (default: 10s)
+	VerifyTimeout   time.Duration // Deadline for an ID token verification, including JWKS fetches (default: 10s)
+
+	JWKSRefreshInterval    time.Duration // Background refresh age for cached IdP signing keys (default: 1h)
+	JWKSMinRefreshInterval time.Duration // Min gap between JWKS fetches for unknown keys (default: 1m)
+
+	OIDCCAFile             string // PEM bundle trusted for the IdP in addition to system roots
+	OIDCInsecureSkipVerify bool   // Skip IdP TLS verification (development only)
+	OIDCMinRSABits         int    // Min RSA key size in IdP certificates (default: 2048, 0 = no check)
+	PKCEMethod             string // PKCE code_challenge_method: "S256" (default) or "plain"
 
 	// Kubernetes Configuration
 	ClusterName   string
 	ClusterServer string
 	ClusterCA     string // Base64 encoded CA cert
+	Namespace     string // Namespace holding OAuthSession resources
+
+	// ClusterProxyURL is written as the cluster's proxy-url in issued
+	// kubeconfigs, for API servers reachable only through a proxy.
+	ClusterProxyURL string
+
+	// ClusterTLSServerName is written as the cluster's tls-server-name, for
+	// API servers whose certificate names a host other than the URL's.
+	ClusterTLSServerName string
+
+	// AuditLog is where JSON audit records go: "" (disabled), "stdout", or
+	// a file path appended to.
+	AuditLog string
+
+	// AuditK8sEvents records logins and denials as Kubernetes Events in
+	// Namespace, in addition to the audit log.
+	AuditK8sEvents bool
 
 	// Server Configuration
 	BaseURL     string // e.g. https://kauth.example.com
@@ -20,6 +72,14 @@ type Config struct {
 	TLSCertFile string
 	TLSKeyFile  string
 
+	// TLSMinVersion is the oldest TLS version the HTTPS listener accepts:
+	// TLSVersion12 (default) or TLSVersion13.
+	TLSMinVersion string
+
+	// SuccessTemplateFile is an html/template rendered after a successful
+	// login instead of the built-in page (see handlers.SuccessPageData).
+	SuccessTemplateFile string
+
 	// WebhookListenAddr is the address for the dedicated webhook HTTP listener.
 	// The token-review webhook is served here so it bypasses the main mux's rate
 	// limiter (which would throttle burst requests from the API server on pod
@@ -27,20 +87,433 @@ type Config struct {
 	// Leave empty to disable the webhook listener.
 	WebhookListenAddr string
 
+	// MetricsAddr is the address for the internal listener serving
+	// Prometheus metrics at /metrics, kept off the client-facing API.
+	// Leave empty to disable metrics.
+	MetricsAddr string
+
 	// JWT Configuration (required for stateless operation)
 	JWTSigningKey    []byte        // 32+ bytes for HMAC-SHA256
-	JWTEncryptionKey []byte        // 32 bytes for AES-256
+	JWTEncryptionKey []byte        // 32 bytes for AES-256 or ChaCha20-Poly1305
+	JWTAlgorithm     string        // AEAD for new tokens: "aes-gcm" (default) or "chacha20poly1305"
+	JWTEd25519Key    []byte        // Optional 32-byte Ed25519 seed; signs tokens verifiably and serves /jwks.json
 	SessionTTL       time.Duration // OAuth session TTL (default: 15 minutes)
 	RefreshTokenTTL  time.Duration // Refresh token TTL (default: 7 days)
 
+	// AbsoluteSessionTTL caps a session's total lifetime across refresh token
+	// rotations (default: 30 days, 0 = no cap).
+	AbsoluteSessionTTL time.Duration
+
+	// MinTokenIssuedAt rejects session and refresh tokens from logins before
+	// it (RFC 3339), forcing everyone to log in again after a security event.
+	// Reloaded on SIGHUP, so it can be bumped without a restart.
+	MinTokenIssuedAt time.Time
+
+	// UnscopedTokensUntil keeps accepting session and refresh tokens minted
+	// before tokens carried an issuer and audience until it (RFC 3339). Set it
+	// to about one refresh TTL after upgrading; the zero value rejects them.
+	UnscopedTokensUntil time.Time
+
 	// Security Configuration
-	AllowedOrigins    []string // CORS allowed origins (empty = none, ["*"] = all)
-	RateLimitRPS      float64  // Rate limit requests per second (default: 10)
-	RateLimitBurst    int      // Rate limit burst size (default: 20)
-	RotationWindow    int      // Number of previous refresh tokens to accept (default: 2)
-	TrustedProxyCIDRs []string // CIDR blocks for trusted reverse proxies (e.g., "10.0.0.0/8,172.16.0.0/12")
+	AllowedOrigins    []string      // CORS allowed origins (empty = none, ["*"] = all)
+	RateLimitRPS      float64       // Rate limit requests per second (default: 10)
+	RateLimitBurst    int           // Rate limit burst size (default: 20)
+	RotationWindow    int           // Number of previous refresh tokens to accept (default: 2)
+	TrustedProxyCIDRs []string      // CIDR blocks for trusted reverse proxies (e.g., "10.0.0.0/8,172.16.0.0/12")
+	RequestTimeout    time.Duration // Max handler time for non-streaming requests (default: 60s, 0 = none)
+
+	// EnforceHTTPS redirects plain HTTP GET and HEAD requests on the API
+	// listener to BASE_URL's host over https:// and refuses other methods.
+	// X-Forwarded-Proto is honoured from TrustedProxyCIDRs.
+	EnforceHTTPS bool
+
+	// OTLPEndpoint enables OpenTelemetry tracing, exporting spans over
+	// OTLP/HTTP; the exporter reads the other OTEL_* variables itself.
+	OTLPEndpoint string
+
+	// MaxRequestBodyBytes caps request bodies on the API and webhook
+	// listeners; larger requests get 413 (default: 64KiB).
+	MaxRequestBodyBytes int
+
+	// MaxPendingSessions caps logins in progress across all replicas;
+	// /start-login returns 503 beyond it (default: 1000, 0 = no cap).
+	MaxPendingSessions int
+	// WatchKeepaliveInterval is the /watch SSE keepalive period (default:
+	// 5s, at most 10s); keep it below any proxy idle timeout.
+	WatchKeepaliveInterval time.Duration
+	// WatchMaxDuration ends a /watch stream with an error event if the
+	// login has not completed (default: 15m, 0 = no limit).
+	WatchMaxDuration time.Duration
+	// SessionCleanupInterval is how often stale sessions are expired and
+	// deleted (default: 30s).
+	SessionCleanupInterval time.Duration
+
+	// RefreshRequireNoOrigin rejects /refresh requests carrying an Origin
+	// header not in AllowedOrigins. The CLI sends no Origin.
+	RefreshRequireNoOrigin bool
+	// RefreshRequireContentType rejects /refresh requests without a
+	// Content-Type. Requests with a non-JSON Content-Type always get 415;
+	// a missing header is accepted by default for older clients.
+	RefreshRequireContentType bool
 
 	// Authorization Configuration
 	AllowedGroups []string // OIDC groups allowed to authenticate (empty = allow all)
 	AdminGroups   []string // OIDC groups allowed to manage/revoke sessions (empty = no admins)
+	MaxGroups     int      // Max user groups considered during authorization (default: 1000, 0 = no cap)
+
+	// RequireVerifiedEmail refuses users whose email the IdP has not
+	// verified: "false" (default), "true" (refuse email_verified=false) or
+	// "strict" (also refuse a missing claim).
+	RequireVerifiedEmail string
+
+	// RequiredClaims are ID token claims every login and refresh must
+	// match, from REQUIRED_CLAIMS (a JSON object; see
+	// handlers.ParseRequiredClaims). Empty requires nothing.
+	RequiredClaims handlers.RequiredClaims
+
+	// UsernameClaim is the ID token claim identifying users in refresh
+	// tokens and kubeconfigs (default: email). Match the API server's
+	// --oidc-username-claim.
+	UsernameClaim string
+
+	// UsernamePrefix is prepended to kubeconfig user and context names to
+	// match the API server's --oidc-username-prefix (e.g. "oidc:").
+	UsernamePrefix string
+}
+
+// LoadConfigFromEnv builds a Config from environment variables, applying
+// defaults and validating the result. If CONFIG_FILE names a file of
+// KEY=VALUE lines, its values take precedence over the environment; unlike
+// the environment, the file can change while the server runs, which is what
+// makes SIGHUP reloads useful. Every problem found is reported, not just the
+// first. ClusterCA is not loaded here; see GetClusterCA.
+func LoadConfigFromEnv() (Config, error) {
+	env := &envReader{getenv: os.Getenv}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, err := readEnvFile(path)
+		if err != nil {
+			return Config{}, err
+		}
+		env.getenv = func(key string) string {
+			if value, ok := file[key]; ok {
+				return value
+			}
+			return os.Getenv(key)
+		}
+	}
+
+	cfg := Config{
+		IssuerURL:                 env.string("OIDC_ISSUER_URL", ""),
+		ClientID:                  env.string("OIDC_CLIENT_ID", ""),
+		ClientSecret:              env.secret("OIDC_CLIENT_SECRET"),
+		ClaimsPrefix:              env.string("OIDC_CLAIMS_PREFIX", ""),
+		AdditionalAudiences:       env.stringSlice("OIDC_ADDITIONAL_AUDIENCES", nil),
+		DiscoveryRetries:          env.int("OIDC_DISCOVERY_RETRIES", 60),
+		DiscoveryTimeout:          env.duration("OIDC_DISCOVERY_TIMEOUT", 10*time.Second),
+		ExchangeTimeout:           env.duration("OIDC_EXCHANGE_TIMEOUT", oauth.DefaultExchangeTimeout),
+		VerifyTimeout:             env.duration("OIDC_VERIFY_TIMEOUT", oauth.DefaultVerifyTimeout),
+		OIDCCAFile:                env.string("OIDC_CA_FILE", ""),
+		JWKSRefreshInterval:       env.duration("OIDC_JWKS_REFRESH_INTERVAL", oauth.DefaultJWKSRefreshInterval),
+		JWKSMinRefreshInterval:    env.duration("OIDC_JWKS_MIN_REFRESH_INTERVAL", oauth.DefaultJWKSMinRefreshInterval),
+		OIDCInsecureSkipVerify:    env.bool("OIDC_INSECURE_SKIP_VERIFY", false),
+		OIDCMinRSABits:            env.int("OIDC_MIN_RSA_BITS", oauth.DefaultMinRSABits),
+		PKCEMethod:                env.string("PKCE_METHOD", oauth.PKCEMethodS256),
+		ClusterName:               env.string("CLUSTER_NAME", "kubernetes"),
+		ClusterServer:             env.string("KUBERNETES_API_URL", ""),
+		ClusterProxyURL:           env.string("CLUSTER_PROXY_URL", ""),
+		ClusterTLSServerName:      env.string("CLUSTER_TLS_SERVER_NAME", ""),
+		Namespace:                 env.string("KAUTH_NAMESPACE", "default"),
+		AuditLog:                  env.string("AUDIT_LOG", ""),
+		AuditK8sEvents:            env.bool("AUDIT_K8S_EVENTS", false),
+		BaseURL:                   env.string("BASE_URL", ""),
+		ListenAddr:                env.string("LISTEN_ADDR", ":8080"),
+		TLSCertFile:               env.string("TLS_CERT_FILE", ""),
+		TLSKeyFile:                env.string("TLS_KEY_FILE", ""),
+		TLSMinVersion:             env.string("TLS_MIN_VERSION", TLSVersion12),
+		WebhookListenAddr:         env.string("WEBHOOK_LISTEN_ADDR", ""),
+		MetricsAddr:               env.string("METRICS_ADDR", ""),
+		SuccessTemplateFile:       env.string("SUCCESS_TEMPLATE_FILE", ""),
+		JWTSigningKey:             env.bytes("JWT_SIGNING_KEY"),
+		JWTEncryptionKey:          env.bytes("JWT_ENCRYPTION_KEY"),
+		JWTAlgorithm:              env.string("JWT_ALGORITHM", string(jwt.AlgorithmAESGCM)),
+		JWTEd25519Key:             env.bytes("JWT_ED25519_KEY"),
+		SessionTTL:                env.duration("SESSION_TTL", 15*time.Minute),
+		RefreshTokenTTL:           env.duration("REFRESH_TOKEN_TTL", 7*24*time.Hour),
+		AbsoluteSessionTTL:        env.duration("ABSOLUTE_SESSION_TTL", 30*24*time.Hour),
+		MinTokenIssuedAt:          env.time("MIN_TOKEN_ISSUED_AT"),
+		UnscopedTokensUntil:       env.time("UNSCOPED_TOKENS_UNTIL"),
+		AllowedOrigins:            env.stringSlice("ALLOWED_ORIGINS", []string{}),
+		AllowedGroups:             env.stringSlice("ALLOWED_GROUPS", []string{}),
+		AdminGroups:               env.stringSlice("ADMIN_GROUPS", []string{}),
+		MaxGroups:                 env.int("MAX_GROUPS", handlers.DefaultMaxGroups),
+		RequireVerifiedEmail:      env.string("REQUIRE_VERIFIED_EMAIL", handlers.VerifiedEmailOff),
+		RequiredClaims:            env.requiredClaims("REQUIRED_CLAIMS"),
+		UsernameClaim:             env.string("USERNAME_CLAIM", handlers.DefaultUsernameClaim),
+		UsernamePrefix:            env.string("USERNAME_PREFIX", ""),
+		RateLimitRPS:              env.float("RATE_LIMIT_RPS", 10.0),
+		RateLimitBurst:            env.int("RATE_LIMIT_BURST", 20),
+		RotationWindow:            env.int("ROTATION_WINDOW", 2),
+		TrustedProxyCIDRs:         env.stringSlice("TRUSTED_PROXY_CIDRS", []string{}),
+		EnforceHTTPS:              env.bool("ENFORCE_HTTPS", false),
+		RequestTimeout:            env.duration("REQUEST_TIMEOUT", 60*time.Second),
+		OTLPEndpoint:              env.string("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+		MaxRequestBodyBytes:       env.int("MAX_REQUEST_BODY_BYTES", middleware.DefaultMaxBodyBytes),
+		MaxPendingSessions:        env.int("MAX_PENDING_SESSIONS", handlers.DefaultMaxPendingSessions),
+		SessionCleanupInterval:    env.duration("SESSION_CLEANUP_INTERVAL", handlers.DefaultSessionCleanupInterval),
+		WatchKeepaliveInterval:    env.duration("WATCH_KEEPALIVE_INTERVAL", handlers.DefaultWatchKeepaliveInterval),
+		WatchMaxDuration:          env.duration("WATCH_MAX_DURATION", handlers.DefaultWatchMaxDuration),
+		RefreshRequireNoOrigin:    env.bool("REFRESH_REQUIRE_NO_ORIGIN", false),
+		RefreshRequireContentType: env.bool("REFRESH_REQUIRE_CONTENT_TYPE", false),
+	}
+
+	errs := append(env.errs, cfg.validate()...)
+	return cfg, errors.Join(errs...)
+}
+
+// validate checks required settings and key sizes.
+func (c *Config) validate() []error {
+	var errs []error
+
+	if len(c.JWTSigningKey) == 0 || len(c.JWTEncryptionKey) == 0 {
+		errs = append(errs, errors.New("JWT_SIGNING_KEY and JWT_ENCRYPTION_KEY must be set (generate with: openssl rand -base64 32)"))
+	} else {
+		if len(c.JWTSigningKey) < 32 {
+			errs = append(errs, fmt.Errorf("JWT_SIGNING_KEY too short: got %d bytes, need at least 32", len(c.JWTSigningKey)))
+		}
+		if len(c.JWTEncryptionKey) != 32 {
+			errs = append(errs, fmt.Errorf("JWT_ENCRYPTION_KEY wrong size: got %d bytes, need exactly 32", len(c.JWTEncryptionKey)))
+		}
+	}
+
+	if len(c.JWTEd25519Key) != 0 && len(c.JWTEd25519Key) != ed25519.SeedSize {
+		errs = append(errs, fmt.Errorf("JWT_ED25519_KEY wrong size: got %d bytes, need exactly %d", len(c.JWTEd25519Key), ed25519.SeedSize))
+	}
+
+	if err := validation.ValidateResourceName(c.ClusterName); err != nil {
+		errs = append(errs, fmt.Errorf("invalid CLUSTER_NAME (lowercase alphanumeric with hyphens or dots, max 63 characters): %w", err))
+	}
+
+	if c.IssuerURL == "" || c.ClientID == "" || c.ClientSecret == "" {
+		errs = append(errs, errors.New("OIDC_ISSUER_URL, OIDC_CLIENT_ID, and OIDC_CLIENT_SECRET (or OIDC_CLIENT_SECRET_FILE) are required"))
+	}
+	if err := oauth.ValidatePKCEMethod(c.PKCEMethod); err != nil {
+		errs = append(errs, fmt.Errorf("invalid PKCE_METHOD: %w", err))
+	}
+	switch c.RequireVerifiedEmail {
+	case handlers.VerifiedEmailOff, handlers.VerifiedEmailRequire, handlers.VerifiedEmailStrict:
+	default:
+		errs = append(errs, fmt.Errorf("REQUIRE_VERIFIED_EMAIL must be false, true or strict, got %q", c.RequireVerifiedEmail))
+	}
+	if _, err := parseTLSVersion(c.TLSMinVersion); err != nil {
+		errs = append(errs, err)
+	}
+	if c.OIDCMinRSABits < 0 {
+		errs = append(errs, fmt.Errorf("OIDC_MIN_RSA_BITS must not be negative, got %d", c.OIDCMinRSABits))
+	}
+	if c.ExchangeTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("OIDC_EXCHANGE_TIMEOUT must be positive, got %s", c.ExchangeTimeout))
+	}
+	if c.VerifyTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("OIDC_VERIFY_TIMEOUT must be positive, got %s", c.VerifyTimeout))
+	}
+	if c.MaxRequestBodyBytes <= 0 {
+		errs = append(errs, fmt.Errorf("MAX_REQUEST_BODY_BYTES must be positive, got %d", c.MaxRequestBodyBytes))
+	}
+	if c.MaxPendingSessions < 0 {
+		errs = append(errs, fmt.Errorf("MAX_PENDING_SESSIONS must not be negative, got %d", c.MaxPendingSessions))
+	}
+	if c.SessionCleanupInterval <= 0 {
+		errs = append(errs, fmt.Errorf("SESSION_CLEANUP_INTERVAL must be positive, got %s", c.SessionCleanupInterval))
+	}
+	if c.WatchKeepaliveInterval <= 0 || c.WatchKeepaliveInterval > handlers.MaxWatchKeepaliveInterval {
+		errs = append(errs, fmt.Errorf("WATCH_KEEPALIVE_INTERVAL must be positive and at most %s (kauth login reconnects after 30s of silence), got %s", handlers.MaxWatchKeepaliveInterval, c.WatchKeepaliveInterval))
+	}
+	if c.WatchMaxDuration < 0 {
+		errs = append(errs, fmt.Errorf("WATCH_MAX_DURATION must not be negative, got %s", c.WatchMaxDuration))
+	}
+	if c.BaseURL == "" {
+		errs = append(errs, errors.New("BASE_URL is required (e.g. https://kauth.example.com)"))
+	}
+	if c.EnforceHTTPS && c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil || u.Host == "" {
+			errs = append(errs, fmt.Errorf("ENFORCE_HTTPS needs BASE_URL to be an absolute URL to redirect to, got %q", c.BaseURL))
+		}
+	}
+	if c.ClusterServer == "" {
+		errs = append(errs, errors.New("KUBERNETES_API_URL is required (e.g. https://kubernetes.example.com:6443)"))
+	}
+	if c.ClusterProxyURL != "" {
+		if u, err := url.Parse(c.ClusterProxyURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			errs = append(errs, fmt.Errorf("CLUSTER_PROXY_URL must be an http, https or socks5 URL, got %q", c.ClusterProxyURL))
+		}
+	}
+
+	return errs
+}
+
+// readEnvFile parses a file of KEY=VALUE lines. Blank lines and lines
+// starting with # are ignored; values may be wrapped in double quotes.
+func readEnvFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CONFIG_FILE: %w", err)
+	}
+
+	values := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("CONFIG_FILE %s:%d: expected KEY=VALUE", path, i+1)
+		}
+		value = strings.TrimSpace(value)
+		if unquoted, err := strconv.Unquote(value); err == nil && strings.HasPrefix(value, `"`) {
+			value = unquoted
+		}
+		values[strings.TrimSpace(key)] = value
+	}
+	return values, nil
+}
+
+// envReader reads typed environment variables, collecting parse errors
+// instead of silently falling back to defaults.
+type envReader struct {
+	getenv func(string) string
+	errs   []error
+}
+
+func (e *envReader) string(key, defaultValue string) string {
+	if value := e.getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+// secret reads key from the file named by key_FILE (e.g. a mounted Secret)
+// if that is set, trimming surrounding whitespace such as a trailing
+// newline, and otherwise from key itself. Files keep secrets out of the
+// process environment.
+func (e *envReader) secret(key string) string {
+	path := e.getenv(key + "_FILE")
+	if path == "" {
+		return e.getenv(key)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("failed to read %s_FILE: %w", key, err))
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// bytes decodes base64 values and falls back to the raw string. Like secret,
+// it prefers the file named by key_FILE; a file holding raw key bytes is
+// used as-is, without trimming.
+func (e *envReader) bytes(key string) []byte {
+	if path := e.getenv(key + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			e.errs = append(e.errs, fmt.Errorf("failed to read %s_FILE: %w", key, err))
+			return nil
+		}
+		if decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+			return decoded
+		}
+		return data
+	}
+	value := e.getenv(key)
+	if value == "" {
+		return nil
+	}
+	if decoded, err := base64.StdEncoding.DecodeString(value); err == nil {
+		return decoded
+	}
+	return []byte(value)
+}
+
+func (e *envReader) duration(key string, defaultValue time.Duration) time.Duration {
+	value := e.getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %w", key, value, err))
+		return defaultValue
+	}
+	return d
+}
+
+// requiredClaims parses a REQUIRED_CLAIMS JSON object; unset is none.
+func (e *envReader) requiredClaims(key string) handlers.RequiredClaims {
+	value := e.getenv(key)
+	required, err := handlers.ParseRequiredClaims(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %w", key, value, err))
+	}
+	return required
+}
+
+// time parses an RFC 3339 timestamp; unset is the zero time.
+func (e *envReader) time(key string) time.Time {
+	value := e.getenv(key)
+	if value == "" {
+		return time.Time{}
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %w", key, value, err))
+		return time.Time{}
+	}
+	return t
+}
+
+func (e *envReader) int(key string, defaultValue int) int {
+	value := e.getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %w", key, value, err))
+		return defaultValue
+	}
+	return n
+}
+
+func (e *envReader) float(key string, defaultValue float64) float64 {
+	value := e.getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %w", key, value, err))
+		return defaultValue
+	}
+	return f
+}
+
+func (e *envReader) bool(key string, defaultValue bool) bool {
+	value := e.getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.errs = append(e.errs, fmt.Errorf("invalid %s %q: %w", key, value, err))
+		return defaultValue
+	}
+	return b
+}
+
+func (e *envReader) stringSlice(key string, defaultValue []string) []string {
+	value := e.getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return strings.Split(value, ",")
 }
@@ -0,0 +1,387 @@
+package server
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setRequiredEnv sets the minimum environment LoadConfigFromEnv accepts.
+func setRequiredEnv(t *testing.T) {
+	t.Helper()
+	t.Setenv("OIDC_ISSUER_URL", "https://idp.example.com")
+	t.Setenv("OIDC_CLIENT_ID", "kauth")
+	t.Setenv("OIDC_CLIENT_SECRET", "secret")
+	t.Setenv("BASE_URL", "https://kauth.example.com")
+	t.Setenv("KUBERNETES_API_URL", "https://k8s.example.com:6443")
+	t.Setenv("JWT_SIGNING_KEY", base64.StdEncoding.EncodeToString([]byte(strings.Repeat("s", 32))))
+	t.Setenv("JWT_ENCRYPTION_KEY", base64.StdEncoding.EncodeToString([]byte(strings.Repeat("e", 32))))
+}
+
+func TestLoadConfigFromEnv_Defaults(t *testing.T) {
+	setRequiredEnv(t)
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv() error = %v", err)
+	}
+
+	if cfg.ClusterName != "kubernetes" {
+		t.Errorf("ClusterName = %q, want %q", cfg.ClusterName, "kubernetes")
+	}
+	if cfg.Namespace != "default" {
+		t.Errorf("Namespace = %q, want %q", cfg.Namespace, "default")
+	}
+	if cfg.ListenAddr != ":8080" {
+		t.Errorf("ListenAddr = %q, want %q", cfg.ListenAddr, ":8080")
+	}
+	if cfg.MetricsAddr != "" {
+		t.Errorf("MetricsAddr = %q, want metrics disabled", cfg.MetricsAddr)
+	}
+	if cfg.JWTAlgorithm != "aes-gcm" {
+		t.Errorf("JWTAlgorithm = %q, want %q", cfg.JWTAlgorithm, "aes-gcm")
+	}
+	if cfg.SessionTTL != 15*time.Minute || cfg.RefreshTokenTTL != 7*24*time.Hour || cfg.AbsoluteSessionTTL != 30*24*time.Hour {
+		t.Errorf("TTLs = %v/%v/%v, want 15m/168h/720h", cfg.SessionTTL, cfg.RefreshTokenTTL, cfg.AbsoluteSessionTTL)
+	}
+	if cfg.RateLimitRPS != 10 || cfg.RateLimitBurst != 20 || cfg.RotationWindow != 2 {
+		t.Errorf("rate limit/rotation = %v/%d/%d, want 10/20/2", cfg.RateLimitRPS, cfg.RateLimitBurst, cfg.RotationWindow)
+	}
+	if cfg.RequestTimeout != 60*time.Second {
+		t.Errorf("RequestTimeout = %v, want 60s", cfg.RequestTimeout)
+	}
+	if cfg.MaxRequestBodyBytes != 64<<10 {
+		t.Errorf("MaxRequestBodyBytes = %d, want 64KiB", cfg.MaxRequestBodyBytes)
+	}
+	if cfg.MaxPendingSessions != 1000 || cfg.SessionCleanupInterval != 30*time.Second {
+		t.Errorf("pending sessions = %d/%v, want 1000/30s", cfg.MaxPendingSessions, cfg.SessionCleanupInterval)
+	}
+	if cfg.WatchKeepaliveInterval != 5*time.Second || cfg.WatchMaxDuration != 15*time.Minute {
+		t.Errorf("watch = %v/%v, want 5s/15m", cfg.WatchKeepaliveInterval, cfg.WatchMaxDuration)
+	}
+	if cfg.MaxGroups != 1000 {
+		t.Errorf("MaxGroups = %d, want 1000", cfg.MaxGroups)
+	}
+	if cfg.RequireVerifiedEmail != "false" {
+		t.Errorf("RequireVerifiedEmail = %q, want false", cfg.RequireVerifiedEmail)
+	}
+	if cfg.RequiredClaims != nil {
+		t.Errorf("RequiredClaims = %v, want none", cfg.RequiredClaims)
+	}
+	if cfg.UsernameClaim != "email" {
+		t.Errorf("UsernameClaim = %q, want email", cfg.UsernameClaim)
+	}
+	if cfg.UsernamePrefix != "" {
+		t.Errorf("UsernamePrefix = %q, want empty", cfg.UsernamePrefix)
+	}
+	if cfg.OIDCMinRSABits != 2048 {
+		t.Errorf("OIDCMinRSABits = %d, want 2048", cfg.OIDCMinRSABits)
+	}
+	if cfg.DiscoveryRetries != 60 || cfg.DiscoveryTimeout != 10*time.Second {
+		t.Errorf("discovery = %d/%v, want 60/10s", cfg.DiscoveryRetries, cfg.DiscoveryTimeout)
+	}
+	if cfg.TLSMinVersion != TLSVersion12 {
+		t.Errorf("TLSMinVersion = %q, want %q", cfg.TLSMinVersion, TLSVersion12)
+	}
+	if cfg.EnforceHTTPS {
+		t.Errorf("EnforceHTTPS = true, want false")
+	}
+	if cfg.OTLPEndpoint != "" {
+		t.Errorf("OTLPEndpoint = %q, want empty (tracing off)", cfg.OTLPEndpoint)
+	}
+	if cfg.ExchangeTimeout != 10*time.Second || cfg.VerifyTimeout != 10*time.Second {
+		t.Errorf("exchange/verify timeouts = %v/%v, want 10s/10s", cfg.ExchangeTimeout, cfg.VerifyTimeout)
+	}
+	if len(cfg.AllowedGroups) != 0 || len(cfg.AdminGroups) != 0 {
+		t.Errorf("groups = %v/%v, want empty", cfg.AllowedGroups, cfg.AdminGroups)
+	}
+}
+
+func TestLoadConfigFromEnv_Overrides(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("CLUSTER_NAME", "eu-prod")
+	t.Setenv("KAUTH_NAMESPACE", "kauth-system")
+	t.Setenv("SESSION_TTL", "5m")
+	t.Setenv("RATE_LIMIT_RPS", "2.5")
+	t.Setenv("MAX_GROUPS", "0")
+	t.Setenv("ALLOWED_GROUPS", "admins,devs")
+	t.Setenv("OIDC_DISCOVERY_TIMEOUT", "3s")
+
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv() error = %v", err)
+	}
+
+	if cfg.ClusterName != "eu-prod" || cfg.Namespace != "kauth-system" {
+		t.Errorf("ClusterName/Namespace = %q/%q, want eu-prod/kauth-system", cfg.ClusterName, cfg.Namespace)
+	}
+	if cfg.SessionTTL != 5*time.Minute {
+		t.Errorf("SessionTTL = %v, want 5m", cfg.SessionTTL)
+	}
+	if cfg.RateLimitRPS != 2.5 {
+		t.Errorf("RateLimitRPS = %v, want 2.5", cfg.RateLimitRPS)
+	}
+	if cfg.MaxGroups != 0 {
+		t.Errorf("MaxGroups = %d, want 0", cfg.MaxGroups)
+	}
+	if cfg.DiscoveryTimeout != 3*time.Second {
+		t.Errorf("DiscoveryTimeout = %v, want 3s", cfg.DiscoveryTimeout)
+	}
+	if len(cfg.AllowedGroups) != 2 || cfg.AllowedGroups[1] != "devs" {
+		t.Errorf("AllowedGroups = %v, want [admins devs]", cfg.AllowedGroups)
+	}
+}
+
+func TestLoadConfigFromEnv_JWTKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		signing string
+		wantLen int
+		wantErr bool
+	}{
+		{name: "base64", signing: base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 48))), wantLen: 48},
+		{name: "raw", signing: strings.Repeat("raw-key!", 5), wantLen: 40},
+		{name: "too short", signing: base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("JWT_SIGNING_KEY", tt.signing)
+
+			cfg, err := LoadConfigFromEnv()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfigFromEnv() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && len(cfg.JWTSigningKey) != tt.wantLen {
+				t.Errorf("len(JWTSigningKey) = %d, want %d", len(cfg.JWTSigningKey), tt.wantLen)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromEnv_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		value   string
+		wantErr string
+	}{
+		{name: "bad duration", key: "SESSION_TTL", value: "15", wantErr: "SESSION_TTL"},
+		{name: "bad int", key: "RATE_LIMIT_BURST", value: "many", wantErr: "RATE_LIMIT_BURST"},
+		{name: "bad float", key: "RATE_LIMIT_RPS", value: "fast", wantErr: "RATE_LIMIT_RPS"},
+		{name: "bad PKCE method", key: "PKCE_METHOD", value: "S512", wantErr: "PKCE_METHOD"},
+		{name: "negative min RSA bits", key: "OIDC_MIN_RSA_BITS", value: "-1", wantErr: "OIDC_MIN_RSA_BITS"},
+		{name: "bad min issued at", key: "MIN_TOKEN_ISSUED_AT", value: "yesterday", wantErr: "MIN_TOKEN_ISSUED_AT"},
+		{name: "bad unscoped tokens until", key: "UNSCOPED_TOKENS_UNTIL", value: "168h", wantErr: "UNSCOPED_TOKENS_UNTIL"},
+		{name: "bad cluster proxy URL", key: "CLUSTER_PROXY_URL", value: "proxy.example.com:3128", wantErr: "CLUSTER_PROXY_URL"},
+		{name: "bad required claims", key: "REQUIRED_CLAIMS", value: "tenant=acme", wantErr: "REQUIRED_CLAIMS"},
+		{name: "bad verified email mode", key: "REQUIRE_VERIFIED_EMAIL", value: "yes", wantErr: "REQUIRE_VERIFIED_EMAIL"},
+		{name: "zero max request body", key: "MAX_REQUEST_BODY_BYTES", value: "0", wantErr: "MAX_REQUEST_BODY_BYTES"},
+		{name: "negative max pending sessions", key: "MAX_PENDING_SESSIONS", value: "-1", wantErr: "MAX_PENDING_SESSIONS"},
+		{name: "zero cleanup interval", key: "SESSION_CLEANUP_INTERVAL", value: "0s", wantErr: "SESSION_CLEANUP_INTERVAL"},
+		{name: "zero keepalive interval", key: "WATCH_KEEPALIVE_INTERVAL", value: "0s", wantErr: "WATCH_KEEPALIVE_INTERVAL"},
+		{name: "keepalive interval past the CLI read timeout", key: "WATCH_KEEPALIVE_INTERVAL", value: "30s", wantErr: "WATCH_KEEPALIVE_INTERVAL"},
+		{name: "TLS 1.1", key: "TLS_MIN_VERSION", value: "1.1", wantErr: "TLS_MIN_VERSION"},
+		{name: "zero exchange timeout", key: "OIDC_EXCHANGE_TIMEOUT", value: "0s", wantErr: "OIDC_EXCHANGE_TIMEOUT"},
+		{name: "negative verify timeout", key: "OIDC_VERIFY_TIMEOUT", value: "-1s", wantErr: "OIDC_VERIFY_TIMEOUT"},
+		{name: "negative watch max duration", key: "WATCH_MAX_DURATION", value: "-1m", wantErr: "WATCH_MAX_DURATION"},
+		{name: "bad cluster name", key: "CLUSTER_NAME", value: "Prod_Cluster", wantErr: "CLUSTER_NAME"},
+		{name: "wrong Ed25519 key size", key: "JWT_ED25519_KEY", value: base64.StdEncoding.EncodeToString([]byte("16-byte-key-1234")), wantErr: "JWT_ED25519_KEY"},
+		{name: "wrong encryption key size", key: "JWT_ENCRYPTION_KEY", value: base64.StdEncoding.EncodeToString([]byte("16-byte-key-1234")), wantErr: "JWT_ENCRYPTION_KEY"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv(tt.key, tt.value)
+
+			_, err := LoadConfigFromEnv()
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("LoadConfigFromEnv() error = %v, want mention of %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromEnv_EnforceHTTPSNeedsBaseURLHost(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("ENFORCE_HTTPS", "true")
+	t.Setenv("BASE_URL", "kauth.example.com")
+
+	if _, err := LoadConfigFromEnv(); err == nil || !strings.Contains(err.Error(), "ENFORCE_HTTPS") {
+		t.Errorf("LoadConfigFromEnv() error = %v, want mention of ENFORCE_HTTPS", err)
+	}
+}
+
+func TestLoadConfigFromEnv_MissingRequired(t *testing.T) {
+	for _, key := range []string{"OIDC_ISSUER_URL", "BASE_URL", "KUBERNETES_API_URL", "JWT_SIGNING_KEY"} {
+		t.Run(key, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv(key, "")
+
+			if _, err := LoadConfigFromEnv(); err == nil {
+				t.Errorf("LoadConfigFromEnv() error = nil without %s", key)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromEnv_ReportsAllErrors(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("SESSION_TTL", "soon")
+	t.Setenv("BASE_URL", "")
+
+	_, err := LoadConfigFromEnv()
+	if err == nil {
+		t.Fatal("LoadConfigFromEnv() error = nil, want error")
+	}
+	for _, want := range []string{"SESSION_TTL", "BASE_URL"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestLoadConfigFromEnv_ClientSecretFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client-secret")
+	if err := os.WriteFile(path, []byte("from-file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		env     string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{name: "env only", env: "from-env", want: "from-env"},
+		{name: "file preferred and trimmed", env: "from-env", file: path, want: "from-file"},
+		{name: "file only", file: path, want: "from-file"},
+		{name: "missing file", env: "from-env", file: filepath.Join(t.TempDir(), "missing"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("OIDC_CLIENT_SECRET", tt.env)
+			t.Setenv("OIDC_CLIENT_SECRET_FILE", tt.file)
+
+			cfg, err := LoadConfigFromEnv()
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), "OIDC_CLIENT_SECRET_FILE") {
+					t.Errorf("LoadConfigFromEnv() error = %v, want OIDC_CLIENT_SECRET_FILE error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfigFromEnv() error = %v", err)
+			}
+			if cfg.ClientSecret != tt.want {
+				t.Errorf("ClientSecret = %q, want %q", cfg.ClientSecret, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromEnv_JWTKeyFiles(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		t.Helper()
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base64Key := write("signing-b64", []byte(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("f", 40)))+"\n"))
+	rawKey := write("signing-raw", []byte(strings.Repeat("raw-key!", 4)))
+	shortKey := write("signing-short", []byte(base64.StdEncoding.EncodeToString([]byte("short"))))
+	encKey := write("encryption-b64", []byte(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("x", 32)))))
+
+	tests := []struct {
+		name    string
+		file    string
+		wantKey string
+		wantErr string
+	}{
+		{name: "base64 file preferred over inline", file: base64Key, wantKey: strings.Repeat("f", 40)},
+		{name: "raw file", file: rawKey, wantKey: strings.Repeat("raw-key!", 4)},
+		{name: "too short", file: shortKey, wantErr: "JWT_SIGNING_KEY too short"},
+		{name: "missing file", file: filepath.Join(dir, "missing"), wantErr: "JWT_SIGNING_KEY_FILE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setRequiredEnv(t)
+			t.Setenv("JWT_SIGNING_KEY_FILE", tt.file)
+			t.Setenv("JWT_ENCRYPTION_KEY_FILE", encKey)
+
+			cfg, err := LoadConfigFromEnv()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadConfigFromEnv() error = %v, want mention of %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfigFromEnv() error = %v", err)
+			}
+			if string(cfg.JWTSigningKey) != tt.wantKey {
+				t.Errorf("JWTSigningKey = %q, want %q", cfg.JWTSigningKey, tt.wantKey)
+			}
+			if string(cfg.JWTEncryptionKey) != strings.Repeat("x", 32) {
+				t.Errorf("JWTEncryptionKey = %q, want file value", cfg.JWTEncryptionKey)
+			}
+		})
+	}
+}
+
+func TestLoadConfigFromEnv_ConfigFile(t *testing.T) {
+	setRequiredEnv(t)
+	t.Setenv("ALLOWED_ORIGINS", "https://env.example.com")
+	t.Setenv("RATE_LIMIT_BURST", "7")
+
+	path := filepath.Join(t.TempDir(), "config.env")
+	t.Setenv("CONFIG_FILE", path)
+	write := func(content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("# reloadable settings\nALLOWED_ORIGINS=https://a.example.com\nRATE_LIMIT_RPS=\"5\"\n")
+	cfg, err := LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv() error = %v", err)
+	}
+	if len(cfg.AllowedOrigins) != 1 || cfg.AllowedOrigins[0] != "https://a.example.com" {
+		t.Errorf("AllowedOrigins = %v, want file value", cfg.AllowedOrigins)
+	}
+	if cfg.RateLimitRPS != 5 {
+		t.Errorf("RateLimitRPS = %v, want 5", cfg.RateLimitRPS)
+	}
+	if cfg.RateLimitBurst != 7 {
+		t.Errorf("RateLimitBurst = %d, want env value 7", cfg.RateLimitBurst)
+	}
+
+	// A second load sees edits to the file, which is what SIGHUP relies on.
+	write("ALLOWED_ORIGINS=https://b.example.com,https://c.example.com\n")
+	cfg, err = LoadConfigFromEnv()
+	if err != nil {
+		t.Fatalf("LoadConfigFromEnv() error = %v", err)
+	}
+	if len(cfg.AllowedOrigins) != 2 || cfg.AllowedOrigins[0] != "https://b.example.com" {
+		t.Errorf("AllowedOrigins after edit = %v, want reloaded value", cfg.AllowedOrigins)
+	}
+
+	write("not a setting\n")
+	if _, err := LoadConfigFromEnv(); err == nil {
+		t.Error("LoadConfigFromEnv() error = nil for a malformed CONFIG_FILE")
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// TLS versions accepted in TLS_MIN_VERSION.
+const (
+	TLSVersion12 = "1.2"
+	TLSVersion13 = "1.3"
+)
+
+// tlsCipherSuites are the TLS 1.2 cipher suites the HTTPS listener offers:
+// forward-secret ECDHE key exchange with AEAD ciphers only. TLS 1.3 suites
+// are fixed by Go and all qualify.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// TLSConfig returns the settings for the HTTPS listener: TLS minVersion
+// (TLSVersion12 or TLSVersion13) or later, and only tlsCipherSuites under
+// TLS 1.2.
+func TLSConfig(minVersion string) (*tls.Config, error) {
+	version, err := parseTLSVersion(minVersion)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   version,
+		CipherSuites: tlsCipherSuites,
+	}, nil
+}
+
+func parseTLSVersion(v string) (uint16, error) {
+	switch v {
+	case TLSVersion12:
+		return tls.VersionTLS12, nil
+	case TLSVersion13:
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("TLS_MIN_VERSION must be %s or %s, got %q", TLSVersion12, TLSVersion13, v)
+}
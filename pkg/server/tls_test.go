@@ -0,0 +1,73 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestTLSConfig(t *testing.T) {
+	tests := []struct {
+		minVersion string
+		want       uint16
+		wantErr    bool
+	}{
+		{minVersion: TLSVersion12, want: tls.VersionTLS12},
+		{minVersion: TLSVersion13, want: tls.VersionTLS13},
+		{minVersion: "1.1", wantErr: true},
+		{minVersion: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.minVersion, func(t *testing.T) {
+			cfg, err := TLSConfig(tt.minVersion)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("TLSConfig(%q) error = %v, wantErr %v", tt.minVersion, err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if cfg.MinVersion != tt.want {
+				t.Errorf("MinVersion = %x, want %x", cfg.MinVersion, tt.want)
+			}
+			for _, id := range cfg.CipherSuites {
+				if slices.ContainsFunc(tls.InsecureCipherSuites(), func(s *tls.CipherSuite) bool { return s.ID == id }) {
+					t.Errorf("insecure cipher suite %s offered", tls.CipherSuiteName(id))
+				}
+			}
+		})
+	}
+}
+
+func TestTLSConfig_RejectsTLS11(t *testing.T) {
+	cfg, err := TLSConfig(TLSVersion12)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = cfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	dial := func(minVersion, maxVersion uint16) error {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: true, //nolint:gosec // test server certificate
+			MinVersion:         minVersion,
+			MaxVersion:         maxVersion,
+		}}}
+		resp, err := client.Get(srv.URL)
+		if err == nil {
+			_ = resp.Body.Close()
+		}
+		return err
+	}
+
+	if err := dial(tls.VersionTLS10, tls.VersionTLS11); err == nil {
+		t.Error("TLS 1.1 handshake succeeded, want it rejected")
+	}
+	if err := dial(tls.VersionTLS12, tls.VersionTLS12); err != nil {
+		t.Errorf("TLS 1.2 handshake failed: %v", err)
+	}
+}
@@ -2,22 +2,38 @@ package session
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
 	"kauth/pkg/validation"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
-	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/util/retry"
 )
 
+// Labels set on every OAuthSession. The timestamps are Unix seconds so the
+// cleanup loops can select stale sessions server-side with "<" selectors
+// instead of listing and filtering every session.
+const (
+	managedBySelector = "app.kubernetes.io/managed-by=kauth"
+	labelCreatedAt    = "kauth.io/created-at"
+	labelLastUsed     = "kauth.io/last-used"
+)
+
+func unixLabel(t time.Time) string {
+	return strconv.FormatInt(t.Unix(), 10)
+}
+
 // Client wraps Kubernetes dynamic client for OAuthSession operations
 type Client struct {
 	dynamicClient dynamic.Interface
@@ -48,6 +64,7 @@ func (c *Client) gvr() schema.GroupVersionResource {
 
 // Create creates a new OAuthSession
 func (c *Client) Create(ctx context.Context, sessionID, verifier, userID string) (*v1alpha1.OAuthSession, error) {
+	now := metav1.Now()
 	session := &v1alpha1.OAuthSession{
 		TypeMeta: metav1.TypeMeta{
 			APIVersion: "kauth.io/v1alpha1",
@@ -58,13 +75,15 @@ func (c *Client) Create(ctx context.Context, sessionID, verifier, userID string)
 			Namespace: c.namespace,
 			Labels: map[string]string{
 				"app.kubernetes.io/managed-by": "kauth",
+				labelCreatedAt:                 unixLabel(now.Time),
+				labelLastUsed:                  unixLabel(now.Time),
 			},
 		},
 		Spec: v1alpha1.OAuthSessionSpec{
 			SessionID: sessionID,
 			Verifier:  verifier,
 			UserID:    userID,
-			CreatedAt: metav1.Now(),
+			CreatedAt: now,
 		},
 		Status: v1alpha1.OAuthSessionStatus{
 			Phase: v1alpha1.SessionPending,
@@ -101,11 +120,14 @@ func (c *Client) Create(ctx context.Context, sessionID, verifier, userID string)
 
 // Get retrieves an OAuthSession by session ID
 func (c *Client) Get(ctx context.Context, sessionID string) (*v1alpha1.OAuthSession, error) {
-	result, err := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).Get(
-		ctx,
-		sanitizeName(sessionID),
-		metav1.GetOptions{},
-	)
+	resource := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace)
+	name := sanitizeName(sessionID)
+	result, err := resource.Get(ctx, name, metav1.GetOptions{})
+	legacy := false
+	if apierrors.IsNotFound(err) {
+		result, err = resource.Get(ctx, legacyName(sessionID), metav1.GetOptions{})
+		legacy = true
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -114,59 +136,130 @@ func (c *Client) Get(ctx context.Context, sessionID string) (*v1alpha1.OAuthSess
 	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(result.Object, &session); err != nil {
 		return nil, fmt.Errorf("failed to convert from unstructured: %w", err)
 	}
+	// Legacy names can collide, so the object found may be another session's
+	if legacy && session.Spec.SessionID != sessionID {
+		return nil, apierrors.NewNotFound(c.gvr().GroupResource(), name)
+	}
 
 	return &session, nil
 }
 
-// UpdateStatus updates the status of an OAuthSession
-func (c *Client) UpdateStatus(ctx context.Context, sessionID string, status v1alpha1.OAuthSessionStatus) error {
-	session, err := c.Get(ctx, sessionID)
-	if err != nil {
-		return fmt.Errorf("failed to get session: %w", err)
-	}
+// ErrSessionSettled is returned by UpdateStatus when a login failure would
+// overwrite a session that has already completed or failed.
+var ErrSessionSettled = errors.New("session already settled")
 
-	// Refuse to re-activate a session that has reached a terminal state.
-	// This closes the TOCTOU window where a concurrent revoke between
-	// ValidateSession and UpdateStatus would be silently undone.
-	if status.Phase == v1alpha1.SessionActive &&
-		(session.Status.Phase == v1alpha1.SessionRevoked || session.Status.Phase == v1alpha1.SessionExpired) {
-		return fmt.Errorf("session is in terminal state %s, cannot reactivate", session.Status.Phase)
-	}
+// ErrSessionNotActive is returned by Rotate when the session has left the
+// Active phase, e.g. it was revoked or expired while the refresh was running.
+var ErrSessionNotActive = errors.New("session is not active")
 
-	existingWebhookToken := session.Status.WebhookToken
-	existingCompletedAt := session.Status.CompletedAt
-	session.Status = status
-	// Preserve the WebhookToken across status updates that don't explicitly set one.
-	// The token is created once at login and must survive subsequent refresh cycles.
-	if status.WebhookToken == "" && existingWebhookToken != "" {
-		session.Status.WebhookToken = existingWebhookToken
+// CheckStatusTransition reports whether a session whose status is current
+// may be given status next. A terminal session cannot be reactivated, and a
+// failure (a status carrying an Error) only applies to a login still
+// pending: when two callbacks race for the same state, the one whose code
+// exchange lost must not clobber the result of the one that won.
+func CheckStatusTransition(current, next v1alpha1.OAuthSessionStatus) error {
+	if next.Phase == v1alpha1.SessionActive &&
+		(current.Phase == v1alpha1.SessionRevoked || current.Phase == v1alpha1.SessionExpired) {
+		return fmt.Errorf("session is in terminal state %s, cannot reactivate", current.Phase)
 	}
-	if status.Phase == v1alpha1.SessionActive && status.CompletedAt == nil {
-		if existingCompletedAt != nil {
-			session.Status.CompletedAt = existingCompletedAt
-		} else {
-			now := metav1.Now()
-			session.Status.CompletedAt = &now
-		}
+	if next.Error != "" &&
+		(current.Error != "" || (current.Phase != "" && current.Phase != v1alpha1.SessionPending)) {
+		return ErrSessionSettled
 	}
+	return nil
+}
 
-	unstructuredObj := &unstructured.Unstructured{}
-	unstructuredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(session)
-	if err != nil {
-		return fmt.Errorf("failed to convert to unstructured: %w", err)
-	}
-	unstructuredObj.Object = unstructuredMap
+// UpdateStatus updates the status of an OAuthSession. The write is
+// conditional on the session's resourceVersion and is retried against the
+// newer state on a conflict, so CheckStatusTransition always judges the
+// status actually being replaced.
+func (c *Client) UpdateStatus(ctx context.Context, sessionID string, status v1alpha1.OAuthSessionStatus) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		session, err := c.Get(ctx, sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to get session: %w", err)
+		}
+		if err := CheckStatusTransition(session.Status, status); err != nil {
+			return err
+		}
 
-	_, err = c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).UpdateStatus(
-		ctx,
-		unstructuredObj,
-		metav1.UpdateOptions{},
-	)
-	if err != nil {
-		return fmt.Errorf("failed to update status: %w", err)
-	}
+		existing := session.Status
+		session.Status = status
+		// Preserve the WebhookToken across status updates that don't explicitly set one.
+		// The token is created once at login and must survive subsequent refresh cycles.
+		if status.WebhookToken == "" && existing.WebhookToken != "" {
+			session.Status.WebhookToken = existing.WebhookToken
+		}
+		// Likewise the rotation state, which only Rotate advances.
+		if status.RotationCounter == 0 {
+			session.Status.RotationCounter = existing.RotationCounter
+		}
+		if status.LastRotation == nil {
+			session.Status.LastRotation = existing.LastRotation
+		}
+		if status.Phase == v1alpha1.SessionActive && status.CompletedAt == nil {
+			if existing.CompletedAt != nil {
+				session.Status.CompletedAt = existing.CompletedAt
+			} else {
+				now := metav1.Now()
+				session.Status.CompletedAt = &now
+			}
+		}
 
-	return nil
+		unstructuredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(session)
+		if err != nil {
+			return fmt.Errorf("failed to convert to unstructured: %w", err)
+		}
+		_, err = c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).UpdateStatus(
+			ctx,
+			&unstructured.Unstructured{Object: unstructuredMap},
+			metav1.UpdateOptions{},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update status: %w", err)
+		}
+		return nil
+	})
+}
+
+// Rotate records a refresh token rotation as a compare-and-swap on the
+// session, so concurrent refreshes on different replicas cannot both rotate
+// the same token. check sees the current session and may reject the
+// rotation (e.g. a replayed counter); update then applies the new status.
+// The write is conditional on the session's resourceVersion, and on a
+// conflict the whole read-check-write is retried against the newer state.
+// A session that is no longer Active fails with ErrSessionNotActive.
+func (c *Client) Rotate(ctx context.Context, sessionID string, check func(*v1alpha1.OAuthSession) error, update func(*v1alpha1.OAuthSessionStatus)) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		session, err := c.Get(ctx, sessionID)
+		if err != nil {
+			return fmt.Errorf("failed to get session: %w", err)
+		}
+		if session.Status.Phase != v1alpha1.SessionActive {
+			return fmt.Errorf("%w: session is %s", ErrSessionNotActive, session.Status.Phase)
+		}
+		if err := check(session); err != nil {
+			return err
+		}
+
+		update(&session.Status)
+		now := metav1.Now()
+		session.Status.LastRotation = &now
+
+		unstructuredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(session)
+		if err != nil {
+			return fmt.Errorf("failed to convert to unstructured: %w", err)
+		}
+		_, err = c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).UpdateStatus(
+			ctx,
+			&unstructured.Unstructured{Object: unstructuredMap},
+			metav1.UpdateOptions{},
+		)
+		if err != nil {
+			return fmt.Errorf("failed to update status: %w", err)
+		}
+		return nil
+	})
 }
 
 // Revoke marks a session as revoked
@@ -208,7 +301,7 @@ func (c *Client) ListActive(ctx context.Context) ([]v1alpha1.OAuthSession, error
 	list, err := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).List(
 		ctx,
 		metav1.ListOptions{
-			LabelSelector: "app.kubernetes.io/managed-by=kauth",
+			LabelSelector: managedBySelector,
 		},
 	)
 	if err != nil {
@@ -252,6 +345,7 @@ func (c *Client) UpdateLastUsed(ctx context.Context, sessionID string) error {
 	}
 
 	session.Spec.LastUsed = metav1.Now()
+	setLabel(session, labelLastUsed, unixLabel(session.Spec.LastUsed.Time))
 
 	unstructuredObj := &unstructured.Unstructured{}
 	unstructuredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(session)
@@ -281,6 +375,7 @@ func (c *Client) UpdateUserID(ctx context.Context, sessionID, userID string) err
 
 	session.Spec.UserID = userID
 	session.Spec.LastUsed = metav1.Now()
+	setLabel(session, labelLastUsed, unixLabel(session.Spec.LastUsed.Time))
 
 	unstructuredObj := &unstructured.Unstructured{}
 	unstructuredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(session)
@@ -306,7 +401,7 @@ func (c *Client) GetByUser(ctx context.Context, userID string) ([]v1alpha1.OAuth
 	list, err := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).List(
 		ctx,
 		metav1.ListOptions{
-			LabelSelector: "app.kubernetes.io/managed-by=kauth",
+			LabelSelector: managedBySelector,
 		},
 	)
 	if err != nil {
@@ -333,49 +428,33 @@ func (c *Client) GetByUser(ctx context.Context, userID string) ([]v1alpha1.OAuth
 
 // Delete deletes an OAuthSession
 func (c *Client) Delete(ctx context.Context, sessionID string) error {
-	err := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).Delete(
-		ctx,
-		sanitizeName(sessionID),
-		metav1.DeleteOptions{},
-	)
+	resource := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace)
+	err := resource.Delete(ctx, sanitizeName(sessionID), metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		var legacy *v1alpha1.OAuthSession
+		if legacy, err = c.Get(ctx, sessionID); err == nil {
+			err = resource.Delete(ctx, legacy.Name, metav1.DeleteOptions{})
+		}
+	}
 	if err != nil {
 		return fmt.Errorf("failed to delete OAuthSession: %w", err)
 	}
 	return nil
 }
 
-// Watch watches for OAuthSession changes, resuming from resourceVersion if non-empty.
-func (c *Client) Watch(ctx context.Context, resourceVersion string) (watch.Interface, error) {
-	return c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).Watch(
-		ctx,
-		metav1.ListOptions{
-			LabelSelector:       "app.kubernetes.io/managed-by=kauth",
-			ResourceVersion:     resourceVersion,
-			AllowWatchBookmarks: true,
-		},
-	)
-}
-
 // CleanupOldSessions deletes sessions older than the specified TTL
 // Only deletes sessions that are Revoked or Expired
 func (c *Client) CleanupOldSessions(ctx context.Context, ttl time.Duration) error {
-	list, err := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).List(
-		ctx,
-		metav1.ListOptions{
-			LabelSelector: "app.kubernetes.io/managed-by=kauth",
-		},
-	)
+	cutoff := time.Now().Add(-ttl)
+
+	// A session's revocation is never before its creation, so the sessions
+	// created before the cutoff include every one this can delete.
+	sessions, err := c.listBefore(ctx, labelCreatedAt, cutoff)
 	if err != nil {
-		return fmt.Errorf("failed to list sessions: %w", err)
+		return err
 	}
 
-	cutoff := time.Now().Add(-ttl)
-
-	for _, item := range list.Items {
-		var session v1alpha1.OAuthSession
-		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &session); err != nil {
-			continue
-		}
+	for _, session := range sessions {
 
 		// Only delete terminal or stale pending sessions; skip active ones
 		phase := session.Status.Phase
@@ -402,23 +481,14 @@ func (c *Client) CleanupOldSessions(ctx context.Context, ttl time.Duration) erro
 
 // ExpireInactiveSessions marks sessions as expired if they haven't been used within the TTL
 func (c *Client) ExpireInactiveSessions(ctx context.Context, ttl time.Duration) error {
-	list, err := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).List(
-		ctx,
-		metav1.ListOptions{
-			LabelSelector: "app.kubernetes.io/managed-by=kauth",
-		},
-	)
+	cutoff := time.Now().Add(-ttl)
+
+	sessions, err := c.listBefore(ctx, labelLastUsed, cutoff)
 	if err != nil {
-		return fmt.Errorf("failed to list sessions: %w", err)
+		return err
 	}
 
-	cutoff := time.Now().Add(-ttl)
-
-	for _, item := range list.Items {
-		var session v1alpha1.OAuthSession
-		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &session); err != nil {
-			continue
-		}
+	for _, session := range sessions {
 
 		// Only expire active sessions
 		if session.Status.Phase != v1alpha1.SessionActive {
@@ -451,9 +521,50 @@ func (c *Client) ExpireInactiveSessions(ctx context.Context, ttl time.Duration)
 	return nil
 }
 
+// listBefore returns the sessions whose Unix-seconds label is before t,
+// filtered by the API server, plus any session without the label (created
+// before kauth set it). Callers still check the session's own timestamps.
+func (c *Client) listBefore(ctx context.Context, label string, t time.Time) ([]v1alpha1.OAuthSession, error) {
+	var sessions []v1alpha1.OAuthSession
+	for _, selector := range []string{
+		fmt.Sprintf("%s,%s<%s", managedBySelector, label, unixLabel(t)),
+		fmt.Sprintf("%s,!%s", managedBySelector, label),
+	} {
+		list, err := c.dynamicClient.Resource(c.gvr()).Namespace(c.namespace).List(
+			ctx,
+			metav1.ListOptions{LabelSelector: selector},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list sessions: %w", err)
+		}
+		for _, item := range list.Items {
+			var session v1alpha1.OAuthSession
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &session); err != nil {
+				continue
+			}
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
+
+func setLabel(session *v1alpha1.OAuthSession, key, value string) {
+	if session.Labels == nil {
+		session.Labels = make(map[string]string)
+	}
+	session.Labels[key] = value
+}
+
 // sanitizeName converts a session ID to a valid Kubernetes resource name
 func sanitizeName(sessionID string) string {
-	sanitized := validation.SanitizeToResourceName(sessionID)
+	return validation.SanitizeToResourceName("oauth-" + sessionID)
+}
+
+// legacyName is the resource name sessions were created under before
+// sanitizeName added a hash suffix. Lookups fall back to it so sessions
+// from before an upgrade keep working until they expire.
+func legacyName(sessionID string) string {
+	sanitized := validation.LegacySanitizeToResourceName(sessionID)
 	if len(sanitized)+6 > 63 {
 		sanitized = strings.TrimRight(sanitized[:57], "-.")
 	}
@@ -2,38 +2,33 @@ package session
 
 import (
 	"context"
+	"errors"
+	"strings"
 	"testing"
+	"time"
 
 	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 func newFakeClient(t *testing.T) *Client {
 	t.Helper()
 
+	// Objects are stored as unstructured, as the API server returns them;
+	// registering the typed OAuthSession would break List conversion.
 	scheme := runtime.NewScheme()
 	gvr := schema.GroupVersionResource{
 		Group:    "kauth.io",
 		Version:  "v1alpha1",
 		Resource: "oauthsessions",
 	}
-	gvk := schema.GroupVersionKind{
-		Group:   "kauth.io",
-		Version: "v1alpha1",
-		Kind:    "OAuthSession",
-	}
-	gvkList := schema.GroupVersionKind{
-		Group:   "kauth.io",
-		Version: "v1alpha1",
-		Kind:    "OAuthSessionList",
-	}
-	scheme.AddKnownTypeWithName(gvk, &v1alpha1.OAuthSession{})
-	scheme.AddKnownTypeWithName(gvkList, &v1alpha1.OAuthSessionList{})
-	metav1.AddToGroupVersion(scheme, schema.GroupVersion{Group: "kauth.io", Version: "v1alpha1"})
 
 	fakeClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme,
 		map[schema.GroupVersionResource]string{
@@ -122,6 +117,49 @@ func TestClient_Get_NotFound(t *testing.T) {
 	}
 }
 
+func TestClient_Get_LegacyName(t *testing.T) {
+	client := newFakeClient(t)
+	ctx := context.Background()
+
+	// Stored under its pre-hash-suffix name, as older releases did
+	createRaw(t, client, &v1alpha1.OAuthSession{
+		ObjectMeta: metav1.ObjectMeta{Name: legacyName("abc_def")},
+		Spec:       v1alpha1.OAuthSessionSpec{SessionID: "abc_def", Verifier: "verifier"},
+	})
+
+	got, err := client.Get(ctx, "abc_def")
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got.Spec.Verifier != "verifier" {
+		t.Errorf("Verifier = %q, want %q", got.Spec.Verifier, "verifier")
+	}
+
+	// "abc!def" has the same legacy name but is a different session.
+	if _, err := client.Get(ctx, "abc!def"); !apierrors.IsNotFound(err) {
+		t.Errorf("Get() of a colliding session ID error = %v, want NotFound", err)
+	}
+
+	if err := client.Delete(ctx, "abc_def"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := client.Get(ctx, "abc_def"); !apierrors.IsNotFound(err) {
+		t.Errorf("Get() after Delete() error = %v, want NotFound", err)
+	}
+}
+
+func TestSanitizeName_DistinctForCollidingIDs(t *testing.T) {
+	if legacyName("abc!def") != legacyName("abc@def") {
+		t.Fatal("test inputs no longer collide under the legacy scheme")
+	}
+	if sanitizeName("abc!def") == sanitizeName("abc@def") {
+		t.Errorf("sanitizeName maps distinct session IDs to %q", sanitizeName("abc!def"))
+	}
+	if name := sanitizeName("abc!def"); !strings.HasPrefix(name, "oauth-") {
+		t.Errorf("sanitizeName() = %q, want oauth- prefix", name)
+	}
+}
+
 func TestClient_UpdateStatus(t *testing.T) {
 	client := newFakeClient(t)
 	ctx := context.Background()
@@ -185,6 +223,149 @@ func TestClient_UpdateStatus_PendingNoCompletedAt(t *testing.T) {
 	}
 }
 
+func TestClient_UpdateStatus_FailureDoesNotOverwriteSettled(t *testing.T) {
+	tests := []struct {
+		name    string
+		current v1alpha1.OAuthSessionStatus
+	}{
+		{name: "active", current: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, RefreshToken: "token"}},
+		{name: "already failed", current: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending, Error: "IdP denied"}},
+		{name: "revoked", current: v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionRevoked}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeClient(t)
+			ctx := context.Background()
+
+			_, _ = client.Create(ctx, "settled-test", "verifier", "")
+			if err := client.UpdateStatus(ctx, "settled-test", tt.current); err != nil {
+				t.Fatalf("UpdateStatus() error = %v", err)
+			}
+
+			err := client.UpdateStatus(ctx, "settled-test", v1alpha1.OAuthSessionStatus{
+				Phase: v1alpha1.SessionPending,
+				Error: "Token exchange failed",
+			})
+			if !errors.Is(err, ErrSessionSettled) {
+				t.Errorf("UpdateStatus() error = %v, want %v", err, ErrSessionSettled)
+			}
+			got, _ := client.Get(ctx, "settled-test")
+			if got.Status.Phase != tt.current.Phase || got.Status.Error != tt.current.Error {
+				t.Errorf("status = %q/%q, want %q/%q", got.Status.Phase, got.Status.Error, tt.current.Phase, tt.current.Error)
+			}
+		})
+	}
+}
+
+func TestClient_UpdateStatus_RetriesConflict(t *testing.T) {
+	client := newFakeClient(t)
+	ctx := context.Background()
+
+	_, _ = client.Create(ctx, "conflict-test", "verifier", "")
+
+	// The winning callback's Active write lands between the failing
+	// callback's read and write.
+	fake := client.dynamicClient.(*dynamicfake.FakeDynamicClient)
+	gvr := client.gvr()
+	conflicts := 0
+	fake.PrependReactor("update", "oauthsessions", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" || conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		obj, err := fake.Tracker().Get(gvr, "default", sanitizeName("conflict-test"))
+		if err != nil {
+			return true, nil, err
+		}
+		won := obj.(*unstructured.Unstructured).DeepCopy()
+		_ = unstructured.SetNestedField(won.Object, string(v1alpha1.SessionActive), "status", "phase")
+		if err := fake.Tracker().Update(gvr, won, "default"); err != nil {
+			return true, nil, err
+		}
+		return true, nil, apierrors.NewConflict(gvr.GroupResource(), "conflict-test", errors.New("object was modified"))
+	})
+
+	err := client.UpdateStatus(ctx, "conflict-test", v1alpha1.OAuthSessionStatus{
+		Phase: v1alpha1.SessionPending,
+		Error: "Token exchange failed",
+	})
+	if !errors.Is(err, ErrSessionSettled) {
+		t.Errorf("UpdateStatus() error = %v, want %v after re-reading the session", err, ErrSessionSettled)
+	}
+	got, _ := client.Get(ctx, "conflict-test")
+	if got.Status.Phase != v1alpha1.SessionActive || got.Status.Error != "" {
+		t.Errorf("status = %q/%q, want Active without error", got.Status.Phase, got.Status.Error)
+	}
+}
+
+func TestClient_Rotate(t *testing.T) {
+	client := newFakeClient(t)
+	ctx := context.Background()
+
+	_, _ = client.Create(ctx, "rotate-test", "verifier", "user@example.com")
+	if err := client.UpdateStatus(ctx, "rotate-test", v1alpha1.OAuthSessionStatus{
+		Phase:        v1alpha1.SessionActive,
+		RefreshToken: "token-0",
+	}); err != nil {
+		t.Fatalf("UpdateStatus() error = %v", err)
+	}
+
+	// Another replica's write lands between our read and write once.
+	conflicts := 0
+	fake := client.dynamicClient.(*dynamicfake.FakeDynamicClient)
+	fake.PrependReactor("update", "oauthsessions", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" || conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Group: "kauth.io", Resource: "oauthsessions"}, "rotate-test", errors.New("object was modified"))
+	})
+
+	checks := 0
+	err := client.Rotate(ctx, "rotate-test",
+		func(*v1alpha1.OAuthSession) error { checks++; return nil },
+		func(status *v1alpha1.OAuthSessionStatus) {
+			status.RefreshToken = "token-1"
+			status.RotationCounter = 1
+		},
+	)
+	if err != nil {
+		t.Fatalf("Rotate() error = %v", err)
+	}
+	if checks != 2 {
+		t.Errorf("check called %d times, want 2 (retried after conflict)", checks)
+	}
+
+	got, _ := client.Get(ctx, "rotate-test")
+	if got.Status.RefreshToken != "token-1" || got.Status.RotationCounter != 1 {
+		t.Errorf("status = %q/%d, want token-1/1", got.Status.RefreshToken, got.Status.RotationCounter)
+	}
+	if got.Status.LastRotation == nil {
+		t.Error("LastRotation should be set")
+	}
+
+	// A later status update without rotation fields keeps them.
+	_ = client.UpdateStatus(ctx, "rotate-test", v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, RefreshToken: "token-1"})
+	got, _ = client.Get(ctx, "rotate-test")
+	if got.Status.RotationCounter != 1 || got.Status.LastRotation == nil {
+		t.Errorf("UpdateStatus dropped rotation state: %d/%v", got.Status.RotationCounter, got.Status.LastRotation)
+	}
+
+	// A rejected rotation leaves the session untouched.
+	rejected := errors.New("replayed")
+	err = client.Rotate(ctx, "rotate-test",
+		func(*v1alpha1.OAuthSession) error { return rejected },
+		func(status *v1alpha1.OAuthSessionStatus) { status.RefreshToken = "token-2" },
+	)
+	if !errors.Is(err, rejected) {
+		t.Errorf("Rotate() error = %v, want %v", err, rejected)
+	}
+	got, _ = client.Get(ctx, "rotate-test")
+	if got.Status.RefreshToken != "token-1" {
+		t.Errorf("RefreshToken = %q after rejected rotation, want token-1", got.Status.RefreshToken)
+	}
+}
+
 func TestClient_Revoke(t *testing.T) {
 	client := newFakeClient(t)
 	ctx := context.Background()
@@ -318,3 +499,125 @@ func TestClient_Delete_Nonexistent(t *testing.T) {
 		t.Error("Delete() should fail for nonexistent session")
 	}
 }
+
+// createRaw stores s as-is, so tests can backdate timestamps and labels.
+// s is named after its session ID unless it already has a name.
+func createRaw(t *testing.T, client *Client, s *v1alpha1.OAuthSession) {
+	t.Helper()
+	if s.Name == "" {
+		s.Name = sanitizeName(s.Spec.SessionID)
+	}
+	s.Namespace = client.namespace
+	obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.dynamicClient.Resource(client.gvr()).Namespace(client.namespace).Create(
+		context.Background(), &unstructured.Unstructured{Object: obj}, metav1.CreateOptions{},
+	); err != nil {
+		t.Fatalf("Create(%s) error = %v", s.Spec.SessionID, err)
+	}
+}
+
+func TestClient_CleanupSelectsServerSide(t *testing.T) {
+	client := newFakeClient(t)
+	ctx := context.Background()
+	old := metav1.NewTime(time.Now().Add(-2 * time.Hour))
+	now := metav1.Now()
+
+	labels := func(created, lastUsed time.Time) map[string]string {
+		return map[string]string{
+			"app.kubernetes.io/managed-by": "kauth",
+			labelCreatedAt:                 unixLabel(created),
+			labelLastUsed:                  unixLabel(lastUsed),
+		}
+	}
+	for _, s := range []*v1alpha1.OAuthSession{
+		{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels(old.Time, old.Time)},
+			Spec:       v1alpha1.OAuthSessionSpec{SessionID: "stale-pending", CreatedAt: old},
+			Status:     v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels(now.Time, now.Time)},
+			Spec:       v1alpha1.OAuthSessionSpec{SessionID: "fresh-pending", CreatedAt: now},
+			Status:     v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+		},
+		{
+			// Created before the timestamp labels existed.
+			ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app.kubernetes.io/managed-by": "kauth"}},
+			Spec:       v1alpha1.OAuthSessionSpec{SessionID: "legacy-pending", CreatedAt: old},
+			Status:     v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionPending},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels(old.Time, old.Time)},
+			Spec:       v1alpha1.OAuthSessionSpec{SessionID: "idle-active", CreatedAt: old, LastUsed: old},
+			Status:     v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Labels: labels(old.Time, now.Time)},
+			Spec:       v1alpha1.OAuthSessionSpec{SessionID: "busy-active", CreatedAt: old, LastUsed: now},
+			Status:     v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive},
+		},
+	} {
+		createRaw(t, client, s)
+	}
+
+	if err := client.ExpireInactiveSessions(ctx, time.Hour); err != nil {
+		t.Fatalf("ExpireInactiveSessions() error = %v", err)
+	}
+	if err := client.CleanupOldSessions(ctx, time.Hour); err != nil {
+		t.Fatalf("CleanupOldSessions() error = %v", err)
+	}
+
+	for id, want := range map[string]v1alpha1.SessionPhase{
+		"stale-pending":  "",
+		"legacy-pending": "",
+		"fresh-pending":  v1alpha1.SessionPending,
+		"idle-active":    "", // expired, then deleted as an old terminal session
+		"busy-active":    v1alpha1.SessionActive,
+	} {
+		got, err := client.Get(ctx, id)
+		switch {
+		case want == "" && err == nil:
+			t.Errorf("%s still exists, want deleted", id)
+		case want != "" && err != nil:
+			t.Errorf("%s: Get() error = %v, want phase %s", id, err, want)
+		case want != "" && got.Status.Phase != want:
+			t.Errorf("%s: phase = %s, want %s", id, got.Status.Phase, want)
+		}
+	}
+
+	// Every list was narrowed by a timestamp selector.
+	fake := client.dynamicClient.(*dynamicfake.FakeDynamicClient)
+	for _, action := range fake.Actions() {
+		if list, ok := action.(k8stesting.ListAction); ok {
+			selector := list.GetListRestrictions().Labels.String()
+			if !strings.Contains(selector, "<") && !strings.Contains(selector, "!") {
+				t.Errorf("list selector %q is not narrowed server-side", selector)
+			}
+		}
+	}
+}
+
+func TestClient_UpdateLastUsedLabel(t *testing.T) {
+	client := newFakeClient(t)
+	ctx := context.Background()
+
+	created, _ := client.Create(ctx, "label-test", "verifier", "user@example.com")
+	if created.Labels[labelCreatedAt] == "" || created.Labels[labelLastUsed] == "" {
+		t.Fatalf("labels = %v, want created-at and last-used", created.Labels)
+	}
+
+	createRaw(t, client, &v1alpha1.OAuthSession{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app.kubernetes.io/managed-by": "kauth"}},
+		Spec:       v1alpha1.OAuthSessionSpec{SessionID: "legacy-label-test"},
+	})
+	if err := client.UpdateLastUsed(ctx, "legacy-label-test"); err != nil {
+		t.Fatalf("UpdateLastUsed() error = %v", err)
+	}
+	got, _ := client.Get(ctx, "legacy-label-test")
+	if got.Labels[labelLastUsed] != unixLabel(got.Spec.LastUsed.Time) {
+		t.Errorf("last-used label = %q, want %q", got.Labels[labelLastUsed], unixLabel(got.Spec.LastUsed.Time))
+	}
+}
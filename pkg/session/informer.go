@@ -0,0 +1,107 @@
+package session
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EventHandler receives OAuthSession changes from an Informer. Either
+// callback may be nil.
+type EventHandler struct {
+	// OnUpdate is called when a session is added or modified, including for
+	// every existing session when the informer first lists them.
+	OnUpdate func(*v1alpha1.OAuthSession)
+	// OnDelete is called when a session is deleted.
+	OnDelete func(*v1alpha1.OAuthSession)
+}
+
+// Informer delivers OAuthSession changes from a shared informer. Unlike a
+// raw watch it lists on start and relists and rewatches by itself after a
+// disconnect or an expired resourceVersion, so changes made while the
+// stream was down are still delivered.
+type Informer struct {
+	informer cache.SharedIndexInformer
+}
+
+// NewInformer creates an informer over the kauth-managed OAuthSessions in
+// the client's namespace. A non-zero resync redelivers every cached
+// session through OnUpdate at that interval.
+func (c *Client) NewInformer(resync time.Duration) *Informer {
+	factory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(
+		c.dynamicClient,
+		resync,
+		c.namespace,
+		func(opts *metav1.ListOptions) {
+			opts.LabelSelector = managedBySelector
+		},
+	)
+	return &Informer{informer: factory.ForResource(c.gvr()).Informer()}
+}
+
+// AddEventHandler registers h. Handlers added before Run see the initial
+// list of sessions.
+func (i *Informer) AddEventHandler(h EventHandler) error {
+	update := func(obj any) {
+		if h.OnUpdate == nil {
+			return
+		}
+		if session, err := fromObject(obj); err != nil {
+			slog.Error("Failed to convert session from informer", "error", err)
+		} else {
+			h.OnUpdate(session)
+		}
+	}
+	_, err := i.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj any) { update(obj) },
+		DeleteFunc: func(obj any) {
+			if h.OnDelete == nil {
+				return
+			}
+			// A delete missed during a disconnect arrives as a tombstone.
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if session, err := fromObject(obj); err != nil {
+				slog.Error("Failed to convert deleted session from informer", "error", err)
+			} else {
+				h.OnDelete(session)
+			}
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add session event handler: %w", err)
+	}
+	return nil
+}
+
+// Run starts the informer and blocks until stopCh is closed.
+func (i *Informer) Run(stopCh <-chan struct{}) {
+	i.informer.Run(stopCh)
+}
+
+// HasSynced reports whether the initial list has been delivered.
+func (i *Informer) HasSynced() bool {
+	return i.informer.HasSynced()
+}
+
+func fromObject(obj any) (*v1alpha1.OAuthSession, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object type %T", obj)
+	}
+	var session v1alpha1.OAuthSession
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &session); err != nil {
+		return nil, fmt.Errorf("failed to convert from unstructured: %w", err)
+	}
+	return &session, nil
+}
@@ -0,0 +1,81 @@
+package session
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1alpha1 "kauth/pkg/apis/kauth.io/v1alpha1"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestInformer_RecoversFromListFailure(t *testing.T) {
+	client := newFakeClient(t)
+	ctx := context.Background()
+
+	if _, err := client.Create(ctx, "informer-test", "verifier", "user@example.com"); err != nil {
+		t.Fatalf("Create() error = %v", err)
+	}
+
+	// The API server is unreachable for the informer's first list.
+	var lists atomic.Int32
+	fake := client.dynamicClient.(*dynamicfake.FakeDynamicClient)
+	fake.PrependReactor("list", "oauthsessions", func(k8stesting.Action) (bool, runtime.Object, error) {
+		if lists.Add(1) == 1 {
+			return true, nil, errors.New("dial tcp 10.0.0.1:443: connect: connection refused")
+		}
+		return false, nil, nil
+	})
+
+	updates := make(chan *v1alpha1.OAuthSession, 10)
+	deletes := make(chan *v1alpha1.OAuthSession, 10)
+	informer := client.NewInformer(0)
+	if err := informer.AddEventHandler(EventHandler{
+		OnUpdate: func(s *v1alpha1.OAuthSession) { updates <- s },
+		OnDelete: func(s *v1alpha1.OAuthSession) { deletes <- s },
+	}); err != nil {
+		t.Fatalf("AddEventHandler() error = %v", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go informer.Run(stop)
+
+	waitFor := func(ch <-chan *v1alpha1.OAuthSession, what string) *v1alpha1.OAuthSession {
+		t.Helper()
+		select {
+		case s := <-ch:
+			return s
+		case <-time.After(10 * time.Second):
+			t.Fatalf("no %s event", what)
+			return nil
+		}
+	}
+
+	// The session that existed before the informer started arrives once the
+	// relist succeeds.
+	if s := waitFor(updates, "initial"); s.Spec.SessionID != "informer-test" {
+		t.Errorf("SessionID = %q, want informer-test", s.Spec.SessionID)
+	}
+	if lists.Load() < 2 {
+		t.Errorf("lists = %d, want a retry after the failure", lists.Load())
+	}
+
+	if err := client.UpdateStatus(ctx, "informer-test", v1alpha1.OAuthSessionStatus{Phase: v1alpha1.SessionActive, Email: "user@example.com"}); err != nil {
+		t.Fatalf("UpdateStatus() error = %v", err)
+	}
+	if s := waitFor(updates, "update"); s.Status.Phase != v1alpha1.SessionActive {
+		t.Errorf("Phase = %q, want Active", s.Status.Phase)
+	}
+
+	if err := client.Delete(ctx, "informer-test"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if s := waitFor(deletes, "delete"); s.Spec.SessionID != "informer-test" {
+		t.Errorf("deleted SessionID = %q, want informer-test", s.Spec.SessionID)
+	}
+}
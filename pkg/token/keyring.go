@@ -0,0 +1,114 @@
+package token
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/zalando/go-keyring"
+)
+
+const (
+	keyringService = "kauth"
+	keyringUser    = "token-cache"
+)
+
+// KeyringStore keeps the token cache in the OS keyring (macOS Keychain,
+// Secret Service on Linux, Windows Credential Manager) as a single JSON
+// secret. Updates are serialized with the same advisory lock file the file
+// backend uses.
+type KeyringStore struct {
+	lockPath string
+}
+
+// NewKeyringStore creates a keyring-backed store that serializes updates
+// with the lock file at lockPath.
+func NewKeyringStore(lockPath string) *KeyringStore {
+	return &KeyringStore{lockPath: lockPath}
+}
+
+// Get returns the cached credentials, or nil if the keyring holds none.
+func (k *KeyringStore) Get() (*Cache, error) {
+	secret, err := keyring.Get(keyringService, keyringUser)
+	if err != nil {
+		if errors.Is(err, keyring.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read token from keyring: %w", err)
+	}
+
+	var cache Cache
+	if err := json.Unmarshal([]byte(secret), &cache); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal token from keyring: %w", err)
+	}
+	return &cache, nil
+}
+
+// Set stores the credentials in the keyring, replacing any previous entry.
+func (k *KeyringStore) Set(cache *Cache) error {
+	unlock, err := k.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return k.set(cache)
+}
+
+// Delete removes the credentials from the keyring.
+func (k *KeyringStore) Delete() error {
+	if err := keyring.Delete(keyringService, keyringUser); err != nil && !errors.Is(err, keyring.ErrNotFound) {
+		return fmt.Errorf("failed to delete token from keyring: %w", err)
+	}
+	return nil
+}
+
+// Update runs fn on the stored credentials and stores the result under an
+// exclusive lock. See Storage.Update.
+func (k *KeyringStore) Update(fn func(*Cache) (*Cache, error)) error {
+	unlock, err := k.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := k.Get()
+	if err != nil {
+		return err
+	}
+	updated, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if updated == nil {
+		return nil
+	}
+	return k.set(updated)
+}
+
+func (k *KeyringStore) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(k.lockPath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	unlock, err := lockFile(k.lockPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock token cache: %w", err)
+	}
+	return unlock, nil
+}
+
+func (k *KeyringStore) set(cache *Cache) error {
+	if cache == nil {
+		return fmt.Errorf("cannot save nil cache")
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return fmt.Errorf("failed to marshal token: %w", err)
+	}
+	if err := keyring.Set(keyringService, keyringUser, string(data)); err != nil {
+		return fmt.Errorf("failed to write token to keyring: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package token
+
+// lockFile is a no-op on platforms kauth is not released for; cache writes
+// are still atomic, but concurrent refreshes are not serialized.
+func lockFile(string) (func(), error) {
+	return func() {}, nil
+}
@@ -0,0 +1,25 @@
+//go:build linux || darwin
+
+package token
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile blocks until it holds an exclusive flock on path, creating the
+// file if needed. The returned function releases the lock.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		_ = f.Close()
+	}, nil
+}
@@ -18,6 +18,20 @@ type Cache struct {
 	SessionID    string    `json:"session_id,omitempty"`
 	WebhookToken string    `json:"webhook_token,omitempty"`
 	Expiry       time.Time `json:"expiry,omitempty"`
+
+	// RefreshExpiry is when RefreshToken stops working: its own expiry or
+	// the session's absolute lifetime, whichever comes first.
+	RefreshExpiry time.Time `json:"refresh_expiry,omitempty"`
+}
+
+// DefaultExpiryBuffer is how long before its expiry a token stops being
+// handed out, so it does not expire in flight.
+const DefaultExpiryBuffer = 5 * time.Minute
+
+// IsTokenValid reports whether a token expiring at expiry can still be used
+// at now, leaving buffer before the expiry. A zero expiry never expires.
+func IsTokenValid(expiry, now time.Time, buffer time.Duration) bool {
+	return expiry.IsZero() || now.Before(expiry.Add(-buffer))
 }
 
 // Storage handles token persistence
@@ -60,8 +74,59 @@ func (s *Storage) Load() (*Cache, error) {
 }
 
 // Save saves a token to the cache with secure permissions.
-// Uses a temp-file + rename to avoid partial writes under concurrent kubectl calls.
+// Uses a temp-file + rename to avoid partial writes under concurrent kubectl calls,
+// and holds the cache lock so it cannot interleave with an Update.
 func (s *Storage) Save(cache *Cache) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return s.save(cache)
+}
+
+// Update runs fn on the current cache contents and saves the result while
+// holding an exclusive lock, so concurrent kauth processes serialize their
+// read-modify-write cycles. This matters for refresh: refresh tokens rotate,
+// so two processes refreshing from the same stale token would lose one of
+// the rotations. A process that waited for the lock sees the other's result.
+// fn receives nil if no cache exists; returning a nil cache skips the save.
+func (s *Storage) Update(fn func(*Cache) (*Cache, error)) error {
+	unlock, err := s.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	current, err := s.Load()
+	if err != nil {
+		return err
+	}
+
+	updated, err := fn(current)
+	if err != nil {
+		return err
+	}
+	if updated == nil {
+		return nil
+	}
+	return s.save(updated)
+}
+
+// lock takes the exclusive advisory lock guarding the cache file.
+func (s *Storage) lock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(s.cachePath), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	unlock, err := lockFile(s.cachePath + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock token cache: %w", err)
+	}
+	return unlock, nil
+}
+
+func (s *Storage) save(cache *Cache) error {
 	if cache == nil {
 		return fmt.Errorf("cannot save nil cache")
 	}
@@ -102,6 +167,16 @@ func (s *Storage) Save(cache *Cache) error {
 	return nil
 }
 
+// Get implements CredentialStore.
+func (s *Storage) Get() (*Cache, error) {
+	return s.Load()
+}
+
+// Set implements CredentialStore.
+func (s *Storage) Set(cache *Cache) error {
+	return s.Save(cache)
+}
+
 // Delete removes the token cache file
 func (s *Storage) Delete() error {
 	if err := os.Remove(s.cachePath); err != nil {
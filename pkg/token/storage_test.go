@@ -0,0 +1,91 @@
+package token
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestStorageSaveLoad(t *testing.T) {
+	storage := NewStorage(filepath.Join(t.TempDir(), "cache", "kauth-token.json"))
+
+	cache, err := storage.Load()
+	if err != nil || cache != nil {
+		t.Fatalf("Load() on missing cache = %v, %v; want nil, nil", cache, err)
+	}
+
+	want := &Cache{ServerURL: "https://kauth.example.com", RefreshToken: "rt"}
+	if err := storage.Save(want); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	got, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if *got != *want {
+		t.Errorf("Load() = %+v, want %+v", got, want)
+	}
+}
+
+func TestStorageUpdateSerializesConcurrentWriters(t *testing.T) {
+	storage := NewStorage(filepath.Join(t.TempDir(), "kauth-token.json"))
+	if err := storage.Save(&Cache{RefreshToken: "0"}); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	// Each writer rotates the refresh token from n to n+1, mimicking a
+	// refresh. Without the lock, writers would read the same n and lose
+	// increments.
+	const writers = 20
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- storage.Update(func(c *Cache) (*Cache, error) {
+				n, err := strconv.Atoi(c.RefreshToken)
+				if err != nil {
+					return nil, err
+				}
+				c.RefreshToken = strconv.Itoa(n + 1)
+				return c, nil
+			})
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	}
+
+	got, err := storage.Load()
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+	if got.RefreshToken != strconv.Itoa(writers) {
+		t.Errorf("RefreshToken = %q, want %q", got.RefreshToken, strconv.Itoa(writers))
+	}
+}
+
+func TestStorageUpdateNilSkipsSave(t *testing.T) {
+	storage := NewStorage(filepath.Join(t.TempDir(), "kauth-token.json"))
+
+	err := storage.Update(func(c *Cache) (*Cache, error) {
+		if c != nil {
+			t.Errorf("Update() passed %+v for missing cache, want nil", c)
+		}
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %v", err)
+	}
+	if storage.Exists() {
+		t.Error("Update() returning nil created a cache file")
+	}
+}
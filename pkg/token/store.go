@@ -0,0 +1,47 @@
+package token
+
+import (
+	"fmt"
+	"os"
+)
+
+// CredentialStore persists the kauth token cache. The file backend is the
+// default; the keyring backend keeps credentials in the OS secret store.
+type CredentialStore interface {
+	// Get returns the cached credentials, or nil if none are stored.
+	Get() (*Cache, error)
+	// Set replaces the cached credentials.
+	Set(cache *Cache) error
+	// Delete removes the cached credentials. Deleting a missing entry is not an error.
+	Delete() error
+	// Update runs a read-modify-write cycle that excludes other kauth
+	// processes; see Storage.Update.
+	Update(fn func(*Cache) (*Cache, error)) error
+}
+
+// Cache backends selectable with KAUTH_CACHE_BACKEND.
+const (
+	BackendFile    = "file"
+	BackendKeyring = "keyring"
+)
+
+// BackendEnv selects the credential store backend.
+const BackendEnv = "KAUTH_CACHE_BACKEND"
+
+// NewCredentialStore returns the store for the named backend. An empty name
+// selects the file backend.
+func NewCredentialStore(backend string) (CredentialStore, error) {
+	switch backend {
+	case "", BackendFile:
+		return NewStorage(DefaultCachePath()), nil
+	case BackendKeyring:
+		return NewKeyringStore(DefaultCachePath() + ".lock"), nil
+	default:
+		return nil, fmt.Errorf("unknown %s %q (want %q or %q)", BackendEnv, backend, BackendFile, BackendKeyring)
+	}
+}
+
+// DefaultCredentialStore returns the store selected by KAUTH_CACHE_BACKEND.
+func DefaultCredentialStore() (CredentialStore, error) {
+	return NewCredentialStore(os.Getenv(BackendEnv))
+}
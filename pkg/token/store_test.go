@@ -0,0 +1,87 @@
+package token
+
+import (
+	"testing"
+
+	"github.com/zalando/go-keyring"
+)
+
+func TestNewCredentialStore(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	tests := []struct {
+		backend     string
+		wantKeyring bool
+		wantErr     bool
+	}{
+		{backend: ""},
+		{backend: BackendFile},
+		{backend: BackendKeyring, wantKeyring: true},
+		{backend: "vault", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			store, err := NewCredentialStore(tt.backend)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewCredentialStore(%q) error = %v, wantErr %v", tt.backend, err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if _, isKeyring := store.(*KeyringStore); isKeyring != tt.wantKeyring {
+				t.Errorf("NewCredentialStore(%q) = %T, want keyring %v", tt.backend, store, tt.wantKeyring)
+			}
+		})
+	}
+}
+
+// TestCredentialStores runs the same contract against both backends.
+func TestCredentialStores(t *testing.T) {
+	keyring.MockInit()
+	dir := t.TempDir()
+
+	stores := map[string]CredentialStore{
+		BackendFile:    NewStorage(dir + "/kauth-token.json"),
+		BackendKeyring: NewKeyringStore(dir + "/kauth-token.json.lock"),
+	}
+
+	for name, store := range stores {
+		t.Run(name, func(t *testing.T) {
+			if got, err := store.Get(); err != nil || got != nil {
+				t.Fatalf("Get() on empty store = %v, %v; want nil, nil", got, err)
+			}
+
+			want := &Cache{ServerURL: "https://kauth.example.com", RefreshToken: "rt1"}
+			if err := store.Set(want); err != nil {
+				t.Fatalf("Set() error = %v", err)
+			}
+
+			err := store.Update(func(c *Cache) (*Cache, error) {
+				c.RefreshToken = "rt2"
+				return c, nil
+			})
+			if err != nil {
+				t.Fatalf("Update() error = %v", err)
+			}
+
+			got, err := store.Get()
+			if err != nil {
+				t.Fatalf("Get() error = %v", err)
+			}
+			if got.ServerURL != want.ServerURL || got.RefreshToken != "rt2" {
+				t.Errorf("Get() = %+v, want updated cache", got)
+			}
+
+			if err := store.Delete(); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if got, err := store.Get(); err != nil || got != nil {
+				t.Errorf("Get() after Delete() = %v, %v; want nil, nil", got, err)
+			}
+			if err := store.Delete(); err != nil {
+				t.Errorf("Delete() on empty store error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+// Package tracing provides optional OpenTelemetry tracing for kauth-server.
+//
+// Until Setup installs an exporter the global tracer provider is
+// OpenTelemetry's no-op one, so spans started with Start cost next to
+// nothing in deployments without tracing.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName names the tracer kauth's spans come from.
+const InstrumentationName = "kauth"
+
+// Setup exports spans over OTLP/HTTP to endpoint, a base URL as in
+// OTEL_EXPORTER_OTLP_ENDPOINT (spans go to its /v1/traces), and accepts W3C
+// trace context from incoming requests. The exporter honours the other
+// OTEL_EXPORTER_OTLP_* variables (headers, timeout, TLS), and the resource
+// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES. With an empty endpoint
+// tracing stays disabled. The returned func flushes pending spans and must
+// be called on shutdown.
+func Setup(ctx context.Context, endpoint, serviceName string) (func(context.Context) error, error) {
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(strings.TrimRight(endpoint, "/")+"/v1/traces"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %w", err)
+	}
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", serviceName)),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+	return provider.Shutdown, nil
+}
+
+// Start starts a span named name as a child of any span in ctx.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(InstrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, marking it failed if err is non-nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// restoreGlobals puts back the global tracer provider and propagator Setup
+// replaces.
+func restoreGlobals(t *testing.T) {
+	t.Helper()
+	provider, propagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(provider)
+		otel.SetTextMapPropagator(propagator)
+	})
+}
+
+func TestSetup_Disabled(t *testing.T) {
+	restoreGlobals(t)
+	before := otel.GetTracerProvider()
+
+	shutdown, err := Setup(context.Background(), "", "kauth-server")
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	if otel.GetTracerProvider() != before {
+		t.Error("Setup() without an endpoint replaced the tracer provider")
+	}
+	_, span := Start(context.Background(), "noop")
+	if span.IsRecording() {
+		t.Error("span is recording with tracing disabled")
+	}
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown() error = %v", err)
+	}
+}
+
+func TestSetup_ExportsSpans(t *testing.T) {
+	restoreGlobals(t)
+	var exports atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/traces" {
+			exports.Add(1)
+		}
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	}))
+	defer collector.Close()
+
+	shutdown, err := Setup(context.Background(), collector.URL+"/", "kauth-server")
+	if err != nil {
+		t.Fatalf("Setup() error = %v", err)
+	}
+	_, span := Start(context.Background(), "test")
+	if !span.IsRecording() {
+		t.Error("span is not recording with tracing enabled")
+	}
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown() error = %v", err)
+	}
+	if exports.Load() == 0 {
+		t.Error("no spans exported to the collector's /v1/traces")
+	}
+	if len(otel.GetTextMapPropagator().Fields()) == 0 {
+		t.Error("no trace context propagator installed")
+	}
+}
+
+func TestEnd_RecordsError(t *testing.T) {
+	restoreGlobals(t)
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	_, span := Start(context.Background(), "ok")
+	End(span, nil)
+	_, span = Start(context.Background(), "failed")
+	End(span, errors.New("boom"))
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("ended %d spans, want 2", len(spans))
+	}
+	if got := spans[0].Status().Code; got != codes.Unset {
+		t.Errorf("ok span status = %v, want Unset", got)
+	}
+	if got := spans[1].Status(); got.Code != codes.Error || got.Description != "boom" {
+		t.Errorf("failed span status = %+v, want Error/boom", got)
+	}
+}
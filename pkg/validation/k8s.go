@@ -1,6 +1,8 @@
 package validation
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"regexp"
 	"strings"
@@ -22,14 +24,38 @@ func ValidateResourceName(name string) error {
 	return nil
 }
 
+// hashSuffixLen is the number of hex characters of the input's SHA-256 that
+// SanitizeToResourceName appends.
+const hashSuffixLen = 8
+
 // SanitizeToResourceName converts any string to a valid Kubernetes resource name
 // following RFC 1123 subdomain rules: lowercase alphanumeric characters, '-' or '.',
-// and must start and end with an alphanumeric character
+// and must start and end with an alphanumeric character. Sanitizing is lossy
+// ("abc!def" and "abc@def" both read "abc-def"), so the name ends in a short
+// hash of the original input to keep distinct inputs apart.
 func SanitizeToResourceName(input string) string {
 	if input == "" {
 		return "default"
 	}
 
+	sum := sha256.Sum256([]byte(input))
+	suffix := "-" + hex.EncodeToString(sum[:])[:hashSuffixLen]
+
+	name := LegacySanitizeToResourceName(input)
+	if maxBase := 63 - len(suffix); len(name) > maxBase {
+		name = strings.TrimRight(name[:maxBase], "-.")
+	}
+	return name + suffix
+}
+
+// LegacySanitizeToResourceName is SanitizeToResourceName without the hash
+// suffix, as names were built before it. Distinct inputs can collide; use it
+// only to find objects named that way.
+func LegacySanitizeToResourceName(input string) string {
+	if input == "" {
+		return "default"
+	}
+
 	var b strings.Builder
 	b.Grow(len(input))
 	for _, ch := range input {
@@ -83,7 +83,7 @@ func TestValidateResourceName(t *testing.T) {
 	}
 }
 
-func TestSanitizeToResourceName(t *testing.T) {
+func TestLegacySanitizeToResourceName(t *testing.T) {
 	tests := []struct {
 		name     string
 		input    string
@@ -173,17 +173,74 @@ func TestSanitizeToResourceName(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := SanitizeToResourceName(tt.input)
+			result := LegacySanitizeToResourceName(tt.input)
 			if result != tt.expected {
-				t.Errorf("SanitizeToResourceName(%q) = %q, want %q", tt.input, result, tt.expected)
+				t.Errorf("LegacySanitizeToResourceName(%q) = %q, want %q", tt.input, result, tt.expected)
 			}
 
 			// Verify result is valid
+			if err := ValidateResourceName(result); err != nil {
+				t.Errorf("LegacySanitizeToResourceName(%q) produced invalid result %q: %v", tt.input, result, err)
+			}
+		})
+	}
+}
+
+func TestSanitizeToResourceName(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		wantPrefix string
+	}{
+		{name: "already valid", input: "valid-name", wantPrefix: "valid-name-"},
+		{name: "email address", input: "User.Name@Example.COM", wantPrefix: "user-name-example-com-"},
+		{name: "only special characters", input: "!@#$%", wantPrefix: "default-"},
+		{name: "too long", input: strings.Repeat("a", 100), wantPrefix: strings.Repeat("a", 54) + "-"},
+		{name: "too long with trailing dash", input: strings.Repeat("a", 53) + "-" + strings.Repeat("b", 50), wantPrefix: strings.Repeat("a", 53) + "-"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := SanitizeToResourceName(tt.input)
+			if !strings.HasPrefix(result, tt.wantPrefix) || len(result) != len(tt.wantPrefix)+hashSuffixLen {
+				t.Errorf("SanitizeToResourceName(%q) = %q, want %q followed by %d hash characters", tt.input, result, tt.wantPrefix, hashSuffixLen)
+			}
 			if err := ValidateResourceName(result); err != nil {
 				t.Errorf("SanitizeToResourceName(%q) produced invalid result %q: %v", tt.input, result, err)
 			}
+			if again := SanitizeToResourceName(tt.input); again != result {
+				t.Errorf("SanitizeToResourceName(%q) not deterministic: %q then %q", tt.input, result, again)
+			}
 		})
 	}
+
+	if got := SanitizeToResourceName(""); got != "default" {
+		t.Errorf(`SanitizeToResourceName("") = %q, want "default"`, got)
+	}
+}
+
+func TestSanitizeToResourceName_NoCollisions(t *testing.T) {
+	long := strings.Repeat("x", 80)
+	// Each input sanitizes to the same legacy name as some other input.
+	inputs := []string{
+		"abc!def", "abc@def", "abc-def", "ABC-DEF", "abc_def", "abc def",
+		"-abc-def", "abc-def-", ".abc-def.",
+		"!@#$%", "%$#@!", "default", "DEFAULT",
+		long + "a", long + "b", long + "-a", long + "_a",
+		"x96Pc3ynjOX2eMnby1oZI1jSmfCwUn7ai_O9TYPJaBc", "x96pc3ynjox2emnby1ozi1jsmfcwun7ai-o9typjabc",
+	}
+
+	seen := make(map[string]string, len(inputs))
+	for _, input := range inputs {
+		name := SanitizeToResourceName(input)
+		if prev, ok := seen[name]; ok {
+			t.Errorf("SanitizeToResourceName(%q) = SanitizeToResourceName(%q) = %q", input, prev, name)
+		}
+		seen[name] = input
+		if err := ValidateResourceName(name); err != nil {
+			t.Errorf("SanitizeToResourceName(%q) produced invalid result %q: %v", input, name, err)
+		}
+	}
 }
 
 // Benchmark tests